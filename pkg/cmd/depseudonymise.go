@@ -0,0 +1,245 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dnstapir/edm/pkg/runner"
+)
+
+// depseudonymiseOptions are the flags of the "depseudonymise" command.
+type depseudonymiseOptions struct {
+	keyFile     string
+	salt        string
+	epoch       string
+	sessionFile string
+	reason      string
+	auditLog    string
+	// assumeCryptopan confirms that the addresses given as arguments were
+	// pseudonymised with the cryptopan pseudonymisation-mode. Unlike for a
+	// session file there is no metadata to check that against.
+	assumeCryptopan bool
+}
+
+// newDepseudonymiseFlagSet builds the flagset for the "depseudonymise"
+// subcommand. There is deliberately no flag taking the Crypto-PAn key
+// itself, so it never ends up in a shell history or process listing.
+func newDepseudonymiseFlagSet(opts *depseudonymiseOptions) (fs *flag.FlagSet) {
+	defaults := runner.DefaultConfig()
+	fs = flag.NewFlagSet("depseudonymise", flag.ContinueOnError)
+
+	fs.StringVar(&opts.keyFile, "cryptopan-key-file", "", "file containing the cryptopan-key the addresses were pseudonymised with, \"-\" reads it from stdin")
+	fs.StringVar(&opts.salt, "cryptopan-key-salt", defaults.CryptopanKeySalt, "the salt used for key derivation")
+	fs.StringVar(&opts.epoch, "epoch", "", "RFC 3339 start time of the Crypto-PAn key epoch, defaults to the epoch in the session file metadata")
+	fs.StringVar(&opts.sessionFile, "session-file", "", "session parquet file to depseudonymise all addresses of")
+	fs.BoolVar(&opts.assumeCryptopan, "assume-cryptopan", false, "confirm that the addresses given as arguments were pseudonymised with the cryptopan pseudonymisation-mode (required for them)")
+	fs.StringVar(&opts.reason, "reason", "", "case or legal reference recorded in the audit log (required)")
+	fs.StringVar(&opts.auditLog, "audit-log", filepath.Join(defaults.DataDir, "depseudonymise-audit.log"), "file every run is recorded in")
+
+	return fs
+}
+
+// runDepseudonymise implements the "depseudonymise" subcommand: it maps
+// pseudonymised addresses given as arguments or read from a session file
+// back to the original addresses, writing one "<pseudonym> <address>" line
+// per address to outW. Only Crypto-PAn pseudonyms can be inverted, so a
+// session file written with another pseudonymisation-mode is refused and
+// addresses given as arguments need -assume-cryptopan. A record of the run
+// is appended to the audit log before any address is written; if that fails
+// nothing is written.
+func runDepseudonymise(args []string, outW, errW io.Writer) (err error) {
+	opts := new(depseudonymiseOptions)
+	fs := newDepseudonymiseFlagSet(opts)
+	fs.SetOutput(errW)
+	var usage bytes.Buffer
+	fs.Usage = func() {
+		usage.Reset()
+		printFlagSetUsage(&usage, fs)
+	}
+
+	err = fs.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		_, err = io.Copy(outW, &usage)
+		return
+	}
+	if err != nil {
+		if _, copyErr := io.Copy(errW, &usage); copyErr != nil {
+			err = errors.Join(err, copyErr)
+		}
+		return
+	}
+
+	err = depseudonymise(opts, fs.Args(), outW)
+	if err != nil {
+		fmt.Fprintln(errW, err)
+	}
+	return
+}
+
+func depseudonymise(opts *depseudonymiseOptions, args []string, outW io.Writer) error {
+	switch {
+	case opts.keyFile == "":
+		return errNoCryptopanKeyFile
+	case opts.reason == "":
+		return errNoDepseudonymiseReason
+	case opts.sessionFile == "" && len(args) == 0:
+		return errNoDepseudonymiseInput
+	case len(args) > 0 && !opts.assumeCryptopan:
+		return errNoAssumeCryptopan
+	}
+
+	var epoch time.Time
+	if opts.epoch != "" {
+		var err error
+		epoch, err = time.Parse(time.RFC3339, opts.epoch)
+		if err != nil {
+			return fmt.Errorf("invalid epoch: %w", err)
+		}
+	}
+
+	var pseudonyms []netip.Addr
+	for _, arg := range args {
+		addr, err := netip.ParseAddr(arg)
+		if err != nil {
+			return fmt.Errorf("invalid address: %w", err)
+		}
+		pseudonyms = append(pseudonyms, addr)
+	}
+
+	if opts.sessionFile != "" {
+		addrs, epochs, err := readSessionFileAddresses(opts.sessionFile)
+		if err != nil {
+			return err
+		}
+		pseudonyms = append(pseudonyms, addrs...)
+
+		if opts.epoch == "" {
+			switch len(epochs) {
+			case 0:
+			case 1:
+				epoch = epochs[0]
+			default:
+				return fmt.Errorf("%s has rows of %d key epochs, select one with -epoch", opts.sessionFile, len(epochs))
+			}
+		}
+	}
+
+	key, err := readCryptopanKey(opts.keyFile)
+	if err != nil {
+		return err
+	}
+	d, err := runner.NewDepseudonymiser(key, opts.salt, epoch)
+	if err != nil {
+		return err
+	}
+
+	err = writeDepseudonymiseAudit(opts, epoch, pseudonyms)
+	if err != nil {
+		return err
+	}
+
+	for _, pseudonym := range pseudonyms {
+		_, err = fmt.Fprintf(outW, "%s %s\n", pseudonym, d.Depseudonymise(pseudonym))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readCryptopanKey reads the Crypto-PAn key from name, or from stdin if
+// name is "-". Surrounding whitespace, like a trailing newline, is not part
+// of the key.
+func readCryptopanKey(name string) (string, error) {
+	var b []byte
+	var err error
+	if name == "-" {
+		b, err = io.ReadAll(stdin)
+	} else {
+		b, err = os.ReadFile(name) // #nosec G304 -- key file given by the operator
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to read Crypto-PAn key: %w", err)
+	}
+
+	key := strings.TrimSpace(string(b))
+	if key == "" {
+		return "", errors.New("empty Crypto-PAn key")
+	}
+	return key, nil
+}
+
+func readSessionFileAddresses(name string) ([]netip.Addr, []time.Time, error) {
+	f, err := os.Open(name) // #nosec G304 -- session file given by the operator
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to open session file: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to stat session file: %w", err)
+	}
+
+	return runner.SessionFileAddresses(f, info.Size())
+}
+
+// writeDepseudonymiseAudit appends a JSON record of a run to the audit log:
+// who ran it, why, and which pseudonyms were depseudonymised. The original
+// addresses are not recorded.
+func writeDepseudonymiseAudit(opts *depseudonymiseOptions, epoch time.Time, pseudonyms []netip.Addr) error {
+	f, err := os.OpenFile(opts.auditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("unable to open audit log: %w", err)
+	}
+
+	username := strconv.Itoa(os.Getuid())
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+
+	addrs := make([]string, 0, len(pseudonyms))
+	for _, pseudonym := range pseudonyms {
+		addrs = append(addrs, pseudonym.String())
+	}
+
+	attrs := []any{"user", username, "reason", opts.reason, "pseudonymisation_mode", runner.PseudonymisationModeCryptopan, "addresses", addrs}
+	if !epoch.IsZero() {
+		attrs = append(attrs, "epoch", epoch.UTC().Format(time.RFC3339))
+	}
+	if opts.sessionFile != "" {
+		attrs = append(attrs, "session_file", opts.sessionFile)
+	}
+	if opts.assumeCryptopan {
+		attrs = append(attrs, "assume_cryptopan", true)
+	}
+	record := slog.NewRecord(time.Now(), slog.LevelInfo, "depseudonymise", 0)
+	record.Add(attrs...)
+
+	// Make sure the record is on disk before any address is revealed.
+	err = slog.NewJSONHandler(f, nil).Handle(context.Background(), record)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("unable to write audit log: %w", err)
+	}
+
+	return nil
+}
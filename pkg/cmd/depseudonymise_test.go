@@ -0,0 +1,175 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dnstapir/edm/pkg/runner"
+	"github.com/parquet-go/parquet-go"
+)
+
+func TestDispatchDepseudonymise(t *testing.T) {
+	restoreCmdGlobals(t)
+	stdin = strings.NewReader("test-secret\n")
+
+	auditLog := filepath.Join(t.TempDir(), "audit.log")
+	pseudonym := "203.0.113.99"
+
+	var out, errOut bytes.Buffer
+	err := dispatch([]string{"depseudonymise", "-cryptopan-key-file", "-", "-cryptopan-key-salt", "test-salt", "-reason", "case 42", "-audit-log", auditLog, "-assume-cryptopan", pseudonym}, &out, &errOut)
+	if err != nil {
+		t.Fatalf("dispatch: %s, stderr: %s", err, errOut.String())
+	}
+
+	d, err := runner.NewDepseudonymiser("test-secret", "test-salt", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := pseudonym + " " + d.Depseudonymise(netip.MustParseAddr(pseudonym)).String() + "\n"
+	if out.String() != want {
+		t.Fatalf("output = %q, want %q", out.String(), want)
+	}
+
+	b, err := os.ReadFile(auditLog) // #nosec G304 -- test file in t.TempDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry struct {
+		Msg       string   `json:"msg"`
+		User      string   `json:"user"`
+		Reason    string   `json:"reason"`
+		Addresses []string `json:"addresses"`
+		Mode      string   `json:"pseudonymisation_mode"`
+		Assumed   bool     `json:"assume_cryptopan"`
+	}
+	if err := json.Unmarshal(b, &entry); err != nil {
+		t.Fatalf("audit log %q: %s", b, err)
+	}
+	if entry.Msg != "depseudonymise" || entry.User == "" || entry.Reason != "case 42" || len(entry.Addresses) != 1 || entry.Addresses[0] != pseudonym ||
+		entry.Mode != runner.PseudonymisationModeCryptopan || !entry.Assumed {
+		t.Fatalf("unexpected audit log entry %q", b)
+	}
+	if strings.Contains(string(b), "test-secret") {
+		t.Fatalf("audit log contains the key: %q", b)
+	}
+}
+
+func TestDispatchDepseudonymiseSessionFile(t *testing.T) {
+	restoreCmdGlobals(t)
+	stdin = strings.NewReader("test-secret\n")
+
+	dir := t.TempDir()
+	sessionFile := writeSessionFile(t, dir, runner.PseudonymisationModeCryptopan)
+
+	// A session file says how it was pseudonymised, -assume-cryptopan is
+	// not needed.
+	var out, errOut bytes.Buffer
+	err := dispatch([]string{"depseudonymise", "-cryptopan-key-file", "-", "-reason", "case 42", "-audit-log", filepath.Join(dir, "audit.log"), "-session-file", sessionFile}, &out, &errOut)
+	if err != nil {
+		t.Fatalf("dispatch: %s, stderr: %s", err, errOut.String())
+	}
+	if !strings.HasPrefix(out.String(), "1.2.3.4 ") {
+		t.Fatalf("output = %q, want the address in the session file", out.String())
+	}
+}
+
+func TestDispatchDepseudonymiseErrors(t *testing.T) {
+	restoreCmdGlobals(t)
+
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key")
+	if err := os.WriteFile(keyFile, []byte("test-secret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	auditLog := filepath.Join(dir, "audit.log")
+	truncateSessionFile := writeSessionFile(t, dir, runner.PseudonymisationModeTruncate)
+
+	for _, tc := range []struct {
+		name string
+		args []string
+		want error
+	}{
+		{
+			name: "no key file",
+			args: []string{"-reason", "case 42", "-audit-log", auditLog, "-assume-cryptopan", "203.0.113.99"},
+			want: errNoCryptopanKeyFile,
+		},
+		{
+			name: "no reason",
+			args: []string{"-cryptopan-key-file", keyFile, "-audit-log", auditLog, "-assume-cryptopan", "203.0.113.99"},
+			want: errNoDepseudonymiseReason,
+		},
+		{
+			name: "no input",
+			args: []string{"-cryptopan-key-file", keyFile, "-reason", "case 42", "-audit-log", auditLog},
+			want: errNoDepseudonymiseInput,
+		},
+		{
+			name: "addresses without -assume-cryptopan",
+			args: []string{"-cryptopan-key-file", keyFile, "-reason", "case 42", "-audit-log", auditLog, "203.0.113.99"},
+			want: errNoAssumeCryptopan,
+		},
+		{
+			name: "session file not pseudonymised with Crypto-PAn",
+			args: []string{"-cryptopan-key-file", keyFile, "-reason", "case 42", "-audit-log", auditLog, "-session-file", truncateSessionFile},
+			want: runner.ErrNotCryptopanSession,
+		},
+		{
+			name: "unwritable audit log",
+			args: []string{"-cryptopan-key-file", keyFile, "-reason", "case 42", "-audit-log", filepath.Join(dir, "missing", "audit.log"), "-assume-cryptopan", "203.0.113.99"},
+		},
+		{
+			name: "key on the command line",
+			args: []string{"-cryptopan-key", "test-secret", "-reason", "case 42", "-audit-log", auditLog, "203.0.113.99"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var out, errOut bytes.Buffer
+			err := dispatch(append([]string{"depseudonymise"}, tc.args...), &out, &errOut)
+			if err == nil || (tc.want != nil && !errors.Is(err, tc.want)) {
+				t.Fatalf("dispatch error = %v, want %v", err, tc.want)
+			}
+			if out.Len() != 0 {
+				t.Fatalf("unexpected output %q", out.String())
+			}
+		})
+	}
+
+	if _, err := os.Stat(auditLog); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("audit log written for failed runs: %v", err)
+	}
+}
+
+// writeSessionFile writes a session file with a single address and the
+// given edm_pseudonymisation_mode metadata to dir.
+func writeSessionFile(t *testing.T, dir string, mode string) string {
+	t.Helper()
+
+	type row struct {
+		SourceIPv4 *int32 `parquet:"source_ipv4,optional"`
+	}
+	name := filepath.Join(dir, "dns_session_block.parquet")
+	f, err := os.Create(name) // #nosec G304 -- test file in t.TempDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := int32(0x01020304)
+	w := parquet.NewGenericWriter[row](f, parquet.KeyValueMetadata("edm_pseudonymisation_mode", mode))
+	if _, err := w.Write([]row{{SourceIPv4: &addr}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
@@ -26,10 +26,44 @@ var (
 	exitProcess = os.Exit
 	userHomeDir = os.UserHomeDir
 	osArgs      = func() []string { return os.Args }
+	stdin       = io.Reader(os.Stdin)
 )
 
-// errUnknownCommand is returned by dispatch for an unrecognized subcommand.
-var errUnknownCommand = errors.New("unknown command")
+var (
+	// errUnknownCommand is returned by dispatch for an unrecognized subcommand.
+	errUnknownCommand = errors.New("unknown command")
+	// errNoReplayFiles is returned by the "replay" command when no capture
+	// file is given.
+	errNoReplayFiles = errors.New("no dnstap capture files given")
+	// errNoCryptopanKeyFile is returned by the "depseudonymise" command
+	// when no -cryptopan-key-file is given.
+	errNoCryptopanKeyFile = errors.New("no -cryptopan-key-file given")
+	// errNoDepseudonymiseReason is returned by the "depseudonymise" command
+	// when no -reason is given for the audit log.
+	errNoDepseudonymiseReason = errors.New("no -reason given")
+	// errNoDepseudonymiseInput is returned by the "depseudonymise" command
+	// when neither addresses nor a session file are given.
+	errNoDepseudonymiseInput = errors.New("no addresses or -session-file given")
+	// errNoAssumeCryptopan is returned by the "depseudonymise" command when
+	// addresses are given as arguments without -assume-cryptopan, since
+	// nothing tells how they were pseudonymised.
+	errNoAssumeCryptopan = errors.New("addresses given as arguments require -assume-cryptopan")
+	// errNoSeenOperation is returned by the "seen" command when no
+	// operation is given.
+	errNoSeenOperation = errors.New("no seen operation given")
+	// errUnknownSeenOperation is returned by the "seen" command for an
+	// unrecognized operation.
+	errUnknownSeenOperation = errors.New("unknown seen operation")
+	// errNoSeenQnames is returned by the "seen" command when an operation
+	// taking names is given none.
+	errNoSeenQnames = errors.New("no names given")
+	// errSeenArguments is returned by the "seen" command when an operation
+	// is given the wrong number of arguments.
+	errSeenArguments = errors.New("wrong number of arguments")
+	// errQnameNotSeen is returned by the "seen check" operation for a name
+	// that is not in the seen-qname store.
+	errQnameNotSeen = errors.New("not seen")
+)
 
 // Execute parses the command line and dispatches to the matching subcommand.
 //
@@ -85,6 +119,12 @@ func dispatch(args []string, outW, errW io.Writer) (err error) {
 	switch rest[0] {
 	case "run":
 		err = runRun(rest[1:], rootCfgFile, outW, errW)
+	case "replay":
+		err = runReplay(rest[1:], rootCfgFile, outW, errW)
+	case "depseudonymise":
+		err = runDepseudonymise(rest[1:], outW, errW)
+	case "seen":
+		err = runSeen(rest[1:], outW, errW)
 	default:
 		fmt.Fprintf(errW, "unknown command %q\n\n", rest[0])
 		printUsage(errW, rootFS)
@@ -94,7 +134,8 @@ func dispatch(args []string, outW, errW io.Writer) (err error) {
 }
 
 // printUsage writes the top-level help text: the tool description, the
-// available commands, the root flags and the full set of "run" command flags.
+// available commands, the root flags and the full set of "run" command flags,
+// which the "replay" command shares.
 //
 // The "run" command carries every operational flag, so its flagset is built
 // and printed here too; that keeps "help"/"-help" documenting the complete
@@ -105,10 +146,19 @@ outputting minimised output data.
 
 Usage:
   dnstapir-edm [flags] <command> [command flags]
+  dnstapir-edm [flags] replay [run command flags] <file>...
+  dnstapir-edm depseudonymise [depseudonymise flags] [address...]
+  dnstapir-edm seen [seen flags] <operation> [arguments]
 
 Commands:
-  run     Run dnstapir-edm in dnstap capture mode
-  help    Show this help text
+  run             Run dnstapir-edm in dnstap capture mode
+  replay          Process framestream dnstap capture files, using the frame
+                  timestamps for the histogram and session intervals
+  depseudonymise  Map Crypto-PAn pseudonymised addresses back to the original
+                  addresses, see "depseudonymise -help"
+  seen            Inspect and maintain the seen-qname store of a stopped
+                  dnstapir-edm, see "seen -help"
+  help            Show this help text
 
 Flags:`)
 	rootFS.SetOutput(w)
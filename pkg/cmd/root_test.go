@@ -30,6 +30,7 @@ func restoreCmdGlobals(t *testing.T) {
 	oldExitProcess := exitProcess
 	oldUserHomeDir := userHomeDir
 	oldOSArgs := osArgs
+	oldStdin := stdin
 
 	t.Cleanup(func() {
 		edmLogger = oldLogger
@@ -37,6 +38,7 @@ func restoreCmdGlobals(t *testing.T) {
 		exitProcess = oldExitProcess
 		userHomeDir = oldUserHomeDir
 		osArgs = oldOSArgs
+		stdin = oldStdin
 	})
 }
 
@@ -349,6 +351,46 @@ func TestBuildRunProviderOverridesSurviveReload(t *testing.T) {
 	}
 }
 
+func TestBuildReplayProvider(t *testing.T) {
+	configFile := writeTestConfig(t, "")
+
+	provider, err := buildReplayProvider([]string{"--config-file", configFile, "--data-dir", "/srv/replay", "a.fstrm", "b.fstrm"}, "", io.Discard, io.Discard)
+	if err != nil {
+		t.Fatalf("buildReplayProvider: %s", err)
+	}
+	conf, err := provider.GetConfig()
+	if err != nil {
+		t.Fatalf("GetConfig: %s", err)
+	}
+	if !reflect.DeepEqual(conf.ReplayFiles, []string{"a.fstrm", "b.fstrm"}) {
+		t.Fatalf("ReplayFiles = %q, want [a.fstrm b.fstrm]", conf.ReplayFiles)
+	}
+	if conf.DataDir != "/srv/replay" {
+		t.Fatalf("DataDir = %q, want /srv/replay", conf.DataDir)
+	}
+
+	t.Run("no files", func(t *testing.T) {
+		var errW bytes.Buffer
+		_, err := buildReplayProvider([]string{"--config-file", configFile}, "", io.Discard, &errW)
+		if !errors.Is(err, errNoReplayFiles) {
+			t.Fatalf("buildReplayProvider() = %v, want errNoReplayFiles", err)
+		}
+		if !strings.Contains(errW.String(), errNoReplayFiles.Error()) {
+			t.Fatalf("error not reported to writer: %q", errW.String())
+		}
+	})
+
+	t.Run("usage names the command", func(t *testing.T) {
+		var outW bytes.Buffer
+		if _, err := buildReplayProvider([]string{"-help"}, "", &outW, io.Discard); !errors.Is(err, flag.ErrHelp) {
+			t.Fatalf("buildReplayProvider(-help) = %v, want flag.ErrHelp", err)
+		}
+		if !strings.HasPrefix(outW.String(), "Usage of replay:") {
+			t.Fatalf("usage = %q, want it to start with \"Usage of replay:\"", outW.String())
+		}
+	})
+}
+
 func TestApplyEnvOverridesInvalidValue(t *testing.T) {
 	t.Setenv("DNSTAPIR_EDM_DEBUG", "release")
 
@@ -449,7 +491,7 @@ func TestOverrideForCoversAllFlags(t *testing.T) {
 		var dst, want runner.Config
 		o(&dst)
 		setSentinel(reflect.ValueOf(&want).Elem().Field(idx))
-		if dst != want {
+		if !reflect.DeepEqual(dst, want) {
 			t.Errorf("overrideFor(%q) copied the wrong field: got %+v, want only %s set", f.Name, dst, confType.Field(idx).Name)
 		}
 	})
@@ -512,7 +554,7 @@ func TestPrintUsageMentionsRunCommand(t *testing.T) {
 	rootFS := flag.NewFlagSet("dnstapir-edm", flag.ContinueOnError)
 	rootFS.String("config-file", "", "config file")
 	printUsage(out, rootFS)
-	for _, want := range []string{"run", "help", "config-file", "cryptopan-key", "data-dir", "mqtt-server", "debug"} {
+	for _, want := range []string{"run", "replay", "help", "config-file", "cryptopan-key", "data-dir", "mqtt-server", "debug"} {
 		if !strings.Contains(out.String(), want) {
 			t.Fatalf("usage output missing %q:\n%s", want, out.String())
 		}
@@ -28,11 +28,17 @@ func newRunFlagSet(conf *runner.Config) (fs *flag.FlagSet) {
 	fs.StringVar(&conf.ConfigFile, "config-file", "", "config file for sensitive information (default is $HOME/.dnstapir-edm.toml)")
 
 	fs.BoolVar(&conf.DisableSessionFiles, "disable-session-files", conf.DisableSessionFiles, "do not write out session parquet files")
+	fs.BoolVar(&conf.DisableSessionScrubbing, "disable-session-scrubbing", conf.DisableSessionScrubbing, "store DNS messages in session files without removing EDNS client subnet addresses and cookies")
+	fs.BoolVar(&conf.DisableSessionMessages, "disable-session-messages", conf.DisableSessionMessages, "leave the query_message and response_message columns out of session files")
+	fs.BoolVar(&conf.SessionDerivedColumns, "session-derived-columns", conf.SessionDerivedColumns, "add columns with fields parsed from the DNS message, like qtype and rcode, to session files")
 	fs.BoolVar(&conf.DisableHistogramSender, "disable-histogram-sender", conf.DisableHistogramSender, "do not check for histogram files to upload to core")
 	fs.BoolVar(&conf.DisableMQTT, "disable-mqtt", conf.DisableMQTT, "disable MQTT message sending")
 	fs.BoolVar(&conf.DisableMQTTFilequeue, "disable-mqtt-filequeue", conf.DisableMQTTFilequeue, "disable MQTT file based queue")
 	fs.BoolVar(&conf.EnableManualParquetRotation, "enable-manual-parquet-rotation", conf.EnableManualParquetRotation, "enable localhost HTTP endpoint for manually rotating session and histogram parquet files")
 	fs.BoolVar(&conf.PebbleSync, "pebble-sync", conf.PebbleSync, "fsync seen-qname pebble writes")
+	fs.BoolVar(&conf.ProcessQueryMessages, "process-query-messages", conf.ProcessQueryMessages, "also process query type dnstap messages, not only responses")
+	fs.BoolVar(&conf.CorrelateQueryResponses, "correlate-query-responses", conf.CorrelateQueryResponses, "join CLIENT_QUERY messages with their CLIENT_RESPONSE into one session row")
+	fs.BoolVar(&conf.PartitionByIdentity, "partition-by-identity", conf.PartitionByIdentity, "write separate session and histogram files per dnstap identity")
 
 	fs.StringVar(&conf.InputUnix, "input-unix", conf.InputUnix, "create unix socket for reading dnstap (e.g. /var/lib/unbound/dnstap.sock)")
 	fs.StringVar(&conf.InputTCP, "input-tcp", conf.InputTCP, "create TCP socket for reading dnstap (e.g. '127.0.0.1:53535')")
@@ -43,6 +49,10 @@ func newRunFlagSet(conf *runner.Config) (fs *flag.FlagSet) {
 
 	fs.StringVar(&conf.CryptopanKey, "cryptopan-key", conf.CryptopanKey, "override the secret used for Crypto-PAn pseudonymization")
 	fs.StringVar(&conf.CryptopanKeySalt, "cryptopan-key-salt", conf.CryptopanKeySalt, "the salt used for key derivation")
+	fs.StringVar(&conf.CryptopanKeyRotation, "cryptopan-key-rotation", conf.CryptopanKeyRotation, "Derive a new Crypto-PAn key from cryptopan-key at wall clock boundaries of this interval, e.g. 24h, empty disables rotation")
+	fs.StringVar(&conf.PseudonymisationMode, "pseudonymisation-mode", conf.PseudonymisationMode, "How client and server addresses are pseudonymised: \"cryptopan\", \"truncate\", \"hmac\" or \"none\"")
+	fs.IntVar(&conf.PseudonymisationIPv4Prefix, "pseudonymisation-ipv4-prefix", conf.PseudonymisationIPv4Prefix, "Number of leading bits kept of IPv4 addresses with truncate pseudonymisation-mode")
+	fs.IntVar(&conf.PseudonymisationIPv6Prefix, "pseudonymisation-ipv6-prefix", conf.PseudonymisationIPv6Prefix, "Number of leading bits kept of IPv6 addresses with truncate pseudonymisation-mode")
 	fs.StringVar(&conf.WellKnownDomainsFile, "well-known-domains-file", conf.WellKnownDomainsFile, "the DAWG file used for filtering well-known domains")
 	fs.StringVar(&conf.IgnoredClientIPsFile, "ignored-client-ips-file", conf.IgnoredClientIPsFile, "file containing a newline separated list of IPv4/IPv6 CIDRs of DNS clients that will be ignored")
 	fs.StringVar(&conf.IgnoredQuestionNamesFile, "ignored-question-names-file", conf.IgnoredQuestionNamesFile, "a DAWG file containing question section names that will be ignored")
@@ -65,9 +75,24 @@ func newRunFlagSet(conf *runner.Config) (fs *flag.FlagSet) {
 	})
 
 	fs.IntVar(&conf.QnameSeenEntries, "qname-seen-entries", conf.QnameSeenEntries, "Number of 'seen' qnames stored in LRU cache, need to be changed based on RAM")
+	fs.StringVar(&conf.SeenQnameTTL, "seen-qname-ttl", conf.SeenQnameTTL, "Announce a qname in a new_qname event again once it has not been seen for this long, e.g. 720h, empty means never")
+	fs.StringVar(&conf.SeenQnameBackend, "seen-qname-backend", conf.SeenQnameBackend, "Where the qnames already announced in new_qname events are kept: \"pebble\" (on disk), \"memory\" (lost on restart) or \"bloom\" (a fixed size Bloom filter on disk)")
+	fs.IntVar(&conf.SeenQnameCapacity, "seen-qname-capacity", conf.SeenQnameCapacity, "Number of qnames the memory and bloom seen-qname-backends are sized for")
+	fs.Float64Var(&conf.SeenQnameFalsePositiveRate, "seen-qname-false-positive-rate", conf.SeenQnameFalsePositiveRate, "False-positive rate of the bloom seen-qname-backend at seen-qname-capacity qnames")
 	fs.IntVar(&conf.CryptopanAddressEntries, "cryptopan-address-entries", conf.CryptopanAddressEntries, "Number of cryptopan pseudonymised addresses stored in LRU cache, 0 disables the cache, need to be changed based on RAM")
 	fs.IntVar(&conf.NewQnameBuffer, "newqname-buffer", conf.NewQnameBuffer, "Number of slots in new_qname publisher channel, if this is filled up we skip new_qname events")
+	fs.IntVar(&conf.NewQnameDedupeLabels, "new-qname-dedupe-labels", conf.NewQnameDedupeLabels, "Deduplicate new_qname events on the public suffix plus this many labels, 1 for the registrable domain, with the number of distinct names seen below it in each event; 0 deduplicates on the full qname")
+	fs.IntVar(&conf.CorrelationWindow, "correlation-window", conf.CorrelationWindow, "Seconds a session row waits for the other half of its query/response pair when correlate-query-responses is enabled")
+	fs.StringVar(&conf.SessionInterval, "session-interval", conf.SessionInterval, "How often session parquet files are rotated, aligned to the wall clock, e.g. 1m, 15m or 1h")
+	fs.StringVar(&conf.HistogramInterval, "histogram-interval", conf.HistogramInterval, "How often histogram parquet files are rotated, aligned to the wall clock, e.g. 1m, 15m or 1h")
+	fs.IntVar(&conf.SessionRowGroupSize, "session-row-group-size", conf.SessionRowGroupSize, "Number of session rows buffered in memory before they are flushed to the session file as a row group")
+	fs.IntVar(&conf.SessionMaxFileSize, "session-max-file-size", conf.SessionMaxFileSize, "Size in MiB at which a session file is rotated before the end of its interval, 0 means no limit")
 	fs.IntVar(&conf.HistogramHLLExplicitThreshold, "histogram-hll-explicit-threshold", conf.HistogramHLLExplicitThreshold, "When the number of unique IP addresses is beyond this threshold we will include HLL data for a domain in the histogram parquet file")
+	fs.IntVar(&conf.HistogramMinClients, "histogram-min-clients", conf.HistogramMinClients, "Leave out histogram rows of domains seen from fewer unique clients than this, 0 disables the threshold")
+	fs.StringVar(&conf.HistogramSuppressedRows, "histogram-suppressed-rows", conf.HistogramSuppressedRows, "What to do with histogram rows below histogram-min-clients: \"drop\" them or \"merge-tld\" them into one row per TLD")
+	fs.StringVar(&conf.HistogramNoise, "histogram-noise", conf.HistogramNoise, "Random noise added to histogram counters: \"none\", \"laplace\" or \"gaussian\"")
+	fs.Float64Var(&conf.HistogramNoiseEpsilon, "histogram-noise-epsilon", conf.HistogramNoiseEpsilon, "Epsilon the histogram-noise is scaled for, smaller values add more noise")
+	fs.Float64Var(&conf.HistogramNoiseDelta, "histogram-noise-delta", conf.HistogramNoiseDelta, "Delta the gaussian histogram-noise is scaled for")
 
 	fs.StringVar(&conf.HTTPCAFile, "http-ca-file", conf.HTTPCAFile, "CA cert used for validating aggregate-receiver connection, defaults to using OS CA certs")
 	fs.StringVar(&conf.HTTPSigningKeyFile, "http-signing-key-file", conf.HTTPSigningKeyFile, "ECSDSA key used for signing HTTP messages to aggregate-receiver")
@@ -123,6 +148,12 @@ func overrideFor(name string, src *runner.Config) runner.ConfigOverride {
 	switch name {
 	case "disable-session-files":
 		return func(c *runner.Config) { c.DisableSessionFiles = src.DisableSessionFiles }
+	case "disable-session-scrubbing":
+		return func(c *runner.Config) { c.DisableSessionScrubbing = src.DisableSessionScrubbing }
+	case "disable-session-messages":
+		return func(c *runner.Config) { c.DisableSessionMessages = src.DisableSessionMessages }
+	case "session-derived-columns":
+		return func(c *runner.Config) { c.SessionDerivedColumns = src.SessionDerivedColumns }
 	case "disable-histogram-sender":
 		return func(c *runner.Config) { c.DisableHistogramSender = src.DisableHistogramSender }
 	case "disable-mqtt":
@@ -133,6 +164,12 @@ func overrideFor(name string, src *runner.Config) runner.ConfigOverride {
 		return func(c *runner.Config) { c.EnableManualParquetRotation = src.EnableManualParquetRotation }
 	case "pebble-sync":
 		return func(c *runner.Config) { c.PebbleSync = src.PebbleSync }
+	case "process-query-messages":
+		return func(c *runner.Config) { c.ProcessQueryMessages = src.ProcessQueryMessages }
+	case "correlate-query-responses":
+		return func(c *runner.Config) { c.CorrelateQueryResponses = src.CorrelateQueryResponses }
+	case "partition-by-identity":
+		return func(c *runner.Config) { c.PartitionByIdentity = src.PartitionByIdentity }
 	case "input-unix":
 		return func(c *runner.Config) { c.InputUnix = src.InputUnix }
 	case "input-tcp":
@@ -149,6 +186,14 @@ func overrideFor(name string, src *runner.Config) runner.ConfigOverride {
 		return func(c *runner.Config) { c.CryptopanKey = src.CryptopanKey }
 	case "cryptopan-key-salt":
 		return func(c *runner.Config) { c.CryptopanKeySalt = src.CryptopanKeySalt }
+	case "cryptopan-key-rotation":
+		return func(c *runner.Config) { c.CryptopanKeyRotation = src.CryptopanKeyRotation }
+	case "pseudonymisation-mode":
+		return func(c *runner.Config) { c.PseudonymisationMode = src.PseudonymisationMode }
+	case "pseudonymisation-ipv4-prefix":
+		return func(c *runner.Config) { c.PseudonymisationIPv4Prefix = src.PseudonymisationIPv4Prefix }
+	case "pseudonymisation-ipv6-prefix":
+		return func(c *runner.Config) { c.PseudonymisationIPv6Prefix = src.PseudonymisationIPv6Prefix }
 	case "well-known-domains-file":
 		return func(c *runner.Config) { c.WellKnownDomainsFile = src.WellKnownDomainsFile }
 	case "ignored-client-ips-file":
@@ -173,12 +218,42 @@ func overrideFor(name string, src *runner.Config) runner.ConfigOverride {
 		return func(c *runner.Config) { c.MQTTKeepalive = src.MQTTKeepalive }
 	case "qname-seen-entries":
 		return func(c *runner.Config) { c.QnameSeenEntries = src.QnameSeenEntries }
+	case "seen-qname-ttl":
+		return func(c *runner.Config) { c.SeenQnameTTL = src.SeenQnameTTL }
+	case "seen-qname-backend":
+		return func(c *runner.Config) { c.SeenQnameBackend = src.SeenQnameBackend }
+	case "seen-qname-capacity":
+		return func(c *runner.Config) { c.SeenQnameCapacity = src.SeenQnameCapacity }
+	case "seen-qname-false-positive-rate":
+		return func(c *runner.Config) { c.SeenQnameFalsePositiveRate = src.SeenQnameFalsePositiveRate }
 	case "cryptopan-address-entries":
 		return func(c *runner.Config) { c.CryptopanAddressEntries = src.CryptopanAddressEntries }
 	case "newqname-buffer":
 		return func(c *runner.Config) { c.NewQnameBuffer = src.NewQnameBuffer }
+	case "new-qname-dedupe-labels":
+		return func(c *runner.Config) { c.NewQnameDedupeLabels = src.NewQnameDedupeLabels }
+	case "correlation-window":
+		return func(c *runner.Config) { c.CorrelationWindow = src.CorrelationWindow }
+	case "session-interval":
+		return func(c *runner.Config) { c.SessionInterval = src.SessionInterval }
+	case "histogram-interval":
+		return func(c *runner.Config) { c.HistogramInterval = src.HistogramInterval }
+	case "session-row-group-size":
+		return func(c *runner.Config) { c.SessionRowGroupSize = src.SessionRowGroupSize }
+	case "session-max-file-size":
+		return func(c *runner.Config) { c.SessionMaxFileSize = src.SessionMaxFileSize }
 	case "histogram-hll-explicit-threshold":
 		return func(c *runner.Config) { c.HistogramHLLExplicitThreshold = src.HistogramHLLExplicitThreshold }
+	case "histogram-min-clients":
+		return func(c *runner.Config) { c.HistogramMinClients = src.HistogramMinClients }
+	case "histogram-suppressed-rows":
+		return func(c *runner.Config) { c.HistogramSuppressedRows = src.HistogramSuppressedRows }
+	case "histogram-noise":
+		return func(c *runner.Config) { c.HistogramNoise = src.HistogramNoise }
+	case "histogram-noise-epsilon":
+		return func(c *runner.Config) { c.HistogramNoiseEpsilon = src.HistogramNoiseEpsilon }
+	case "histogram-noise-delta":
+		return func(c *runner.Config) { c.HistogramNoiseDelta = src.HistogramNoiseDelta }
 	case "http-ca-file":
 		return func(c *runner.Config) { c.HTTPCAFile = src.HTTPCAFile }
 	case "http-signing-key-file":
@@ -212,9 +287,29 @@ func overrideFor(name string, src *runner.Config) runner.ConfigOverride {
 // afterwards enumerates exactly the union of env-set and CLI-set flags, which
 // becomes the immutable override layer re-applied on every config reload.
 func buildRunProvider(args []string, rootCfgFile string, outW, errW io.Writer) (provider *runner.FileConfigProvider, err error) {
+	return buildProvider("run", args, rootCfgFile, outW, errW, nil)
+}
+
+// buildReplayProvider is [buildRunProvider] for the "replay" command, which
+// takes the run flags followed by the dnstap capture files to replay.
+func buildReplayProvider(args []string, rootCfgFile string, outW, errW io.Writer) (provider *runner.FileConfigProvider, err error) {
+	return buildProvider("replay", args, rootCfgFile, outW, errW, func(files []string) (runner.ConfigOverride, error) {
+		if len(files) == 0 {
+			return nil, errNoReplayFiles
+		}
+		return func(c *runner.Config) { c.ReplayFiles = files }, nil
+	})
+}
+
+// buildProvider implements [buildRunProvider] for the command name. A
+// command without positional arguments passes a nil positional; otherwise
+// positional turns the arguments left after the flags into an extra
+// override.
+func buildProvider(name string, args []string, rootCfgFile string, outW, errW io.Writer, positional func([]string) (runner.ConfigOverride, error)) (provider *runner.FileConfigProvider, err error) {
 	// flagConf escapes into the override closures, which outlive this call.
 	flagConf := new(runner.Config)
 	fs := newRunFlagSet(flagConf)
+	fs.Init(name, flag.ContinueOnError)
 	fs.SetOutput(errW)
 	var usage bytes.Buffer
 	fs.Usage = func() {
@@ -234,8 +329,14 @@ func buildRunProvider(args []string, rootCfgFile string, outW, errW io.Writer) (
 			parseReported = true
 		}
 	}
-	if err == nil && fs.NArg() > 0 {
-		err = fmt.Errorf("unexpected argument(s): %q", fs.Args())
+	var positionalOverride runner.ConfigOverride
+	if err == nil {
+		switch {
+		case positional != nil:
+			positionalOverride, err = positional(fs.Args())
+		case fs.NArg() > 0:
+			err = fmt.Errorf("unexpected argument(s): %q", fs.Args())
+		}
 	}
 
 	var path string
@@ -254,6 +355,9 @@ func buildRunProvider(args []string, rootCfgFile string, outW, errW io.Writer) (
 				overrides = append(overrides, o)
 			}
 		})
+		if positionalOverride != nil {
+			overrides = append(overrides, positionalOverride)
+		}
 		provider = runner.NewFileConfigProvider(path, overrides...)
 	}
 
@@ -292,8 +396,23 @@ func runRun(args []string, rootCfgFile string, outW, errW io.Writer) (err error)
 	return
 }
 
+// runReplay implements the "replay" subcommand.
+func runReplay(args []string, rootCfgFile string, outW, errW io.Writer) (err error) {
+	var provider *runner.FileConfigProvider
+	provider, err = buildReplayProvider(args, rootCfgFile, outW, errW)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	if err == nil {
+		edmLogger.Info("using config file", "filename", provider.Path())
+		err = runMinimiser(provider)
+	}
+	return
+}
+
 // runMinimiser constructs the minimiser from provider and runs it until
-// SIGINT or SIGTERM. Errors are logged before being returned.
+// SIGINT or SIGTERM, or until a replay is done. Errors are logged before
+// being returned.
 func runMinimiser(provider runner.ConfigProvider) (err error) {
 	var edm *runner.DnstapMinimiser
 	edm, err = runner.NewDnstapMinimiser(provider, edmLogger, runner.WithLoggerLevel(edmLoggerLevel))
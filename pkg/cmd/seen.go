@@ -0,0 +1,210 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/dnstapir/edm/pkg/runner"
+)
+
+// seenOptions are the flags of the "seen" command and its operations.
+type seenOptions struct {
+	dataDir string
+	backend string
+	prefix  string
+	suffix  bool
+}
+
+// newSeenFlagSet builds the flagset for the "seen" subcommand, preceding the
+// operation.
+func newSeenFlagSet(opts *seenOptions) (fs *flag.FlagSet) {
+	defaults := runner.DefaultConfig()
+	fs = flag.NewFlagSet("seen", flag.ContinueOnError)
+	fs.StringVar(&opts.dataDir, "data-dir", defaults.DataDir, "directory of the seen-qname store, as given to the run command")
+	fs.StringVar(&opts.backend, "seen-qname-backend", defaults.SeenQnameBackend, "seen-qname-backend as given to the run command, only \"pebble\" stores can be inspected")
+	return fs
+}
+
+// newSeenOperationFlagSet builds the flagset of a "seen" operation, most of
+// which take no flags.
+func newSeenOperationFlagSet(op string, opts *seenOptions) (fs *flag.FlagSet) {
+	fs = flag.NewFlagSet("seen "+op, flag.ContinueOnError)
+	switch op {
+	case "list":
+		fs.StringVar(&opts.prefix, "prefix", "", "only list qnames starting with this prefix")
+	case "delete":
+		fs.BoolVar(&opts.suffix, "suffix", false, "also delete every name below the given names")
+	}
+	return fs
+}
+
+// runSeen implements the "seen" subcommand: inspecting and maintaining the
+// seen-qname store of a stopped dnstapir-edm. It refuses to touch a store
+// held open by a running dnstapir-edm.
+func runSeen(args []string, outW, errW io.Writer) (err error) {
+	opts := new(seenOptions)
+	fs := newSeenFlagSet(opts)
+	help, err := parseSeenFlags(fs, args, outW, errW, printSeenUsage)
+	if help || err != nil {
+		return
+	}
+
+	rest := fs.Args()
+	if len(rest) == 0 {
+		printSeenUsage(errW, fs)
+		return errNoSeenOperation
+	}
+	op := rest[0]
+	switch op {
+	case "list", "check", "delete", "import", "export", "stats":
+	default:
+		fmt.Fprintf(errW, "unknown seen operation %q\n\n", op)
+		printSeenUsage(errW, fs)
+		return fmt.Errorf("%w: %q", errUnknownSeenOperation, op)
+	}
+
+	opFS := newSeenOperationFlagSet(op, opts)
+	help, err = parseSeenFlags(opFS, rest[1:], outW, errW, printFlagSetUsage)
+	if help || err != nil {
+		return
+	}
+
+	err = seen(opts, op, opFS.Args(), outW)
+	if err != nil {
+		fmt.Fprintln(errW, err)
+	}
+	return
+}
+
+// parseSeenFlags parses args with fs, writing the usage printed by
+// printUsage to outW for -help, reported as help, and to errW on errors.
+func parseSeenFlags(fs *flag.FlagSet, args []string, outW, errW io.Writer, printUsage func(io.Writer, *flag.FlagSet)) (help bool, err error) {
+	fs.SetOutput(errW)
+	var usage bytes.Buffer
+	fs.Usage = func() {
+		usage.Reset()
+		printUsage(&usage, fs)
+	}
+
+	err = fs.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		_, err = io.Copy(outW, &usage)
+		return true, err
+	}
+	if err != nil {
+		if _, copyErr := io.Copy(errW, &usage); copyErr != nil {
+			err = errors.Join(err, copyErr)
+		}
+	}
+	return false, err
+}
+
+// printSeenUsage writes the help text of the "seen" command.
+func printSeenUsage(w io.Writer, fs *flag.FlagSet) {
+	fmt.Fprintln(w, `Usage:
+  dnstapir-edm seen [-data-dir dir] [-seen-qname-backend pebble] <operation> [operation flags] [arguments]
+
+Operations:
+  list [-prefix prefix]     List the qnames in the store
+  check <name>              Show when a name was last seen, fails if it was not
+  delete [-suffix] <name>...
+                            Delete names, and with -suffix every name below
+                            them, so they are announced as new again
+  import <file>             Record the names in file ("-" for stdin), one per
+                            line, as seen
+  export                    Write every qname and its last-seen time, in the
+                            format read by import
+  stats                     Show the number of qnames and the disk space used
+
+The store is locked while it is open, so dnstapir-edm must not be running.
+
+Flags:`)
+	fs.SetOutput(w)
+	fs.PrintDefaults()
+}
+
+func seen(opts *seenOptions, op string, args []string, outW io.Writer) (err error) {
+	switch {
+	case (op == "check" || op == "delete") && len(args) == 0:
+		return fmt.Errorf("%w for %s", errNoSeenQnames, op)
+	case op == "check" && len(args) > 1, op == "import" && len(args) != 1:
+		return fmt.Errorf("%w for %s", errSeenArguments, op)
+	case (op == "list" || op == "export" || op == "stats") && len(args) > 0:
+		return fmt.Errorf("%w for %s", errSeenArguments, op)
+	case opts.backend != runner.SeenQnameBackendPebble:
+		return fmt.Errorf("%w, got %q", runner.ErrSeenQnameBackendNotPebble, opts.backend)
+	}
+
+	store, err := runner.OpenSeenQnameDB(opts.dataDir, op == "import")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := store.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	switch op {
+	case "list":
+		return store.List(opts.prefix, func(qname string, _ time.Time) error {
+			_, err := fmt.Fprintln(outW, qname)
+			return err
+		})
+	case "check":
+		lastSeen, found, err := store.LastSeen(args[0])
+		switch {
+		case err != nil:
+			return err
+		case !found:
+			return fmt.Errorf("%w: %s", errQnameNotSeen, args[0])
+		case lastSeen.IsZero():
+			_, err = fmt.Fprintf(outW, "%s seen, last-seen time unknown\n", args[0])
+		default:
+			_, err = fmt.Fprintf(outW, "%s last seen %s\n", args[0], lastSeen.UTC().Format(time.RFC3339))
+		}
+		return err
+	case "delete":
+		var deleted int
+		for _, name := range args {
+			n, err := store.Delete(name, opts.suffix)
+			if err != nil {
+				return err
+			}
+			deleted += n
+		}
+		_, err = fmt.Fprintf(outW, "deleted %d qnames\n", deleted)
+		return err
+	case "import":
+		r := stdin
+		if args[0] != "-" {
+			f, err := os.Open(args[0]) // #nosec G304 -- name file given by the operator
+			if err != nil {
+				return fmt.Errorf("unable to open name file: %w", err)
+			}
+			defer f.Close()
+			r = f
+		}
+		imported, err := store.Import(r, time.Now())
+		if err != nil {
+			return fmt.Errorf("imported %d qnames before failing: %w", imported, err)
+		}
+		_, err = fmt.Fprintf(outW, "imported %d qnames\n", imported)
+		return err
+	case "export":
+		_, err = store.Export(outW)
+		return err
+	default: // "stats"
+		entries, diskUsage, err := store.Stats()
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(outW, "entries: %d\ndisk usage: %d bytes\n", entries, diskUsage)
+		return err
+	}
+}
@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dnstapir/edm/pkg/runner"
+)
+
+func runSeenDispatch(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	var out, errOut bytes.Buffer
+	err := dispatch(append([]string{"seen"}, args...), &out, &errOut)
+	return out.String(), err
+}
+
+func TestDispatchSeen(t *testing.T) {
+	restoreCmdGlobals(t)
+	dataDir := t.TempDir()
+
+	stdin = strings.NewReader("www.example.com\nmail.example.com\nexample.org\n")
+	out, err := runSeenDispatch(t, "-data-dir", dataDir, "import", "-")
+	if err != nil || out != "imported 3 qnames\n" {
+		t.Fatalf("import = %q, %v", out, err)
+	}
+
+	nameFile := filepath.Join(t.TempDir(), "names")
+	if err := os.WriteFile(nameFile, []byte("example.net 2023-01-02T03:04:05Z\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := runSeenDispatch(t, "-data-dir", dataDir, "import", nameFile); err != nil || out != "imported 1 qnames\n" {
+		t.Fatalf("import file = %q, %v", out, err)
+	}
+
+	if out, err := runSeenDispatch(t, "-data-dir", dataDir, "list", "-prefix", "example."); err != nil || out != "example.net.\nexample.org.\n" {
+		t.Fatalf("list = %q, %v", out, err)
+	}
+	if out, err := runSeenDispatch(t, "-data-dir", dataDir, "check", "example.net"); err != nil || out != "example.net last seen 2023-01-02T03:04:05Z\n" {
+		t.Fatalf("check = %q, %v", out, err)
+	}
+	if out, err := runSeenDispatch(t, "-data-dir", dataDir, "export"); err != nil || !strings.HasPrefix(out, "example.net. 2023-01-02T03:04:05Z\nexample.org. ") {
+		t.Fatalf("export = %q, %v", out, err)
+	}
+
+	if out, err := runSeenDispatch(t, "-data-dir", dataDir, "delete", "-suffix", "example.com"); err != nil || out != "deleted 2 qnames\n" {
+		t.Fatalf("delete = %q, %v", out, err)
+	}
+	if _, err := runSeenDispatch(t, "-data-dir", dataDir, "check", "www.example.com"); !errors.Is(err, errQnameNotSeen) {
+		t.Fatalf("check deleted name: %v, want %v", err, errQnameNotSeen)
+	}
+
+	if out, err := runSeenDispatch(t, "-data-dir", dataDir, "stats"); err != nil || !strings.HasPrefix(out, "entries: 2\ndisk usage: ") {
+		t.Fatalf("stats = %q, %v", out, err)
+	}
+
+	if out, err := runSeenDispatch(t, "-help"); err != nil || !strings.Contains(out, "Operations:") {
+		t.Fatalf("help = %q, %v", out, err)
+	}
+}
+
+func TestDispatchSeenErrors(t *testing.T) {
+	restoreCmdGlobals(t)
+
+	dataDir := t.TempDir()
+	s, err := runner.OpenSeenQnameDB(dataDir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, tc := range []struct {
+		name string
+		args []string
+		want error
+	}{
+		{
+			name: "no operation",
+			args: []string{"-data-dir", dataDir},
+			want: errNoSeenOperation,
+		},
+		{
+			name: "unknown operation",
+			args: []string{"-data-dir", dataDir, "drop"},
+			want: errUnknownSeenOperation,
+		},
+		{
+			name: "no names",
+			args: []string{"-data-dir", dataDir, "delete", "-suffix"},
+			want: errNoSeenQnames,
+		},
+		{
+			name: "extra arguments",
+			args: []string{"-data-dir", dataDir, "stats", "example.com"},
+			want: errSeenArguments,
+		},
+		{
+			name: "store in use",
+			args: []string{"-data-dir", dataDir, "list"},
+			want: runner.ErrSeenQnameStoreInUse,
+		},
+		{
+			name: "missing store",
+			args: []string{"-data-dir", t.TempDir(), "list"},
+		},
+		{
+			name: "bloom backend",
+			args: []string{"-data-dir", dataDir, "-seen-qname-backend", runner.SeenQnameBackendBloom, "list"},
+			want: runner.ErrSeenQnameBackendNotPebble,
+		},
+		{
+			name: "unknown operation flag",
+			args: []string{"-data-dir", dataDir, "list", "-suffix"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := runSeenDispatch(t, tc.args...)
+			if err == nil || (tc.want != nil && !errors.Is(err, tc.want)) {
+				t.Fatalf("dispatch error = %v, want %v", err, tc.want)
+			}
+			if out != "" {
+				t.Fatalf("unexpected output %q", out)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package protocols
 import (
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/miekg/dns"
 )
 
@@ -29,6 +30,12 @@ type NewQnameJSON struct {
 	// Rdlength corresponds to the JSON schema field "rdlength".
 	Rdlength *int `json:"rdlength,omitempty"`
 
+	// SubnameCount is the number of distinct names seen below Qname until
+	// the end of the histogram interval the event was sent at, set when
+	// new_qname events are deduplicated per registrable domain. It is not
+	// yet part of the upstream schema.
+	SubnameCount *int `json:"subname_count,omitempty"`
+
 	// Timestamp corresponds to the JSON schema field "timestamp".
 	Timestamp *time.Time `json:"timestamp,omitempty"`
 
@@ -95,21 +102,33 @@ func bitsFromMsg(dns *dns.Msg) uint16 {
 	return bits
 }
 
-// NewQnameEvent constructs a NewQnameJSON event from a DNS message and a
-// timestamp. If the Question section is empty the returned event will have
-// an empty Qname, nil Qtype and nil Qclass, but other header-derived fields
-// will still be populated.
-func NewQnameEvent(msg *dns.Msg, ts time.Time) NewQnameJSON {
+// NewQnameEvent constructs a NewQnameJSON event from a DNS message, the
+// initiator of the message and a timestamp. An empty initiator leaves
+// Initiator unset. Each event gets a unique UUIDv7 MessageID so receivers can
+// recognise the same event sent more than once. Rdlength is the RDLENGTH of
+// the first record in the Answer section, as received, and unset without
+// answers. If the Question section is empty the returned event will have an
+// empty Qname, nil Qtype and nil Qclass, but other header-derived fields will
+// still be populated.
+func NewQnameEvent(msg *dns.Msg, initiator NewQnameJSONInitiator, ts time.Time) NewQnameJSON {
 	bits := bitsFromMsg(msg)
 	flags := int(bits)
+	// NewV7 only fails if crypto/rand does, which never returns an error
+	// since Go 1.24.
+	messageID := uuid.Must(uuid.NewV7()).String()
 
 	event := NewQnameJSON{
 		Type:      NewQnameJSONType,
 		Timestamp: &ts,
 		Flags:     &flags,
+		MessageID: &messageID,
 		Version:   NewQnameJSONVersion,
 	}
 
+	if initiator != "" {
+		event.Initiator = &initiator
+	}
+
 	if len(msg.Question) > 0 {
 		qType := int(msg.Question[0].Qtype)
 		qClass := int(msg.Question[0].Qclass)
@@ -118,5 +137,10 @@ func NewQnameEvent(msg *dns.Msg, ts time.Time) NewQnameJSON {
 		event.Qclass = &qClass
 	}
 
+	if len(msg.Answer) > 0 {
+		rdlength := int(msg.Answer[0].Header().Rdlength)
+		event.Rdlength = &rdlength
+	}
+
 	return event
 }
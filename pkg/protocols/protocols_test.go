@@ -4,6 +4,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/miekg/dns"
 )
 
@@ -36,7 +37,7 @@ func TestNewQnameEvent(t *testing.T) {
 	msg.RecursionDesired = true
 	ts := time.Date(2026, 5, 28, 12, 13, 14, 15, time.UTC)
 
-	got := NewQnameEvent(msg, ts)
+	got := NewQnameEvent(msg, NewQnameJSONInitiatorClient, ts)
 
 	if got.Type != NewQnameJSONType {
 		t.Fatalf("Type = %q, want %q", got.Type, NewQnameJSONType)
@@ -59,6 +60,32 @@ func TestNewQnameEvent(t *testing.T) {
 	if got.Flags == nil || *got.Flags != int(_RD) {
 		t.Fatalf("Flags = %v, want %d", got.Flags, _RD)
 	}
+	if got.Initiator == nil || *got.Initiator != NewQnameJSONInitiatorClient {
+		t.Fatalf("Initiator = %v, want %q", got.Initiator, NewQnameJSONInitiatorClient)
+	}
+	if got.Rdlength != nil {
+		t.Fatalf("Rdlength = %d without answers, want nil", *got.Rdlength)
+	}
+	if got.MessageID == nil {
+		t.Fatal("MessageID not set")
+	}
+	if id, err := uuid.Parse(*got.MessageID); err != nil || id.Version() != 7 {
+		t.Fatalf("MessageID = %q, want a UUIDv7", *got.MessageID)
+	}
+	if again := NewQnameEvent(msg, NewQnameJSONInitiatorClient, ts); *again.MessageID == *got.MessageID {
+		t.Fatalf("MessageID %q reused", *got.MessageID)
+	}
+}
+
+func TestNewQnameEventRdlength(t *testing.T) {
+	got := NewQnameEvent(testResponse(t), NewQnameJSONInitiatorResolver, time.Time{})
+
+	if got.Initiator == nil || *got.Initiator != NewQnameJSONInitiatorResolver {
+		t.Fatalf("Initiator = %v, want %q", got.Initiator, NewQnameJSONInitiatorResolver)
+	}
+	if got.Rdlength == nil || *got.Rdlength != 4 {
+		t.Fatalf("Rdlength = %v, want 4", got.Rdlength)
+	}
 }
 
 func TestNewQnameEventEmptyQuestion(t *testing.T) {
@@ -72,7 +99,7 @@ func TestNewQnameEventEmptyQuestion(t *testing.T) {
 		}
 	}()
 
-	event := NewQnameEvent(msg, ts)
+	event := NewQnameEvent(msg, "", ts)
 
 	if event.Qname != "" {
 		t.Fatalf("Qname have: %q want: %q", event.Qname, "")
@@ -95,4 +122,7 @@ func TestNewQnameEventEmptyQuestion(t *testing.T) {
 	if event.Flags == nil {
 		t.Fatal("Flags have: nil want: non-nil")
 	}
+	if event.Initiator != nil {
+		t.Fatalf("Initiator have: %v want: nil", *event.Initiator)
+	}
 }
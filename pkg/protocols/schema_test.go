@@ -0,0 +1,249 @@
+package protocols
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v3"
+)
+
+// loadSchema reads a JSON schema in YAML from testdata.
+func loadSchema(t *testing.T, name string) map[string]any {
+	t.Helper()
+
+	b, err := os.ReadFile(filepath.Join("testdata", name)) // #nosec G304 -- Test data file
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema map[string]any
+	if err := yaml.Unmarshal(b, &schema); err != nil {
+		t.Fatalf("unable to parse %s: %s", name, err)
+	}
+	return schema
+}
+
+// validateSchema checks value, decoded from JSON with UseNumber, against
+// schema. Only the keywords used by the dnstapir event schemas are
+// supported, any other keyword is reported so the validator is extended
+// when the schemas are.
+func validateSchema(schema map[string]any, value any, path string) error {
+	for keyword, arg := range schema {
+		var err error
+		switch keyword {
+		case "$schema", "$id", "title", "description", "properties":
+		case "type":
+			err = validateType(arg, value)
+		case "const":
+			if !reflect.DeepEqual(value, arg) {
+				err = fmt.Errorf("%v is not %v", value, arg)
+			}
+		case "enum":
+			if !slices.Contains(arg.([]any), value) {
+				err = fmt.Errorf("%v is not one of %v", value, arg)
+			}
+		case "format":
+			err = validateFormat(arg, value)
+		case "minimum", "maximum":
+			n, ok := value.(json.Number)
+			if !ok {
+				break
+			}
+			i, _ := n.Int64()
+			if (keyword == "minimum" && i < int64(arg.(int))) || (keyword == "maximum" && i > int64(arg.(int))) {
+				err = fmt.Errorf("%d is outside the %s %d", i, keyword, arg)
+			}
+		case "required":
+			object, _ := value.(map[string]any)
+			for _, name := range arg.([]any) {
+				if _, ok := object[name.(string)]; !ok {
+					err = fmt.Errorf("required property %q missing", name)
+				}
+			}
+		default:
+			err = fmt.Errorf("unsupported schema keyword %q", keyword)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	properties, _ := schema["properties"].(map[string]any)
+	object, _ := value.(map[string]any)
+	for name, propertySchema := range properties {
+		if v, ok := object[name]; ok {
+			if err := validateSchema(propertySchema.(map[string]any), v, path+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateType(typ any, value any) error {
+	ok := false
+	switch typ {
+	case "object":
+		_, ok = value.(map[string]any)
+	case "string":
+		_, ok = value.(string)
+	case "integer":
+		if n, isNumber := value.(json.Number); isNumber {
+			_, err := n.Int64()
+			ok = err == nil
+		}
+	default:
+		return fmt.Errorf("unsupported type %q", typ)
+	}
+	if !ok {
+		return fmt.Errorf("%v is not of type %s", value, typ)
+	}
+	return nil
+}
+
+func validateFormat(format any, value any) error {
+	s, ok := value.(string)
+	if !ok {
+		return nil
+	}
+	var err error
+	switch format {
+	case "date-time":
+		_, err = time.Parse(time.RFC3339, s)
+	case "uuid":
+		_, err = uuid.Parse(s)
+	default:
+		return fmt.Errorf("unsupported format %q", format)
+	}
+	if err != nil {
+		return fmt.Errorf("%q is not a %s: %w", s, format, err)
+	}
+	return nil
+}
+
+// eventJSON returns event as decoded from its JSON encoding.
+func eventJSON(t *testing.T, event any) map[string]any {
+	t.Helper()
+
+	b, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var value map[string]any
+	if err := d.Decode(&value); err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+// testResponse returns a packed and unpacked response, as the minimiser
+// sees it, with an A record answer.
+func testResponse(t *testing.T) *dns.Msg {
+	t.Helper()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.example.com.", dns.TypeA)
+	msg.Response = true
+	rr, err := dns.NewRR("www.example.com. 300 IN A 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Answer = append(msg.Answer, rr)
+	packed, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unpacked := new(dns.Msg)
+	if err := unpacked.Unpack(packed); err != nil {
+		t.Fatal(err)
+	}
+	return unpacked
+}
+
+func TestNewQnameEventSchema(t *testing.T) {
+	schema := loadSchema(t, "new_qname.yaml")
+	ts := time.Date(2026, 5, 28, 12, 13, 0, 0, time.UTC)
+
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeAAAA)
+
+	events := map[string]NewQnameJSON{
+		"client query":      NewQnameEvent(query, NewQnameJSONInitiatorClient, ts),
+		"resolver response": NewQnameEvent(testResponse(t), NewQnameJSONInitiatorResolver, ts),
+		"no initiator":      NewQnameEvent(query, "", ts),
+		"empty question":    NewQnameEvent(new(dns.Msg), "", ts),
+	}
+	for name, event := range events {
+		if err := validateSchema(schema, eventJSON(t, event), "new_qname"); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+
+	// An event deduplicated per registrable domain carries the subname
+	// count instead of the fields of the subname's message.
+	deduplicated := NewQnameEvent(testResponse(t), NewQnameJSONInitiatorClient, ts)
+	deduplicated.Qtype, deduplicated.Qclass, deduplicated.Flags, deduplicated.Rdlength = nil, nil, nil, nil
+	count := 12
+	deduplicated.SubnameCount = &count
+	if err := validateSchema(schema, eventJSON(t, deduplicated), "new_qname"); err != nil {
+		t.Errorf("deduplicated: %s", err)
+	}
+
+	// The response and deduplicated events together set every field in
+	// the schema.
+	response := eventJSON(t, events["resolver response"])
+	dedupedValue := eventJSON(t, deduplicated)
+	for name := range schema["properties"].(map[string]any) {
+		_, inResponse := response[name]
+		_, inDeduplicated := dedupedValue[name]
+		if !inResponse && !inDeduplicated {
+			t.Errorf("%s not set in a response or deduplicated event", name)
+		}
+	}
+
+	// Every field of the events is in the schema.
+	event := events["resolver response"]
+	event.SubnameCount = &count
+	for name := range eventJSON(t, event) {
+		if _, ok := schema["properties"].(map[string]any)[name]; !ok {
+			t.Errorf("%s is not in the schema", name)
+		}
+	}
+}
+
+func TestNewQnameSchemaRejects(t *testing.T) {
+	schema := loadSchema(t, "new_qname.yaml")
+	ts := time.Date(2026, 5, 28, 12, 13, 0, 0, time.UTC)
+
+	tests := map[string]func(event map[string]any){
+		"unknown initiator": func(event map[string]any) { event["initiator"] = "stub" },
+		"invalid message_id": func(event map[string]any) {
+			event["message_id"] = "not-a-uuid"
+		},
+		"wrong type":         func(event map[string]any) { event["type"] = "new_domain" },
+		"missing qname":      func(event map[string]any) { delete(event, "qname") },
+		"oversized qtype":    func(event map[string]any) { event["qtype"] = json.Number("65536") },
+		"string rdlength":    func(event map[string]any) { event["rdlength"] = "4" },
+		"zero subname_count": func(event map[string]any) { event["subname_count"] = json.Number("0") },
+	}
+	for name, mutate := range tests {
+		event := eventJSON(t, NewQnameEvent(testResponse(t), NewQnameJSONInitiatorClient, ts))
+		mutate(event)
+		if err := validateSchema(schema, event, "new_qname"); err == nil {
+			t.Errorf("%s: event accepted", name)
+		} else if strings.Contains(err.Error(), "unsupported") {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+}
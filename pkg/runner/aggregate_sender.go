@@ -93,7 +93,7 @@ func newAggregateSender(log *slog.Logger, aggrecURL *url.URL, signingJwk jwk.Key
 }
 
 // Send sends histogram data via signed HTTP message to aggregate-receiver.
-func (as realAggregateSender) Send(ctx context.Context, fileName string, ts time.Time, duration time.Duration) error {
+func (as realAggregateSender) Send(ctx context.Context, fileName string, ts time.Time, duration time.Duration, identity string) error {
 	fs := as.fs
 	if fs == nil {
 		fs = osFileSystem{}
@@ -157,11 +157,19 @@ func (as realAggregateSender) Send(ctx context.Context, fileName string, ts time
 	// Aggregate-Interval: 2023-11-16T09:24:13+01:00/PT45S
 	req.Header.Add("Aggregate-Interval", fmt.Sprintf("%s/%s", ts.Format(time.RFC3339), iso8601Duration(duration)))
 
+	// Tell the receiver which resolver a histogram partitioned per dnstap
+	// identity describes. The value uses the same escaping as the
+	// identity=<id> partition directory name, e.g:
+	// Aggregate-Identity: resolver-1.example.net
+	if identity != "" {
+		req.Header.Add("Aggregate-Identity", escapePartitionValue(identity))
+	}
+
 	// Add a User-Agent based on what version of EDM we are running, eg:
 	// edm/v0.0.0-20260617090550-63aad075ec62 linux/amd64
 	req.Header.Add("User-Agent", getUserAgent())
 
-	as.log.Info("aggregateSender.send", "filename", fileName, "url", histogramURL)
+	as.log.Info("aggregateSender.send", "filename", fileName, "url", histogramURL, "identity", identity)
 	startTime := clock.Now()
 	res, err := as.signingHTTPClient.Do(req)
 	elapsedTime := clock.Now().Sub(startTime)
@@ -90,7 +90,7 @@ func TestAggregateSenderClosesBodyOnReadError(t *testing.T) {
 	}
 
 	start := time.Date(2026, 4, 29, 12, 34, 45, 0, time.UTC)
-	err = as.Send(t.Context(), file.Name(), start, 45*time.Second)
+	err = as.Send(t.Context(), file.Name(), start, 45*time.Second, "")
 	if err == nil {
 		t.Fatal("expected error from send when response body is truncated")
 	}
@@ -174,7 +174,7 @@ func TestAggregateSenderUsesExactIntervalHeader(t *testing.T) {
 	}
 
 	start := time.Date(2026, 4, 29, 12, 34, 45, 0, time.UTC)
-	if err := as.Send(t.Context(), fileName, start, 45*time.Second); err != nil {
+	if err := as.Send(t.Context(), fileName, start, 45*time.Second, ""); err != nil {
 		t.Fatalf("send: %s", err)
 	}
 
@@ -224,14 +224,14 @@ func TestAggregateSender(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err := as.Send(t.Context(), fileName, time.Date(2026, 5, 28, 12, 34, 56, 0, time.UTC), 2*time.Minute); err != nil {
+	if err := as.Send(t.Context(), fileName, time.Date(2026, 5, 28, 12, 34, 56, 0, time.UTC), 2*time.Minute, ""); err != nil {
 		t.Fatal(err)
 	}
 	if !sawRequest {
 		t.Fatal("server did not receive request")
 	}
 
-	if err := as.Send(t.Context(), filepath.Join(t.TempDir(), "missing.parquet"), time.Now(), time.Minute); err == nil {
+	if err := as.Send(t.Context(), filepath.Join(t.TempDir(), "missing.parquet"), time.Now(), time.Minute, ""); err == nil {
 		t.Fatal("sending missing file succeeded")
 	}
 
@@ -264,7 +264,7 @@ func TestAggregateSenderStatusAndLocationErrors(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err := as.Send(t.Context(), fileName, time.Now(), time.Minute); err == nil {
+	if err := as.Send(t.Context(), fileName, time.Now(), time.Minute, ""); err == nil {
 		t.Fatal("unexpected status succeeded")
 	}
 
@@ -278,7 +278,7 @@ func TestAggregateSenderStatusAndLocationErrors(t *testing.T) {
 		t.Fatal(err)
 	}
 	as.aggrecURL = locationURL
-	if err := as.Send(t.Context(), fileName, time.Now(), time.Minute); err == nil {
+	if err := as.Send(t.Context(), fileName, time.Now(), time.Minute, ""); err == nil {
 		t.Fatal("bad Location succeeded")
 	}
 }
@@ -364,7 +364,7 @@ func TestSetupHistogramSenderClosesOldTransport(t *testing.T) {
 	// Make a request through the old transport so it holds an idle keep-alive
 	// connection that the reload is expected to close.
 	fileName := writeTempFile(t, "hist.parquet", []byte("payload"))
-	if err := oldSender.Send(t.Context(), fileName, time.Now(), time.Minute); err != nil {
+	if err := oldSender.Send(t.Context(), fileName, time.Now(), time.Minute, ""); err != nil {
 		t.Fatal(err)
 	}
 	waitForConnState(t, connStateCh, http.StateIdle)
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"math"
 	"os"
+	"time"
 
 	"github.com/pelletier/go-toml/v2"
 )
@@ -16,47 +18,242 @@ const defaultLabelLimit = 10
 //
 // The toml struct tags name the config file keys and stay in sync with the
 // flags in pkg/cmd. Validation rules are enforced by [Config.Validate].
+//
+// ReplayFiles is not read from the config file, it is set by the "replay"
+// command. When it is non-empty [DnstapMinimiser.Run] reads dnstap frames
+// from those capture files instead of the configured listeners.
 type Config struct {
-	ConfigFile                    string `toml:"config-file"`
-	DisableSessionFiles           bool   `toml:"disable-session-files" reload:"true"`
-	DisableHistogramSender        bool   `toml:"disable-histogram-sender" reload:"true"`
-	DisableMQTT                   bool   `toml:"disable-mqtt"`
-	DisableMQTTFilequeue          bool   `toml:"disable-mqtt-filequeue"`
-	EnableManualParquetRotation   bool   `toml:"enable-manual-parquet-rotation"`
-	PebbleSync                    bool   `toml:"pebble-sync" reload:"true"`
-	InputUnix                     string `toml:"input-unix"`
-	InputTCP                      string `toml:"input-tcp"`
-	InputTLS                      string `toml:"input-tls"`
-	InputTLSCertFile              string `toml:"input-tls-cert-file"`
-	InputTLSKeyFile               string `toml:"input-tls-key-file"`
-	InputTLSClientCAFile          string `toml:"input-tls-client-ca-file"`
-	CryptopanKey                  string `toml:"cryptopan-key" reload:"true"`
-	CryptopanKeySalt              string `toml:"cryptopan-key-salt" reload:"true"`
-	WellKnownDomainsFile          string `toml:"well-known-domains-file" reload:"true"`
-	HistogramHLLExplicitThreshold int    `toml:"histogram-hll-explicit-threshold"`
-	IgnoredClientIPsFile          string `toml:"ignored-client-ips-file" reload:"true"`
-	IgnoredQuestionNamesFile      string `toml:"ignored-question-names-file" reload:"true"`
-	DataDir                       string `toml:"data-dir"`
-	MinimiserWorkers              int    `toml:"minimiser-workers"`
-	MQTTSigningKeyFile            string `toml:"mqtt-signing-key-file"`
-	MQTTClientKeyFile             string `toml:"mqtt-client-key-file" reload:"true"`
-	MQTTClientCertFile            string `toml:"mqtt-client-cert-file" reload:"true"`
-	MQTTServer                    string `toml:"mqtt-server"`
-	MQTTCAFile                    string `toml:"mqtt-ca-file"`
-	MQTTKeepalive                 uint16 `toml:"mqtt-keepalive"`
-	MQTTSignWorkers               int    `toml:"mqtt-sign-workers"`
-	QnameSeenEntries              int    `toml:"qname-seen-entries"`
-	CryptopanAddressEntries       int    `toml:"cryptopan-address-entries"`
-	NewQnameBuffer                int    `toml:"newqname-buffer"`
-	HTTPCAFile                    string `toml:"http-ca-file"`
-	HTTPSigningKeyFile            string `toml:"http-signing-key-file"`
-	HTTPClientKeyFile             string `toml:"http-client-key-file" reload:"true"`
-	HTTPClientCertFile            string `toml:"http-client-cert-file" reload:"true"`
-	HTTPURL                       string `toml:"http-url"`
-	Debug                         bool   `toml:"debug"`
-	DebugDnstapFilename           string `toml:"debug-dnstap-filename"`
-	DebugEnableBlockProfiling     bool   `toml:"debug-enable-blockprofiling"`
-	DebugEnableMutexProfiling     bool   `toml:"debug-enable-mutexprofiling"`
+	ConfigFile                    string        `toml:"config-file"`
+	DisableSessionFiles           bool          `toml:"disable-session-files" reload:"true"`
+	DisableSessionScrubbing       bool          `toml:"disable-session-scrubbing" reload:"true"`
+	DisableSessionMessages        bool          `toml:"disable-session-messages"`
+	SessionDerivedColumns         bool          `toml:"session-derived-columns"`
+	DisableHistogramSender        bool          `toml:"disable-histogram-sender" reload:"true"`
+	DisableMQTT                   bool          `toml:"disable-mqtt"`
+	DisableMQTTFilequeue          bool          `toml:"disable-mqtt-filequeue"`
+	EnableManualParquetRotation   bool          `toml:"enable-manual-parquet-rotation"`
+	PebbleSync                    bool          `toml:"pebble-sync" reload:"true"`
+	ProcessQueryMessages          bool          `toml:"process-query-messages" reload:"true"`
+	CorrelateQueryResponses       bool          `toml:"correlate-query-responses"`
+	PartitionByIdentity           bool          `toml:"partition-by-identity"`
+	InputUnix                     string        `toml:"input-unix"`
+	InputTCP                      string        `toml:"input-tcp"`
+	InputTLS                      string        `toml:"input-tls"`
+	InputTLSCertFile              string        `toml:"input-tls-cert-file"`
+	InputTLSKeyFile               string        `toml:"input-tls-key-file"`
+	InputTLSClientCAFile          string        `toml:"input-tls-client-ca-file"`
+	Inputs                        []InputConfig `toml:"input"`
+	ReplayFiles                   []string      `toml:"-"`
+	CryptopanKey                  string        `toml:"cryptopan-key" reload:"true"`
+	CryptopanKeySalt              string        `toml:"cryptopan-key-salt" reload:"true"`
+	CryptopanKeyRotation          string        `toml:"cryptopan-key-rotation"`
+	SeenQnameTTL                  string        `toml:"seen-qname-ttl"`
+	SeenQnameBackend              string        `toml:"seen-qname-backend"`
+	SeenQnameCapacity             int           `toml:"seen-qname-capacity"`
+	SeenQnameFalsePositiveRate    float64       `toml:"seen-qname-false-positive-rate"`
+	PseudonymisationMode          string        `toml:"pseudonymisation-mode"`
+	PseudonymisationIPv4Prefix    int           `toml:"pseudonymisation-ipv4-prefix"`
+	PseudonymisationIPv6Prefix    int           `toml:"pseudonymisation-ipv6-prefix"`
+	WellKnownDomainsFile          string        `toml:"well-known-domains-file" reload:"true"`
+	HistogramHLLExplicitThreshold int           `toml:"histogram-hll-explicit-threshold"`
+	HistogramMinClients           int           `toml:"histogram-min-clients" reload:"true"`
+	HistogramSuppressedRows       string        `toml:"histogram-suppressed-rows" reload:"true"`
+	HistogramNoise                string        `toml:"histogram-noise" reload:"true"`
+	HistogramNoiseEpsilon         float64       `toml:"histogram-noise-epsilon" reload:"true"`
+	HistogramNoiseDelta           float64       `toml:"histogram-noise-delta" reload:"true"`
+	IgnoredClientIPsFile          string        `toml:"ignored-client-ips-file" reload:"true"`
+	IgnoredQuestionNamesFile      string        `toml:"ignored-question-names-file" reload:"true"`
+	AllowedMessageTypes           []string      `toml:"allowed-message-types" reload:"true"`
+	IgnoredMessageTypes           []string      `toml:"ignored-message-types" reload:"true"`
+	AllowedIdentities             []string      `toml:"allowed-identities" reload:"true"`
+	IgnoredIdentities             []string      `toml:"ignored-identities" reload:"true"`
+	DataDir                       string        `toml:"data-dir"`
+	MinimiserWorkers              int           `toml:"minimiser-workers"`
+	MQTTSigningKeyFile            string        `toml:"mqtt-signing-key-file"`
+	MQTTClientKeyFile             string        `toml:"mqtt-client-key-file" reload:"true"`
+	MQTTClientCertFile            string        `toml:"mqtt-client-cert-file" reload:"true"`
+	MQTTServer                    string        `toml:"mqtt-server"`
+	MQTTCAFile                    string        `toml:"mqtt-ca-file"`
+	MQTTKeepalive                 uint16        `toml:"mqtt-keepalive"`
+	MQTTSignWorkers               int           `toml:"mqtt-sign-workers"`
+	QnameSeenEntries              int           `toml:"qname-seen-entries"`
+	CryptopanAddressEntries       int           `toml:"cryptopan-address-entries"`
+	NewQnameBuffer                int           `toml:"newqname-buffer"`
+	NewQnameDedupeLabels          int           `toml:"new-qname-dedupe-labels"`
+	CorrelationWindow             int           `toml:"correlation-window"`
+	SessionInterval               string        `toml:"session-interval"`
+	HistogramInterval             string        `toml:"histogram-interval"`
+	SessionRowGroupSize           int           `toml:"session-row-group-size"`
+	SessionMaxFileSize            int           `toml:"session-max-file-size"`
+	HTTPCAFile                    string        `toml:"http-ca-file"`
+	HTTPSigningKeyFile            string        `toml:"http-signing-key-file"`
+	HTTPClientKeyFile             string        `toml:"http-client-key-file" reload:"true"`
+	HTTPClientCertFile            string        `toml:"http-client-cert-file" reload:"true"`
+	HTTPURL                       string        `toml:"http-url"`
+	Debug                         bool          `toml:"debug"`
+	DebugDnstapFilename           string        `toml:"debug-dnstap-filename"`
+	DebugEnableBlockProfiling     bool          `toml:"debug-enable-blockprofiling"`
+	DebugEnableMutexProfiling     bool          `toml:"debug-enable-mutexprofiling"`
+}
+
+// parseRotationInterval parses the session-interval or histogram-interval
+// value for key. Intervals are cut at wall clock boundaries, so the interval
+// has to be a whole number of minutes that evenly divides a day, e.g. "5m",
+// "15m" or "1h".
+func parseRotationInterval(key string, value string) (time.Duration, error) {
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	if interval < time.Minute || interval%time.Minute != 0 || (24*time.Hour)%interval != 0 {
+		return 0, fmt.Errorf("%s must be a whole number of minutes that evenly divides 24h, got %q", key, value)
+	}
+	return interval, nil
+}
+
+// sessionRotationInterval returns the session-interval, one minute if it is
+// unset or invalid. [Config.Validate] rejects invalid values.
+func (conf Config) sessionRotationInterval() time.Duration {
+	interval, err := parseRotationInterval("session-interval", conf.SessionInterval)
+	if err != nil {
+		return time.Minute
+	}
+	return interval
+}
+
+// histogramRotationInterval returns the histogram-interval, one minute if it
+// is unset or invalid. [Config.Validate] rejects invalid values.
+func (conf Config) histogramRotationInterval() time.Duration {
+	interval, err := parseRotationInterval("histogram-interval", conf.HistogramInterval)
+	if err != nil {
+		return time.Minute
+	}
+	return interval
+}
+
+// cryptopanKeyRotationInterval returns the cryptopan-key-rotation interval,
+// 0 if key rotation is disabled or the value is invalid. [Config.Validate]
+// rejects invalid values.
+func (conf Config) cryptopanKeyRotationInterval() time.Duration {
+	if conf.CryptopanKeyRotation == "" {
+		return 0
+	}
+	interval, err := parseRotationInterval("cryptopan-key-rotation", conf.CryptopanKeyRotation)
+	if err != nil {
+		return 0
+	}
+	return interval
+}
+
+// seenQnameTTL returns the seen-qname-ttl duration, 0 when names are never
+// re-announced.
+func (conf Config) seenQnameTTL() time.Duration {
+	if conf.SeenQnameTTL == "" {
+		return 0
+	}
+	ttl, err := time.ParseDuration(conf.SeenQnameTTL)
+	if err != nil {
+		return 0
+	}
+	return ttl
+}
+
+// Supported values for [Config.PseudonymisationMode], how client and server
+// addresses are pseudonymised.
+const (
+	PseudonymisationModeCryptopan = "cryptopan"
+	PseudonymisationModeTruncate  = "truncate"
+	PseudonymisationModeHMAC      = "hmac"
+	PseudonymisationModeNone      = "none"
+)
+
+// Supported values for [Config.SeenQnameBackend], where the qnames already
+// announced in new_qname events are kept.
+const (
+	SeenQnameBackendPebble = "pebble"
+	SeenQnameBackendMemory = "memory"
+	SeenQnameBackendBloom  = "bloom"
+)
+
+// Supported values for [Config.HistogramSuppressedRows], what happens to
+// histogram rows of domains seen from fewer than
+// [Config.HistogramMinClients] clients.
+const (
+	HistogramSuppressedRowsDrop     = "drop"
+	HistogramSuppressedRowsMergeTLD = "merge-tld"
+)
+
+// Supported values for [Config.HistogramNoise], the distribution of the
+// noise added to histogram counters.
+const (
+	HistogramNoiseNone     = "none"
+	HistogramNoiseLaplace  = "laplace"
+	HistogramNoiseGaussian = "gaussian"
+)
+
+// Supported values for [InputConfig.Type].
+const (
+	InputTypeUnix = "unix"
+	InputTypeTCP  = "tcp"
+	InputTypeTLS  = "tls"
+)
+
+// InputConfig describes one dnstap listener.
+//
+// Listeners are configured as [[input]] tables in the config file, each with
+// its own TLS and client mTLS settings. The input-unix, input-tcp and
+// input-tls keys remain as a shorthand for one listener of each type and are
+// combined with the [[input]] tables, see [Config.dnstapInputs].
+type InputConfig struct {
+	// Name labels the listener in logs and metrics, it defaults to
+	// Type + ":" + Address.
+	Name            string `toml:"name"`
+	Type            string `toml:"type"`
+	Address         string `toml:"address"`
+	TLSCertFile     string `toml:"tls-cert-file"`
+	TLSKeyFile      string `toml:"tls-key-file"`
+	TLSClientCAFile string `toml:"tls-client-ca-file"`
+
+	// keyPrefix turns the keys above into the setting the listener was
+	// configured with in messages: the "-input-" flags for the shorthand
+	// keys, "input[<index>]." for [[input]] tables.
+	keyPrefix string
+}
+
+// label returns the name used for the listener in logs and metrics.
+func (in InputConfig) label() string {
+	if in.Name != "" {
+		return in.Name
+	}
+	return in.Type + ":" + in.Address
+}
+
+// dnstapInputs returns every configured dnstap listener: one for each of the
+// input-unix, input-tcp and input-tls shorthand keys that is set, followed by
+// the [[input]] tables in file order.
+func (conf Config) dnstapInputs() []InputConfig {
+	var inputs []InputConfig
+	if conf.InputUnix != "" {
+		inputs = append(inputs, InputConfig{Type: InputTypeUnix, Address: conf.InputUnix, keyPrefix: "-input-"})
+	}
+	if conf.InputTCP != "" {
+		inputs = append(inputs, InputConfig{Type: InputTypeTCP, Address: conf.InputTCP, keyPrefix: "-input-"})
+	}
+	if conf.InputTLS != "" {
+		inputs = append(inputs, InputConfig{
+			Type:            InputTypeTLS,
+			Address:         conf.InputTLS,
+			TLSCertFile:     conf.InputTLSCertFile,
+			TLSKeyFile:      conf.InputTLSKeyFile,
+			TLSClientCAFile: conf.InputTLSClientCAFile,
+			keyPrefix:       "-input-",
+		})
+	}
+	for i, in := range conf.Inputs {
+		in.keyPrefix = fmt.Sprintf("input[%d].", i)
+		inputs = append(inputs, in)
+	}
+	return inputs
 }
 
 // Validate checks the configuration rules for Config.
@@ -65,14 +262,13 @@ type Config struct {
 // combined with [errors.Join] and the result wraps [ErrInvalidConfig] for
 // matching with [errors.Is]. Violations of the exactly-one-input rule
 // additionally wrap the same error identities returned by the dnstap input
-// setup. Messages use the CLI flag / config key spelling.
+// setup. Messages use the CLI flag / config key spelling, with [[input]]
+// tables referred to as input[<index>].
 func (conf Config) Validate() (err error) {
 	var errs []error
 
 	for _, f := range []struct{ key, value string }{
 		{"config-file", conf.ConfigFile},
-		{"cryptopan-key", conf.CryptopanKey},
-		{"cryptopan-key-salt", conf.CryptopanKeySalt},
 		{"well-known-domains-file", conf.WellKnownDomainsFile},
 		{"data-dir", conf.DataDir},
 	} {
@@ -81,17 +277,32 @@ func (conf Config) Validate() (err error) {
 		}
 	}
 
-	inputs := 0
-	for _, in := range []string{conf.InputUnix, conf.InputTCP, conf.InputTLS} {
-		if in != "" {
-			inputs++
+	switch conf.PseudonymisationMode {
+	case PseudonymisationModeCryptopan, PseudonymisationModeHMAC:
+		// Only the keyed modes need key material.
+		for _, f := range []struct{ key, value string }{
+			{"cryptopan-key", conf.CryptopanKey},
+			{"cryptopan-key-salt", conf.CryptopanKeySalt},
+		} {
+			if f.value == "" {
+				errs = append(errs, fmt.Errorf("%s must be set", f.key))
+			}
+		}
+	case PseudonymisationModeTruncate:
+		if conf.PseudonymisationIPv4Prefix < 0 || conf.PseudonymisationIPv4Prefix > 32 {
+			errs = append(errs, fmt.Errorf("pseudonymisation-ipv4-prefix must be between 0 and 32, got %d", conf.PseudonymisationIPv4Prefix))
 		}
+		if conf.PseudonymisationIPv6Prefix < 0 || conf.PseudonymisationIPv6Prefix > 128 {
+			errs = append(errs, fmt.Errorf("pseudonymisation-ipv6-prefix must be between 0 and 128, got %d", conf.PseudonymisationIPv6Prefix))
+		}
+	case PseudonymisationModeNone:
+	default:
+		errs = append(errs, fmt.Errorf("pseudonymisation-mode must be %q, %q, %q or %q, got %q", PseudonymisationModeCryptopan, PseudonymisationModeTruncate, PseudonymisationModeHMAC, PseudonymisationModeNone, conf.PseudonymisationMode))
 	}
-	switch {
-	case inputs == 0:
-		errs = append(errs, fmt.Errorf("%w: set one of input-unix, input-tcp or input-tls", errNoInputConfigured))
-	case inputs > 1:
-		errs = append(errs, fmt.Errorf("%w: set only one of input-unix, input-tcp or input-tls", errMultipleInputsConfigured))
+
+	// Listeners are not opened when replaying capture files.
+	if len(conf.dnstapInputs()) == 0 && len(conf.ReplayFiles) == 0 {
+		errs = append(errs, fmt.Errorf("%w: set one of input-unix, input-tcp or input-tls, or add an [[input]] table", errNoInputConfigured))
 	}
 
 	if conf.InputTLS != "" {
@@ -103,12 +314,162 @@ func (conf Config) Validate() (err error) {
 		}
 	}
 
+	for i, in := range conf.Inputs {
+		key := fmt.Sprintf("input[%d]", i)
+		switch in.Type {
+		case InputTypeUnix, InputTypeTCP:
+		case InputTypeTLS:
+			if in.TLSCertFile == "" {
+				errs = append(errs, fmt.Errorf("%s.tls-cert-file must be set when type is tls", key))
+			}
+			if in.TLSKeyFile == "" {
+				errs = append(errs, fmt.Errorf("%s.tls-key-file must be set when type is tls", key))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("%s.type must be one of unix, tcp or tls, got %q", key, in.Type))
+		}
+		if in.Address == "" {
+			errs = append(errs, fmt.Errorf("%s.address must be set", key))
+		}
+	}
+
+	// Two listeners on the same address would fail to bind, and for unix
+	// sockets the second setup would remove the first one's socket file.
+	// Names must be unique too since they label the per-listener metrics.
+	seenAddresses := map[string]bool{}
+	seenNames := map[string]bool{}
+	for _, in := range conf.dnstapInputs() {
+		if in.Address == "" {
+			continue
+		}
+		network := "tcp"
+		if in.Type == InputTypeUnix {
+			network = "unix"
+		}
+		if seenAddresses[network+" "+in.Address] {
+			errs = append(errs, fmt.Errorf("%w: %s address %q", errDuplicateInput, network, in.Address))
+		}
+		seenAddresses[network+" "+in.Address] = true
+		if seenNames[in.label()] {
+			errs = append(errs, fmt.Errorf("%w: name %q", errDuplicateInput, in.label()))
+		}
+		seenNames[in.label()] = true
+	}
+
+	for i, name := range conf.ReplayFiles {
+		if name == "" {
+			errs = append(errs, fmt.Errorf("replay file %d must not be empty", i))
+		}
+	}
+	// Key epochs follow the wall clock, they would not match the capture
+	// time of the replayed frames.
+	if len(conf.ReplayFiles) > 0 && conf.CryptopanKeyRotation != "" {
+		errs = append(errs, errors.New("cryptopan-key-rotation can not be used when replaying capture files"))
+	}
+
+	for _, f := range []struct {
+		key   string
+		names []string
+	}{
+		{"allowed-message-types", conf.AllowedMessageTypes},
+		{"ignored-message-types", conf.IgnoredMessageTypes},
+	} {
+		if _, err := parseMessageTypes(f.key, f.names); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
 	if conf.HistogramHLLExplicitThreshold < 1 {
 		errs = append(errs, errors.New("histogram-hll-explicit-threshold must be greater than 0"))
 	}
+	if conf.HistogramMinClients < 0 {
+		errs = append(errs, errors.New("histogram-min-clients must not be negative"))
+	}
+	switch conf.HistogramSuppressedRows {
+	case HistogramSuppressedRowsDrop, HistogramSuppressedRowsMergeTLD:
+	default:
+		errs = append(errs, fmt.Errorf("histogram-suppressed-rows must be %q or %q, got %q", HistogramSuppressedRowsDrop, HistogramSuppressedRowsMergeTLD, conf.HistogramSuppressedRows))
+	}
+	switch conf.HistogramNoise {
+	case HistogramNoiseNone:
+	case HistogramNoiseLaplace:
+		if !(conf.HistogramNoiseEpsilon > 0) || math.IsInf(conf.HistogramNoiseEpsilon, 1) {
+			errs = append(errs, errors.New("histogram-noise-epsilon must be greater than 0 with laplace histogram-noise"))
+		}
+	case HistogramNoiseGaussian:
+		if !(conf.HistogramNoiseEpsilon > 0 && conf.HistogramNoiseEpsilon < 1) {
+			errs = append(errs, errors.New("histogram-noise-epsilon must be between 0 and 1 with gaussian histogram-noise"))
+		}
+		if !(conf.HistogramNoiseDelta > 0 && conf.HistogramNoiseDelta < 1) {
+			errs = append(errs, errors.New("histogram-noise-delta must be between 0 and 1 with gaussian histogram-noise"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("histogram-noise must be %q, %q or %q, got %q", HistogramNoiseNone, HistogramNoiseLaplace, HistogramNoiseGaussian, conf.HistogramNoise))
+	}
 	if conf.CryptopanAddressEntries < 0 {
 		errs = append(errs, errors.New("cryptopan-address-entries must not be negative"))
 	}
+	if conf.CorrelateQueryResponses && conf.CorrelationWindow < 1 {
+		errs = append(errs, errors.New("correlation-window must be greater than 0 when correlate-query-responses is true"))
+	}
+	if conf.SessionRowGroupSize < 1 {
+		errs = append(errs, errors.New("session-row-group-size must be greater than 0"))
+	}
+	if conf.SessionMaxFileSize < 0 {
+		errs = append(errs, errors.New("session-max-file-size must not be negative"))
+	}
+	for _, f := range []struct{ key, value string }{
+		{"session-interval", conf.SessionInterval},
+		{"histogram-interval", conf.HistogramInterval},
+	} {
+		if _, err := parseRotationInterval(f.key, f.value); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if conf.CryptopanKeyRotation != "" {
+		keyRotation, err := parseRotationInterval("cryptopan-key-rotation", conf.CryptopanKeyRotation)
+		if err != nil {
+			errs = append(errs, err)
+		} else if sessionInterval := conf.sessionRotationInterval(); keyRotation%sessionInterval != 0 {
+			// Session files then start and end with a key epoch.
+			errs = append(errs, fmt.Errorf("cryptopan-key-rotation must be a multiple of session-interval %s, got %q", sessionInterval, conf.CryptopanKeyRotation))
+		}
+	}
+
+	if conf.SeenQnameTTL != "" {
+		ttl, err := time.ParseDuration(conf.SeenQnameTTL)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid seen-qname-ttl %q: %w", conf.SeenQnameTTL, err))
+		} else if ttl < 0 {
+			errs = append(errs, fmt.Errorf("seen-qname-ttl must not be negative, got %q", conf.SeenQnameTTL))
+		}
+	}
+
+	if conf.NewQnameDedupeLabels < 0 {
+		errs = append(errs, fmt.Errorf("new-qname-dedupe-labels must not be negative, got %d", conf.NewQnameDedupeLabels))
+	}
+
+	switch conf.SeenQnameBackend {
+	case SeenQnameBackendPebble:
+	case SeenQnameBackendMemory:
+		if conf.SeenQnameCapacity <= 0 {
+			errs = append(errs, fmt.Errorf("seen-qname-capacity must be above 0, got %d", conf.SeenQnameCapacity))
+		}
+	case SeenQnameBackendBloom:
+		if conf.SeenQnameCapacity <= 0 {
+			errs = append(errs, fmt.Errorf("seen-qname-capacity must be above 0, got %d", conf.SeenQnameCapacity))
+		}
+		if !(conf.SeenQnameFalsePositiveRate > 0 && conf.SeenQnameFalsePositiveRate < 1) {
+			errs = append(errs, fmt.Errorf("seen-qname-false-positive-rate must be between 0 and 1, got %g", conf.SeenQnameFalsePositiveRate))
+		}
+		// A Bloom filter cannot forget names.
+		if conf.seenQnameTTL() > 0 {
+			errs = append(errs, fmt.Errorf("seen-qname-ttl is not supported by the %q seen-qname-backend", SeenQnameBackendBloom))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("seen-qname-backend must be %q, %q or %q, got %q", SeenQnameBackendPebble, SeenQnameBackendMemory, SeenQnameBackendBloom, conf.SeenQnameBackend))
+	}
 
 	if !conf.DisableMQTT {
 		for _, f := range []struct{ key, value string }{
@@ -170,9 +531,21 @@ func DefaultConfig() (conf Config) {
 		MQTTServer:                    "127.0.0.1:8883",
 		MQTTKeepalive:                 30,
 		QnameSeenEntries:              10_000_000,
+		SeenQnameBackend:              SeenQnameBackendPebble,
+		SeenQnameCapacity:             10_000_000,
+		SeenQnameFalsePositiveRate:    0.001,
 		CryptopanAddressEntries:       10_000_000,
 		NewQnameBuffer:                1000,
+		CorrelationWindow:             10,
+		SessionInterval:               "1m",
+		HistogramInterval:             "1m",
+		SessionRowGroupSize:           10_000,
 		HistogramHLLExplicitThreshold: 20,
+		HistogramSuppressedRows:       HistogramSuppressedRowsDrop,
+		PseudonymisationMode:          PseudonymisationModeCryptopan,
+		PseudonymisationIPv4Prefix:    24,
+		PseudonymisationIPv6Prefix:    48,
+		HistogramNoise:                HistogramNoiseNone,
 		HTTPSigningKeyFile:            "edm-http-signer-key.pem",
 		HTTPClientKeyFile:             "edm-http-client-key.pem",
 		HTTPClientCertFile:            "edm-http-client.pem",
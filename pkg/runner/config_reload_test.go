@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"sync"
 	"syscall"
@@ -251,7 +252,7 @@ func TestConfigUpdaterBranches(t *testing.T) {
 			runConfigUpdaterUntil(t, edm, &sequenceConfiger{err: errors.New("boom")}, func() bool {
 				return strings.Contains(buf.String(), "unable to update edm config")
 			})
-			if edm.getConfig() != startConf {
+			if !reflect.DeepEqual(edm.getConfig(), startConf) {
 				t.Fatal("config changed even though the provider returned an error")
 			}
 		})
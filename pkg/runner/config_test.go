@@ -5,6 +5,7 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 
@@ -44,6 +45,34 @@ func TestFileConfigProvider(t *testing.T) {
 		}
 	})
 
+	t.Run("input tables", func(t *testing.T) {
+		path := writeConfigFile(t, minimalConfigData+`
+[[input]]
+name = "knot"
+type = "tls"
+address = "0.0.0.0:53535"
+tls-cert-file = "cert.pem"
+tls-key-file = "key.pem"
+tls-client-ca-file = "ca.pem"
+
+[[input]]
+type = "tcp"
+address = "127.0.0.1:53536"
+`)
+		conf, err := NewFileConfigProvider(path).GetConfig()
+		if err != nil {
+			t.Fatalf("GetConfig: %s", err)
+		}
+		want := []InputConfig{
+			{Type: InputTypeUnix, Address: "/tmp/dnstap.sock", keyPrefix: "-input-"},
+			{Name: "knot", Type: InputTypeTLS, Address: "0.0.0.0:53535", TLSCertFile: "cert.pem", TLSKeyFile: "key.pem", TLSClientCAFile: "ca.pem", keyPrefix: "input[0]."},
+			{Type: InputTypeTCP, Address: "127.0.0.1:53536", keyPrefix: "input[1]."},
+		}
+		if got := conf.dnstapInputs(); !slices.Equal(got, want) {
+			t.Fatalf("dnstapInputs() = %#v, want %#v", got, want)
+		}
+	})
+
 	t.Run("overrides win over file on every read", func(t *testing.T) {
 		path := writeConfigFile(t, minimalConfigData+"debug = false\n")
 		provider := NewFileConfigProvider(path, func(c *Config) { c.Debug = true })
@@ -228,47 +257,117 @@ func TestConfigValidate(t *testing.T) {
 			wantMsgs: []string{"set one of input-unix, input-tcp or input-tls"},
 		},
 		{
-			name: "input-tcp only is valid",
+			name: "replay files without input is valid",
 			mutate: func(c *Config) {
 				c.InputUnix = ""
-				c.InputTCP = "127.0.0.1:53535"
+				c.ReplayFiles = []string{"capture.fstrm"}
 			},
 		},
 		{
-			name:     "multiple inputs configured",
-			mutate:   func(c *Config) { c.InputTCP = "127.0.0.1:53535" },
-			wantErrs: []error{ErrInvalidConfig, errMultipleInputsConfigured},
-			wantMsgs: []string{"set only one of input-unix, input-tcp or input-tls"},
+			name: "empty replay file name",
+			mutate: func(c *Config) {
+				c.ReplayFiles = []string{"capture.fstrm", ""}
+			},
+			wantErrs: []error{ErrInvalidConfig},
+			wantMsgs: []string{"replay file 1 must not be empty"},
 		},
 		{
-			name: "multiple inputs unix and tls",
+			name: "cryptopan-key-rotation with replay files",
 			mutate: func(c *Config) {
-				c.InputTLS = "127.0.0.1:53535"
-				c.InputTLSCertFile = "cert.pem"
-				c.InputTLSKeyFile = "key.pem"
+				c.ReplayFiles = []string{"capture.fstrm"}
+				c.CryptopanKeyRotation = "24h"
 			},
-			wantErrs: []error{ErrInvalidConfig, errMultipleInputsConfigured},
+			wantErrs: []error{ErrInvalidConfig},
+			wantMsgs: []string{"cryptopan-key-rotation can not be used when replaying capture files"},
 		},
 		{
-			name: "multiple inputs tcp and tls",
+			name: "input-tcp only is valid",
 			mutate: func(c *Config) {
 				c.InputUnix = ""
 				c.InputTCP = "127.0.0.1:53535"
-				c.InputTLS = "127.0.0.1:53536"
-				c.InputTLSCertFile = "cert.pem"
-				c.InputTLSKeyFile = "key.pem"
 			},
-			wantErrs: []error{ErrInvalidConfig, errMultipleInputsConfigured},
 		},
 		{
-			name: "all three inputs configured",
+			name:   "multiple inputs unix and tcp is valid",
+			mutate: func(c *Config) { c.InputTCP = "127.0.0.1:53535" },
+		},
+		{
+			name: "all three inputs configured is valid",
 			mutate: func(c *Config) {
 				c.InputTCP = "127.0.0.1:53535"
 				c.InputTLS = "127.0.0.1:53536"
 				c.InputTLSCertFile = "cert.pem"
 				c.InputTLSKeyFile = "key.pem"
 			},
-			wantErrs: []error{ErrInvalidConfig, errMultipleInputsConfigured},
+		},
+		{
+			name: "input tables only is valid",
+			mutate: func(c *Config) {
+				c.InputUnix = ""
+				c.Inputs = []InputConfig{
+					{Type: InputTypeUnix, Address: "/run/edm/unbound.sock"},
+					{Type: InputTypeTLS, Address: "0.0.0.0:53535", TLSCertFile: "cert.pem", TLSKeyFile: "key.pem", TLSClientCAFile: "ca.pem"},
+					{Type: InputTypeTLS, Address: "0.0.0.0:53536", TLSCertFile: "cert2.pem", TLSKeyFile: "key2.pem"},
+				}
+			},
+		},
+		{
+			name: "input table with unknown type",
+			mutate: func(c *Config) {
+				c.Inputs = []InputConfig{{Type: "udp", Address: "127.0.0.1:53535"}}
+			},
+			wantErrs: []error{ErrInvalidConfig},
+			wantMsgs: []string{`input[0].type must be one of unix, tcp or tls, got "udp"`},
+		},
+		{
+			name: "input table without address",
+			mutate: func(c *Config) {
+				c.Inputs = []InputConfig{{Type: InputTypeTCP}}
+			},
+			wantErrs: []error{ErrInvalidConfig},
+			wantMsgs: []string{"input[0].address must be set"},
+		},
+		{
+			name: "input table tls without cert and key files",
+			mutate: func(c *Config) {
+				c.Inputs = []InputConfig{
+					{Type: InputTypeTCP, Address: "127.0.0.1:53535"},
+					{Type: InputTypeTLS, Address: "127.0.0.1:53536"},
+				}
+			},
+			wantErrs: []error{ErrInvalidConfig},
+			wantMsgs: []string{
+				"input[1].tls-cert-file must be set when type is tls",
+				"input[1].tls-key-file must be set when type is tls",
+			},
+		},
+		{
+			name: "input table duplicating input-unix",
+			mutate: func(c *Config) {
+				c.Inputs = []InputConfig{{Type: InputTypeUnix, Address: c.InputUnix}}
+			},
+			wantErrs: []error{ErrInvalidConfig, errDuplicateInput},
+			wantMsgs: []string{`unix address "/run/edm/dnstap.sock"`},
+		},
+		{
+			name: "tcp and tls inputs on the same address",
+			mutate: func(c *Config) {
+				c.InputTCP = "127.0.0.1:53535"
+				c.Inputs = []InputConfig{{Type: InputTypeTLS, Address: "127.0.0.1:53535", TLSCertFile: "cert.pem", TLSKeyFile: "key.pem"}}
+			},
+			wantErrs: []error{ErrInvalidConfig, errDuplicateInput},
+			wantMsgs: []string{`tcp address "127.0.0.1:53535"`},
+		},
+		{
+			name: "input tables with the same name",
+			mutate: func(c *Config) {
+				c.Inputs = []InputConfig{
+					{Name: "resolver", Type: InputTypeTCP, Address: "127.0.0.1:53535"},
+					{Name: "resolver", Type: InputTypeTCP, Address: "127.0.0.1:53536"},
+				}
+			},
+			wantErrs: []error{ErrInvalidConfig, errDuplicateInput},
+			wantMsgs: []string{`name "resolver"`},
 		},
 		{
 			name: "input-tls without cert and key files",
@@ -333,6 +432,198 @@ func TestConfigValidate(t *testing.T) {
 			wantErrs: []error{ErrInvalidConfig},
 			wantMsgs: []string{"cryptopan-address-entries must not be negative"},
 		},
+		{
+			name: "message type filters are valid",
+			mutate: func(c *Config) {
+				c.AllowedMessageTypes = []string{"CLIENT_RESPONSE"}
+				c.IgnoredMessageTypes = []string{"RESOLVER_RESPONSE"}
+			},
+		},
+		{
+			name: "unknown message type",
+			mutate: func(c *Config) {
+				c.AllowedMessageTypes = []string{"CLIENT_RESPONSE", "BOGUS"}
+			},
+			wantErrs: []error{ErrInvalidConfig},
+			wantMsgs: []string{`allowed-message-types: unknown dnstap message type "BOGUS"`},
+		},
+		{
+			name: "correlation-window zero with correlation",
+			mutate: func(c *Config) {
+				c.CorrelateQueryResponses = true
+				c.CorrelationWindow = 0
+			},
+			wantErrs: []error{ErrInvalidConfig},
+			wantMsgs: []string{"correlation-window must be greater than 0"},
+		},
+		{
+			name:   "correlation-window zero without correlation is valid",
+			mutate: func(c *Config) { c.CorrelationWindow = 0 },
+		},
+		{
+			name: "longer rotation intervals are valid",
+			mutate: func(c *Config) {
+				c.SessionInterval = "15m"
+				c.HistogramInterval = "1h"
+			},
+		},
+		{
+			name: "invalid rotation intervals",
+			mutate: func(c *Config) {
+				c.SessionInterval = "7m"
+				c.HistogramInterval = "soon"
+			},
+			wantErrs: []error{ErrInvalidConfig},
+			wantMsgs: []string{
+				`session-interval must be a whole number of minutes that evenly divides 24h, got "7m"`,
+				`histogram-interval: time: invalid duration "soon"`,
+			},
+		},
+		{
+			name: "invalid session file limits",
+			mutate: func(c *Config) {
+				c.SessionRowGroupSize = 0
+				c.SessionMaxFileSize = -1
+			},
+			wantErrs: []error{ErrInvalidConfig},
+			wantMsgs: []string{
+				"session-row-group-size must be greater than 0",
+				"session-max-file-size must not be negative",
+			},
+		},
+		{
+			name: "invalid histogram suppression",
+			mutate: func(c *Config) {
+				c.HistogramMinClients = -1
+				c.HistogramSuppressedRows = "hide"
+			},
+			wantErrs: []error{ErrInvalidConfig},
+			wantMsgs: []string{
+				"histogram-min-clients must not be negative",
+				`histogram-suppressed-rows must be "drop" or "merge-tld", got "hide"`,
+			},
+		},
+		{
+			name: "invalid histogram noise",
+			mutate: func(c *Config) {
+				c.HistogramNoise = HistogramNoiseGaussian
+				c.HistogramNoiseEpsilon = 2
+			},
+			wantErrs: []error{ErrInvalidConfig},
+			wantMsgs: []string{
+				"histogram-noise-epsilon must be between 0 and 1 with gaussian histogram-noise",
+				"histogram-noise-delta must be between 0 and 1 with gaussian histogram-noise",
+			},
+		},
+		{
+			name: "laplace histogram noise is valid",
+			mutate: func(c *Config) {
+				c.HistogramNoise = HistogramNoiseLaplace
+				c.HistogramNoiseEpsilon = 2
+			},
+		},
+		{
+			name: "cryptopan-key-rotation not a multiple of session-interval",
+			mutate: func(c *Config) {
+				c.SessionInterval = "15m"
+				c.CryptopanKeyRotation = "10m"
+			},
+			wantErrs: []error{ErrInvalidConfig},
+			wantMsgs: []string{`cryptopan-key-rotation must be a multiple of session-interval 15m0s, got "10m"`},
+		},
+		{
+			name: "daily cryptopan-key-rotation is valid",
+			mutate: func(c *Config) {
+				c.SessionInterval = "15m"
+				c.CryptopanKeyRotation = "24h"
+			},
+		},
+		{
+			name: "negative seen-qname-ttl",
+			mutate: func(c *Config) {
+				c.SeenQnameTTL = "-1h"
+			},
+			wantErrs: []error{ErrInvalidConfig},
+			wantMsgs: []string{`seen-qname-ttl must not be negative, got "-1h"`},
+		},
+		{
+			name: "monthly seen-qname-ttl is valid",
+			mutate: func(c *Config) {
+				c.SeenQnameTTL = "720h"
+			},
+		},
+		{
+			name: "unknown seen-qname-backend",
+			mutate: func(c *Config) {
+				c.SeenQnameBackend = "redis"
+			},
+			wantErrs: []error{ErrInvalidConfig},
+			wantMsgs: []string{`seen-qname-backend must be "pebble", "memory" or "bloom", got "redis"`},
+		},
+		{
+			name: "memory seen-qname-backend without capacity",
+			mutate: func(c *Config) {
+				c.SeenQnameBackend = SeenQnameBackendMemory
+				c.SeenQnameCapacity = 0
+			},
+			wantErrs: []error{ErrInvalidConfig},
+			wantMsgs: []string{"seen-qname-capacity must be above 0, got 0"},
+		},
+		{
+			name: "invalid bloom seen-qname-backend",
+			mutate: func(c *Config) {
+				c.SeenQnameBackend = SeenQnameBackendBloom
+				c.SeenQnameFalsePositiveRate = 1
+				c.SeenQnameTTL = "720h"
+			},
+			wantErrs: []error{ErrInvalidConfig},
+			wantMsgs: []string{
+				"seen-qname-false-positive-rate must be between 0 and 1, got 1",
+				`seen-qname-ttl is not supported by the "bloom" seen-qname-backend`,
+			},
+		},
+		{
+			name: "memory seen-qname-backend with seen-qname-ttl is valid",
+			mutate: func(c *Config) {
+				c.SeenQnameBackend = SeenQnameBackendMemory
+				c.SeenQnameTTL = "720h"
+			},
+		},
+		{
+			name: "negative new-qname-dedupe-labels",
+			mutate: func(c *Config) {
+				c.NewQnameDedupeLabels = -1
+			},
+			wantErrs: []error{ErrInvalidConfig},
+			wantMsgs: []string{"new-qname-dedupe-labels must not be negative, got -1"},
+		},
+		{
+			name: "invalid truncate prefix lengths",
+			mutate: func(c *Config) {
+				c.PseudonymisationMode = PseudonymisationModeTruncate
+				c.PseudonymisationIPv4Prefix = 33
+				c.PseudonymisationIPv6Prefix = -1
+			},
+			wantErrs: []error{ErrInvalidConfig},
+			wantMsgs: []string{
+				"pseudonymisation-ipv4-prefix must be between 0 and 32, got 33",
+				"pseudonymisation-ipv6-prefix must be between 0 and 128, got -1",
+			},
+		},
+		{
+			name: "no cryptopan key needed without pseudonymisation",
+			mutate: func(c *Config) {
+				c.PseudonymisationMode = PseudonymisationModeNone
+				c.CryptopanKey = ""
+				c.CryptopanKeySalt = ""
+			},
+		},
+		{
+			name:     "unknown pseudonymisation-mode",
+			mutate:   func(c *Config) { c.PseudonymisationMode = "rot13" },
+			wantErrs: []error{ErrInvalidConfig},
+			wantMsgs: []string{`pseudonymisation-mode must be "cryptopan", "truncate", "hmac" or "none", got "rot13"`},
+		},
 		{
 			name:   "cryptopan-address-entries zero is valid",
 			mutate: func(c *Config) { c.CryptopanAddressEntries = 0 },
@@ -396,10 +687,11 @@ func TestConfigValidate(t *testing.T) {
 			mutate: func(c *Config) {
 				c.CryptopanKey = ""
 				c.InputTCP = "127.0.0.1:53535"
+				c.Inputs = []InputConfig{{Type: InputTypeTCP, Address: "127.0.0.1:53535"}}
 				c.HistogramHLLExplicitThreshold = 0
 				c.HTTPURL = ""
 			},
-			wantErrs: []error{ErrInvalidConfig, errMultipleInputsConfigured},
+			wantErrs: []error{ErrInvalidConfig, errDuplicateInput},
 			wantMsgs: []string{
 				"cryptopan-key must be set",
 				"histogram-hll-explicit-threshold must be greater than 0",
@@ -0,0 +1,170 @@
+package runner
+
+import (
+	"net/netip"
+	"strings"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+)
+
+// sessionKey identifies the query and response messages of one DNS
+// transaction. The addresses are the pseudonymised ones, so the key does
+// not carry anything more sensitive than the session row itself.
+type sessionKey struct {
+	queryAddress    netip.Addr
+	responseAddress netip.Addr
+	queryPort       uint32
+	responsePort    uint32
+	protocol        dnstap.SocketProtocol
+	id              uint16
+	qname           string
+}
+
+// newSessionKey returns the correlation key for a CLIENT_QUERY or
+// CLIENT_RESPONSE message, or nil for every other message type which are
+// written out without correlation.
+func newSessionKey(dt *dnstap.Dnstap, msg *dns.Msg) *sessionKey {
+	switch dt.Message.GetType() {
+	case dnstap.Message_CLIENT_QUERY, dnstap.Message_CLIENT_RESPONSE:
+	default:
+		return nil
+	}
+
+	// An address that fails to parse is left as the zero Addr, the
+	// key still has to be equal for both messages.
+	queryAddress, _ := netip.AddrFromSlice(dt.Message.QueryAddress)
+	responseAddress, _ := netip.AddrFromSlice(dt.Message.ResponseAddress)
+
+	return &sessionKey{
+		queryAddress:    queryAddress,
+		responseAddress: responseAddress,
+		queryPort:       dt.Message.GetQueryPort(),
+		responsePort:    dt.Message.GetResponsePort(),
+		protocol:        dt.Message.GetSocketProtocol(),
+		id:              msg.Id,
+		qname:           strings.ToLower(msg.Question[0].Name),
+	}
+}
+
+type pendingSession struct {
+	key  sessionKey
+	sd   *sessionData
+	seen time.Time
+}
+
+// sessionCorrelator joins the query and response session rows of the same
+// DNS transaction into one row.
+//
+// Rows are held for up to window waiting for the other half. Either half
+// may arrive first since the messages can be handled by different
+// minimiser workers. A row that is not matched within the window is
+// released as is, so a query that never got an answer still shows up in
+// the session data.
+//
+// It is only used by the data collector goroutine and is not safe for
+// concurrent use.
+type sessionCorrelator struct {
+	window  time.Duration
+	pending map[sessionKey]*pendingSession
+	// queue holds the pending rows in arrival order so expiry only needs
+	// to look at the front. Entries that have since been matched are
+	// skipped when they reach the front.
+	queue []*pendingSession
+}
+
+func newSessionCorrelator(window time.Duration) *sessionCorrelator {
+	return &sessionCorrelator{
+		window:  window,
+		pending: map[sessionKey]*pendingSession{},
+	}
+}
+
+// add hands a row with a correlation key to the correlator. It returns
+// the joined row when sd completes a pending transaction and the replaced
+// row when sd repeats the same half of a pending one, as for a
+// retransmitted query. Otherwise sd is held and nil is returned.
+func (c *sessionCorrelator) add(sd *sessionData) *sessionData {
+	key := *sd.correlationKey
+	// The message columns can be left out of the rows, the query time
+	// is what tells a query from a response.
+	isQuery := sd.QueryTime != nil
+
+	if p, ok := c.pending[key]; ok {
+		delete(c.pending, key)
+		if (p.sd.QueryTime != nil) != isQuery {
+			if isQuery {
+				return joinSessions(sd, p.sd)
+			}
+			return joinSessions(p.sd, sd)
+		}
+		c.hold(key, sd)
+		return p.sd
+	}
+
+	c.hold(key, sd)
+	return nil
+}
+
+func (c *sessionCorrelator) hold(key sessionKey, sd *sessionData) {
+	p := &pendingSession{key: key, sd: sd, seen: sd.timestamp()}
+	c.pending[key] = p
+	c.queue = append(c.queue, p)
+}
+
+// expire returns the rows that have been waiting for at least the window
+// at time now.
+func (c *sessionCorrelator) expire(now time.Time) []*sessionData {
+	var expired []*sessionData
+	for len(c.queue) > 0 {
+		p := c.queue[0]
+		if now.Sub(p.seen) < c.window {
+			break
+		}
+		c.queue[0] = nil
+		c.queue = c.queue[1:]
+		if c.pending[p.key] == p {
+			delete(c.pending, p.key)
+			expired = append(expired, p.sd)
+		}
+	}
+	return expired
+}
+
+// flush returns every pending row, used when shutting down.
+func (c *sessionCorrelator) flush() []*sessionData {
+	var flushed []*sessionData
+	for _, p := range c.queue {
+		if c.pending[p.key] == p {
+			flushed = append(flushed, p.sd)
+		}
+	}
+	c.queue = nil
+	clear(c.pending)
+	return flushed
+}
+
+// joinSessions fills in the query half of response and sets the latency
+// between the two messages.
+func joinSessions(query, response *sessionData) *sessionData {
+	response.QueryTime = query.QueryTime
+	response.QueryMessage = query.QueryMessage
+	if response.QueryTime != nil && response.ResponseTime != nil {
+		latency := *response.ResponseTime - *response.QueryTime
+		response.LatencyMicroseconds = &latency
+	}
+	return response
+}
+
+// timestamp returns the message time of a session row, the query time if
+// it is set and the response time otherwise.
+func (sd *sessionData) timestamp() time.Time {
+	if sd.QueryTime != nil {
+		return time.UnixMicro(*sd.QueryTime).UTC()
+	}
+	if sd.ResponseTime != nil {
+		return time.UnixMicro(*sd.ResponseTime).UTC()
+	}
+	return time.Time{}
+}
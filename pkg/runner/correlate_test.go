@@ -0,0 +1,225 @@
+package runner
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/dnstapir/edm/pkg/protocols"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/miekg/dns"
+)
+
+// correlationTestSession returns one half of a transaction identified by
+// id, the query half if isQuery is set.
+func correlationTestSession(id uint16, isQuery bool, ts time.Time) *sessionData {
+	sd := &sessionData{
+		correlationKey: &sessionKey{
+			queryAddress:    netip.MustParseAddr("198.51.100.20"),
+			responseAddress: netip.MustParseAddr("198.51.100.53"),
+			queryPort:       12345,
+			responsePort:    53,
+			protocol:        dnstap.SocketProtocol_UDP,
+			id:              id,
+			qname:           "example.com.",
+		},
+	}
+	us := ts.UnixMicro()
+	if isQuery {
+		sd.QueryTime = &us
+		sd.QueryMessage = ptr("query")
+	} else {
+		sd.ResponseTime = &us
+		sd.ResponseMessage = ptr("response")
+	}
+	return sd
+}
+
+func TestSessionCorrelator(t *testing.T) {
+	base := time.Date(2023, 11, 14, 22, 13, 0, 0, time.UTC)
+	c := newSessionCorrelator(10 * time.Second)
+
+	if sd := c.add(correlationTestSession(1, true, base)); sd != nil {
+		t.Fatalf("unmatched query was released: %#v", sd)
+	}
+	joined := c.add(correlationTestSession(1, false, base.Add(1500*time.Microsecond)))
+	if joined == nil || joined.QueryMessage == nil || joined.ResponseMessage == nil {
+		t.Fatalf("query and response were not joined: %#v", joined)
+	}
+	if joined.LatencyMicroseconds == nil || *joined.LatencyMicroseconds != 1500 {
+		t.Fatalf("latency = %v, want 1500", joined.LatencyMicroseconds)
+	}
+
+	// The response may reach the collector before its query.
+	c.add(correlationTestSession(2, false, base.Add(2*time.Millisecond)))
+	joined = c.add(correlationTestSession(2, true, base))
+	if joined == nil || joined.LatencyMicroseconds == nil || *joined.LatencyMicroseconds != 2000 {
+		t.Fatalf("response first was not joined: %#v", joined)
+	}
+
+	// A retransmitted query releases the earlier one unmatched.
+	first := correlationTestSession(3, true, base)
+	c.add(first)
+	if sd := c.add(correlationTestSession(3, true, base.Add(time.Second))); sd != first {
+		t.Fatalf("retransmission released %#v, want the first query", sd)
+	}
+
+	unanswered := correlationTestSession(4, true, base.Add(2*time.Second))
+	c.add(unanswered)
+
+	if expired := c.expire(base.Add(10*time.Second + 999*time.Millisecond)); len(expired) != 0 {
+		t.Fatalf("rows expired before the window ran out: %d", len(expired))
+	}
+	expired := c.expire(base.Add(11 * time.Second))
+	if len(expired) != 1 || expired[0].LatencyMicroseconds != nil || *expired[0].QueryTime != base.Add(time.Second).UnixMicro() {
+		t.Fatalf("expire = %#v, want the retransmitted query only", expired)
+	}
+
+	flushed := c.flush()
+	if len(flushed) != 1 || flushed[0] != unanswered {
+		t.Fatalf("flush = %#v, want the unanswered query", flushed)
+	}
+	if len(c.pending) != 0 || len(c.queue) != 0 {
+		t.Fatalf("correlator not empty after flush: %d pending, %d queued", len(c.pending), len(c.queue))
+	}
+}
+
+func TestDataCollectorCorrelatesSessions(t *testing.T) {
+	tc := defaultTC
+	tc.CorrelateQueryResponses = true
+	edm := newTestDnstapMinimiser(t, tc)
+	wkdTracker, err := newWellKnownDomainsTracker(testDawgFinder(t, "known.example."), time.Unix(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go edm.dataCollector(&wg, wkdTracker, "unused-in-shutdown-test.dawg")
+
+	base := time.Date(2023, 11, 14, 22, 13, 0, 0, time.UTC)
+	edm.sessionCollectorCh <- correlationTestSession(1, true, base)
+	edm.sessionCollectorCh <- correlationTestSession(1, false, base.Add(time.Millisecond))
+	edm.sessionCollectorCh <- correlationTestSession(2, true, base.Add(2*time.Millisecond))
+	// Rows without a key, like other message types, pass straight through.
+	edm.sessionCollectorCh <- &sessionData{ServerID: ptr("server")}
+
+	close(wkdTracker.stop)
+	waitOrFail(t, &wg, 2*time.Second, "dataCollector did not exit after stop")
+
+	ps, ok := readSessionInterval(edm.sessionWriterCh)
+	if !ok {
+		t.Fatal("sessionWriterCh closed without flushing session data")
+	}
+	if len(ps.sessions) != 3 {
+		t.Fatalf("flushed sessions have: %d, want: 3", len(ps.sessions))
+	}
+	if ps.sessions[0].LatencyMicroseconds == nil || *ps.sessions[0].LatencyMicroseconds != 1000 {
+		t.Fatalf("first row is not the joined pair: %#v", ps.sessions[0])
+	}
+	if ps.sessions[1].ServerID == nil || ps.sessions[2].QueryMessage == nil || ps.sessions[2].ResponseMessage != nil {
+		t.Fatalf("unexpected remaining rows: %#v, %#v", ps.sessions[1], ps.sessions[2])
+	}
+	if got := testMetricValue(t, edm.promSessionsCorrelated); got != 1 {
+		t.Fatalf("correlated sessions metric = %v, want 1", got)
+	}
+	if got := testMetricValue(t, edm.promSessionsUncorrelated); got != 1 {
+		t.Fatalf("uncorrelated sessions metric = %v, want 1", got)
+	}
+}
+
+func TestRunMinimiserCorrelateQueryResponses(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		tc := defaultTC
+		tc.CorrelateQueryResponses = true
+		edm := newSynctestDnstapMinimiser(t, tc)
+		edm.reloadMinimiserConfigCh = []chan struct{}{make(chan struct{}, 1)}
+		edm.newQnamePublisherCh = make(chan *protocols.NewQnameJSON, 1)
+		edm.sessionCollectorCh = make(chan *sessionData, 1)
+		cache, err := lru.New[string, seenQname](2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db := newTestPebble(t)
+		wkd, err := newWellKnownDomainsTracker(testDawgFinder(t, "known.example."), time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(t.Context())
+		defer cancel()
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go edm.runMinimiser(ctx, 0, &wg, edm.reloadMinimiserConfigCh[0], nil, cache, &pebbleSeenQnameStore{db: db}, nil, defaultLabelLimit, wkd)
+
+		pack := func(name string, response bool) []byte {
+			msg := new(dns.Msg)
+			msg.SetQuestion(name, dns.TypeA)
+			msg.Id = 4711
+			msg.Response = response
+			packed, err := msg.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			return packed
+		}
+
+		// The query is only used for its session row while
+		// process-query-messages is off.
+		edm.inputChannel <- marshaledDnstap(t, testDnstapMessage(t, dnstap.Message_CLIENT_QUERY, dnstap.SocketFamily_INET, pack("New.Example.", false)))
+		var query *sessionData
+		select {
+		case query = <-edm.sessionCollectorCh:
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for query session")
+		}
+		if query.correlationKey == nil || query.QueryMessage == nil {
+			t.Fatalf("query session can not be correlated: %#v", query)
+		}
+		synctest.Wait()
+		select {
+		case ev := <-edm.newQnamePublisherCh:
+			t.Fatalf("unexpected new_qname event for a correlation only query: %#v", ev)
+		default:
+		}
+
+		edm.inputChannel <- marshaledDnstap(t, testDnstapMessage(t, dnstap.Message_CLIENT_RESPONSE, dnstap.SocketFamily_INET, pack("new.example.", true)))
+		select {
+		case ev := <-edm.newQnamePublisherCh:
+			if ev.Qname != "new.example." {
+				t.Fatalf("new qname = %s", ev.Qname)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for new_qname event")
+		}
+		select {
+		case response := <-edm.sessionCollectorCh:
+			if response.correlationKey == nil || *response.correlationKey != *query.correlationKey {
+				t.Fatalf("response key %+v does not match query key %+v", response.correlationKey, query.correlationKey)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for response session")
+		}
+
+		// Only client queries are let through, and well-known
+		// domains are still not counted from them.
+		edm.inputChannel <- marshaledDnstap(t, testDnstapMessage(t, dnstap.Message_RESOLVER_QUERY, dnstap.SocketFamily_INET, pack("other.example.", false)))
+		edm.inputChannel <- marshaledDnstap(t, testDnstapMessage(t, dnstap.Message_CLIENT_QUERY, dnstap.SocketFamily_INET, pack("known.example.", false)))
+		synctest.Wait()
+		select {
+		case sd := <-edm.sessionCollectorCh:
+			t.Fatalf("unexpected session: %#v", sd)
+		default:
+		}
+		if m := collectedHistogram(wkd); len(m) != 0 {
+			t.Fatalf("unexpected histogram data for a correlation only query: %#v", m)
+		}
+
+		cancel()
+		wg.Wait()
+	})
+}
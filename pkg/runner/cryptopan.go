@@ -1,9 +1,12 @@
 package runner
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/netip"
+	"sync"
+	"time"
 
 	dnstap "github.com/dnstap/golang-dnstap"
 	lru "github.com/hashicorp/golang-lru/v2"
@@ -30,6 +33,49 @@ func (realCryptopanFactory) NewCryptopan(key, salt string) (*cryptopan.Cryptopan
 	return createCryptopan(key, salt)
 }
 
+// cryptopanState is the address pseudonymiser in use together with the key
+// epoch it was derived for. The pseudonymiser is a Crypto-PAn instance
+// unless pseudonymisation-mode selects another one. epoch is the zero time
+// unless cryptopan-key-rotation is set.
+type cryptopanState struct {
+	cpn   addressPseudonymiser
+	epoch time.Time
+}
+
+// pseudonymisationSettings are the settings of the address pseudonymiser
+// that can not be reloaded. They are captured from the config once at
+// startup, so a reload that changes them can not switch the pseudonymiser
+// mid run; only the key and salt are taken from the live config.
+type pseudonymisationSettings struct {
+	mode        string
+	ipv4Prefix  int
+	ipv6Prefix  int
+	keyRotation time.Duration
+}
+
+func newPseudonymisationSettings(conf Config) pseudonymisationSettings {
+	mode := conf.PseudonymisationMode
+	if mode == "" {
+		mode = PseudonymisationModeCryptopan
+	}
+	return pseudonymisationSettings{
+		mode:        mode,
+		ipv4Prefix:  conf.PseudonymisationIPv4Prefix,
+		ipv6Prefix:  conf.PseudonymisationIPv6Prefix,
+		keyRotation: conf.cryptopanKeyRotationInterval(),
+	}
+}
+
+// cryptopanEpochSalt returns the salt used for deriving the Crypto-PAn key
+// of the key epoch starting at epoch from the configured key and salt, so
+// every epoch gets an unrelated key.
+func cryptopanEpochSalt(salt string, epoch time.Time) string {
+	return salt + "/epoch=" + epoch.UTC().Format(time.RFC3339)
+}
+
+// setCryptopan installs the address pseudonymiser of the pseudonymisation-mode
+// captured at startup, keyed by key and salt. With cryptopan-key-rotation set
+// the key is derived for the key epoch the current time falls in.
 func (edm *DnstapMinimiser) setCryptopan(key string, salt string, cacheEntries int) error {
 	// cacheEntries is the per-worker LRU size, validated here so a bad config
 	// value surfaces at load time instead of crashing a worker when it builds
@@ -42,17 +88,68 @@ func (edm *DnstapMinimiser) setCryptopan(key string, salt string, cacheEntries i
 		return fmt.Errorf("setCryptopan: invalid cache size %d", cacheEntries)
 	}
 
-	cpn, err := edm.deps.CryptopanFactory.NewCryptopan(key, salt)
-	if err != nil {
-		return fmt.Errorf("setCryptopan: unable to create cryptopan: %w", err)
+	settings := edm.pseudonymisation
+
+	// The epoch is read from the clock while holding the lock, so the
+	// state stored last always has the latest epoch.
+	edm.cryptopanMu.Lock()
+	defer edm.cryptopanMu.Unlock()
+
+	var epoch time.Time
+	if interval := settings.keyRotation; interval > 0 {
+		epoch = edm.deps.Clock.Now().UTC().Truncate(interval)
+		salt = cryptopanEpochSalt(salt, epoch)
 	}
 
-	edm.cryptopan.Store(cpn)
+	var cpn addressPseudonymiser
+	switch settings.mode {
+	case PseudonymisationModeTruncate:
+		cpn = truncatePseudonymiser{
+			ipv4PrefixLength: settings.ipv4Prefix,
+			ipv6PrefixLength: settings.ipv6Prefix,
+		}
+	case PseudonymisationModeHMAC:
+		cpn = hmacPseudonymiser{key: getCryptopanAESKey(key, salt)}
+	case PseudonymisationModeNone:
+		cpn = noPseudonymiser{}
+	default:
+		var err error
+		cpn, err = edm.deps.CryptopanFactory.NewCryptopan(key, salt)
+		if err != nil {
+			return fmt.Errorf("setCryptopan: unable to create cryptopan: %w", err)
+		}
+	}
+
+	edm.cryptopan.Store(&cryptopanState{cpn: cpn, epoch: epoch})
 	edm.cryptopanGen.Add(1)
 
 	return nil
 }
 
+// cryptopanKeyRotator derives a new Crypto-PAn key from cryptopan-key at
+// every cryptopan-key-rotation boundary.
+func (edm *DnstapMinimiser) cryptopanKeyRotator(ctx context.Context, wg *sync.WaitGroup, interval time.Duration) {
+	defer wg.Done()
+
+	for {
+		now := edm.deps.Clock.Now()
+		select {
+		case <-edm.deps.Clock.After(nextIntervalBoundary(now, interval).Sub(now)):
+		case <-ctx.Done():
+			edm.log.Info("exiting cryptopanKeyRotator loop")
+			return
+		}
+
+		conf := edm.getConfig()
+		err := edm.setCryptopan(conf.CryptopanKey, conf.CryptopanKeySalt, conf.CryptopanAddressEntries)
+		if err != nil {
+			edm.log.Error("cryptopanKeyRotator: unable to rotate Crypto-PAn key", "error", err)
+			continue
+		}
+		edm.log.Info("cryptopanKeyRotator: rotated Crypto-PAn key", "epoch", edm.cryptopan.Load().epoch)
+	}
+}
+
 func createCryptopan(key string, salt string) (*cryptopan.Cryptopan, error) {
 	cryptopanKey := getCryptopanAESKey(key, salt)
 
@@ -70,7 +167,7 @@ func createCryptopan(key string, salt string) (*cryptopan.Cryptopan, error) {
 // cryptopan instance taken once per frame so QueryAddress and ResponseAddress
 // see the same key. The per-worker cache and cryptopan snapshot are passed in
 // rather than read from shared state, so the hot path needs no locking.
-func (edm *DnstapMinimiser) pseudonymiseDnstap(dt *dnstap.Dnstap, cpn *cryptopan.Cryptopan, cache *lru.Cache[netip.Addr, netip.Addr]) {
+func (edm *DnstapMinimiser) pseudonymiseDnstap(dt *dnstap.Dnstap, cpn addressPseudonymiser, cache *lru.Cache[netip.Addr, netip.Addr]) {
 	var err error
 	if dt.Message.QueryAddress != nil {
 		dt.Message.QueryAddress, err = edm.pseudonymiseIP(dt.Message.QueryAddress, cpn, cache)
@@ -88,7 +185,7 @@ func (edm *DnstapMinimiser) pseudonymiseDnstap(dt *dnstap.Dnstap, cpn *cryptopan
 
 // Pseudonymise IP address, even on error the returned []byte is usable (zeroed address).
 // Caller passes the per-worker cache and the cryptopan snapshot; nil cache disables caching.
-func (edm *DnstapMinimiser) pseudonymiseIP(ipBytes []byte, cpn *cryptopan.Cryptopan, cache *lru.Cache[netip.Addr, netip.Addr]) ([]byte, error) {
+func (edm *DnstapMinimiser) pseudonymiseIP(ipBytes []byte, cpn addressPseudonymiser, cache *lru.Cache[netip.Addr, netip.Addr]) ([]byte, error) {
 	addr, ok := netip.AddrFromSlice(ipBytes)
 	if !ok {
 		// Replace address with zeroes since we do not know if
@@ -2,9 +2,13 @@ package runner
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"net/netip"
+	"sync"
 	"testing"
+	"testing/synctest"
+	"time"
 
 	dnstap "github.com/dnstap/golang-dnstap"
 	lru "github.com/hashicorp/golang-lru/v2"
@@ -518,7 +522,7 @@ func TestPseudonymiseIPCacheBranches(t *testing.T) {
 
 	t.Run("cache hit on repeat", func(t *testing.T) {
 		edm := newTestDnstapMinimiser(t, defaultTC)
-		cpn := edm.cryptopan.Load()
+		cpn := edm.cryptopan.Load().cpn
 		cache, err := lru.New[netip.Addr, netip.Addr](10)
 		if err != nil {
 			t.Fatalf("lru.New: %v", err)
@@ -550,7 +554,7 @@ func TestPseudonymiseIPCacheBranches(t *testing.T) {
 
 	t.Run("cache eviction at size limit", func(t *testing.T) {
 		edm := newTestDnstapMinimiser(t, defaultTC)
-		cpn := edm.cryptopan.Load()
+		cpn := edm.cryptopan.Load().cpn
 		// Shrink the LRU to a single entry so the second distinct
 		// address evicts the first — exercising the evicted arm and
 		// the promCryptopanCacheEvicted.Inc() call.
@@ -571,7 +575,7 @@ func TestPseudonymiseIPCacheBranches(t *testing.T) {
 
 	t.Run("cache disabled bypasses cache logic", func(t *testing.T) {
 		edm := newTestDnstapMinimiser(t, defaultTC)
-		cpn := edm.cryptopan.Load()
+		cpn := edm.cryptopan.Load().cpn
 		// A nil cache skips the cache-Get and cache-Add branches
 		// entirely, mirroring CryptopanAddressEntries == 0.
 		if _, err := edm.pseudonymiseIP(addrA, cpn, nil); err != nil {
@@ -589,7 +593,7 @@ func TestIPConversionErrorsAndPseudonymiseInvalid(t *testing.T) {
 	}
 
 	edm := newTestDnstapMinimiser(t, defaultTC)
-	got, err := edm.pseudonymiseIP([]byte{1, 2, 3}, edm.cryptopan.Load(), nil)
+	got, err := edm.pseudonymiseIP([]byte{1, 2, 3}, edm.cryptopan.Load().cpn, nil)
 	if err == nil {
 		t.Fatal("invalid pseudonymiseIP succeeded")
 	}
@@ -604,6 +608,56 @@ func TestIPConversionErrorsAndPseudonymiseInvalid(t *testing.T) {
 	}
 }
 
+func TestCryptopanKeyRotator(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		tc := defaultTC
+		tc.CryptopanKeyRotation = "24h"
+		edm := newSynctestDnstapMinimiser(t, tc)
+
+		// The synctest clock starts at midnight UTC.
+		start := time.Now().UTC()
+		first := edm.cryptopan.Load()
+		if !first.epoch.Equal(start.Truncate(24 * time.Hour)) {
+			t.Fatalf("initial epoch = %s, want %s", first.epoch, start.Truncate(24*time.Hour))
+		}
+		gen := edm.cryptopanGen.Load()
+
+		ctx, cancel := context.WithCancel(t.Context())
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go edm.cryptopanKeyRotator(ctx, &wg, 24*time.Hour)
+
+		time.Sleep(23 * time.Hour)
+		synctest.Wait()
+		if edm.cryptopan.Load() != first {
+			t.Fatal("key rotated before the end of the epoch")
+		}
+
+		time.Sleep(time.Hour)
+		synctest.Wait()
+		second := edm.cryptopan.Load()
+		if !second.epoch.Equal(first.epoch.Add(24*time.Hour)) || edm.cryptopanGen.Load() != gen+1 {
+			t.Fatalf("epoch after rotation = %s, generation %d", second.epoch, edm.cryptopanGen.Load())
+		}
+
+		// Every epoch gets its own key derived from cryptopan-key.
+		addr := []byte{198, 51, 100, 20}
+		if bytes.Equal(first.cpn.Anonymize(addr), second.cpn.Anonymize(addr)) {
+			t.Fatal("pseudonyms are the same in both epochs")
+		}
+		want, err := fastTestCryptopanFactory{}.NewCryptopan(tc.CryptopanKey, cryptopanEpochSalt(tc.CryptopanKeySalt, second.epoch))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(second.cpn.Anonymize(addr), want.Anonymize(addr)) {
+			t.Fatal("rotated key is not derived from cryptopan-key and the epoch")
+		}
+
+		cancel()
+		wg.Wait()
+	})
+}
+
 // TestSetCryptopanBumpsGeneration verifies the contract that runMinimiser
 // workers rely on: every successful setCryptopan call must increment
 // edm.cryptopanGen by exactly one and atomic.Store a new cryptopan
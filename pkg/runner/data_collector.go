@@ -10,7 +10,8 @@ import (
 func (edm *DnstapMinimiser) dataCollector(wg *sync.WaitGroup, wkd *wellKnownDomainsTracker, dawgFile string) {
 	defer wg.Done()
 
-	// Keep track of if we have recorded any dnstap packets in session data
+	// Keep track of if we have sent any session rows to the session
+	// writer in the current interval
 	var sessionUpdated bool
 
 	// Start retryer, handles instances where the received update has a
@@ -19,39 +20,89 @@ func (edm *DnstapMinimiser) dataCollector(wg *sync.WaitGroup, wkd *wellKnownDoma
 	retryerWg.Add(1)
 	go wkd.updateRetryer(edm, &retryerWg)
 
-	sessions := []*sessionData{}
-	sessionIntervalStart := edm.deps.Clock.Now().UTC()
-	histogramIntervalStart := sessionIntervalStart
+	// Intervals follow capture time rather than the wall clock when
+	// replaying dnstap files.
+	clk := edm.intervalClock()
 
-	ticker := edm.deps.Clock.NewTicker(timeUntilNextMinuteFrom(edm.deps.Clock.Now()))
+	conf := edm.getConfig()
+
+	// Sessions and histograms are rotated at their own wall clock
+	// aligned intervals.
+	startTime := clk.Now().UTC()
+	sessionSchedule := newRotationSchedule(startTime, conf.sessionRotationInterval())
+	histogramSchedule := newRotationSchedule(startTime, conf.histogramRotationInterval())
+
+	// untilNextRotation returns the time from now until the end of the
+	// first of the open intervals. A rotation that is already late is
+	// picked up right away.
+	untilNextRotation := func(now time.Time) time.Duration {
+		end := sessionSchedule.end
+		if histogramSchedule.end.Before(end) {
+			end = histogramSchedule.end
+		}
+		return max(end.Sub(now), time.Millisecond)
+	}
+
+	ticker := clk.NewTicker(untilNextRotation(clk.Now()))
 	defer ticker.Stop()
 
 	retryChannelClosed := false
 
-	conf := edm.getConfig()
-
 	hllSettings := getHllDefaults(conf.HistogramHLLExplicitThreshold)
 
+	// Queries and responses are joined before being added to the
+	// session data when correlation is enabled.
+	var correlator *sessionCorrelator
+	if conf.CorrelateQueryResponses {
+		correlator = newSessionCorrelator(time.Duration(conf.CorrelationWindow) * time.Second)
+	}
+
+	// Session rows are streamed to the session writer as they arrive
+	// rather than collected for the whole interval.
+	appendSession := func(sd *sessionData) {
+		startTime := sessionSchedule.start
+		if startTime.IsZero() {
+			// Replay time is the zero time until the first
+			// rotation, the interval starts at the first
+			// captured minute.
+			startTime = clk.Now()
+		}
+		edm.sessionWriterCh <- sessionWriterMsg{sd: sd, startTime: startTime}
+		sessionUpdated = true
+	}
+
+	appendUncorrelated := func(uncorrelated []*sessionData) {
+		for _, sd := range uncorrelated {
+			edm.promSessionsUncorrelated.Inc()
+			appendSession(sd)
+		}
+	}
+
 	processSession := func(sd *sessionData) {
 		if sd == nil {
 			return
 		}
-		sessions = append(sessions, sd)
-		sessionUpdated = true
+		if correlator != nil && sd.correlationKey != nil {
+			appendUncorrelated(correlator.expire(sd.timestamp()))
+			sd = correlator.add(sd)
+			if sd == nil {
+				return
+			}
+			if sd.LatencyMicroseconds != nil {
+				edm.promSessionsCorrelated.Inc()
+			} else {
+				edm.promSessionsUncorrelated.Inc()
+			}
+		}
+		appendSession(sd)
 	}
 
-	flushSessions := func(startTime time.Time, rotationTime time.Time) {
+	flushSessions := func(rotationTime time.Time) {
 		if !sessionUpdated {
 			return
 		}
-		ps := &prevSessions{
-			sessions:     sessions,
-			startTime:    startTime,
-			rotationTime: rotationTime,
-		}
-		sessions = []*sessionData{}
+		edm.sessionWriterCh <- sessionWriterMsg{rotationTime: rotationTime}
 		sessionUpdated = false
-		edm.sessionWriterCh <- ps
 	}
 
 	processWKDUpdate := func(wu wkdUpdate) {
@@ -70,28 +121,7 @@ func (edm *DnstapMinimiser) dataCollector(wg *sync.WaitGroup, wkd *wellKnownDoma
 			return
 		}
 
-		if _, exists := wkd.m[wu.dawgIndex]; !exists {
-			wkd.m[wu.dawgIndex] = edm.newHistogramData(hllSettings, wu.suffixMatch)
-		}
-
-		wkd.m[wu.dawgIndex].OKCount += wu.OKCount
-		wkd.m[wu.dawgIndex].NXCount += wu.NXCount
-		wkd.m[wu.dawgIndex].FailCount += wu.FailCount
-		wkd.m[wu.dawgIndex].ACount += wu.ACount
-		wkd.m[wu.dawgIndex].AAAACount += wu.AAAACount
-		wkd.m[wu.dawgIndex].MXCount += wu.MXCount
-		wkd.m[wu.dawgIndex].NSCount += wu.NSCount
-		wkd.m[wu.dawgIndex].OtherTypeCount += wu.OtherTypeCount
-		wkd.m[wu.dawgIndex].OtherRcodeCount += wu.OtherRcodeCount
-		wkd.m[wu.dawgIndex].NonINCount += wu.NonINCount
-
-		if wu.ip.IsValid() {
-			if wu.ip.Unmap().Is4() {
-				wkd.m[wu.dawgIndex].v4ClientHLL.AddRaw(wu.hllHash)
-			} else {
-				wkd.m[wu.dawgIndex].v6ClientHLL.AddRaw(wu.hllHash)
-			}
-		}
+		edm.countUpdate(partitionMap(wkd.m, wkd.partitions, wu.identity), wu, hllSettings)
 	}
 
 	drainCollectorQueues := func() {
@@ -107,8 +137,17 @@ func (edm *DnstapMinimiser) dataCollector(wg *sync.WaitGroup, wkd *wellKnownDoma
 		}
 	}
 
-	rotateCollectedData := func(sessionStart time.Time, histogramStart time.Time, rotationTime time.Time) error {
-		flushSessions(sessionStart, rotationTime)
+	rotateSessions := func(rotationTime time.Time) {
+		// Rows still waiting for their other half stay pending
+		// across the rotation unless their window has run out.
+		if correlator != nil {
+			appendUncorrelated(correlator.expire(rotationTime))
+		}
+		flushSessions(rotationTime)
+	}
+
+	rotateHistogram := func(histogramStart time.Time, rotationTime time.Time) error {
+		edm.flushNewQnameDedupe(false)
 
 		prevWKD, err := wkd.rotateTracker(edm, dawgFile, histogramStart, rotationTime)
 		if err != nil {
@@ -119,21 +158,67 @@ func (edm *DnstapMinimiser) dataCollector(wg *sync.WaitGroup, wkd *wellKnownDoma
 		if len(prevWKD.m) > 0 {
 			edm.histogramWriterCh <- prevWKD
 		}
+		// Identity partitions only exist once they have been updated.
+		for _, partition := range prevWKD.partitions {
+			edm.histogramWriterCh <- partition
+		}
+
+		return nil
+	}
+
+	rotateCollectedData := func(histogramStart time.Time, rotationTime time.Time) error {
+		rotateSessions(rotationTime)
+		return rotateHistogram(histogramStart, rotationTime)
+	}
+
+	// rotateScheduled rotates the sessions and histograms whose interval
+	// has ended at ts.
+	rotateScheduled := func(ts time.Time, now time.Time) error {
+		if rotationTime, ok := sessionSchedule.due(ts); ok {
+			rotateSessions(rotationTime)
+			sessionSchedule.advance(rotationTime, now)
+		}
+
+		rotationTime, ok := histogramSchedule.due(ts)
+		if !ok {
+			return nil
+		}
+		err := rotateHistogram(histogramSchedule.start, rotationTime)
+		if err != nil {
+			// Keep collecting into the open interval and try
+			// again at the next boundary.
+			histogramSchedule.postpone(now)
+			return err
+		}
+		histogramSchedule.advance(rotationTime, now)
+
+		// See if we need to modify anything based on a config update
+		conf = edm.getConfig()
+
+		if conf.HistogramHLLExplicitThreshold != hllSettings.ExplicitThreshold {
+			edm.log.Info("updating HLL explicit threshold based on config change", "from", hllSettings.ExplicitThreshold, "to", conf.HistogramHLLExplicitThreshold)
+			hllSettings.ExplicitThreshold = conf.HistogramHLLExplicitThreshold
+		}
 
 		return nil
 	}
 
 	flushHistogram := func(startTime time.Time, rotationTime time.Time) {
-		if len(wkd.m) == 0 {
-			return
+		snap := wkd.snap.Load()
+		wkd.collectShards(snap.dawgModTime)
+		dawgFinder := snap.dawgFinder
+		if len(wkd.m) > 0 {
+			edm.histogramWriterCh <- &wellKnownDomainsData{
+				m:            wkd.m,
+				startTime:    startTime,
+				rotationTime: rotationTime,
+				dawgFinder:   dawgFinder,
+			}
+			wkd.m = map[int]*histogramData{}
 		}
-		edm.histogramWriterCh <- &wellKnownDomainsData{
-			m:            wkd.m,
-			startTime:    startTime,
-			rotationTime: rotationTime,
-			dawgFinder:   wkd.snap.Load().dawgFinder,
+		for _, partition := range wkd.takePartitions(dawgFinder, startTime, rotationTime) {
+			edm.histogramWriterCh <- partition
 		}
-		wkd.m = map[int]*histogramData{}
 	}
 
 collectorLoop:
@@ -146,32 +231,30 @@ collectorLoop:
 			processWKDUpdate(wu)
 
 		case ts := <-ticker.C():
-			// We want to tick at the start of each minute
-			ticker.Reset(timeUntilNextMinuteFrom(edm.deps.Clock.Now()))
-
-			err := rotateCollectedData(sessionIntervalStart, histogramIntervalStart, ts)
-			// Sessions were already flushed; advance their boundary regardless.
-			sessionIntervalStart = ts
+			now := clk.Now()
+			err := rotateScheduled(ts, now)
+			// We want to tick at the end of the next interval
+			ticker.Reset(untilNextRotation(now))
 			if err != nil {
 				edm.log.Error("unable to rotate parquet data", "error", err)
-				continue
-			}
-			histogramIntervalStart = ts
-
-			// See if we need to modify anything based on a config update
-			conf = edm.getConfig()
-
-			if conf.HistogramHLLExplicitThreshold != hllSettings.ExplicitThreshold {
-				edm.log.Info("updating HLL explicit threshold based on config change", "from", hllSettings.ExplicitThreshold, "to", conf.HistogramHLLExplicitThreshold)
-				hllSettings.ExplicitThreshold = conf.HistogramHLLExplicitThreshold
 			}
 
 		case req := <-edm.parquetRotationRequestCh:
-			edm.log.Info("dataCollector: manual parquet rotation requested", "rotation_time", req.rotationTime)
 			drainCollectorQueues()
-			err := rotateCollectedData(sessionIntervalStart, histogramIntervalStart, req.rotationTime)
+			if req.scheduled {
+				// Replay time has moved on to rotationTime,
+				// which rotates what a tick would have.
+				err := rotateScheduled(req.rotationTime, req.rotationTime)
+				req.done <- err
+				if err != nil {
+					edm.log.Error("unable to rotate parquet data", "error", err)
+				}
+				continue
+			}
+			edm.log.Info("dataCollector: manual parquet rotation requested", "rotation_time", req.rotationTime)
+			err := rotateCollectedData(histogramSchedule.start, req.rotationTime)
 			// Sessions were already flushed; advance their boundary regardless.
-			sessionIntervalStart = req.rotationTime
+			sessionSchedule.advance(req.rotationTime, req.rotationTime)
 			req.done <- err
 			if err != nil {
 				edm.log.Error("unable to rotate parquet data", "error", err)
@@ -179,7 +262,7 @@ collectorLoop:
 			}
 			// The histogram only rotates on success, so its boundary
 			// advances only once rotateTracker has succeeded.
-			histogramIntervalStart = req.rotationTime
+			histogramSchedule.advance(req.rotationTime, req.rotationTime)
 
 		case <-wkd.stop:
 			// Tell retryer to stop
@@ -194,9 +277,13 @@ collectorLoop:
 		case <-wkd.retryerDone:
 			edm.log.Info("dataCollector: update retryer is done")
 			drainCollectorQueues()
-			shutdownTime := edm.deps.Clock.Now().UTC()
-			flushSessions(sessionIntervalStart, shutdownTime)
-			flushHistogram(histogramIntervalStart, shutdownTime)
+			if correlator != nil {
+				appendUncorrelated(correlator.flush())
+			}
+			shutdownTime := clk.Now().UTC()
+			flushSessions(shutdownTime)
+			flushHistogram(histogramSchedule.start, shutdownTime)
+			edm.flushNewQnameDedupe(true)
 			break collectorLoop
 		}
 	}
@@ -9,6 +9,7 @@ import (
 	"testing/synctest"
 	"time"
 
+	dnstap "github.com/dnstap/golang-dnstap"
 	"github.com/miekg/dns"
 	"github.com/smhanov/dawg"
 	"github.com/twmb/murmur3"
@@ -43,7 +44,7 @@ func TestDataCollectorFlushesPendingDataOnShutdown(t *testing.T) {
 	close(wkdTracker.stop)
 	waitOrFail(t, &wg, 2*time.Second, "dataCollector did not exit after stop")
 
-	ps, ok := <-edm.sessionWriterCh
+	ps, ok := readSessionInterval(edm.sessionWriterCh)
 	if !ok {
 		t.Fatal("sessionWriterCh closed without flushing pending session data")
 	}
@@ -105,7 +106,7 @@ func TestDataCollectorAdvancesSessionIntervalWhenRotationFails(t *testing.T) {
 	}
 
 	// The failed rotation still flushed the first session interval.
-	first, ok := <-edm.sessionWriterCh
+	first, ok := readSessionInterval(edm.sessionWriterCh)
 	if !ok {
 		t.Fatal("sessionWriterCh closed without flushing the first session interval")
 	}
@@ -125,7 +126,7 @@ func TestDataCollectorAdvancesSessionIntervalWhenRotationFails(t *testing.T) {
 	// The shutdown flush must start the second session interval at the
 	// failed rotation's time, proving the session boundary advanced even
 	// though histogram rotation failed.
-	second, ok := <-edm.sessionWriterCh
+	second, ok := readSessionInterval(edm.sessionWriterCh)
 	if !ok {
 		t.Fatal("sessionWriterCh closed without flushing the second session interval")
 	}
@@ -163,7 +164,7 @@ func TestDataCollector(t *testing.T) {
 			log:                slog.New(slog.NewTextHandler(io.Discard, nil)),
 			deps:               deps,
 			sessionCollectorCh: make(chan *sessionData, 1),
-			sessionWriterCh:    make(chan *prevSessions, 1),
+			sessionWriterCh:    make(chan sessionWriterMsg, 2),
 			histogramWriterCh:  make(chan *wellKnownDomainsData, 1),
 		}
 
@@ -201,3 +202,107 @@ func TestDataCollector(t *testing.T) {
 		}
 	})
 }
+
+func TestDataCollectorRotationIntervals(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		edm := &DnstapMinimiser{
+			conf:               Config{HistogramHLLExplicitThreshold: 20, HistogramInterval: "5m"},
+			log:                slog.New(slog.NewTextHandler(io.Discard, nil)),
+			deps:               defaultDependencies(),
+			sessionCollectorCh: make(chan *sessionData, 1),
+			sessionWriterCh:    make(chan sessionWriterMsg, 20),
+			histogramWriterCh:  make(chan *wellKnownDomainsData, 10),
+		}
+		wkd, err := newWellKnownDomainsTracker(testDawgFinder(t, "example.com."), time.Unix(0, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Start half way into a minute so the first intervals are short.
+		time.Sleep(timeUntilNextMinute() + 30*time.Second)
+		start := time.Now().UTC()
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go edm.dataCollector(&wg, wkd, "unused.dawg")
+
+		for range 7 {
+			edm.sessionCollectorCh <- &sessionData{ServerID: ptr("server")}
+			wkd.updateCh <- wkdUpdate{histogramData: histogramData{ACount: 1}, dawgModTime: time.Unix(0, 0)}
+			time.Sleep(time.Minute)
+		}
+		synctest.Wait()
+
+		// Sessions still rotate every minute.
+		ps, _ := readSessionInterval(edm.sessionWriterCh)
+		if !ps.startTime.Equal(start) || !ps.rotationTime.Equal(start.Truncate(time.Minute).Add(time.Minute)) {
+			t.Fatalf("first session interval = %s-%s", ps.startTime, ps.rotationTime)
+		}
+		intervals := 1
+		for len(edm.sessionWriterCh) > 0 {
+			if _, ok := readSessionInterval(edm.sessionWriterCh); ok {
+				intervals++
+			}
+		}
+		if intervals != 7 {
+			t.Fatalf("session intervals after 7 minutes = %d, want 7", intervals)
+		}
+
+		prevWKD := <-edm.histogramWriterCh
+		if want := start.Truncate(5 * time.Minute).Add(5 * time.Minute); !prevWKD.startTime.Equal(start) || !prevWKD.rotationTime.Equal(want) {
+			t.Fatalf("first histogram interval = %s-%s, want it to end at %s", prevWKD.startTime, prevWKD.rotationTime, want)
+		}
+		select {
+		case prevWKD := <-edm.histogramWriterCh:
+			t.Fatalf("histogram rotated again after %s", prevWKD.rotationTime)
+		default:
+		}
+
+		close(wkd.stop)
+		wg.Wait()
+	})
+}
+
+func TestDataCollectorPartitionsByIdentity(t *testing.T) {
+	tc := defaultTC
+	tc.PartitionByIdentity = true
+	edm := newTestDnstapMinimiser(t, tc)
+	wkdTracker, err := newWellKnownDomainsTracker(testDawgFinder(t, "example.com."), time.Unix(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go edm.dataCollector(&wg, wkdTracker, "unused-in-shutdown-test.dawg")
+
+	edm.sessionCollectorCh <- &sessionData{ServerID: ptr("resolver-b")}
+	edm.sessionCollectorCh <- &sessionData{ServerID: ptr("resolver-a")}
+	edm.sessionCollectorCh <- &sessionData{}
+	edm.sessionCollectorCh <- &sessionData{ServerID: ptr("resolver-b")}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	dawgIndex, suffixMatch, dawgModTime := wkdTracker.lookup(msg)
+	for _, identity := range []string{"resolver-b", "", "resolver-a", "resolver-b"} {
+		wkdTracker.updateCh <- newWKDUpdate(nil, msg, false, dnstap.SocketProtocol_UDP, dawgIndex, suffixMatch, dawgModTime, identity)
+	}
+
+	close(wkdTracker.stop)
+	waitOrFail(t, &wg, 2*time.Second, "dataCollector did not exit after stop")
+
+	// Sessions are partitioned by the session writer, the collector
+	// passes them all on in one interval.
+	ps, ok := readSessionInterval(edm.sessionWriterCh)
+	if !ok || len(ps.sessions) != 4 {
+		t.Fatalf("flushed sessions have: %d, want: 4", len(ps.sessions))
+	}
+
+	histogramCounts := map[string]uint64{}
+	for prevWKD := range edm.histogramWriterCh {
+		histogramCounts[prevWKD.identity] += prevWKD.m[dawgIndex].OKCount
+	}
+	if len(histogramCounts) != 3 || histogramCounts["resolver-a"] != 1 || histogramCounts["resolver-b"] != 2 || histogramCounts[""] != 1 {
+		t.Fatalf("histogram counts per identity = %v", histogramCounts)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -13,6 +14,8 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/cockroachdb/pebble"
@@ -74,6 +77,7 @@ type dnstapInput interface {
 	ReadInto(context.Context, chan<- []byte) error
 	SetTimeout(time.Duration)
 	SetLogger(dnstap.Logger)
+	SetMetrics(dnstapInputMetrics)
 	Close() error
 }
 
@@ -82,19 +86,36 @@ type dnstapInputFactory interface {
 	NewFrameStreamSockInput(listener net.Listener) dnstapInput
 }
 
-// seenQnameStore stores the persistent set of previously observed qnames.
-type seenQnameStore interface {
-	// Has reports whether qname is recorded in the store. It may report
-	// true together with a non-nil error when the value was found but
+// SeenQnameStore stores the set of previously observed qnames together
+// with when they were last seen. It is the interface implemented by the
+// seen-qname backends selected with [Config.SeenQnameBackend], and by
+// custom backends passed to [WithSeenQnameStoreFactory].
+//
+// Calls from the minimiser workers are serialised, but Expire may run
+// concurrently with them.
+type SeenQnameStore interface {
+	// LastSeen reports whether qname is recorded in the store and when it
+	// was last seen, the zero time for qnames recorded without a
+	// timestamp, which are never re-announced. It may report true
+	// together with a non-nil error when the value was found but
 	// releasing lookup resources failed; callers should trust the bool.
-	Has(qname string) (bool, error)
-	MarkSeen(qname string, sync bool) error
+	LastSeen(qname string) (time.Time, bool, error)
+	// MarkSeen records qname as last seen at lastSeen. With sync set the
+	// write should be durable before MarkSeen returns.
+	MarkSeen(qname string, lastSeen time.Time, sync bool) error
+	// Expire removes the qnames last seen before cutoff, returning how
+	// many qnames are left in the store and how many were removed.
+	// Qnames without a timestamp are kept but stamped as last seen at now,
+	// so they expire once they have gone unseen for as long as the others.
+	Expire(cutoff, now time.Time) (entries int, expired int, err error)
 	Close() error
 }
 
-// seenQnameStoreFactory opens SeenQnameStore instances.
-type seenQnameStoreFactory interface {
-	OpenSeenQnameStore(path string) (seenQnameStore, error)
+// SeenQnameStoreFactory opens the [SeenQnameStore] of a minimiser, it is
+// called once at startup with the configuration the minimiser is started
+// with.
+type SeenQnameStoreFactory interface {
+	OpenSeenQnameStore(conf Config) (SeenQnameStore, error)
 }
 
 // httpServerRunner starts an HTTP server.
@@ -102,9 +123,11 @@ type httpServerRunner interface {
 	ListenAndServeHTTP(server *http.Server) error
 }
 
-// aggregateSender sends histogram parquet files to aggregate-receiver.
+// aggregateSender sends histogram parquet files to aggregate-receiver. identity
+// is the dnstap identity the histogram describes, empty unless the output is
+// partitioned per identity.
 type aggregateSender interface {
-	Send(ctx context.Context, fileName string, ts time.Time, duration time.Duration) error
+	Send(ctx context.Context, fileName string, ts time.Time, duration time.Duration, identity string) error
 	CloseIdleConnections()
 }
 
@@ -150,7 +173,7 @@ type dependencies struct {
 	Clock                  clock
 	ListenerFactory        listenerFactory
 	DnstapInputFactory     dnstapInputFactory
-	SeenQnameStoreFactory  seenQnameStoreFactory
+	SeenQnameStoreFactory  SeenQnameStoreFactory
 	HTTPServerRunner       httpServerRunner
 	AggregateSenderFactory aggregateSenderFactory
 	MQTTFactory            mqttFactory
@@ -184,7 +207,7 @@ func fillDependencies(deps dependencies) dependencies {
 		deps.DnstapInputFactory = realDnstapInputFactory{}
 	}
 	if deps.SeenQnameStoreFactory == nil {
-		deps.SeenQnameStoreFactory = pebbleSeenQnameStoreFactory{}
+		deps.SeenQnameStoreFactory = configSeenQnameStoreFactory{}
 	}
 	if deps.HTTPServerRunner == nil {
 		deps.HTTPServerRunner = realHTTPServerRunner{}
@@ -304,40 +327,187 @@ func (realDnstapInputFactory) NewFrameStreamSockInput(listener net.Listener) dns
 	return newSocketDnstapInput(listener)
 }
 
-type pebbleSeenQnameStoreFactory struct{}
+// configSeenQnameStoreFactory opens the seen-qname backend selected with
+// [Config.SeenQnameBackend].
+type configSeenQnameStoreFactory struct{}
+
+func (configSeenQnameStoreFactory) OpenSeenQnameStore(conf Config) (SeenQnameStore, error) {
+	switch conf.SeenQnameBackend {
+	case SeenQnameBackendMemory:
+		return newMemorySeenQnameStore(conf.SeenQnameCapacity)
+	case SeenQnameBackendBloom:
+		return openBloomSeenQnameStore(filepath.Join(conf.DataDir, bloomSeenQnameFile), conf.SeenQnameCapacity, conf.SeenQnameFalsePositiveRate)
+	default:
+		return openPebbleSeenQnameStore(seenQnameStoreDir(conf.DataDir), &pebble.Options{})
+	}
+}
 
-func (pebbleSeenQnameStoreFactory) OpenSeenQnameStore(path string) (seenQnameStore, error) {
-	db, err := pebble.Open(path, &pebble.Options{})
+func openPebbleSeenQnameStore(path string, opts *pebble.Options) (*pebbleSeenQnameStore, error) {
+	db, err := pebble.Open(path, opts)
 	if err != nil {
 		return nil, err
 	}
 	return &pebbleSeenQnameStore{db: db}, nil
 }
 
+// pebbleExpireBatchSize is how many keys Expire re-checks and updates at a
+// time, holding off MarkSeen meanwhile.
+const pebbleExpireBatchSize = 1000
+
 type pebbleSeenQnameStore struct {
 	db *pebble.DB
+	// mu is held by MarkSeen and while Expire re-checks and commits a
+	// batch, so a qname refreshed after Expire read it is not deleted.
+	mu sync.Mutex
 }
 
-func (ps *pebbleSeenQnameStore) Has(qname string) (bool, error) {
-	_, closer, err := ps.db.Get([]byte(qname))
+// The pebble store keeps the last-seen time of a qname as its value, in
+// big endian Unix seconds. Values written before seen-qname-ttl existed are
+// empty.
+func (ps *pebbleSeenQnameStore) LastSeen(qname string) (time.Time, bool, error) {
+	value, closer, err := ps.db.Get([]byte(qname))
 	if err == nil {
+		lastSeen := decodeSeenQnameTime(value)
 		if err := closer.Close(); err != nil {
-			return true, err
+			return lastSeen, true, err
 		}
-		return true, nil
+		return lastSeen, true, nil
 	}
 	if errors.Is(err, pebble.ErrNotFound) {
-		return false, nil
+		return time.Time{}, false, nil
 	}
-	return false, err
+	return time.Time{}, false, err
 }
 
-func (ps *pebbleSeenQnameStore) MarkSeen(qname string, sync bool) error {
+func (ps *pebbleSeenQnameStore) MarkSeen(qname string, lastSeen time.Time, sync bool) error {
 	writeOpts := pebble.NoSync
 	if sync {
 		writeOpts = pebble.Sync
 	}
-	return ps.db.Set([]byte(qname), []byte{}, writeOpts)
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.db.Set([]byte(qname), encodeSeenQnameTime(lastSeen), writeOpts)
+}
+
+// Expire deletes the expired qnames and stamps those without a timestamp
+// in batches. The iterator reads a snapshot of the store, so every key is
+// read again under ps.mu before it is changed. After deleting anything the
+// store is compacted, deletes only free disk space once compacted.
+func (ps *pebbleSeenQnameStore) Expire(cutoff, now time.Time) (int, int, error) {
+	iter, err := ps.db.NewIter(nil)
+	if err != nil {
+		return 0, 0, fmt.Errorf("pebbleSeenQnameStore.Expire: unable to create iterator: %w", err)
+	}
+
+	var entries, expired int
+	var candidates [][]byte
+	var first, last []byte
+	for iter.First(); iter.Valid(); iter.Next() {
+		if first == nil {
+			first = slices.Clone(iter.Key())
+		}
+		last = append(last[:0], iter.Key()...)
+
+		lastSeen := decodeSeenQnameTime(iter.Value())
+		if !lastSeen.IsZero() && !lastSeen.Before(cutoff) {
+			entries++
+			continue
+		}
+		candidates = append(candidates, slices.Clone(iter.Key()))
+		if len(candidates) < pebbleExpireBatchSize {
+			continue
+		}
+		kept, n, err := ps.expireBatch(candidates, cutoff, now)
+		if err != nil {
+			_ = iter.Close()
+			return 0, 0, err
+		}
+		entries += kept
+		expired += n
+		candidates = candidates[:0]
+	}
+	if err := iter.Close(); err != nil {
+		return 0, 0, fmt.Errorf("pebbleSeenQnameStore.Expire: unable to iterate: %w", err)
+	}
+	kept, n, err := ps.expireBatch(candidates, cutoff, now)
+	if err != nil {
+		return 0, 0, err
+	}
+	entries += kept
+	expired += n
+
+	if expired > 0 {
+		if err := ps.db.Compact(first, append(last, 0), true); err != nil {
+			return 0, 0, fmt.Errorf("pebbleSeenQnameStore.Expire: unable to compact: %w", err)
+		}
+	}
+
+	return entries, expired, nil
+}
+
+// expireBatch deletes the keys that are still last seen before cutoff and
+// stamps those still without a timestamp with now, returning the number of
+// kept and of deleted keys.
+func (ps *pebbleSeenQnameStore) expireBatch(keys [][]byte, cutoff, now time.Time) (int, int, error) {
+	if len(keys) == 0 {
+		return 0, 0, nil
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	batch := ps.db.NewBatch()
+	defer batch.Close()
+
+	var kept, expired int
+	for _, key := range keys {
+		value, closer, err := ps.db.Get(key)
+		if errors.Is(err, pebble.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("pebbleSeenQnameStore.Expire: unable to get key: %w", err)
+		}
+		lastSeen := decodeSeenQnameTime(value)
+		if err := closer.Close(); err != nil {
+			return 0, 0, fmt.Errorf("pebbleSeenQnameStore.Expire: unable to get key: %w", err)
+		}
+
+		switch {
+		case lastSeen.IsZero():
+			err = batch.Set(key, encodeSeenQnameTime(now), nil)
+			kept++
+		case lastSeen.Before(cutoff):
+			err = batch.Delete(key, nil)
+			expired++
+		default:
+			// Refreshed by MarkSeen since it was read.
+			kept++
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("pebbleSeenQnameStore.Expire: unable to update key: %w", err)
+		}
+	}
+
+	if err := batch.Commit(pebble.Sync); err != nil {
+		return 0, 0, fmt.Errorf("pebbleSeenQnameStore.Expire: unable to commit: %w", err)
+	}
+
+	return kept, expired, nil
+}
+
+// encodeSeenQnameTime encodes a last-seen time as stored by MarkSeen.
+func encodeSeenQnameTime(lastSeen time.Time) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(lastSeen.Unix())) // #nosec G115 -- Times before 1970 are not expected
+}
+
+// decodeSeenQnameTime decodes a last-seen time stored by MarkSeen, returning
+// the zero time for a value without one.
+func decodeSeenQnameTime(value []byte) time.Time {
+	if len(value) != 8 {
+		return time.Time{}
+	}
+	return time.Unix(int64(binary.BigEndian.Uint64(value)), 0) // #nosec G115 -- Written from a non-negative int64 by MarkSeen
 }
 
 func (ps *pebbleSeenQnameStore) Close() error {
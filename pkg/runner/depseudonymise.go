@@ -0,0 +1,151 @@
+package runner
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/yawning/cryptopan"
+)
+
+// Depseudonymiser maps addresses pseudonymised with Crypto-PAn back to the
+// addresses they were created from. It is meant for incident response
+// under legal authority, see the "depseudonymise" command.
+type Depseudonymiser struct {
+	cpn *cryptopan.Cryptopan
+}
+
+// NewDepseudonymiser returns a Depseudonymiser for the Crypto-PAn key
+// derived from key and salt the same way as for the "run" command. A
+// non-zero epoch selects the key of that key epoch, for files written with
+// cryptopan-key-rotation enabled.
+func NewDepseudonymiser(key string, salt string, epoch time.Time) (*Depseudonymiser, error) {
+	if key == "" {
+		return nil, errors.New("NewDepseudonymiser: empty Crypto-PAn key")
+	}
+	if !epoch.IsZero() {
+		salt = cryptopanEpochSalt(salt, epoch)
+	}
+
+	cpn, err := createCryptopan(key, salt)
+	if err != nil {
+		return nil, fmt.Errorf("NewDepseudonymiser: %w", err)
+	}
+
+	return &Depseudonymiser{cpn: cpn}, nil
+}
+
+// Depseudonymise returns the address pseudonym was created from.
+//
+// Crypto-PAn flips bit i of an address depending only on the bits before
+// it, so the original address can be recovered one bit at a time: with the
+// first i bits known, pseudonymising them followed by a zero bit tells
+// whether bit i of the pseudonym was flipped.
+func (d *Depseudonymiser) Depseudonymise(pseudonym netip.Addr) netip.Addr {
+	pseudonym = pseudonym.Unmap()
+	want := pseudonym.AsSlice()
+	orig := make([]byte, len(want))
+
+	for i := range 8 * len(want) {
+		mask := byte(0x80) >> (i % 8)
+		got := d.cpn.Anonymize(orig)
+		if pseudonym.Is4() {
+			got = got.To4()
+		}
+		if got[i/8]&mask != want[i/8]&mask {
+			orig[i/8] |= mask
+		}
+	}
+
+	addr, _ := netip.AddrFromSlice(orig)
+	return addr
+}
+
+// ErrNotCryptopanSession is returned by [SessionFileAddresses] for a session
+// file whose addresses were not pseudonymised with Crypto-PAn, or that does
+// not say how they were, so they can not be depseudonymised.
+var ErrNotCryptopanSession = errors.New("session file addresses were not pseudonymised with Crypto-PAn")
+
+// sessionAddressColumns are the address columns of [sessionData].
+type sessionAddressColumns struct {
+	SourceIPv4        *int32 `parquet:"source_ipv4"`
+	DestIPv4          *int32 `parquet:"dest_ipv4"`
+	SourceIPv6Network *int64 `parquet:"source_ipv6_network"`
+	SourceIPv6Host    *int64 `parquet:"source_ipv6_host"`
+	DestIPv6Network   *int64 `parquet:"dest_ipv6_network"`
+	DestIPv6Host      *int64 `parquet:"dest_ipv6_host"`
+}
+
+// SessionFileAddresses returns the distinct pseudonymised source and
+// destination addresses in the session parquet file in r, in sorted order,
+// together with the Crypto-PAn key epochs listed in its metadata, if any.
+// Files not written with the cryptopan pseudonymisation-mode, according to
+// their edm_pseudonymisation_mode metadata, are refused with
+// [ErrNotCryptopanSession].
+func SessionFileAddresses(r io.ReaderAt, size int64) ([]netip.Addr, []time.Time, error) {
+	pf, err := parquet.OpenFile(r, size)
+	if err != nil {
+		return nil, nil, fmt.Errorf("SessionFileAddresses: unable to open parquet file: %w", err)
+	}
+
+	mode, ok := pf.Lookup(sessionPseudonymisationModeMetadataKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("SessionFileAddresses: %w: no %s metadata", ErrNotCryptopanSession, sessionPseudonymisationModeMetadataKey)
+	}
+	if mode != PseudonymisationModeCryptopan {
+		return nil, nil, fmt.Errorf("SessionFileAddresses: %w: pseudonymisation mode %q", ErrNotCryptopanSession, mode)
+	}
+
+	var epochs []time.Time
+	if value, ok := pf.Lookup(sessionCryptopanEpochMetadataKey); ok && value != "" {
+		for _, s := range strings.Split(value, ",") {
+			epoch, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return nil, nil, fmt.Errorf("SessionFileAddresses: invalid %s metadata: %w", sessionCryptopanEpochMetadataKey, err)
+			}
+			epochs = append(epochs, epoch)
+		}
+	}
+
+	rows, err := parquet.Read[sessionAddressColumns](r, size)
+	if err != nil {
+		return nil, nil, fmt.Errorf("SessionFileAddresses: unable to read rows: %w", err)
+	}
+
+	seen := map[netip.Addr]struct{}{}
+	addIPv4 := func(i *int32) {
+		if i != nil {
+			var b [4]byte
+			binary.BigEndian.PutUint32(b[:], uint32(*i)) // #nosec G115 -- stored as convertedType=UINT_32, see newSession
+			seen[netip.AddrFrom4(b)] = struct{}{}
+		}
+	}
+	addIPv6 := func(network, host *int64) {
+		if network != nil && host != nil {
+			var b [16]byte
+			binary.BigEndian.PutUint64(b[:8], uint64(*network)) // #nosec G115 -- stored as convertedType=UINT_64, see newSession
+			binary.BigEndian.PutUint64(b[8:], uint64(*host))    // #nosec G115 -- stored as convertedType=UINT_64, see newSession
+			seen[netip.AddrFrom16(b)] = struct{}{}
+		}
+	}
+	for _, row := range rows {
+		addIPv4(row.SourceIPv4)
+		addIPv4(row.DestIPv4)
+		addIPv6(row.SourceIPv6Network, row.SourceIPv6Host)
+		addIPv6(row.DestIPv6Network, row.DestIPv6Host)
+	}
+
+	addrs := make([]netip.Addr, 0, len(seen))
+	for addr := range seen {
+		addrs = append(addrs, addr)
+	}
+	slices.SortFunc(addrs, netip.Addr.Compare)
+
+	return addrs, epochs, nil
+}
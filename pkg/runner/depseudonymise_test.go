@@ -0,0 +1,132 @@
+package runner
+
+import (
+	"bytes"
+	"errors"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+func TestDepseudonymise(t *testing.T) {
+	epoch := time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		name  string
+		salt  string
+		epoch time.Time
+	}{
+		{name: "no rotation", salt: "test-salt"},
+		{name: "epoch", salt: cryptopanEpochSalt("test-salt", epoch), epoch: epoch},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cpn, err := createCryptopan("test-key", tc.salt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d, err := NewDepseudonymiser("test-key", "test-salt", tc.epoch)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, s := range []string{"198.51.100.20", "0.0.0.0", "255.255.255.255", "2001:db8:1122:3344:5566:7788:99aa:bbcc", "::1"} {
+				addr := netip.MustParseAddr(s)
+				pseudonym, ok := netip.AddrFromSlice(cpn.Anonymize(addr.AsSlice()))
+				if !ok {
+					t.Fatalf("unable to pseudonymise %s", addr)
+				}
+				pseudonym = pseudonym.Unmap()
+
+				if got := d.Depseudonymise(pseudonym); got != addr {
+					t.Fatalf("Depseudonymise(%s) = %s, want %s", pseudonym, got, addr)
+				}
+			}
+		})
+	}
+
+	if _, err := NewDepseudonymiser("", "test-salt", time.Time{}); err == nil {
+		t.Fatal("NewDepseudonymiser with an empty key succeeded")
+	}
+}
+
+func TestSessionFileAddresses(t *testing.T) {
+	v4 := netip.MustParseAddr("198.51.100.20")
+	v4Dest := netip.MustParseAddr("192.0.2.53")
+	v6 := netip.MustParseAddr("2001:db8::20")
+
+	v4Int, err := ipBytesToInt(v4.AsSlice())
+	if err != nil {
+		t.Fatal(err)
+	}
+	i32V4 := int32(v4Int) // #nosec G115 -- test value
+	v4DestInt, err := ipBytesToInt(v4Dest.AsSlice())
+	if err != nil {
+		t.Fatal(err)
+	}
+	i32V4Dest := int32(v4DestInt) // #nosec G115 -- test value
+	v6Network, v6Host, err := ip6BytesToInt(v6.AsSlice())
+	if err != nil {
+		t.Fatal(err)
+	}
+	i64V6Network, i64V6Host := int64(v6Network), int64(v6Host) // #nosec G115 -- test value
+
+	var buf bytes.Buffer
+	w := parquet.NewGenericWriter[sessionData](&buf, sessionDataSchema,
+		parquet.KeyValueMetadata(sessionCryptopanEpochMetadataKey, "2026-10-16T00:00:00Z"),
+		parquet.KeyValueMetadata(sessionPseudonymisationModeMetadataKey, PseudonymisationModeCryptopan))
+	rows := []sessionData{
+		{SourceIPv4: &i32V4, DestIPv4: &i32V4Dest},
+		{SourceIPv4: &i32V4, DestIPv4: &i32V4Dest},
+		{SourceIPv6Network: &i64V6Network, SourceIPv6Host: &i64V6Host},
+	}
+	if _, err := w.Write(rows); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	addrs, epochs, err := SessionFileAddresses(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []netip.Addr{v4Dest, v4, v6}; !slices.Equal(addrs, want) {
+		t.Fatalf("addresses = %v, want %v", addrs, want)
+	}
+	if len(epochs) != 1 || !epochs[0].Equal(time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("epochs = %v", epochs)
+	}
+}
+
+func TestSessionFileAddressesNotCryptopan(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		options []parquet.WriterOption
+	}{
+		{name: "no mode metadata"},
+		{
+			name:    "truncate",
+			options: []parquet.WriterOption{parquet.KeyValueMetadata(sessionPseudonymisationModeMetadataKey, PseudonymisationModeTruncate)},
+		},
+		{
+			name:    "hmac",
+			options: []parquet.WriterOption{parquet.KeyValueMetadata(sessionPseudonymisationModeMetadataKey, PseudonymisationModeHMAC)},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := parquet.NewGenericWriter[sessionData](&buf, append([]parquet.WriterOption{sessionDataSchema}, tc.options...)...)
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			_, _, err := SessionFileAddresses(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if !errors.Is(err, ErrNotCryptopanSession) {
+				t.Fatalf("SessionFileAddresses() error = %v, want ErrNotCryptopanSession", err)
+			}
+		})
+	}
+}
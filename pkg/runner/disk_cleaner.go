@@ -27,39 +27,48 @@ timerLoop:
 	for {
 		select {
 		case <-ticker.C():
-			dirEntries, err := edm.deps.FileSystem.ReadDir(sentDir)
+			edm.cleanSentDir(sentDir, true)
+		case <-ctx.Done():
+			break timerLoop
+		}
+	}
+	edm.log.Info("exiting diskCleaner loop")
+}
+
+// cleanSentDir removes expired histogram files from dir. With partitions set
+// the identity partition directories in dir are cleaned as well.
+func (edm *DnstapMinimiser) cleanSentDir(dir string, partitions bool) {
+	dirEntries, err := edm.deps.FileSystem.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			// The directory has not been created yet, this is OK
+			return
+		}
+		edm.log.Error("histogramSender: unable to read sent dir", "error", err)
+		return
+	}
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() {
+			if partitions && strings.HasPrefix(dirEntry.Name(), identityPartitionPrefix) {
+				edm.cleanSentDir(filepath.Join(dir, dirEntry.Name()), false)
+			}
+			continue
+		}
+		if strings.HasPrefix(dirEntry.Name(), histogramFileBase+"-") && strings.HasSuffix(dirEntry.Name(), parquetFileSuffix) {
+			fileInfo, err := dirEntry.Info()
 			if err != nil {
-				if errors.Is(err, fs.ErrNotExist) {
-					// The directory has not been created yet, this is OK
-					continue
-				}
-				edm.log.Error("histogramSender: unable to read sent dir", "error", err)
+				edm.log.Error("diskCleaner: unable to get fileInfo for filename", "error", err, "filename", dirEntry.Name())
 				continue
 			}
-			for _, dirEntry := range dirEntries {
-				if dirEntry.IsDir() {
-					continue
-				}
-				if strings.HasPrefix(dirEntry.Name(), histogramFileBase+"-") && strings.HasSuffix(dirEntry.Name(), parquetFileSuffix) {
-					fileInfo, err := dirEntry.Info()
-					if err != nil {
-						edm.log.Error("diskCleaner: unable to get fileInfo for filename", "error", err, "filename", dirEntry.Name())
-						continue
-					}
 
-					if sentHistogramExpired(fileInfo.ModTime(), edm.deps.Clock.Now()) {
-						absPath := filepath.Join(sentDir, dirEntry.Name())
-						edm.log.Info("diskCleaner: removing file", "filename", absPath)
-						err = edm.deps.FileSystem.Remove(absPath)
-						if err != nil {
-							edm.log.Error("diskCleaner: unable to remove sent histogram file", "error", err)
-						}
-					}
+			if sentHistogramExpired(fileInfo.ModTime(), edm.deps.Clock.Now()) {
+				absPath := filepath.Join(dir, dirEntry.Name())
+				edm.log.Info("diskCleaner: removing file", "filename", absPath)
+				err = edm.deps.FileSystem.Remove(absPath)
+				if err != nil {
+					edm.log.Error("diskCleaner: unable to remove sent histogram file", "error", err)
 				}
 			}
-		case <-ctx.Done():
-			break timerLoop
 		}
 	}
-	edm.log.Info("exiting diskCleaner loop")
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"io"
+	"io/fs"
 	"log/slog"
 	"os"
 	"path/filepath"
@@ -109,3 +110,33 @@ func TestMonitorAndDiskCleaner(t *testing.T) {
 		}
 	})
 }
+
+func TestCleanSentDirIdentityPartitions(t *testing.T) {
+	edm := newTestDnstapMinimiser(t, defaultTC)
+	sentDir := t.TempDir()
+	name := "dns_histogram-2026-05-28T12-00-00Z_2026-05-28T12-01-00Z.parquet"
+	oldTime := time.Now().Add(-sentHistogramRetention - time.Hour)
+
+	partitionFile := filepath.Join(identityPartitionDir(sentDir, "resolver-1"), name)
+	otherFile := filepath.Join(sentDir, "other", name)
+	for _, file := range []string{partitionFile, otherFile} {
+		if err := os.MkdirAll(filepath.Dir(file), 0o750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte("x"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, oldTime, oldTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	edm.cleanSentDir(sentDir, true)
+
+	if _, err := os.Stat(partitionFile); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expired file in identity partition was not removed: %v", err)
+	}
+	if _, err := os.Stat(otherFile); err != nil {
+		t.Fatalf("file outside an identity partition was touched: %s", err)
+	}
+}
@@ -10,52 +10,80 @@ import (
 	"log"
 	"log/slog"
 	"net"
+	"path/filepath"
 	"sync"
 	"syscall"
 	"time"
 
 	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
-// setupDnstapInput constructs the dnstap socket input selected by startConf.
-// Exactly one of InputUnix/InputTCP/InputTLS must be set: none returns
-// errNoInputConfigured and more than one returns errMultipleInputsConfigured,
-// so the contract holds even for a [ConfigProvider] that bypasses
-// [Config.Validate]. On TLS, InputTLSClientCAFile (when set) enables
-// required-and-verify client mTLS via tls.RequireAndVerifyClientCert.
+// setupDnstapInput constructs every dnstap socket input configured in
+// startConf (see [Config.dnstapInputs]) and combines them into one input
+// feeding a shared output channel. No configured input returns
+// errNoInputConfigured, so the contract holds even for a [ConfigProvider]
+// that bypasses [Config.Validate]. If any listener fails to start the ones
+// already created are closed again before the error is returned.
+//
+// When startConf.ReplayFiles is set no listener is created, the capture
+// files are read instead.
 func (edm *DnstapMinimiser) setupDnstapInput(logger *slog.Logger, startConf Config) (dnstapInput, error) {
-	configuredInputs := 0
-	for _, configured := range []bool{startConf.InputUnix != "", startConf.InputTCP != "", startConf.InputTLS != ""} {
-		if configured {
-			configuredInputs++
-		}
+	if len(startConf.ReplayFiles) > 0 {
+		logger.Info("replaying dnstap capture files", "files", startConf.ReplayFiles)
+		dti := newFileDnstapInput(edm.deps.FileSystem, startConf.ReplayFiles)
+		dti.SetMetrics(edm.newDnstapInputMetrics("replay"))
+		dti.SetLogger(log.Default())
+		return dti, nil
 	}
-	if configuredInputs > 1 {
-		return nil, errMultipleInputsConfigured
+
+	inputConfs := startConf.dnstapInputs()
+	if len(inputConfs) == 0 {
+		return nil, errNoInputConfigured
 	}
 
-	var dti dnstapInput
-	switch {
-	case startConf.InputUnix != "":
-		logger.Info("creating dnstap unix socket", "socket", startConf.InputUnix)
-		if err := edm.deps.FileSystem.Remove(startConf.InputUnix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+	multi := &multiDnstapInput{}
+	for _, inputConf := range inputConfs {
+		dti, err := edm.setupDnstapListener(logger, inputConf)
+		if err != nil {
+			if closeErr := multi.Close(); closeErr != nil && !errors.Is(closeErr, net.ErrClosed) {
+				logger.Error("unable to close dnstap inputs after setup failure", "error", closeErr)
+			}
+			return nil, fmt.Errorf("%s: %w", inputConf.label(), err)
+		}
+		dti.SetMetrics(edm.newDnstapInputMetrics(inputConf.label()))
+		multi.inputs = append(multi.inputs, dti)
+	}
+	multi.SetTimeout(time.Second * 5)
+	multi.SetLogger(log.Default())
+	return multi, nil
+}
+
+// setupDnstapListener constructs the dnstap socket input for a single
+// listener. On TLS, TLSClientCAFile (when set) enables required-and-verify
+// client mTLS via tls.RequireAndVerifyClientCert.
+func (edm *DnstapMinimiser) setupDnstapListener(logger *slog.Logger, inputConf InputConfig) (dnstapInput, error) {
+	switch inputConf.Type {
+	case InputTypeUnix:
+		logger.Info("creating dnstap unix socket", "socket", inputConf.Address, "input", inputConf.label())
+		if err := edm.deps.FileSystem.Remove(inputConf.Address); err != nil && !errors.Is(err, fs.ErrNotExist) {
 			return nil, fmt.Errorf("unable to remove stale dnstap unix socket: %w", err)
 		}
-		l, err := edm.deps.ListenerFactory.Listen("unix", startConf.InputUnix)
+		l, err := edm.deps.ListenerFactory.Listen("unix", inputConf.Address)
 		if err != nil {
 			return nil, fmt.Errorf("unable to create dnstap unix socket: %w", err)
 		}
-		dti = edm.deps.DnstapInputFactory.NewFrameStreamSockInput(l)
-	case startConf.InputTCP != "":
-		logger.Info("creating plaintext dnstap TCP socket", "socket", startConf.InputTCP)
-		l, err := edm.deps.ListenerFactory.Listen("tcp", startConf.InputTCP)
+		return edm.deps.DnstapInputFactory.NewFrameStreamSockInput(l), nil
+	case InputTypeTCP:
+		logger.Info("creating plaintext dnstap TCP socket", "socket", inputConf.Address, "input", inputConf.label())
+		l, err := edm.deps.ListenerFactory.Listen("tcp", inputConf.Address)
 		if err != nil {
 			return nil, fmt.Errorf("unable to create plaintext dnstap TCP socket: %w", err)
 		}
-		dti = edm.deps.DnstapInputFactory.NewFrameStreamSockInput(l)
-	case startConf.InputTLS != "":
-		logger.Info("creating encrypted dnstap TLS socket", "socket", startConf.InputTLS)
-		dnstapInputCert, err := edm.deps.KeyMaterialLoader.LoadKeyPair(startConf.InputTLSCertFile, startConf.InputTLSKeyFile)
+		return edm.deps.DnstapInputFactory.NewFrameStreamSockInput(l), nil
+	case InputTypeTLS:
+		logger.Info("creating encrypted dnstap TLS socket", "socket", inputConf.Address, "input", inputConf.label())
+		dnstapInputCert, err := edm.deps.KeyMaterialLoader.LoadKeyPair(inputConf.TLSCertFile, inputConf.TLSKeyFile)
 		if err != nil {
 			return nil, fmt.Errorf("unable to load x509 dnstap listener cert: %w", err)
 		}
@@ -65,27 +93,97 @@ func (edm *DnstapMinimiser) setupDnstapInput(logger *slog.Logger, startConf Conf
 		}
 
 		// Enable client mTLS (client cert auth) if a CA file was passed.
-		if startConf.InputTLSClientCAFile != "" {
-			logger.Info("dnstap socket requiring valid client certs", "ca-file", startConf.InputTLSClientCAFile)
-			inputTLSClientCACertPool, err := edm.deps.KeyMaterialLoader.LoadCertPool(startConf.InputTLSClientCAFile)
+		if inputConf.TLSClientCAFile != "" {
+			logger.Info("dnstap socket requiring valid client certs", "ca-file", inputConf.TLSClientCAFile, "input", inputConf.label())
+			inputTLSClientCACertPool, err := edm.deps.KeyMaterialLoader.LoadCertPool(inputConf.TLSClientCAFile)
 			if err != nil {
-				return nil, fmt.Errorf("failed to create CA cert pool for '-input-tls-client-ca-file': %w", err)
+				return nil, fmt.Errorf("failed to create CA cert pool for '%stls-client-ca-file': %w", inputConf.keyPrefix, err)
 			}
 			dnstapTLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
 			dnstapTLSConfig.ClientCAs = inputTLSClientCACertPool
 		}
 
-		l, err := edm.deps.ListenerFactory.ListenTLS("tcp", startConf.InputTLS, dnstapTLSConfig)
+		l, err := edm.deps.ListenerFactory.ListenTLS("tcp", inputConf.Address, dnstapTLSConfig)
 		if err != nil {
 			return nil, fmt.Errorf("unable to create TCP listener: %w", err)
 		}
-		dti = edm.deps.DnstapInputFactory.NewFrameStreamSockInput(l)
+		return edm.deps.DnstapInputFactory.NewFrameStreamSockInput(l), nil
 	default:
-		return nil, errNoInputConfigured
+		return nil, fmt.Errorf("unsupported dnstap input type %q", inputConf.Type)
+	}
+}
+
+// dnstapInputMetrics holds the per-listener Prometheus metrics of a dnstap
+// input. The zero value disables metrics.
+type dnstapInputMetrics struct {
+	frames            prometheus.Counter
+	connections       prometheus.Counter
+	activeConnections prometheus.Gauge
+}
+
+func (edm *DnstapMinimiser) newDnstapInputMetrics(label string) dnstapInputMetrics {
+	return dnstapInputMetrics{
+		frames:            edm.promDnstapInputFrames.WithLabelValues(label),
+		connections:       edm.promDnstapInputConnections.WithLabelValues(label),
+		activeConnections: edm.promDnstapInputActiveConnections.WithLabelValues(label),
+	}
+}
+
+// multiDnstapInput runs several dnstap inputs as one, all writing to the
+// same output channel.
+type multiDnstapInput struct {
+	inputs []dnstapInput
+}
+
+func (multi *multiDnstapInput) SetTimeout(timeout time.Duration) {
+	for _, input := range multi.inputs {
+		input.SetTimeout(timeout)
+	}
+}
+
+func (multi *multiDnstapInput) SetLogger(logger dnstap.Logger) {
+	for _, input := range multi.inputs {
+		input.SetLogger(logger)
+	}
+}
+
+// SetMetrics is a no-op, metrics are set on each wrapped input since they
+// are labelled per listener.
+func (multi *multiDnstapInput) SetMetrics(dnstapInputMetrics) {}
+
+// Close closes every wrapped input, returning their errors joined.
+func (multi *multiDnstapInput) Close() error {
+	var errs []error
+	for _, input := range multi.inputs {
+		if err := input.Close(); err != nil {
+			errs = append(errs, err)
+		}
 	}
-	dti.SetTimeout(time.Second * 5)
-	dti.SetLogger(log.Default())
-	return dti, nil
+	return errors.Join(errs...)
+}
+
+// ReadInto runs ReadInto of every wrapped input concurrently until ctx is
+// cancelled. The first input to fail cancels the rest, since Run treats a
+// failed input as fatal, and ReadInto returns once all of them have exited.
+func (multi *multiDnstapInput) ReadInto(ctx context.Context, output chan<- []byte) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(multi.inputs))
+	for i, input := range multi.inputs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := input.ReadInto(ctx, output); err != nil {
+				errs[i] = err
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
 }
 
 // socketDnstapInput accepts framestream connections on a listener and pumps
@@ -100,6 +198,7 @@ type socketDnstapInput struct {
 	listener net.Listener
 	timeout  time.Duration
 	log      dnstap.Logger
+	metrics  dnstapInputMetrics
 
 	closeOnce sync.Once
 	closeErr  error
@@ -127,6 +226,10 @@ func (input *socketDnstapInput) SetLogger(logger dnstap.Logger) {
 	input.log = logger
 }
 
+func (input *socketDnstapInput) SetMetrics(metrics dnstapInputMetrics) {
+	input.metrics = metrics
+}
+
 // Close closes the listener and every tracked connection. It is idempotent
 // and safe to call concurrently with ReadInto.
 func (input *socketDnstapInput) Close() error {
@@ -255,11 +358,18 @@ func (input *socketDnstapInput) trackConn(conn net.Conn) {
 	input.connMutex.Lock()
 	defer input.connMutex.Unlock()
 	input.conns[conn] = struct{}{}
+	if input.metrics.connections != nil {
+		input.metrics.connections.Inc()
+		input.metrics.activeConnections.Inc()
+	}
 }
 
 func (input *socketDnstapInput) untrackConn(conn net.Conn) {
 	input.connMutex.Lock()
 	defer input.connMutex.Unlock()
+	if _, ok := input.conns[conn]; ok && input.metrics.activeConnections != nil {
+		input.metrics.activeConnections.Dec()
+	}
 	delete(input.conns, conn)
 }
 
@@ -284,6 +394,107 @@ func (input *socketDnstapInput) readConn(ctx context.Context, conn net.Conn, out
 
 		frame := make([]byte, n)
 		copy(frame, buf[:n])
+		if input.metrics.frames != nil {
+			input.metrics.frames.Inc()
+		}
+		select {
+		case output <- frame:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// fileDnstapInput reads dnstap frames from framestream capture files, as
+// written by "dnstap -w" or fstrm_capture, one file after the other.
+type fileDnstapInput struct {
+	fs      fileSystem
+	files   []string
+	log     dnstap.Logger
+	metrics dnstapInputMetrics
+}
+
+func newFileDnstapInput(fs fileSystem, files []string) *fileDnstapInput {
+	return &fileDnstapInput{
+		fs:    fs,
+		files: files,
+		log:   noOpDnstapLogger{},
+	}
+}
+
+// SetTimeout is a no-op, reads from a file do not time out.
+func (input *fileDnstapInput) SetTimeout(time.Duration) {}
+
+func (input *fileDnstapInput) SetLogger(logger dnstap.Logger) {
+	if logger == nil {
+		input.log = noOpDnstapLogger{}
+		return
+	}
+	input.log = logger
+}
+
+func (input *fileDnstapInput) SetMetrics(metrics dnstapInputMetrics) {
+	input.metrics = metrics
+}
+
+// Close is a no-op, ReadInto closes every file it opens before returning.
+func (input *fileDnstapInput) Close() error {
+	return nil
+}
+
+// ReadInto forwards the frames of every file to output in order. It returns
+// nil once all files have been read or ctx is cancelled, and stops at the
+// first file that cannot be opened or parsed.
+func (input *fileDnstapInput) ReadInto(ctx context.Context, output chan<- []byte) error {
+	for _, name := range input.files {
+		if err := input.readFile(ctx, name, output); err != nil {
+			return fmt.Errorf("replay file %q: %w", name, err)
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (input *fileDnstapInput) readFile(ctx context.Context, name string, output chan<- []byte) error {
+	f, err := input.fs.Open(filepath.Clean(name))
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			input.log.Printf("%s: close failed: %v", name, err)
+		}
+	}()
+
+	reader, err := dnstap.NewReader(f, &dnstap.ReaderOptions{})
+	if err != nil {
+		return fmt.Errorf("open framestream reader: %w", err)
+	}
+
+	input.log.Printf("%s: replaying dnstap frames", name)
+	buf := make([]byte, dnstap.MaxPayloadSize)
+	for {
+		n, err := reader.ReadFrame(buf)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			// A capture cut short, e.g. by the writer being killed,
+			// still holds usable frames before the partial one.
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				input.log.Printf("%s: file ends in a partial frame, skipping it", name)
+				return nil
+			}
+			return fmt.Errorf("read frame: %w", err)
+		}
+
+		frame := make([]byte, n)
+		copy(frame, buf[:n])
+		if input.metrics.frames != nil {
+			input.metrics.frames.Inc()
+		}
 		select {
 		case output <- frame:
 		case <-ctx.Done():
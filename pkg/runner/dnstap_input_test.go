@@ -9,6 +9,7 @@ import (
 	"log/slog"
 	"net"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -17,6 +18,8 @@ import (
 	"time"
 
 	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
 type testDnstapInputFactory struct {
@@ -152,6 +155,8 @@ func (input *testDnstapInput) SetTimeout(time.Duration) {}
 
 func (input *testDnstapInput) SetLogger(dnstap.Logger) {}
 
+func (input *testDnstapInput) SetMetrics(dnstapInputMetrics) {}
+
 func (input *testDnstapInput) Close() error {
 	input.signalDone()
 	return nil
@@ -188,12 +193,73 @@ func TestSetupDnstapInput(t *testing.T) {
 
 	t.Run("multiple inputs configured", func(t *testing.T) {
 		edm := newTestDnstapMinimiser(t, defaultTC)
+		var listened []string
+		var created []*testNetListener
+		edm.deps.FileSystem = faultingFileSystem{
+			fileSystem: edm.deps.FileSystem,
+			remove: func(string) error {
+				return fs.ErrNotExist
+			},
+		}
+		edm.deps.ListenerFactory = testListenerFactory{
+			listenerFactory: edm.deps.ListenerFactory,
+			listen: func(network, address string) (net.Listener, error) {
+				listened = append(listened, network+" "+address)
+				l := newTestNetListener(network, address)
+				created = append(created, l)
+				return l, nil
+			},
+		}
+		socketPath := filepath.Join(t.TempDir(), "dnstap.sock")
+		dti, err := edm.setupDnstapInput(discardLog, Config{
+			InputUnix: socketPath,
+			Inputs: []InputConfig{
+				{Type: InputTypeTCP, Address: "127.0.0.1:53535"},
+				{Name: "remote", Type: InputTypeTCP, Address: "127.0.0.1:53536"},
+			},
+		})
+		if err != nil {
+			t.Fatalf("setupDnstapInput: %v", err)
+		}
+		want := []string{"unix " + socketPath, "tcp 127.0.0.1:53535", "tcp 127.0.0.1:53536"}
+		if !slices.Equal(listened, want) {
+			t.Fatalf("listened = %q, want %q", listened, want)
+		}
+		if err := dti.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		for _, l := range created {
+			if !l.isClosed() {
+				t.Fatalf("listener %s not closed by Close", l.Addr())
+			}
+		}
+	})
+
+	t.Run("multiple inputs second fails", func(t *testing.T) {
+		edm := newTestDnstapMinimiser(t, defaultTC)
+		var first *testNetListener
+		edm.deps.ListenerFactory = testListenerFactory{
+			listenerFactory: edm.deps.ListenerFactory,
+			listen: func(network, address string) (net.Listener, error) {
+				if first != nil {
+					return nil, errInjected
+				}
+				first = newTestNetListener(network, address)
+				return first, nil
+			},
+		}
 		_, err := edm.setupDnstapInput(discardLog, Config{
-			InputUnix: filepath.Join(t.TempDir(), "dnstap.sock"),
-			InputTCP:  "127.0.0.1:0",
+			InputTCP: "127.0.0.1:53535",
+			Inputs:   []InputConfig{{Name: "second", Type: InputTypeTCP, Address: "127.0.0.1:53536"}},
 		})
-		if !errors.Is(err, errMultipleInputsConfigured) {
-			t.Fatalf("err = %v, want errMultipleInputsConfigured", err)
+		if !errors.Is(err, errInjected) {
+			t.Fatalf("err = %v, want errInjected", err)
+		}
+		if !strings.Contains(err.Error(), "second") {
+			t.Fatalf("err = %v, want failing input named", err)
+		}
+		if first == nil || !first.isClosed() {
+			t.Fatal("first listener was not closed after the second failed")
 		}
 	})
 
@@ -381,9 +447,20 @@ func TestSetupDnstapInput(t *testing.T) {
 			InputTLSKeyFile:      keyPath,
 			InputTLSClientCAFile: badCA,
 		})
-		if err == nil || !strings.Contains(err.Error(), "CA cert pool") {
+		if err == nil || !strings.Contains(err.Error(), "failed to create CA cert pool for '-input-tls-client-ca-file'") {
 			t.Fatalf("err = %v, want CA cert pool failure", err)
 		}
+
+		// An [[input]] table is named by its index and address.
+		_, err = edm.setupDnstapInput(discardLog, Config{
+			Inputs: []InputConfig{
+				{Type: InputTypeTCP, Address: "127.0.0.1:0"},
+				{Type: InputTypeTLS, Address: "127.0.0.1:0", TLSCertFile: certPath, TLSKeyFile: keyPath, TLSClientCAFile: badCA},
+			},
+		})
+		if err == nil || !strings.Contains(err.Error(), "tls:127.0.0.1:0: failed to create CA cert pool for 'input[1].tls-client-ca-file'") {
+			t.Fatalf("err = %v, want CA cert pool failure naming input[1]", err)
+		}
 	})
 
 	t.Run("tls listen error", func(t *testing.T) {
@@ -481,6 +558,105 @@ func TestSocketDnstapInputReadIntoRetriesTransientAcceptError(t *testing.T) {
 	}
 }
 
+func TestMultiDnstapInputReadIntoStopsAllOnError(t *testing.T) {
+	healthy := newBlockingTestDnstapInput()
+	failing := &testDnstapInput{err: errInjected}
+	multi := &multiDnstapInput{inputs: []dnstapInput{healthy, failing}}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- multi.ReadInto(t.Context(), make(chan []byte))
+	}()
+
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, errInjected) {
+			t.Fatalf("ReadInto err = %v, want errInjected", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ReadInto did not exit after one input failed")
+	}
+	select {
+	case <-healthy.done:
+	default:
+		t.Fatal("healthy input was not stopped after the other input failed")
+	}
+}
+
+func TestSocketDnstapInputMetrics(t *testing.T) {
+	edm := newTestDnstapMinimiser(t, defaultTC)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := newSocketDnstapInput(listener)
+	input.SetMetrics(edm.newDnstapInputMetrics("test"))
+
+	ctx, cancel := context.WithCancel(t.Context())
+	output := make(chan []byte, 1)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- input.ReadInto(ctx, output)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			t.Logf("close client connection: %s", err)
+		}
+	}()
+	writer, err := dnstap.NewWriter(conn, &dnstap.WriterOptions{Bidirectional: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.WriteFrame([]byte("frame")); err != nil {
+		t.Fatal(err)
+	}
+	// The framestream writer buffers frames until flushed.
+	if err := writer.(interface{ Flush() error }).Flush(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-output:
+	case <-time.After(2 * time.Second):
+		t.Fatal("frame was not forwarded")
+	}
+
+	if got := testMetricValue(t, edm.promDnstapInputFrames.WithLabelValues("test")); got != 1 {
+		t.Fatalf("frames = %v, want 1", got)
+	}
+	if got := testMetricValue(t, edm.promDnstapInputConnections.WithLabelValues("test")); got != 1 {
+		t.Fatalf("connections = %v, want 1", got)
+	}
+	if got := testMetricValue(t, edm.promDnstapInputActiveConnections.WithLabelValues("test")); got != 1 {
+		t.Fatalf("active connections = %v, want 1", got)
+	}
+
+	cancel()
+	if err := <-errCh; err != nil {
+		t.Fatalf("ReadInto err = %v, want nil", err)
+	}
+	if got := testMetricValue(t, edm.promDnstapInputActiveConnections.WithLabelValues("test")); got != 0 {
+		t.Fatalf("active connections after shutdown = %v, want 0", got)
+	}
+}
+
+// testMetricValue returns the current value of a counter or gauge.
+func testMetricValue(t *testing.T, metric prometheus.Metric) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := metric.Write(&m); err != nil {
+		t.Fatalf("write metric: %s", err)
+	}
+	if m.Counter != nil {
+		return m.GetCounter().GetValue()
+	}
+	return m.GetGauge().GetValue()
+}
+
 type timeoutNetError struct{}
 
 func (timeoutNetError) Error() string   { return "i/o timeout" }
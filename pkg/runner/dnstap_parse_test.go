@@ -23,7 +23,7 @@ func TestParsePacketAddressFormattingBranches(t *testing.T) {
 		dt := testDnstapMessage(t, dnstap.Message_CLIENT_RESPONSE, dnstap.SocketFamily_INET, packed)
 		dt.Message.QueryPort = nil
 		dt.Message.ResponsePort = nil
-		if msg, _ := edm.parsePacket(dt, false); msg == nil {
+		if msg, _, _ := edm.parsePacket(dt, false); msg == nil {
 			t.Fatal("parsePacket returned nil msg")
 		}
 	})
@@ -34,7 +34,7 @@ func TestParsePacketAddressFormattingBranches(t *testing.T) {
 		dt.Message.ResponseAddress = nil
 		dt.Message.QueryPort = nil
 		dt.Message.ResponsePort = nil
-		if msg, _ := edm.parsePacket(dt, false); msg == nil {
+		if msg, _, _ := edm.parsePacket(dt, false); msg == nil {
 			t.Fatal("parsePacket returned nil msg")
 		}
 	})
@@ -47,7 +47,7 @@ func TestParsePacketAddressFormattingBranches(t *testing.T) {
 				ResponseTimeNsec: ptr(uint32(0)),
 			},
 		}
-		badMsg, _ := edm.parsePacket(dt, false)
+		badMsg, _, _ := edm.parsePacket(dt, false)
 		if badMsg != nil {
 			t.Fatal("bad response packet returned non-nil message")
 		}
@@ -82,10 +82,13 @@ func TestParsePacketMissingTimestamps(t *testing.T) {
 
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			msg, got := edm.parsePacket(tc.dt, tc.isQuery)
+			msg, got, ok := edm.parsePacket(tc.dt, tc.isQuery)
 			if msg == nil {
 				t.Fatal("parsePacket returned nil DNS message")
 			}
+			if ok {
+				t.Fatal("missing timestamp reported as valid")
+			}
 			if !got.Equal(epoch) {
 				t.Fatalf("timestamp have: %s, want: %s", got, epoch)
 			}
@@ -95,7 +98,10 @@ func TestParsePacketMissingTimestamps(t *testing.T) {
 
 func TestParsePacketMissingMessage(t *testing.T) {
 	edm := discardEDM()
-	msg, got := edm.parsePacket(&dnstap.Dnstap{}, false)
+	msg, got, ok := edm.parsePacket(&dnstap.Dnstap{}, false)
+	if ok {
+		t.Fatal("timestamp of a missing message reported as valid")
+	}
 	if msg != nil {
 		t.Fatalf("parsePacket should return nil DNS message when dnstap message is missing, have: %#v", msg)
 	}
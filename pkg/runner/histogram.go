@@ -6,7 +6,10 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"maps"
+	"net/url"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -29,6 +32,8 @@ func (dsb *edmStatusBits) String() string {
 		return "well-known-exact"
 	case edmStatusWellKnownWildcard:
 		return "well-known-wildcard"
+	case edmStatusSuppressedMerged:
+		return "suppressed-merged"
 	}
 
 	var flags []string
@@ -47,6 +52,7 @@ func (dsb *edmStatusBits) set(flag edmStatusBits) {
 const (
 	edmStatusWellKnownExact    edmStatusBits = 1 << iota // 1
 	edmStatusWellKnownWildcard                           // 2
+	edmStatusSuppressedMerged                            // 4
 
 	// Always leave max at the end to signal unused bits
 	edmStatusMax
@@ -60,6 +66,34 @@ const (
 	parquetFileSuffix = ".parquet"
 )
 
+// histogramIdentityMetadataKey is the parquet key/value metadata key holding
+// the dnstap identity of a histogram file partitioned per identity.
+const histogramIdentityMetadataKey = "dnstap_identity"
+
+// Every histogram file holds the version of the histogramData schema in its
+// parquet key/value metadata so the aggregate receiver can tell the columns
+// apart. Files without the key are version 1. Bump the version whenever
+// columns are added, removed or change meaning.
+//
+// Versions:
+//   - 1: A, AAAA, MX and NS type counters and NOERROR, NXDOMAIN and
+//     SERVFAIL rcode counters
+//   - 2: HTTPS, SVCB, TXT, PTR, CNAME, SOA, DS, DNSKEY and ANY type
+//     counters and REFUSED and FORMERR rcode counters
+//   - 3: response size and latency distribution buckets
+//   - 4: transport protocol counters
+//   - 5: DNSSEC and EDNS signal counters
+//   - 6: per-TLD rows of domains below histogram-min-clients, marked by
+//     the suppressed-merged status bit
+//   - 7: counters optionally noised, described by the
+//     edm_histogram_noise_* metadata
+//   - 8: merged per-TLD rows hold their TLD in merged_tld, with the
+//     labels unset
+const (
+	histogramSchemaVersionMetadataKey = "edm_histogram_schema_version"
+	histogramSchemaVersion            = "8"
+)
+
 // Histogram struct implementing description at https://github.com/dnstapir/datasets/blob/main/HistogramReport.md
 type histogramData struct {
 	StartTime int64 `parquet:"start_time,timestamp(microsecond)"`
@@ -69,13 +103,70 @@ type histogramData struct {
 	AAAACount       uint64 `parquet:"aaaa_count"`
 	MXCount         uint64 `parquet:"mx_count"`
 	NSCount         uint64 `parquet:"ns_count"`
+	HTTPSCount      uint64 `parquet:"https_count"`
+	SVCBCount       uint64 `parquet:"svcb_count"`
+	TXTCount        uint64 `parquet:"txt_count"`
+	PTRCount        uint64 `parquet:"ptr_count"`
+	CNAMECount      uint64 `parquet:"cname_count"`
+	SOACount        uint64 `parquet:"soa_count"`
+	DSCount         uint64 `parquet:"ds_count"`
+	DNSKEYCount     uint64 `parquet:"dnskey_count"`
+	ANYCount        uint64 `parquet:"any_count"`
 	OtherTypeCount  uint64 `parquet:"other_type_count"`
 	NonINCount      uint64 `parquet:"non_in_count"`
 	OKCount         uint64 `parquet:"ok_count"`
 	NXCount         uint64 `parquet:"nx_count"`
 	FailCount       uint64 `parquet:"fail_count"`
+	RefusedCount    uint64 `parquet:"refused_count"`
+	FormErrCount    uint64 `parquet:"formerr_count"`
 	OtherRcodeCount uint64 `parquet:"other_rcode_count"`
-	EDMStatusBits   uint64 `parquet:"edm_status_bits"`
+	// The number of query and response type dnstap messages counted, the
+	// rcode counters above only include responses
+	QueryCount    uint64 `parquet:"query_count"`
+	ResponseCount uint64 `parquet:"response_count"`
+	EDMStatusBits uint64 `parquet:"edm_status_bits"`
+
+	// The number of messages per transport the DNS message was sent
+	// over, other_protocol_count counts messages without a known
+	// transport
+	UDPCount           uint64 `parquet:"udp_count"`
+	TCPCount           uint64 `parquet:"tcp_count"`
+	DOTCount           uint64 `parquet:"dot_count"`
+	DOHCount           uint64 `parquet:"doh_count"`
+	DOQCount           uint64 `parquet:"doq_count"`
+	DNSCryptUDPCount   uint64 `parquet:"dnscrypt_udp_count"`
+	DNSCryptTCPCount   uint64 `parquet:"dnscrypt_tcp_count"`
+	OtherProtocolCount uint64 `parquet:"other_protocol_count"`
+
+	// DNSSEC and EDNS signals: responses with the AD and TC bits set,
+	// messages with the DO and CD bits set (copied from the query into
+	// the response) and responses carrying an EDNS Client Subnet option
+	ADCount  uint64 `parquet:"ad_count"`
+	TCCount  uint64 `parquet:"tc_count"`
+	DOCount  uint64 `parquet:"do_count"`
+	CDCount  uint64 `parquet:"cd_count"`
+	ECSCount uint64 `parquet:"ecs_count"`
+
+	// Distribution of the size in bytes of the DNS response messages,
+	// each bucket counts the responses larger than the previous bucket
+	ResponseSizeLE64Count   uint64 `parquet:"response_size_le_64_count"`
+	ResponseSizeLE128Count  uint64 `parquet:"response_size_le_128_count"`
+	ResponseSizeLE256Count  uint64 `parquet:"response_size_le_256_count"`
+	ResponseSizeLE512Count  uint64 `parquet:"response_size_le_512_count"`
+	ResponseSizeLE1232Count uint64 `parquet:"response_size_le_1232_count"`
+	ResponseSizeLE4096Count uint64 `parquet:"response_size_le_4096_count"`
+	ResponseSizeGT4096Count uint64 `parquet:"response_size_gt_4096_count"`
+	// Distribution of the time from query to response for responses
+	// where the dnstap message holds both timestamps, bucketed like the
+	// response sizes
+	LatencyLE1msCount   uint64 `parquet:"latency_le_1ms_count"`
+	LatencyLE10msCount  uint64 `parquet:"latency_le_10ms_count"`
+	LatencyLE50msCount  uint64 `parquet:"latency_le_50ms_count"`
+	LatencyLE100msCount uint64 `parquet:"latency_le_100ms_count"`
+	LatencyLE500msCount uint64 `parquet:"latency_le_500ms_count"`
+	LatencyLE1sCount    uint64 `parquet:"latency_le_1s_count"`
+	LatencyGT1sCount    uint64 `parquet:"latency_gt_1s_count"`
+
 	// The hll.Hll structs are not expected to be included in the output
 	// parquet file, and thus do not need to be exported
 	v4ClientHLL hll.Hll
@@ -90,6 +181,107 @@ type histogramData struct {
 	// contain the probabilistic HLL bytes
 	V4ClientCountHLLBytes []byte `parquet:"v4client_count_hll,optional"`
 	V6ClientCountHLLBytes []byte `parquet:"v6client_count_hll,optional"`
+
+	// The TLD of a row merging the domains below histogram-min-clients.
+	// The labels of such a row are left unset so it can not be mistaken
+	// for a row of the TLD itself.
+	MergedTLD *string `parquet:"merged_tld"`
+}
+
+// addCounters adds the query and response counters of other to hd.
+func (hd *histogramData) addCounters(other *histogramData) {
+	hd.OKCount += other.OKCount
+	hd.NXCount += other.NXCount
+	hd.FailCount += other.FailCount
+	hd.RefusedCount += other.RefusedCount
+	hd.FormErrCount += other.FormErrCount
+	hd.ACount += other.ACount
+	hd.AAAACount += other.AAAACount
+	hd.MXCount += other.MXCount
+	hd.NSCount += other.NSCount
+	hd.HTTPSCount += other.HTTPSCount
+	hd.SVCBCount += other.SVCBCount
+	hd.TXTCount += other.TXTCount
+	hd.PTRCount += other.PTRCount
+	hd.CNAMECount += other.CNAMECount
+	hd.SOACount += other.SOACount
+	hd.DSCount += other.DSCount
+	hd.DNSKEYCount += other.DNSKEYCount
+	hd.ANYCount += other.ANYCount
+	hd.OtherTypeCount += other.OtherTypeCount
+	hd.OtherRcodeCount += other.OtherRcodeCount
+	hd.QueryCount += other.QueryCount
+	hd.ResponseCount += other.ResponseCount
+	hd.NonINCount += other.NonINCount
+	hd.UDPCount += other.UDPCount
+	hd.TCPCount += other.TCPCount
+	hd.DOTCount += other.DOTCount
+	hd.DOHCount += other.DOHCount
+	hd.DOQCount += other.DOQCount
+	hd.DNSCryptUDPCount += other.DNSCryptUDPCount
+	hd.DNSCryptTCPCount += other.DNSCryptTCPCount
+	hd.OtherProtocolCount += other.OtherProtocolCount
+	hd.ADCount += other.ADCount
+	hd.TCCount += other.TCCount
+	hd.DOCount += other.DOCount
+	hd.CDCount += other.CDCount
+	hd.ECSCount += other.ECSCount
+	hd.ResponseSizeLE64Count += other.ResponseSizeLE64Count
+	hd.ResponseSizeLE128Count += other.ResponseSizeLE128Count
+	hd.ResponseSizeLE256Count += other.ResponseSizeLE256Count
+	hd.ResponseSizeLE512Count += other.ResponseSizeLE512Count
+	hd.ResponseSizeLE1232Count += other.ResponseSizeLE1232Count
+	hd.ResponseSizeLE4096Count += other.ResponseSizeLE4096Count
+	hd.ResponseSizeGT4096Count += other.ResponseSizeGT4096Count
+	hd.LatencyLE1msCount += other.LatencyLE1msCount
+	hd.LatencyLE10msCount += other.LatencyLE10msCount
+	hd.LatencyLE50msCount += other.LatencyLE50msCount
+	hd.LatencyLE100msCount += other.LatencyLE100msCount
+	hd.LatencyLE500msCount += other.LatencyLE500msCount
+	hd.LatencyLE1sCount += other.LatencyLE1sCount
+	hd.LatencyGT1sCount += other.LatencyGT1sCount
+}
+
+// addResponseSize counts a DNS response message of size bytes in the
+// response size distribution.
+func (hd *histogramData) addResponseSize(size int) {
+	switch {
+	case size <= 64:
+		hd.ResponseSizeLE64Count++
+	case size <= 128:
+		hd.ResponseSizeLE128Count++
+	case size <= 256:
+		hd.ResponseSizeLE256Count++
+	case size <= 512:
+		hd.ResponseSizeLE512Count++
+	case size <= 1232:
+		hd.ResponseSizeLE1232Count++
+	case size <= 4096:
+		hd.ResponseSizeLE4096Count++
+	default:
+		hd.ResponseSizeGT4096Count++
+	}
+}
+
+// addLatency counts the time from query to response in the latency
+// distribution.
+func (hd *histogramData) addLatency(latency time.Duration) {
+	switch {
+	case latency <= time.Millisecond:
+		hd.LatencyLE1msCount++
+	case latency <= 10*time.Millisecond:
+		hd.LatencyLE10msCount++
+	case latency <= 50*time.Millisecond:
+		hd.LatencyLE50msCount++
+	case latency <= 100*time.Millisecond:
+		hd.LatencyLE100msCount++
+	case latency <= 500*time.Millisecond:
+		hd.LatencyLE500msCount++
+	case latency <= time.Second:
+		hd.LatencyLE1sCount++
+	default:
+		hd.LatencyGT1sCount++
+	}
 }
 
 func getHllDefaults(explicitThreshold int) hll.Settings {
@@ -104,6 +296,10 @@ func getHllDefaults(explicitThreshold int) hll.Settings {
 func (edm *DnstapMinimiser) createHistogramFile(prevWellKnownDomainsData *wellKnownDomainsData, labelLimit int, outboxDir string) (string, error) {
 	startTime := intervalStartFromTimes(prevWellKnownDomainsData.startTime, prevWellKnownDomainsData.rotationTime)
 
+	// Partitioned histograms are kept in one level of identity
+	// directories below the outbox, see histogramSender.
+	outboxDir = identityPartitionDir(outboxDir, prevWellKnownDomainsData.identity)
+
 	absoluteTmpFileName, absoluteFileName := buildParquetFilenames(outboxDir, histogramFileBase, startTime, prevWellKnownDomainsData.rotationTime)
 
 	absoluteTmpFileName = filepath.Clean(absoluteTmpFileName)
@@ -135,8 +331,6 @@ func (edm *DnstapMinimiser) histogramWriter(labelLimit int, outboxDir string, wg
 func (edm *DnstapMinimiser) histogramSender(ctx context.Context, outboxDir string, sentDir string, wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	backoffDuration := edm.deps.HistogramSenderBackoff
-
 	// We will scan the outbox directory each tick for histogram parquet
 	// files to send
 	ticker := edm.deps.Clock.NewTicker(edm.deps.HistogramSenderInterval)
@@ -157,56 +351,8 @@ timerLoop:
 			if conf.DisableHistogramSender {
 				continue
 			}
-			dirEntries, err := edm.deps.FileSystem.ReadDir(outboxDir)
-			if err != nil {
-				if errors.Is(err, fs.ErrNotExist) {
-					// The directory has not been created yet, this is OK
-					continue
-				}
-				edm.log.Error("histogramSender: unable to read outbox dir", "error", err)
-				continue
-			}
-			for _, dirEntry := range dirEntries {
-				if dirEntry.IsDir() {
-					continue
-				}
-				if strings.HasPrefix(dirEntry.Name(), histogramFileBase+"-") && strings.HasSuffix(dirEntry.Name(), parquetFileSuffix) {
-					startTS, stopTS, err := timestampsFromFilename(dirEntry.Name())
-					if err != nil {
-						edm.log.Error("histogramSender: unable to parse timestamps from histogram filename", "error", err)
-						continue
-					}
-					duration := stopTS.Sub(startTS)
-
-					absPath := filepath.Join(outboxDir, dirEntry.Name())
-					absPathSent := filepath.Join(sentDir, dirEntry.Name())
-
-					// Make a copy of the struct under lock
-					// so the network communication from
-					// send() does not block aggregSender
-					// management.
-					edm.aggregSenderMutex.RLock()
-					as := edm.aggregSender
-					edm.aggregSenderMutex.RUnlock()
-					if as == nil {
-						edm.log.Error("histogramSender: aggregate sender is not initialized")
-						continue
-					}
-					err = as.Send(ctx, absPath, startTS, duration)
-					if err != nil {
-						edm.log.Error("histogramSender: unable to send histogram file", "error", err, "backoff_duration", backoffDuration)
-						select {
-						case <-edm.deps.Clock.After(backoffDuration):
-						case <-ctx.Done():
-							break timerLoop
-						}
-						continue
-					}
-					err = edm.renameFile(absPath, absPathSent)
-					if err != nil {
-						edm.log.Error("histogramSender: unable to rename sent histogram file", "error", err)
-					}
-				}
+			if !edm.sendHistogramDir(ctx, outboxDir, sentDir, "") {
+				break timerLoop
 			}
 		case <-edm.reloadHistogramSenderConfigCh:
 			edm.log.Info("histogramSender: reloading config")
@@ -228,6 +374,80 @@ timerLoop:
 	edm.log.Info("histogramSender: exiting loop")
 }
 
+// sendHistogramDir sends the histogram files in dir and moves each sent file
+// to sentDir. identity is the dnstap identity of the files in dir, for the
+// top level outbox it is empty and the identity partition directories below
+// it are sent as well. It returns false if ctx was cancelled while backing
+// off after a failed send.
+func (edm *DnstapMinimiser) sendHistogramDir(ctx context.Context, dir string, sentDir string, identity string) bool {
+	dirEntries, err := edm.deps.FileSystem.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			// The directory has not been created yet, this is OK
+			return true
+		}
+		edm.log.Error("histogramSender: unable to read outbox dir", "error", err, "dir", dir)
+		return true
+	}
+
+	backoffDuration := edm.deps.HistogramSenderBackoff
+
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() {
+			if identity != "" || !strings.HasPrefix(dirEntry.Name(), identityPartitionPrefix) {
+				continue
+			}
+			partitionIdentity, err := url.PathUnescape(strings.TrimPrefix(dirEntry.Name(), identityPartitionPrefix))
+			if err != nil || partitionIdentity == "" {
+				edm.log.Error("histogramSender: unable to parse identity from partition dir name", "error", err, "dir", dirEntry.Name())
+				continue
+			}
+			if !edm.sendHistogramDir(ctx, filepath.Join(dir, dirEntry.Name()), filepath.Join(sentDir, dirEntry.Name()), partitionIdentity) {
+				return false
+			}
+			continue
+		}
+		if strings.HasPrefix(dirEntry.Name(), histogramFileBase+"-") && strings.HasSuffix(dirEntry.Name(), parquetFileSuffix) {
+			startTS, stopTS, err := timestampsFromFilename(dirEntry.Name())
+			if err != nil {
+				edm.log.Error("histogramSender: unable to parse timestamps from histogram filename", "error", err)
+				continue
+			}
+			duration := stopTS.Sub(startTS)
+
+			absPath := filepath.Join(dir, dirEntry.Name())
+			absPathSent := filepath.Join(sentDir, dirEntry.Name())
+
+			// Make a copy of the struct under lock
+			// so the network communication from
+			// send() does not block aggregSender
+			// management.
+			edm.aggregSenderMutex.RLock()
+			as := edm.aggregSender
+			edm.aggregSenderMutex.RUnlock()
+			if as == nil {
+				edm.log.Error("histogramSender: aggregate sender is not initialized")
+				continue
+			}
+			err = as.Send(ctx, absPath, startTS, duration, identity)
+			if err != nil {
+				edm.log.Error("histogramSender: unable to send histogram file", "error", err, "backoff_duration", backoffDuration)
+				select {
+				case <-edm.deps.Clock.After(backoffDuration):
+				case <-ctx.Done():
+					return false
+				}
+				continue
+			}
+			err = edm.renameFile(absPath, absPathSent)
+			if err != nil {
+				edm.log.Error("histogramSender: unable to rename sent histogram file", "error", err)
+			}
+		}
+	}
+	return true
+}
+
 // Unfortunately the hll library does not expose what format
 // the HLL is being stored in so figure things out manually.
 //
@@ -282,26 +502,35 @@ func (edm *DnstapMinimiser) writeHistogramParquet(output io.Writer, startTime ti
 	// for the GC to reclaim once no reader references it, matching the
 	// ignoredQuestions/ignoredClients atomic-reload policy.
 
-	snappyCodec := parquet.LookupCompressionCodec(format.Snappy)
-	parquetWriter := parquet.NewGenericWriter[histogramData](output, parquet.Compression(snappyCodec))
+	conf := edm.getConfig()
 
-	startTimeMicro := startTime.UnixMicro()
+	noise, err := newHistogramNoise(conf, nil)
+	if err != nil {
+		return fmt.Errorf("writeHistogramParquet: %w", err)
+	}
 
-	for index, hGramData := range prevWellKnownDomainsData.m {
-		domain, err := prevWellKnownDomainsData.dawgFinder.AtIndex(index)
-		if err != nil {
-			return fmt.Errorf("writeHistogramParquet: unable to find DAWG index %d: %w", index, err)
-		}
+	snappyCodec := parquet.LookupCompressionCodec(format.Snappy)
+	writerOptions := []parquet.WriterOption{
+		parquet.Compression(snappyCodec),
+		parquet.KeyValueMetadata(histogramSchemaVersionMetadataKey, histogramSchemaVersion),
+	}
+	if noise != nil {
+		writerOptions = append(writerOptions, noise.metadata()...)
+	}
+	// Record the identity in the file itself as well, so it is covered
+	// by the content digest of the signed upload.
+	if prevWellKnownDomainsData.identity != "" {
+		writerOptions = append(writerOptions, parquet.KeyValueMetadata(histogramIdentityMetadataKey, prevWellKnownDomainsData.identity))
+	}
+	parquetWriter := parquet.NewGenericWriter[histogramData](output, writerOptions...)
 
-		labels := dns.SplitDomainName(domain)
+	startTimeMicro := startTime.UnixMicro()
 
+	writeRow := func(hGramData *histogramData, labels []string) error {
 		// Setting the labels now when we are out of the hot path.
 		edm.setLabels(labels, labelLimit, &hGramData.dnsLabels)
 		hGramData.StartTime = startTimeMicro
 
-		hGramData.V4ClientCount = hGramData.v4ClientHLL.Cardinality()
-		hGramData.V6ClientCount = hGramData.v6ClientHLL.Cardinality()
-
 		v4HLLBytes := hGramData.v4ClientHLL.ToBytes()
 		v4HLLType, err := parseHllStorageType(v4HLLBytes)
 		if err != nil {
@@ -322,13 +551,82 @@ func (edm *DnstapMinimiser) writeHistogramParquet(output io.Writer, startTime ti
 			hGramData.V6ClientCountHLLBytes = v6HLLBytes
 		}
 
+		if noise != nil {
+			noise.apply(hGramData)
+		}
+
 		_, err = parquetWriter.Write([]histogramData{*hGramData})
 		if err != nil {
 			return fmt.Errorf("writeHistogramParquet: unable to call Write() on parquet writer: %w", err)
 		}
+		return nil
+	}
+
+	minClients := uint64(max(conf.HistogramMinClients, 0)) // #nosec G115 -- negative values are clamped to 0
+	mergeSuppressed := conf.HistogramSuppressedRows == HistogramSuppressedRowsMergeTLD
+
+	// Domains seen from fewer than histogram-min-clients clients are
+	// left out, or counted together per TLD.
+	suppressed := 0
+	otherRows := map[string]*histogramData{}
+
+	for index, hGramData := range prevWellKnownDomainsData.m {
+		domain, err := prevWellKnownDomainsData.dawgFinder.AtIndex(index)
+		if err != nil {
+			return fmt.Errorf("writeHistogramParquet: unable to find DAWG index %d: %w", index, err)
+		}
+
+		labels := dns.SplitDomainName(domain)
+
+		hGramData.V4ClientCount = hGramData.v4ClientHLL.Cardinality()
+		hGramData.V6ClientCount = hGramData.v6ClientHLL.Cardinality()
+
+		if hGramData.V4ClientCount+hGramData.V6ClientCount < minClients {
+			suppressed++
+			if mergeSuppressed && len(labels) > 0 {
+				tld := labels[len(labels)-1]
+				other, ok := otherRows[tld]
+				if !ok {
+					other = edm.newHistogramData(hGramData.v4ClientHLL.Settings(), false)
+					other.EDMStatusBits = uint64(edmStatusSuppressedMerged)
+					otherRows[tld] = other
+				}
+				other.addCounters(hGramData)
+				other.v4ClientHLL.Union(hGramData.v4ClientHLL)
+				other.v6ClientHLL.Union(hGramData.v6ClientHLL)
+			}
+			continue
+		}
+
+		err = writeRow(hGramData, labels)
+		if err != nil {
+			return err
+		}
+	}
+
+	mergedTLDs := 0
+	for _, tld := range slices.Sorted(maps.Keys(otherRows)) {
+		other := otherRows[tld]
+		other.V4ClientCount = other.v4ClientHLL.Cardinality()
+		other.V6ClientCount = other.v6ClientHLL.Cardinality()
+		// The merged row has to reach the threshold as well.
+		if other.V4ClientCount+other.V6ClientCount < minClients {
+			continue
+		}
+		other.MergedTLD = &tld
+		err := writeRow(other, nil)
+		if err != nil {
+			return err
+		}
+		mergedTLDs++
+	}
+
+	if suppressed > 0 {
+		edm.promHistogramRowsSuppressed.Add(float64(suppressed))
+		edm.log.Info("writeHistogramParquet: suppressed histogram rows below histogram-min-clients", "rows", suppressed, "merged_tlds", mergedTLDs, "identity", prevWellKnownDomainsData.identity)
 	}
 
-	err := parquetWriter.Close()
+	err = parquetWriter.Close()
 	if err != nil {
 		return fmt.Errorf("writeHistogramParquet: unable to call Close() on parquet writer: %w", err)
 	}
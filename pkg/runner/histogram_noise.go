@@ -0,0 +1,135 @@
+package runner
+
+import (
+	crand "crypto/rand"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"reflect"
+	"strconv"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// Parquet key/value metadata recording the noise added to the counters of
+// a histogram file, only present in files written with histogram-noise. The
+// scale is the Laplace scale b or the Gaussian standard deviation that
+// epsilon and delta (only for the Gaussian mechanism) were turned into.
+const (
+	histogramNoiseMechanismMetadataKey = "edm_histogram_noise_mechanism"
+	histogramNoiseEpsilonMetadataKey   = "edm_histogram_noise_epsilon"
+	histogramNoiseDeltaMetadataKey     = "edm_histogram_noise_delta"
+	histogramNoiseScaleMetadataKey     = "edm_histogram_noise_scale"
+)
+
+// histogramNoiseL1Sensitivity is the most a single DNS message can change
+// the counters of a histogram row in total: one each in the type, the
+// query/response, the rcode, the transport, the response size and the
+// latency counters, the AD, TC, DO, CD and ECS counters and the client
+// count. Every message is counted in one row only. Keep this in step with
+// newWKDUpdate when adding counters.
+const histogramNoiseL1Sensitivity = 12
+
+// histogramNoise adds random noise to histogram counters. The noise is
+// scaled like the Laplace or Gaussian mechanism for epsilon (and delta) with
+// the counter sensitivity of a single DNS message, but the files are not
+// differentially private: which domains have a row, the histogram-min-clients
+// decision and clients sending many messages are not covered.
+type histogramNoise struct {
+	mechanism string
+	epsilon   float64
+	delta     float64
+	// scale is the Laplace scale b or the Gaussian standard deviation
+	scale float64
+	rand  *rand.Rand
+}
+
+// newHistogramNoise returns the noise for the histogram-noise settings in
+// conf, or nil when noise is disabled. src is the random source, a
+// cryptographically seeded one is used if it is nil.
+func newHistogramNoise(conf Config, src rand.Source) (*histogramNoise, error) {
+	n := &histogramNoise{
+		mechanism: conf.HistogramNoise,
+		epsilon:   conf.HistogramNoiseEpsilon,
+		delta:     conf.HistogramNoiseDelta,
+	}
+
+	switch conf.HistogramNoise {
+	case HistogramNoiseNone, "":
+		return nil, nil
+	case HistogramNoiseLaplace:
+		n.scale = histogramNoiseL1Sensitivity / n.epsilon
+	case HistogramNoiseGaussian:
+		// The classic Gaussian mechanism calibration, which holds for
+		// epsilon < 1, with the L2 sensitivity of the counters.
+		n.scale = math.Sqrt(histogramNoiseL1Sensitivity) * math.Sqrt(2*math.Log(1.25/n.delta)) / n.epsilon
+	default:
+		return nil, fmt.Errorf("newHistogramNoise: unknown mechanism %q", conf.HistogramNoise)
+	}
+
+	if src == nil {
+		var seed [32]byte
+		_, err := crand.Read(seed[:])
+		if err != nil {
+			return nil, fmt.Errorf("newHistogramNoise: unable to seed random source: %w", err)
+		}
+		src = rand.NewChaCha8(seed)
+	}
+	n.rand = rand.New(src)
+
+	return n, nil
+}
+
+// metadata returns the parquet key/value metadata describing the noise.
+func (n *histogramNoise) metadata() []parquet.WriterOption {
+	options := []parquet.WriterOption{
+		parquet.KeyValueMetadata(histogramNoiseMechanismMetadataKey, n.mechanism),
+		parquet.KeyValueMetadata(histogramNoiseEpsilonMetadataKey, strconv.FormatFloat(n.epsilon, 'g', -1, 64)),
+		parquet.KeyValueMetadata(histogramNoiseScaleMetadataKey, strconv.FormatFloat(n.scale, 'g', -1, 64)),
+	}
+	if n.mechanism == HistogramNoiseGaussian {
+		options = append(options, parquet.KeyValueMetadata(histogramNoiseDeltaMetadataKey, strconv.FormatFloat(n.delta, 'g', -1, 64)))
+	}
+	return options
+}
+
+// noisy returns v with noise added, rounded to the nearest non-negative
+// integer.
+func (n *histogramNoise) noisy(v uint64) uint64 {
+	var noise float64
+	switch n.mechanism {
+	case HistogramNoiseLaplace:
+		noise = n.rand.ExpFloat64() * n.scale
+		if n.rand.IntN(2) == 0 {
+			noise = -noise
+		}
+	case HistogramNoiseGaussian:
+		noise = n.rand.NormFloat64() * n.scale
+	}
+
+	noised := math.Round(float64(v) + noise)
+	if noised <= 0 {
+		return 0
+	}
+	if noised >= math.MaxUint64 {
+		return math.MaxUint64
+	}
+	return uint64(noised)
+}
+
+// apply adds noise to every counter of hd, including the client counts.
+// The HLL bytes can not be noised and are removed.
+func (n *histogramNoise) apply(hd *histogramData) {
+	v := reflect.ValueOf(hd).Elem()
+	typ := v.Type()
+	for i := range v.NumField() {
+		field := v.Field(i)
+		if field.Kind() != reflect.Uint64 || typ.Field(i).Name == "EDMStatusBits" {
+			continue
+		}
+		field.SetUint(n.noisy(field.Uint()))
+	}
+
+	hd.V4ClientCountHLLBytes = nil
+	hd.V6ClientCountHLLBytes = nil
+}
@@ -0,0 +1,132 @@
+package runner
+
+import (
+	"bytes"
+	"math"
+	"math/rand/v2"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/twmb/murmur3"
+)
+
+func TestHistogramNoiseDistribution(t *testing.T) {
+	const samples = 20000
+
+	for _, tc := range []struct {
+		conf Config
+		// spread returns the expected mean absolute deviation of the
+		// noise for the scale
+		spread func(scale float64) float64
+	}{
+		{
+			conf:   Config{HistogramNoise: HistogramNoiseLaplace, HistogramNoiseEpsilon: 1},
+			spread: func(scale float64) float64 { return scale },
+		},
+		{
+			conf:   Config{HistogramNoise: HistogramNoiseGaussian, HistogramNoiseEpsilon: 0.5, HistogramNoiseDelta: 1e-6},
+			spread: func(scale float64) float64 { return scale * math.Sqrt(2/math.Pi) },
+		},
+	} {
+		t.Run(tc.conf.HistogramNoise, func(t *testing.T) {
+			noise, err := newHistogramNoise(tc.conf, rand.NewPCG(1, 2))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Far enough from 0 that clamping does not skew the
+			// mean.
+			const v = 100_000
+			var sum, absSum float64
+			for range samples {
+				got := float64(noise.noisy(v))
+				sum += got
+				absSum += math.Abs(got - v)
+			}
+			if mean := sum / samples; math.Abs(mean-v) > noise.scale/10 {
+				t.Fatalf("mean = %f, want about %d", mean, v)
+			}
+			want := tc.spread(noise.scale)
+			if spread := absSum / samples; math.Abs(spread-want) > want/20 {
+				t.Fatalf("mean absolute deviation = %f, want about %f", spread, want)
+			}
+
+			// Small counts are clamped to non-negative values.
+			zeros := 0
+			for range samples {
+				if noise.noisy(0) == 0 {
+					zeros++
+				}
+			}
+			if zeros < samples/3 {
+				t.Fatalf("noised zeros clamped to 0 = %d, want about half of %d", zeros, samples)
+			}
+		})
+	}
+
+	noise, err := newHistogramNoise(Config{HistogramNoise: HistogramNoiseNone}, nil)
+	if noise != nil || err != nil {
+		t.Fatalf("newHistogramNoise(none) = %v, %v", noise, err)
+	}
+}
+
+func TestWriteHistogramParquetNoise(t *testing.T) {
+	conf := defaultTC
+	conf.HistogramNoise = HistogramNoiseGaussian
+	conf.HistogramNoiseEpsilon = 0.5
+	conf.HistogramNoiseDelta = 1e-6
+	edm := newTestDnstapMinimiser(t, conf)
+
+	hd := edm.newHistogramData(getHllDefaults(1), false)
+	hd.ACount = 1000
+	hd.UDPCount = 1000
+	for i := range 100 {
+		addr := netip.AddrFrom4([4]byte{198, 51, 100, byte(i)})
+		hd.v4ClientHLL.AddRaw(murmur3.Sum64(addr.AsSlice()))
+	}
+	wkd := &wellKnownDomainsData{
+		m:          map[int]*histogramData{0: hd},
+		dawgFinder: testDawgFinder(t, "example.com."),
+	}
+
+	var buf bytes.Buffer
+	if err := edm.writeHistogramParquet(&buf, time.Unix(10, 0), wkd, defaultLabelLimit); err != nil {
+		t.Fatal(err)
+	}
+	pf, err := parquet.OpenFile(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	noise, err := newHistogramNoise(conf.Config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{
+		histogramNoiseMechanismMetadataKey: HistogramNoiseGaussian,
+		histogramNoiseEpsilonMetadataKey:   "0.5",
+		histogramNoiseDeltaMetadataKey:     strconv.FormatFloat(1e-6, 'g', -1, 64),
+		histogramNoiseScaleMetadataKey:     strconv.FormatFloat(noise.scale, 'g', -1, 64),
+	} {
+		if got, ok := pf.Lookup(key); !ok || got != want {
+			t.Fatalf("metadata %s = %q, %t, want %q", key, got, ok, want)
+		}
+	}
+
+	rows, err := parquet.Read[histogramData](bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 {
+		t.Fatalf("rows = %d, want 1", len(rows))
+	}
+	row := rows[0]
+	if row.ACount == 1000 && row.UDPCount == 1000 && row.V4ClientCount == 100 {
+		t.Fatalf("counters were not noised: %#v", row)
+	}
+	if row.V4ClientCountHLLBytes != nil || row.EDMStatusBits != uint64(edmStatusWellKnownExact) {
+		t.Fatalf("unexpected HLL bytes or status bits: %#v", row)
+	}
+}
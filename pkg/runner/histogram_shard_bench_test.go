@@ -0,0 +1,82 @@
+package runner
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+)
+
+// BenchmarkHistogramUpdatesParallel compares counting well-known domain hits
+// in per-worker histogram shards with sending every hit to a single
+// collector goroutine, which is how histogram data was aggregated before
+// the shards. Each parallel goroutine plays a minimiser worker. Run with
+// -cpu=1,4,8,... to see the single collector become the ceiling as workers
+// are added while the shards keep scaling.
+func BenchmarkHistogramUpdatesParallel(b *testing.B) {
+	const domains = 1000
+
+	edm := newTestDnstapMinimiser(b, defaultTC)
+	hllSettings := getHllDefaults(edm.conf.HistogramHLLExplicitThreshold)
+	modTime := time.Unix(0, 0)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+
+	// newUpdate returns the update for the n:th hit of a worker, spread
+	// over the domains and a range of client addresses.
+	newUpdate := func(worker uint32, n int) wkdUpdate {
+		var ip [4]byte
+		binary.BigEndian.PutUint32(ip[:], worker<<16|uint32(n%4096)) // #nosec G115 -- n%4096 fits
+		return newWKDUpdate(ip[:], msg, false, dnstap.SocketProtocol_UDP, n%domains, false, modTime, "")
+	}
+
+	b.Run("collector", func(b *testing.B) {
+		wkd, err := newWellKnownDomainsTracker(testDawgFinder(b, "example.com."), modTime)
+		if err != nil {
+			b.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for wu := range wkd.updateCh {
+				edm.countUpdate(wkd.m, wu, hllSettings)
+			}
+		}()
+
+		var workers atomic.Uint32
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			worker := workers.Add(1)
+			for n := 0; pb.Next(); n++ {
+				wkd.updateCh <- newUpdate(worker, n)
+			}
+		})
+		close(wkd.updateCh)
+		wg.Wait()
+	})
+
+	b.Run("sharded", func(b *testing.B) {
+		wkd, err := newWellKnownDomainsTracker(testDawgFinder(b, "example.com."), modTime)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		var workers atomic.Uint32
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			worker := workers.Add(1)
+			shard := wkd.newShard()
+			for n := 0; pb.Next(); n++ {
+				shard.add(edm, newUpdate(worker, n), hllSettings)
+			}
+		})
+		// The merge at rotation is part of the cost of sharding.
+		wkd.collectShards(modTime)
+	})
+}
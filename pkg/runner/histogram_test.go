@@ -3,6 +3,7 @@ package runner
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
@@ -170,6 +171,33 @@ func TestEDMStatusBitsUnknown(t *testing.T) {
 	}
 }
 
+func TestHistogramDistributions(t *testing.T) {
+	hd := &histogramData{}
+	for _, size := range []int{0, 64, 65, 128, 200, 512, 1232, 1233, 4096, 4097, 65535} {
+		hd.addResponseSize(size)
+	}
+	gotSizes := []uint64{hd.ResponseSizeLE64Count, hd.ResponseSizeLE128Count, hd.ResponseSizeLE256Count, hd.ResponseSizeLE512Count, hd.ResponseSizeLE1232Count, hd.ResponseSizeLE4096Count, hd.ResponseSizeGT4096Count}
+	if want := []uint64{2, 2, 1, 1, 1, 2, 2}; !slices.Equal(gotSizes, want) {
+		t.Fatalf("response size buckets = %v, want %v", gotSizes, want)
+	}
+
+	for _, latency := range []time.Duration{0, time.Millisecond, 2 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond, 100 * time.Millisecond, 400 * time.Millisecond, time.Second, 3 * time.Second} {
+		hd.addLatency(latency)
+	}
+	gotLatencies := []uint64{hd.LatencyLE1msCount, hd.LatencyLE10msCount, hd.LatencyLE50msCount, hd.LatencyLE100msCount, hd.LatencyLE500msCount, hd.LatencyLE1sCount, hd.LatencyGT1sCount}
+	if want := []uint64{2, 2, 1, 1, 1, 1, 1}; !slices.Equal(gotLatencies, want) {
+		t.Fatalf("latency buckets = %v, want %v", gotLatencies, want)
+	}
+
+	// The distributions are summed when worker shards are merged.
+	merged := &histogramData{}
+	merged.addCounters(hd)
+	merged.addCounters(hd)
+	if merged.ResponseSizeGT4096Count != 4 || merged.LatencyLE1msCount != 4 {
+		t.Fatalf("merged distributions = %#v", merged)
+	}
+}
+
 func TestHistogramWriter(t *testing.T) {
 	var buf bytes.Buffer
 
@@ -211,6 +239,8 @@ func TestHistogramWriter(t *testing.T) {
 		NXCount:               18,
 		FailCount:             19,
 		OtherRcodeCount:       20,
+		QueryCount:            22,
+		ResponseCount:         23,
 		EDMStatusBits:         21,
 		V4ClientCountHLLBytes: v4hll.ToBytes(),
 		V6ClientCountHLLBytes: v6hll.ToBytes(),
@@ -289,6 +319,8 @@ func BenchmarkHistogramWriter(b *testing.B) {
 		NXCount:               18,
 		FailCount:             19,
 		OtherRcodeCount:       20,
+		QueryCount:            22,
+		ResponseCount:         23,
 		EDMStatusBits:         21,
 		V4ClientCountHLLBytes: v4hll.ToBytes(),
 		V6ClientCountHLLBytes: v6hll.ToBytes(),
@@ -532,6 +564,96 @@ func TestNewHistogramDataAndWriteParquet(t *testing.T) {
 	}
 }
 
+func TestWriteHistogramParquetMinClients(t *testing.T) {
+	// a.com, b.com and c.se are seen from fewer than three clients
+	// each, popular.com and the com TLD itself from three.
+	domains := []string{"a.com.", "b.com.", "popular.com.", "c.se.", "com."}
+	clients := map[string][]string{
+		"a.com.":       {"198.51.100.5"},
+		"b.com.":       {"198.51.100.1", "2001:db8::1"},
+		"popular.com.": {"198.51.100.1", "198.51.100.2", "198.51.100.3"},
+		"c.se.":        {"198.51.100.4"},
+		"com.":         {"198.51.100.1", "198.51.100.2", "198.51.100.3"},
+	}
+
+	for _, tc := range []struct {
+		mode       string
+		wantLabels [][2]string
+		wantMerged int
+	}{
+		{HistogramSuppressedRowsDrop, [][2]string{{"com", ""}, {"com", "popular"}}, 0},
+		// The .se row is dropped as well since it is still below the
+		// threshold after merging. The merged .com row has no labels.
+		{HistogramSuppressedRowsMergeTLD, [][2]string{{"", ""}, {"com", ""}, {"com", "popular"}}, 1},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			conf := defaultTC
+			conf.HistogramMinClients = 3
+			conf.HistogramSuppressedRows = tc.mode
+			edm := newTestDnstapMinimiser(t, conf)
+			logBuf := &syncBuf{}
+			edm.log = slog.New(slog.NewJSONHandler(logBuf, nil))
+
+			finder := testDawgFinder(t, domains...)
+			wkd := &wellKnownDomainsData{m: map[int]*histogramData{}, dawgFinder: finder}
+			for _, domain := range domains {
+				hd := edm.newHistogramData(getHllDefaults(20), false)
+				hd.ACount = 1
+				for _, client := range clients[domain] {
+					addr := netip.MustParseAddr(client)
+					if addr.Is4() {
+						hd.v4ClientHLL.AddRaw(murmur3.Sum64(addr.AsSlice()))
+					} else {
+						hd.v6ClientHLL.AddRaw(murmur3.Sum64(addr.AsSlice()))
+					}
+				}
+				wkd.m[finder.IndexOf(domain)] = hd
+			}
+
+			var buf bytes.Buffer
+			if err := edm.writeHistogramParquet(&buf, time.Unix(10, 0), wkd, defaultLabelLimit); err != nil {
+				t.Fatal(err)
+			}
+			rows, err := parquet.Read[histogramData](bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var labels [][2]string
+			for _, row := range rows {
+				var l [2]string
+				if row.Label0 != nil {
+					l[0] = *row.Label0
+				}
+				if row.Label1 != nil {
+					l[1] = *row.Label1
+				}
+				labels = append(labels, l)
+
+				if row.MergedTLD != nil {
+					// a.com and b.com merged: two queries from
+					// three distinct clients.
+					if l[0] != "" || *row.MergedTLD != "com" || row.ACount != 2 || row.V4ClientCount != 2 || row.V6ClientCount != 1 || row.EDMStatusBits != uint64(edmStatusSuppressedMerged) {
+						t.Fatalf("unexpected merged row: %#v", row)
+					}
+				} else if row.EDMStatusBits&uint64(edmStatusSuppressedMerged) != 0 {
+					t.Fatalf("merged row without merged_tld: %#v", row)
+				}
+			}
+			slices.SortFunc(labels, func(a, b [2]string) int { return strings.Compare(a[0]+"."+a[1], b[0]+"."+b[1]) })
+			if !slices.Equal(labels, tc.wantLabels) {
+				t.Fatalf("row labels = %q, want %q", labels, tc.wantLabels)
+			}
+			if got := testMetricValue(t, edm.promHistogramRowsSuppressed); got != 3 {
+				t.Fatalf("suppressed rows metric = %v, want 3", got)
+			}
+			// Only the merged rows written are logged.
+			if want := fmt.Sprintf(`"merged_tlds":%d`, tc.wantMerged); !strings.Contains(logBuf.String(), want) {
+				t.Fatalf("suppression log = %q, want %s", logBuf.String(), want)
+			}
+		})
+	}
+}
+
 func TestHistogramSender(t *testing.T) {
 	edm := newTestDnstapMinimiser(t, defaultTC)
 	edm.deps.HistogramSenderInterval = time.Millisecond
@@ -579,6 +701,80 @@ func TestHistogramSender(t *testing.T) {
 	t.Fatal("histogramSender did not move sent file")
 }
 
+func TestHistogramSenderIdentityPartitions(t *testing.T) {
+	edm := newTestDnstapMinimiser(t, defaultTC)
+	edm.deps.HistogramSenderInterval = time.Millisecond
+	edm.deps.HistogramSenderBackoff = time.Millisecond
+	edm.reloadHistogramSenderConfigCh = make(chan struct{}, 1)
+	outboxDir := filepath.Join(t.TempDir(), "outbox")
+	sentDir := filepath.Join(t.TempDir(), "sent")
+	partitionDir := identityPartitionDir(outboxDir, "resolver 1")
+	// Only identity directories are sent, other directories are left alone.
+	otherDir := filepath.Join(outboxDir, "other")
+	for _, dir := range []string{partitionDir, otherDir} {
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name := "dns_histogram-2026-05-28T12-00-00Z_2026-05-28T12-01-00Z.parquet"
+	for _, dir := range []string{outboxDir, partitionDir, otherDir} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("payload"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mu sync.Mutex
+	var identities []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		identities = append(identities, r.Header.Get("Aggregate-Identity"))
+		mu.Unlock()
+		w.Header().Set("Location", "/ok")
+		w.WriteHeader(http.StatusCreated)
+	}))
+	t.Cleanup(server.Close)
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	as, err := newAggregateSender(edm.log, u, testJWK(t), nil, edm.httpClientCertStore.getClientCertificate, edm.deps.FileSystem, edm.deps.Clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edm.aggregSender = as
+
+	sentPartition := filepath.Join(sentDir, "identity=resolver%201", name)
+	ctx, cancel := testRunContext(t)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go edm.histogramSender(ctx, outboxDir, sentDir, &wg)
+	moved := false
+	for range 200 {
+		_, errTop := os.Stat(filepath.Join(sentDir, name))
+		_, errPartition := os.Stat(sentPartition)
+		if errTop == nil && errPartition == nil {
+			moved = true
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	wg.Wait()
+	if !moved {
+		t.Fatal("histogramSender did not move sent files")
+	}
+
+	if _, err := os.Stat(filepath.Join(otherDir, name)); err != nil {
+		t.Fatalf("file outside an identity directory was touched: %s", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	slices.Sort(identities)
+	if !slices.Equal(identities, []string{"", "resolver%201"}) {
+		t.Fatalf("Aggregate-Identity headers = %q", identities)
+	}
+}
+
 // TestHistogramSenderBranches covers the histogramSender arms that
 // TestHistogramSender (the happy send-and-rename path) does not reach:
 // disabled-at-startup, parse-error filename, send-error backoff, and
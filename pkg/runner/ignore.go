@@ -121,6 +121,114 @@ func (edm *DnstapMinimiser) getNumIgnoredClientCIDRs() uint64 {
 	return edm.ignoredClientCIDRsParsed.Load()
 }
 
+// dnstapFilter is the parsed form of the message type and identity
+// allow/deny lists. An empty allow list lets everything through, the deny
+// lists are checked first. Nothing is stored when every list is empty.
+type dnstapFilter struct {
+	allowedTypes      map[dnstap.Message_Type]struct{}
+	ignoredTypes      map[dnstap.Message_Type]struct{}
+	allowedIdentities map[string]struct{}
+	ignoredIdentities map[string]struct{}
+}
+
+// parseMessageTypes maps dnstap Message.Type names such as
+// "CLIENT_RESPONSE" to their values, nil for an empty list.
+func parseMessageTypes(key string, names []string) (map[dnstap.Message_Type]struct{}, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	types := make(map[dnstap.Message_Type]struct{}, len(names))
+	for _, name := range names {
+		v, ok := dnstap.Message_Type_value[name]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown dnstap message type %q", key, name)
+		}
+		types[dnstap.Message_Type(v)] = struct{}{}
+	}
+	return types, nil
+}
+
+func stringSet(values []string) map[string]struct{} {
+	if len(values) == 0 {
+		return nil
+	}
+	set := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		set[v] = struct{}{}
+	}
+	return set
+}
+
+func (edm *DnstapMinimiser) setDnstapFilters() error {
+	conf := edm.getConfig()
+
+	allowedTypes, err := parseMessageTypes("allowed-message-types", conf.AllowedMessageTypes)
+	if err != nil {
+		return fmt.Errorf("setDnstapFilters: %w", err)
+	}
+	ignoredTypes, err := parseMessageTypes("ignored-message-types", conf.IgnoredMessageTypes)
+	if err != nil {
+		return fmt.Errorf("setDnstapFilters: %w", err)
+	}
+
+	filter := &dnstapFilter{
+		allowedTypes:      allowedTypes,
+		ignoredTypes:      ignoredTypes,
+		allowedIdentities: stringSet(conf.AllowedIdentities),
+		ignoredIdentities: stringSet(conf.IgnoredIdentities),
+	}
+
+	// Keep the hot path to a single nil check when nothing is filtered.
+	if filter.allowedTypes == nil && filter.ignoredTypes == nil && filter.allowedIdentities == nil && filter.ignoredIdentities == nil {
+		edm.dnstapFilter.Store(nil)
+		edm.log.Info("setDnstapFilters: message type and identity filters unset")
+		return nil
+	}
+
+	edm.dnstapFilter.Store(filter)
+	edm.log.Info("setDnstapFilters: message type and identity filters loaded", "allowed_message_types", conf.AllowedMessageTypes, "ignored_message_types", conf.IgnoredMessageTypes, "num_allowed_identities", len(filter.allowedIdentities), "num_ignored_identities", len(filter.ignoredIdentities))
+
+	return nil
+}
+
+// messageIsFiltered reports whether dt is dropped by the message type or
+// identity lists. Frames without an identity never match the ignore list
+// but are dropped when there is an allow list.
+func (edm *DnstapMinimiser) messageIsFiltered(dt *dnstap.Dnstap) bool {
+	// Atomic snapshot - no lock on the hot path. See clientIPIsIgnored
+	// for the rationale.
+	filter := edm.dnstapFilter.Load()
+	if filter == nil {
+		return false
+	}
+
+	msgType := dt.Message.GetType()
+	if _, ok := filter.ignoredTypes[msgType]; ok {
+		edm.promMessageTypeIgnored.Inc()
+		return true
+	}
+	if filter.allowedTypes != nil {
+		if _, ok := filter.allowedTypes[msgType]; !ok {
+			edm.promMessageTypeNotAllowed.Inc()
+			return true
+		}
+	}
+
+	// The conversion in a map index expression does not allocate.
+	if _, ok := filter.ignoredIdentities[string(dt.Identity)]; ok {
+		edm.promIdentityIgnored.Inc()
+		return true
+	}
+	if filter.allowedIdentities != nil {
+		if _, ok := filter.allowedIdentities[string(dt.Identity)]; !ok {
+			edm.promIdentityNotAllowed.Inc()
+			return true
+		}
+	}
+
+	return false
+}
+
 // dawgFinderHolder is a tiny concrete-type wrapper so dawg.Finder (which is
 // an interface) can be stored in an atomic.Pointer. Used for the
 // ignoredQuestions atomic snapshot.
@@ -3,10 +3,12 @@ package runner
 import (
 	"net/netip"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	dnstap "github.com/dnstap/golang-dnstap"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func TestIgnoredClientIPsValid(t *testing.T) {
@@ -811,3 +813,95 @@ func TestSetIgnoredQuestionNamesBranches(t *testing.T) {
 		}
 	})
 }
+
+func TestDnstapFilters(t *testing.T) {
+	edm := newTestDnstapMinimiser(t, defaultTC)
+
+	frame := func(msgType dnstap.Message_Type, identity string) *dnstap.Dnstap {
+		dt := testDnstapMessage(t, msgType, dnstap.SocketFamily_INET, packedDNSMsg(t, "example.com.", dns.TypeA, dns.RcodeSuccess))
+		dt.Identity = []byte(identity)
+		return dt
+	}
+
+	if err := edm.setDnstapFilters(); err != nil {
+		t.Fatal(err)
+	}
+	if edm.dnstapFilter.Load() != nil {
+		t.Fatal("filter stored without any lists configured")
+	}
+	if edm.messageIsFiltered(frame(dnstap.Message_RESOLVER_RESPONSE, "server-1")) {
+		t.Fatal("frame filtered without any lists configured")
+	}
+
+	edm.conf.AllowedMessageTypes = []string{"CLIENT_RESPONSE", "CLIENT_QUERY"}
+	edm.conf.IgnoredMessageTypes = []string{"CLIENT_QUERY"}
+	edm.conf.AllowedIdentities = []string{"resolver-1", "resolver-2"}
+	edm.conf.IgnoredIdentities = []string{"resolver-2"}
+	if err := edm.setDnstapFilters(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		dt       *dnstap.Dnstap
+		filtered bool
+	}{
+		{"allowed type and identity", frame(dnstap.Message_CLIENT_RESPONSE, "resolver-1"), false},
+		{"type not allowed", frame(dnstap.Message_RESOLVER_RESPONSE, "resolver-1"), true},
+		{"deny list wins over allow list", frame(dnstap.Message_CLIENT_QUERY, "resolver-1"), true},
+		{"identity not allowed", frame(dnstap.Message_CLIENT_RESPONSE, "test-resolver"), true},
+		{"identity ignored", frame(dnstap.Message_CLIENT_RESPONSE, "resolver-2"), true},
+		{"missing identity with allow list", frame(dnstap.Message_CLIENT_RESPONSE, ""), true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := edm.messageIsFiltered(tc.dt); got != tc.filtered {
+				t.Fatalf("messageIsFiltered() = %t, want %t", got, tc.filtered)
+			}
+		})
+	}
+
+	for _, m := range []struct {
+		name    string
+		counter prometheus.Counter
+		want    float64
+	}{
+		{"edm_not_allowed_message_type_total", edm.promMessageTypeNotAllowed, 1},
+		{"edm_ignored_message_type_total", edm.promMessageTypeIgnored, 1},
+		{"edm_not_allowed_identity_total", edm.promIdentityNotAllowed, 2},
+		{"edm_ignored_identity_total", edm.promIdentityIgnored, 1},
+	} {
+		if got := testMetricValue(t, m.counter); got != m.want {
+			t.Fatalf("%s = %v, want %v", m.name, got, m.want)
+		}
+	}
+
+	// A reload with every list emptied stops filtering.
+	edm.conf.AllowedMessageTypes = nil
+	edm.conf.IgnoredMessageTypes = nil
+	edm.conf.AllowedIdentities = nil
+	edm.conf.IgnoredIdentities = nil
+	if err := edm.setDnstapFilters(); err != nil {
+		t.Fatal(err)
+	}
+	if edm.messageIsFiltered(frame(dnstap.Message_RESOLVER_RESPONSE, "test-resolver")) {
+		t.Fatal("frame filtered after the lists were emptied")
+	}
+}
+
+func TestSetDnstapFiltersUnknownType(t *testing.T) {
+	edm := newTestDnstapMinimiser(t, defaultTC)
+	edm.conf.AllowedMessageTypes = []string{"CLIENT_RESPONSE"}
+	if err := edm.setDnstapFilters(); err != nil {
+		t.Fatal(err)
+	}
+
+	edm.conf.IgnoredMessageTypes = []string{"client_response"}
+	if err := edm.setDnstapFilters(); err == nil || !strings.Contains(err.Error(), "ignored-message-types") {
+		t.Fatalf("setDnstapFilters() = %v, want unknown type error naming ignored-message-types", err)
+	}
+	// The previous filter stays in place.
+	if !edm.messageIsFiltered(testDnstapMessage(t, dnstap.Message_RESOLVER_RESPONSE, dnstap.SocketFamily_INET, nil)) {
+		t.Fatal("previous filter was dropped by a failed update")
+	}
+}
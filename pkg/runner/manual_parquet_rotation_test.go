@@ -59,7 +59,7 @@ func TestDataCollectorManualParquetRotationFlushesPendingData(t *testing.T) {
 		t.Fatal("manual parquet rotation timed out")
 	}
 
-	ps, ok := <-edm.sessionWriterCh
+	ps, ok := readSessionInterval(edm.sessionWriterCh)
 	if !ok {
 		t.Fatal("sessionWriterCh closed without manual session flush")
 	}
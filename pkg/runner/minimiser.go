@@ -13,6 +13,7 @@ import (
 	"github.com/dnstapir/edm/pkg/protocols"
 	lru "github.com/hashicorp/golang-lru/v2"
 	"github.com/miekg/dns"
+	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -23,13 +24,13 @@ import (
 // cryptopanCache is the worker-private Crypto-PAn LRU (nil disables
 // caching); Run creates it so a creation failure surfaces as a startup
 // error instead of a silently dead worker.
-func (edm *DnstapMinimiser) runMinimiser(ctx context.Context, minimiserID int, wg *sync.WaitGroup, reloadConfigCh <-chan struct{}, cryptopanCache *lru.Cache[netip.Addr, netip.Addr], seenQnameLRU *lru.Cache[string, struct{}], seenStore seenQnameStore, debugDnstapFile fsFile, labelLimit int, wkdTracker *wellKnownDomainsTracker) {
+func (edm *DnstapMinimiser) runMinimiser(ctx context.Context, minimiserID int, wg *sync.WaitGroup, reloadConfigCh <-chan struct{}, cryptopanCache *lru.Cache[netip.Addr, netip.Addr], seenQnameLRU *lru.Cache[string, seenQname], seenStore SeenQnameStore, debugDnstapFile fsFile, labelLimit int, wkdTracker *wellKnownDomainsTracker) {
 	defer wg.Done()
 
 	dt := &dnstap.Dnstap{}
 
 	// Per-worker scratch buffer for the unpseudonymised client IP we pass
-	// to wkdTracker.sendUpdate for HLL hashing. Sized to fit IPv6 and
+	// to newWKDUpdate for HLL hashing. Sized to fit IPv6 and
 	// resliced to len(QueryAddress) per frame.
 	var dangerScratch [16]byte
 
@@ -46,10 +47,23 @@ func (edm *DnstapMinimiser) runMinimiser(ctx context.Context, minimiserID int, w
 	// conf is meant to be dynamically modified if the config changes at runtime
 	conf := edm.getConfig()
 
+	// Well-known domain hits are counted in a histogram shard of our
+	// own which the data collector merges with the other workers'
+	// shards at rotation.
+	histogramShard := wkdTracker.newShard()
+	hllSettings := getHllDefaults(conf.HistogramHLLExplicitThreshold)
+
+	seenQnameTTL := startConf.seenQnameTTL()
+
 minimiserLoop:
 	for {
 		select {
-		case frame := <-edm.inputChannel:
+		case frame, ok := <-edm.inputChannel:
+			if !ok {
+				// The input channel is only closed once a replay
+				// has read all of its capture files.
+				break minimiserLoop
+			}
 			edm.promDnstapProcessed.Inc()
 			if err := proto.Unmarshal(frame, dt); err != nil {
 				edm.log.Error("DnstapMinimiser.runMinimiser: proto.Unmarshal() failed, skipping frame", "error", err, "minimiser_id", minimiserID)
@@ -82,8 +96,28 @@ minimiserLoop:
 
 			isQuery := strings.HasSuffix(dnstap.Message_Type_name[int32(dt.Message.GetType())], "_QUERY")
 
-			// For now we only care about response type dnstap packets
-			if isQuery {
+			// Every frame read moves replay time, also the ones
+			// filtered out below, or a capture of mostly filtered
+			// frames would hold back the interval rotation. A frame
+			// without a usable timestamp must not move it, it would
+			// start or end the interval in 1970.
+			if edm.replay != nil {
+				if ts, ok := dnstapMessageTime(dt.Message, isQuery); ok {
+					edm.replayAdvance(ts)
+				}
+			}
+
+			if edm.messageIsFiltered(dt) {
+				continue
+			}
+
+			// Query messages are opt-in: a resolver logging both queries
+			// and responses would otherwise have every lookup counted
+			// twice. When queries are correlated with their responses
+			// a CLIENT_QUERY is still needed for the session row, but
+			// is kept out of the histogram and new_qname data.
+			sessionOnly := isQuery && !conf.ProcessQueryMessages
+			if sessionOnly && (!startConf.CorrelateQueryResponses || conf.DisableSessionFiles || dt.Message.GetType() != dnstap.Message_CLIENT_QUERY) {
 				continue
 			}
 
@@ -114,9 +148,10 @@ minimiserLoop:
 				}
 				cryptopanLastGen = gen
 			}
-			edm.pseudonymiseDnstap(dt, edm.cryptopan.Load(), cryptopanCache)
+			cryptopanState := edm.cryptopan.Load()
+			edm.pseudonymiseDnstap(dt, cryptopanState.cpn, cryptopanCache)
 
-			msg, timestamp := edm.parsePacket(dt, isQuery)
+			msg, timestamp, _ := edm.parsePacket(dt, isQuery)
 
 			// Create a less specific timestamp for data sent to
 			// core to make precise tracking harder.
@@ -149,26 +184,82 @@ minimiserLoop:
 			// measurements.
 			dawgIndex, suffixMatch, dawgModTime := wkdTracker.lookup(msg)
 			if dawgIndex != dawgNotFound {
-				wkdTracker.sendUpdate(dangerRealClientIP, msg, dawgIndex, suffixMatch, dawgModTime)
+				if !sessionOnly {
+					var identity string
+					if startConf.PartitionByIdentity {
+						identity = string(dt.Identity)
+					}
+					wu := newWKDUpdate(dangerRealClientIP, msg, isQuery, dnstapSocketProtocol(dt.Message), dawgIndex, suffixMatch, dawgModTime, identity)
+					if !isQuery {
+						wu.addResponseSize(len(dt.Message.ResponseMessage))
+						if latency, ok := dnstapLatency(dt.Message); ok {
+							wu.addLatency(latency)
+						}
+					}
+					if !histogramShard.add(edm, wu, hllSettings) {
+						// The DAWG was swapped since the lookup,
+						// have the name looked up again.
+						wkdTracker.retryCh <- wu
+					}
+				}
 				continue
 			}
 
-			if !edm.qnameSeen(msg, seenQnameLRU, seenStore, conf.PebbleSync) {
-				if !startConf.DisableMQTT {
-					newQname := protocols.NewQnameEvent(msg, truncatedTimestamp)
-
-					select {
-					case edm.newQnamePublisherCh <- &newQname:
-						edm.promNewQnameQueued.Inc()
-					default:
-						// If the publisher channel is full we skip creating an event.
-						edm.promNewQnameDiscarded.Inc()
+			if !sessionOnly {
+				qname := strings.ToLower(msg.Question[0].Name)
+				seenName := qname
+				if startConf.NewQnameDedupeLabels > 0 {
+					seenName = newQnameDedupeName(qname, startConf.NewQnameDedupeLabels)
+				}
+				// The last-seen time is expired against the wall
+				// clock, so it is stamped with it as well rather
+				// than with the frame time, which is missing on
+				// some frames and in the past when replaying.
+				seen := edm.qnameSeen(seenName, seenQnameLRU, seenStore, conf.PebbleSync, edm.deps.Clock.Now(), seenQnameTTL)
+
+				switch {
+				case startConf.DisableMQTT:
+				case edm.newQnameDedupe != nil && seen:
+					edm.newQnameDedupe.addSubname(seenName, qname)
+				case edm.newQnameDedupe != nil:
+					// The event for the registrable domain is sent
+					// when the histogram interval ends, with the
+					// number of names seen below it by then. The
+					// message fields describe the subname queried
+					// and are left out.
+					newQname := protocols.NewQnameEvent(msg, newQnameInitiator(dt.Message.GetType()), truncatedTimestamp)
+					newQname.Qname = seenName
+					newQname.Qtype = nil
+					newQname.Qclass = nil
+					newQname.Flags = nil
+					newQname.Rdlength = nil
+					if err := edm.newQnameDedupe.add(seenName, qname, &newQname); err != nil {
+						edm.log.Error("unable to hold deduplicated new_qname event", "error", err, "minimiser_id", minimiserID)
 					}
+				case !seen:
+					newQname := protocols.NewQnameEvent(msg, newQnameInitiator(dt.Message.GetType()), truncatedTimestamp)
+					edm.queueNewQname(&newQname)
 				}
 			}
 
 			if !conf.DisableSessionFiles {
 				session := edm.newSession(dt, msg, isQuery, labelLimit, timestamp)
+				session.cryptopanEpoch = cryptopanState.epoch
+				if startConf.SessionDerivedColumns {
+					wire := dt.Message.ResponseMessage
+					if isQuery {
+						wire = dt.Message.QueryMessage
+					}
+					session.setDerivedColumns(msg, len(wire))
+				}
+				// Without stored messages only the question
+				// labels are scrubbed.
+				if !conf.DisableSessionScrubbing {
+					edm.scrubSession(session, dt, msg, isQuery, labelLimit, cryptopanState.cpn, dangerRealClientIP, !startConf.DisableSessionMessages)
+				}
+				if startConf.CorrelateQueryResponses {
+					session.correlationKey = newSessionKey(dt, msg)
+				}
 				select {
 				case edm.sessionCollectorCh <- session:
 				case <-ctx.Done():
@@ -185,20 +276,35 @@ minimiserLoop:
 				}
 			}
 
+			if conf.ProcessQueryMessages != newConf.ProcessQueryMessages {
+				if newConf.ProcessQueryMessages {
+					edm.log.Info("enabling processing of query messages", "minimiser_id", minimiserID)
+				} else {
+					edm.log.Info("disabling processing of query messages", "minimiser_id", minimiserID)
+				}
+			}
+
 			conf = newConf
+			hllSettings = getHllDefaults(conf.HistogramHLLExplicitThreshold)
 		case <-ctx.Done():
 			break minimiserLoop
 		}
 	}
+	if edm.replay != nil {
+		edm.replayFinish()
+	}
 	edm.log.Info("runMinimiser: exiting loop", "minimiser_id", minimiserID)
 }
 
-func (edm *DnstapMinimiser) parsePacket(dt *dnstap.Dnstap, isQuery bool) (*dns.Msg, time.Time) {
+// parsePacket unpacks the query or response message of dt and returns it
+// with its dnstap timestamp. The returned bool is false if the timestamp is
+// missing or out of range, the time is then the Unix epoch.
+func (edm *DnstapMinimiser) parsePacket(dt *dnstap.Dnstap, isQuery bool) (*dns.Msg, time.Time, bool) {
 	var err error
 
 	if dt.Message == nil {
 		edm.log.Error("parsePacket: dnstap message is missing")
-		return nil, time.Unix(0, 0).UTC()
+		return nil, time.Unix(0, 0).UTC(), false
 	}
 
 	queryAddress := formatDnstapEndpoint(dt.Message.QueryAddress, dt.Message.QueryPort)
@@ -211,8 +317,8 @@ func (edm *DnstapMinimiser) parsePacket(dt *dnstap.Dnstap, isQuery bool) (*dns.M
 			edm.log.Error("unable to unpack query message", "error", err, "query_address", queryAddress, "response_address", responseAddress)
 			msg = nil
 		}
-		t := edm.dnstapTimestamp(dt.Message.QueryTimeSec, dt.Message.QueryTimeNsec, "dt.Message.QueryTimeSec")
-		return msg, t
+		t, ok := edm.dnstapTimestamp(dt.Message.QueryTimeSec, dt.Message.QueryTimeNsec, "dt.Message.QueryTimeSec")
+		return msg, t, ok
 	}
 
 	err = msg.Unpack(dt.Message.ResponseMessage)
@@ -220,8 +326,85 @@ func (edm *DnstapMinimiser) parsePacket(dt *dnstap.Dnstap, isQuery bool) (*dns.M
 		edm.log.Error("unable to unpack response message", "error", err, "query_address", queryAddress, "response_address", responseAddress)
 		msg = nil
 	}
-	t := edm.dnstapTimestamp(dt.Message.ResponseTimeSec, dt.Message.ResponseTimeNsec, "dt.Message.ResponseTimeSec")
-	return msg, t
+	t, ok := edm.dnstapTimestamp(dt.Message.ResponseTimeSec, dt.Message.ResponseTimeNsec, "dt.Message.ResponseTimeSec")
+	return msg, t, ok
+}
+
+// Socket protocols added to dnstap.proto after the version of
+// golang-dnstap we use. Being a proto2 enum, a value the generated code
+// does not know is not set in the SocketProtocol field but kept among
+// the unknown fields of the message, see dnstapSocketProtocol.
+const (
+	socketProtocolDNSCryptUDP dnstap.SocketProtocol = 5
+	socketProtocolDNSCryptTCP dnstap.SocketProtocol = 6
+	socketProtocolDOQ         dnstap.SocketProtocol = 7
+)
+
+// newQnameInitiator returns the new_qname initiator of a dnstap message type:
+// client for messages between clients and the resolver, resolver for
+// messages the resolver exchanges with authoritative servers, and none for
+// every other type.
+func newQnameInitiator(t dnstap.Message_Type) protocols.NewQnameJSONInitiator {
+	switch t {
+	case dnstap.Message_CLIENT_QUERY, dnstap.Message_CLIENT_RESPONSE:
+		return protocols.NewQnameJSONInitiatorClient
+	case dnstap.Message_RESOLVER_QUERY, dnstap.Message_RESOLVER_RESPONSE:
+		return protocols.NewQnameJSONInitiatorResolver
+	default:
+		return ""
+	}
+}
+
+// dnstapSocketProtocol returns the transport the DNS message was sent
+// over, or 0 if the dnstap message does not say.
+func dnstapSocketProtocol(m *dnstap.Message) dnstap.SocketProtocol {
+	if m.SocketProtocol != nil {
+		return *m.SocketProtocol
+	}
+	// Look for a socket_protocol value unknown to golang-dnstap.
+	unknown := m.ProtoReflect().GetUnknown()
+	var protocol dnstap.SocketProtocol
+	for len(unknown) > 0 {
+		num, typ, n := protowire.ConsumeTag(unknown)
+		if n < 0 {
+			return 0
+		}
+		unknown = unknown[n:]
+		if num == socketProtocolFieldNumber && typ == protowire.VarintType {
+			v, n := protowire.ConsumeVarint(unknown)
+			if n < 0 {
+				return 0
+			}
+			unknown = unknown[n:]
+			protocol = dnstap.SocketProtocol(v) // #nosec G115 -- enum values are int32 on the wire
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, unknown)
+		if n < 0 {
+			return 0
+		}
+		unknown = unknown[n:]
+	}
+	return protocol
+}
+
+// socketProtocolFieldNumber is the field number of socket_protocol in the
+// dnstap Message.
+const socketProtocolFieldNumber protowire.Number = 3
+
+// dnstapLatency returns the time from query to response of a response
+// type dnstap message. ok is false unless the message holds both
+// timestamps in the right order.
+func dnstapLatency(m *dnstap.Message) (latency time.Duration, ok bool) {
+	if m.QueryTimeSec == nil || m.ResponseTimeSec == nil || *m.QueryTimeSec > math.MaxInt64 || *m.ResponseTimeSec > math.MaxInt64 {
+		return 0, false
+	}
+	queryTime := time.Unix(int64(*m.QueryTimeSec), int64(m.GetQueryTimeNsec()))          // #nosec G115 -- sec is checked above and nsec is uint32.
+	responseTime := time.Unix(int64(*m.ResponseTimeSec), int64(m.GetResponseTimeNsec())) // #nosec G115 -- sec is checked above and nsec is uint32.
+	if responseTime.Before(queryTime) {
+		return 0, false
+	}
+	return responseTime.Sub(queryTime), true
 }
 
 func formatDnstapEndpoint(ipBytes []byte, port *uint32) string {
@@ -238,14 +421,30 @@ func formatDnstapEndpoint(ipBytes []byte, port *uint32) string {
 	return "?"
 }
 
-func (edm *DnstapMinimiser) dnstapTimestamp(sec *uint64, nsec *uint32, fieldName string) time.Time {
+// dnstapMessageTime returns the query time of a query message and the
+// response time of a response message, false if it is missing or too large
+// to be used.
+func dnstapMessageTime(m *dnstap.Message, isQuery bool) (time.Time, bool) {
+	sec, nsec := m.ResponseTimeSec, m.GetResponseTimeNsec()
+	if isQuery {
+		sec, nsec = m.QueryTimeSec, m.GetQueryTimeNsec()
+	}
+	if sec == nil || *sec > math.MaxInt64 {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(*sec), int64(nsec)).UTC(), true // #nosec G115 -- sec is checked above and nsec is uint32.
+}
+
+// dnstapTimestamp converts a dnstap timestamp, returning the Unix epoch and
+// false if it is missing or out of range.
+func (edm *DnstapMinimiser) dnstapTimestamp(sec *uint64, nsec *uint32, fieldName string) (time.Time, bool) {
 	if sec == nil {
 		edm.log.Error(fieldName + " is missing, setting time to 0")
-		return time.Unix(0, 0).UTC()
+		return time.Unix(0, 0).UTC(), false
 	}
 	if *sec > math.MaxInt64 {
 		edm.log.Error(fieldName+" is too large for int64, setting time to 0", "value", *sec)
-		return time.Unix(0, 0).UTC()
+		return time.Unix(0, 0).UTC(), false
 	}
 
 	var nsecValue uint32
@@ -253,5 +452,5 @@ func (edm *DnstapMinimiser) dnstapTimestamp(sec *uint64, nsec *uint32, fieldName
 		nsecValue = *nsec
 	}
 
-	return time.Unix(int64(*sec), int64(nsecValue)).UTC() // #nosec G115 -- sec is checked above and nsec is uint32.
+	return time.Unix(int64(*sec), int64(nsecValue)).UTC(), true // #nosec G115 -- sec is checked above and nsec is uint32.
 }
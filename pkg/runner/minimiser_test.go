@@ -1,7 +1,9 @@
 package runner
 
 import (
+	"bytes"
 	"context"
+	"math"
 	"net/netip"
 	"sync"
 	"testing"
@@ -14,8 +16,10 @@ import (
 	lru "github.com/hashicorp/golang-lru/v2"
 	"github.com/miekg/dns"
 	dto "github.com/prometheus/client_model/go"
+	"github.com/segmentio/go-hll"
 	"github.com/twmb/murmur3"
 	"go4.org/netipx"
+	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -25,7 +29,7 @@ func TestRunMinimiserFlows(t *testing.T) {
 		edm.reloadMinimiserConfigCh = []chan struct{}{make(chan struct{}, 1)}
 		edm.newQnamePublisherCh = make(chan *protocols.NewQnameJSON, 1)
 		edm.sessionCollectorCh = make(chan *sessionData, 1)
-		cache, err := lru.New[string, struct{}](2)
+		cache, err := lru.New[string, seenQname](2)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -47,10 +51,11 @@ func TestRunMinimiserFlows(t *testing.T) {
 
 		knownFrame := marshaledDnstap(t, testDnstapMessage(t, dnstap.Message_CLIENT_RESPONSE, dnstap.SocketFamily_INET, packedDNSMsg(t, "known.example.", dns.TypeA, dns.RcodeSuccess)))
 		edm.inputChannel <- knownFrame
-		select {
-		case <-wkd.updateCh:
-		case <-time.After(time.Second):
-			t.Fatal("timed out waiting for WKD update")
+		synctest.Wait()
+		if hd := collectedHistogram(wkd)[0]; hd == nil || hd.OKCount != 1 {
+			t.Fatalf("well-known domain not counted: %#v", hd)
+		} else if hd.ResponseSizeLE64Count != 1 || hd.LatencyGT1sCount != 1 {
+			t.Fatalf("response size and latency not counted: %#v", hd)
 		}
 
 		newFrame := marshaledDnstap(t, testDnstapMessage(t, dnstap.Message_CLIENT_RESPONSE, dnstap.SocketFamily_INET, packedDNSMsg(t, "new.example.", dns.TypeA, dns.RcodeSuccess)))
@@ -60,6 +65,9 @@ func TestRunMinimiserFlows(t *testing.T) {
 			if ev.Qname != "new.example." {
 				t.Fatalf("new qname = %s", ev.Qname)
 			}
+			if ev.Initiator == nil || *ev.Initiator != protocols.NewQnameJSONInitiatorClient {
+				t.Fatalf("new qname initiator = %v, want client", ev.Initiator)
+			}
 		case <-time.After(time.Second):
 			t.Fatal("timed out waiting for new_qname event")
 		}
@@ -95,12 +103,139 @@ func TestRunMinimiserFlows(t *testing.T) {
 	})
 }
 
+func TestRunMinimiserSeenQnameStampedWithClock(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		tc := defaultTC
+		tc.SeenQnameTTL = "24h"
+		edm := newSynctestDnstapMinimiser(t, tc)
+		edm.reloadMinimiserConfigCh = []chan struct{}{make(chan struct{}, 1)}
+		edm.newQnamePublisherCh = make(chan *protocols.NewQnameJSON, 1)
+		edm.sessionCollectorCh = make(chan *sessionData, 1)
+		cache, err := lru.New[string, seenQname](2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store := &pebbleSeenQnameStore{db: newTestPebble(t)}
+		wkd, err := newWellKnownDomainsTracker(testDawgFinder(t, "known.example."), time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(t.Context())
+		defer cancel()
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go edm.runMinimiser(ctx, 0, &wg, edm.reloadMinimiserConfigCh[0], nil, cache, store, nil, defaultLabelLimit, wkd)
+
+		// A frame without a timestamp is parsed as sent in 1970.
+		untimed := testDnstapMessage(t, dnstap.Message_CLIENT_RESPONSE, dnstap.SocketFamily_INET, packedDNSMsg(t, "new.example.", dns.TypeA, dns.RcodeSuccess))
+		untimed.Message.ResponseTimeSec = nil
+		untimed.Message.ResponseTimeNsec = nil
+		edm.inputChannel <- marshaledDnstap(t, untimed)
+		synctest.Wait()
+		<-edm.newQnamePublisherCh
+		<-edm.sessionCollectorCh
+
+		now := edm.deps.Clock.Now()
+		if lastSeen, found, err := store.LastSeen("new.example."); err != nil || !found || !lastSeen.Equal(now) {
+			t.Fatalf("LastSeen = %s, %t, %v, want %s", lastSeen, found, err, now)
+		}
+		if _, expired, err := store.Expire(now.Add(-24*time.Hour), now); err != nil || expired != 0 {
+			t.Fatalf("Expire = %d, %v, want nothing expired", expired, err)
+		}
+		if _, found, _ := store.LastSeen("new.example."); !found {
+			t.Fatal("qname expired right after it was seen")
+		}
+
+		cancel()
+		wg.Wait()
+	})
+}
+
+func TestRunMinimiserProcessQueryMessages(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		tc := defaultTC
+		tc.ProcessQueryMessages = true
+		edm := newSynctestDnstapMinimiser(t, tc)
+		edm.reloadMinimiserConfigCh = []chan struct{}{make(chan struct{}, 1)}
+		edm.newQnamePublisherCh = make(chan *protocols.NewQnameJSON, 1)
+		edm.sessionCollectorCh = make(chan *sessionData, 1)
+		cache, err := lru.New[string, seenQname](2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db := newTestPebble(t)
+		wkd, err := newWellKnownDomainsTracker(testDawgFinder(t, "known.example."), time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(t.Context())
+		defer cancel()
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go edm.runMinimiser(ctx, 0, &wg, edm.reloadMinimiserConfigCh[0], nil, cache, &pebbleSeenQnameStore{db: db}, nil, defaultLabelLimit, wkd)
+
+		knownFrame := marshaledDnstap(t, testDnstapMessage(t, dnstap.Message_CLIENT_QUERY, dnstap.SocketFamily_INET, packedDNSMsg(t, "known.example.", dns.TypeA, dns.RcodeNameError)))
+		edm.inputChannel <- knownFrame
+		synctest.Wait()
+		hd := collectedHistogram(wkd)[0]
+		if hd == nil {
+			t.Fatal("well-known domain not counted")
+		}
+		if hd.QueryCount != 1 || hd.ResponseCount != 0 {
+			t.Fatalf("query/response count = %d/%d, want 1/0", hd.QueryCount, hd.ResponseCount)
+		}
+		if hd.NXCount != 0 {
+			t.Fatalf("NXCount = %d, query messages must not count rcodes", hd.NXCount)
+		}
+		if hd.ACount != 1 {
+			t.Fatalf("ACount = %d, want 1", hd.ACount)
+		}
+
+		newFrame := marshaledDnstap(t, testDnstapMessage(t, dnstap.Message_CLIENT_QUERY, dnstap.SocketFamily_INET, packedDNSMsg(t, "new.example.", dns.TypeA, dns.RcodeSuccess)))
+		edm.inputChannel <- newFrame
+		select {
+		case ev := <-edm.newQnamePublisherCh:
+			if ev.Qname != "new.example." {
+				t.Fatalf("new qname = %s", ev.Qname)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for new_qname event")
+		}
+		select {
+		case sd := <-edm.sessionCollectorCh:
+			if sd.QueryTime == nil || sd.QueryMessage == nil || sd.ResponseMessage != nil {
+				t.Fatalf("session not built from the query message: %#v", sd)
+			}
+			if sd.DnstapMessageType == nil || *sd.DnstapMessageType != int32(dnstap.Message_CLIENT_QUERY) {
+				t.Fatalf("session dnstap message type = %v, want CLIENT_QUERY", sd.DnstapMessageType)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for session")
+		}
+
+		// Turning the mode off on reload drops query messages again.
+		edm.conf.ProcessQueryMessages = false
+		edm.reloadMinimiserConfigCh[0] <- struct{}{}
+		edm.reloadMinimiserConfigCh[0] <- struct{}{}
+		edm.inputChannel <- knownFrame
+		synctest.Wait()
+		if hd := collectedHistogram(wkd)[0]; hd.QueryCount != 1 {
+			t.Fatalf("dropped query counted, query count = %d", hd.QueryCount)
+		}
+
+		cancel()
+		wg.Wait()
+	})
+}
+
 // TestRunMinimiserScratchClientIP verifies that the per-worker scratch buffer
 // used to keep the unpseudonymised client IP yields the correct raw address
 // for every frame, even when a single worker processes consecutive frames of
 // different address families. It feeds an IPv4 frame followed by an IPv6 frame
-// (which fills the scratch buffer completely) and checks that each emitted
-// wkdUpdate carries the original client IP and its matching HLL hash, proving
+// (which fills the scratch buffer completely) and checks that each address
+// family's client HLL holds the hash of the original client IP, proving
 // the IP is captured before pseudonymisation and that reusing the scratch
 // buffer does not corrupt earlier or later frames.
 func TestRunMinimiserScratchClientIP(t *testing.T) {
@@ -109,7 +244,7 @@ func TestRunMinimiserScratchClientIP(t *testing.T) {
 		edm.reloadMinimiserConfigCh = []chan struct{}{make(chan struct{}, 1)}
 		edm.newQnamePublisherCh = make(chan *protocols.NewQnameJSON, 1)
 		edm.sessionCollectorCh = make(chan *sessionData, 1)
-		cache, err := lru.New[string, struct{}](2)
+		cache, err := lru.New[string, seenQname](2)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -135,17 +270,24 @@ func TestRunMinimiserScratchClientIP(t *testing.T) {
 		for _, tc := range tests {
 			frame := marshaledDnstap(t, testDnstapMessage(t, dnstap.Message_CLIENT_RESPONSE, tc.family, packedDNSMsg(t, "known.example.", dns.TypeA, dns.RcodeSuccess)))
 			edm.inputChannel <- frame
-			select {
-			case wu := <-wkd.updateCh:
-				if wu.ip != tc.ip {
-					t.Fatalf("client IP for %s: got %s, want %s", tc.family, wu.ip, tc.ip)
-				}
-				wantHash := murmur3.Sum64(tc.ip.AsSlice())
-				if wu.hllHash != wantHash {
-					t.Fatalf("HLL hash for %s: got %d, want %d", tc.family, wu.hllHash, wantHash)
-				}
-			case <-time.After(time.Second):
-				t.Fatalf("timed out waiting for WKD update for %s", tc.family)
+			synctest.Wait()
+		}
+
+		// Each address family HLL holds exactly the hash of the original
+		// client IP.
+		hd := collectedHistogram(wkd)[0]
+		for _, tc := range tests {
+			want, err := hll.NewHll(getHllDefaults(edm.conf.HistogramHLLExplicitThreshold))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want.AddRaw(murmur3.Sum64(tc.ip.AsSlice()))
+			got := hd.v4ClientHLL
+			if tc.ip.Is6() {
+				got = hd.v6ClientHLL
+			}
+			if !bytes.Equal(got.ToBytes(), want.ToBytes()) {
+				t.Fatalf("client HLL for %s does not hold the hash of %s", tc.family, tc.ip)
 			}
 		}
 
@@ -160,7 +302,7 @@ func TestRunMinimiserParseAndIgnoreFlows(t *testing.T) {
 		edm.reloadMinimiserConfigCh = []chan struct{}{make(chan struct{}, 1)}
 		edm.newQnamePublisherCh = make(chan *protocols.NewQnameJSON)
 		edm.sessionCollectorCh = make(chan *sessionData)
-		cache, err := lru.New[string, struct{}](2)
+		cache, err := lru.New[string, seenQname](2)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -228,7 +370,7 @@ func TestRunMinimiserSessionSendUnblocksOnContextCancel(t *testing.T) {
 		edm.sessionCollectorCh = make(chan *sessionData, 1)
 		edm.sessionCollectorCh <- &sessionData{}
 
-		seenQnameLRU, err := lru.New[string, struct{}](10)
+		seenQnameLRU, err := lru.New[string, seenQname](10)
 		if err != nil {
 			t.Fatalf("lru.New: %s", err)
 		}
@@ -284,13 +426,9 @@ func TestRunMinimiserSkipsMalformedFrames(t *testing.T) {
 		// A well-formed response for a well-known domain must still be processed.
 		edm.inputChannel <- marshaledDnstap(t, testDnstapMessage(t, dnstap.Message_CLIENT_RESPONSE, dnstap.SocketFamily_INET, packedDNSMsg(t, "example.com.", dns.TypeA, dns.RcodeSuccess)))
 
-		select {
-		case wu := <-wkdTracker.updateCh:
-			if wu.dawgIndex == dawgNotFound {
-				t.Fatal("valid frame after malformed input was not treated as well-known")
-			}
-		case <-time.After(2 * time.Second):
-			t.Fatal("valid frame after malformed input was not processed")
+		synctest.Wait()
+		if len(collectedHistogram(wkdTracker)) != 1 {
+			t.Fatal("valid frame after malformed input was not counted as well-known")
 		}
 
 		// Exactly one parse error is counted: only the missing-Message frame both
@@ -309,13 +447,13 @@ func TestRunMinimiserSkipsMalformedFrames(t *testing.T) {
 	})
 }
 
-func newRunMinimiserTestFixture(t *testing.T, knownDomains ...string) (*DnstapMinimiser, *lru.Cache[string, struct{}], *pebble.DB, *wellKnownDomainsTracker) {
+func newRunMinimiserTestFixture(t *testing.T, knownDomains ...string) (*DnstapMinimiser, *lru.Cache[string, seenQname], *pebble.DB, *wellKnownDomainsTracker) {
 	t.Helper()
 
 	edm := newSynctestDnstapMinimiser(t, defaultTC)
 	edm.reloadMinimiserConfigCh = []chan struct{}{make(chan struct{}, 1)}
 
-	seenQnameLRU, err := lru.New[string, struct{}](10)
+	seenQnameLRU, err := lru.New[string, seenQname](10)
 	if err != nil {
 		t.Fatalf("lru.New: %s", err)
 	}
@@ -341,3 +479,87 @@ func marshalPartialDnstap(t *testing.T, dt *dnstap.Dnstap) []byte {
 	}
 	return frame
 }
+
+func TestDnstapLatency(t *testing.T) {
+	sec := func(v uint64) *uint64 { return &v }
+	nsec := func(v uint32) *uint32 { return &v }
+
+	tests := []struct {
+		name string
+		msg  *dnstap.Message
+		want time.Duration
+		ok   bool
+	}{
+		{
+			name: "both timestamps",
+			msg:  &dnstap.Message{QueryTimeSec: sec(10), QueryTimeNsec: nsec(500), ResponseTimeSec: sec(10), ResponseTimeNsec: nsec(2_000_500)},
+			want: 2 * time.Millisecond,
+			ok:   true,
+		},
+		{
+			name: "missing query time",
+			msg:  &dnstap.Message{ResponseTimeSec: sec(10)},
+		},
+		{
+			name: "response before query",
+			msg:  &dnstap.Message{QueryTimeSec: sec(11), ResponseTimeSec: sec(10)},
+		},
+		{
+			name: "out of range",
+			msg:  &dnstap.Message{QueryTimeSec: sec(math.MaxUint64), ResponseTimeSec: sec(math.MaxUint64)},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := dnstapLatency(tc.msg)
+			if got != tc.want || ok != tc.ok {
+				t.Fatalf("dnstapLatency = %s, %t, want %s, %t", got, ok, tc.want, tc.ok)
+			}
+		})
+	}
+}
+
+func TestDnstapSocketProtocol(t *testing.T) {
+	if got := dnstapSocketProtocol(&dnstap.Message{}); got != 0 {
+		t.Fatalf("protocol without socket_protocol = %s, want 0", got)
+	}
+	if got := dnstapSocketProtocol(&dnstap.Message{SocketProtocol: dnstap.SocketProtocol_DOH.Enum()}); got != dnstap.SocketProtocol_DOH {
+		t.Fatalf("protocol = %s, want DOH", got)
+	}
+
+	// Values from a newer dnstap.proto are only found among the
+	// unknown fields after unmarshaling.
+	for _, want := range []dnstap.SocketProtocol{socketProtocolDNSCryptUDP, socketProtocolDNSCryptTCP, socketProtocolDOQ} {
+		msgType := dnstap.Message_CLIENT_RESPONSE
+		b, err := proto.Marshal(&dnstap.Message{Type: &msgType})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b = protowire.AppendTag(b, socketProtocolFieldNumber, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(want))
+
+		m := &dnstap.Message{}
+		if err := proto.Unmarshal(b, m); err != nil {
+			t.Fatal(err)
+		}
+		if got := dnstapSocketProtocol(m); got != want {
+			t.Fatalf("protocol = %d, want %d", got, want)
+		}
+	}
+}
+
+func TestNewQnameInitiator(t *testing.T) {
+	tests := map[dnstap.Message_Type]protocols.NewQnameJSONInitiator{
+		dnstap.Message_CLIENT_QUERY:      protocols.NewQnameJSONInitiatorClient,
+		dnstap.Message_CLIENT_RESPONSE:   protocols.NewQnameJSONInitiatorClient,
+		dnstap.Message_RESOLVER_QUERY:    protocols.NewQnameJSONInitiatorResolver,
+		dnstap.Message_RESOLVER_RESPONSE: protocols.NewQnameJSONInitiatorResolver,
+		dnstap.Message_AUTH_RESPONSE:     "",
+		dnstap.Message_FORWARDER_QUERY:   "",
+	}
+	for msgType, want := range tests {
+		if got := newQnameInitiator(msgType); got != want {
+			t.Errorf("newQnameInitiator(%s) = %q, want %q", msgType, got, want)
+		}
+	}
+}
@@ -11,7 +11,7 @@ import (
 // inputs.
 //
 // The hash feeds HLL sketches that are combined across dnstapir
-// components (see the deterministic-seed comment in sendUpdate in wkd.go),
+// components (see the deterministic-seed comment in newWKDUpdate in wkd.go),
 // so its output is a cross-component contract that must never change —
 // including across hash library swaps.
 //
@@ -0,0 +1,145 @@
+package runner
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/dnstapir/edm/pkg/protocols"
+	"github.com/miekg/dns"
+	"github.com/segmentio/go-hll"
+	"github.com/twmb/murmur3"
+	"golang.org/x/net/publicsuffix"
+)
+
+// newQnameDedupeName returns the name new_qname events for qname are
+// deduplicated on: the public suffix of qname, looked up in the embedded
+// Public Suffix List, plus labels labels, or qname itself if it has no more
+// labels than that. qname is a lower-cased FQDN.
+func newQnameDedupeName(qname string, labels int) string {
+	name := strings.TrimSuffix(qname, ".")
+	if name == "" {
+		return qname
+	}
+
+	suffix, _ := publicsuffix.PublicSuffix(name)
+	keep := strings.Count(suffix, ".") + 1 + labels
+	offsets := dns.Split(qname)
+	if len(offsets) <= keep {
+		return qname
+	}
+	return qname[offsets[len(offsets)-keep]:]
+}
+
+// newQnameDedupe holds the new_qname events of names deduplicated per
+// registrable domain until the histogram interval they were seen in ends,
+// counting the distinct names seen below each of them meanwhile. It is
+// shared by the minimiser workers and emptied by the data collector.
+type newQnameDedupe struct {
+	mu      sync.Mutex
+	pending map[string]*pendingNewQname
+}
+
+// pendingNewQname is a new_qname event waiting for the end of the histogram
+// interval.
+type pendingNewQname struct {
+	event    *protocols.NewQnameJSON
+	subnames hll.Hll
+}
+
+func newNewQnameDedupe() *newQnameDedupe {
+	return &newQnameDedupe{
+		pending: map[string]*pendingNewQname{},
+	}
+}
+
+// add holds event, the new_qname event of the deduplicated name, until the
+// end of the histogram interval, counting subname as the first name seen
+// below it.
+func (d *newQnameDedupe) add(name string, subname string, event *protocols.NewQnameJSON) error {
+	subnames, err := hll.NewHll(getHllDefaults(hll.AutoExplicitThreshold))
+	if err != nil {
+		return err
+	}
+	subnames.AddRaw(murmur3.StringSum64(subname))
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// An event held over from an earlier interval is sent first.
+	if p, ok := d.pending[name]; ok {
+		p.subnames.AddRaw(murmur3.StringSum64(subname))
+		return nil
+	}
+	d.pending[name] = &pendingNewQname{event: event, subnames: subnames}
+	return nil
+}
+
+// addSubname counts subname below name if a new_qname event for name is
+// held in the current histogram interval.
+func (d *newQnameDedupe) addSubname(name string, subname string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if p, ok := d.pending[name]; ok {
+		p.subnames.AddRaw(murmur3.StringSum64(subname))
+	}
+}
+
+// flush hands the pending events with their subname counts set to send,
+// stopping at the first one send does not accept. The events not sent stay
+// pending for the next flush, counting the names seen below them
+// meanwhile. It returns the number of events still pending.
+func (d *newQnameDedupe) flush(send func(*protocols.NewQnameJSON) bool) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for name, p := range d.pending {
+		count := int(p.subnames.Cardinality()) // #nosec G115 -- Far below MaxInt distinct names per interval
+		p.event.SubnameCount = &count
+		if !send(p.event) {
+			break
+		}
+		delete(d.pending, name)
+	}
+	return len(d.pending)
+}
+
+// flushNewQnameDedupe queues the new_qname events of the names deduplicated
+// in the histogram interval that ended for publishing. Events that do not
+// fit in the publisher queue are held until the next interval ends rather
+// than dropped, as their names are already recorded as seen and would never
+// be announced otherwise. With final set they are dropped instead.
+func (edm *DnstapMinimiser) flushNewQnameDedupe(final bool) {
+	if edm.newQnameDedupe == nil {
+		return
+	}
+	if final {
+		edm.newQnameDedupe.flush(func(event *protocols.NewQnameJSON) bool {
+			edm.queueNewQname(event)
+			return true
+		})
+		return
+	}
+	if held := edm.newQnameDedupe.flush(edm.tryQueueNewQname); held > 0 {
+		edm.log.Warn("flushNewQnameDedupe: new_qname publisher queue full, holding deduplicated events until the next interval", "held", held)
+	}
+}
+
+// queueNewQname hands event to the new_qname publisher, dropping it if the
+// publisher is falling behind.
+func (edm *DnstapMinimiser) queueNewQname(event *protocols.NewQnameJSON) {
+	if !edm.tryQueueNewQname(event) {
+		// If the publisher channel is full we skip creating an event.
+		edm.promNewQnameDiscarded.Inc()
+	}
+}
+
+// tryQueueNewQname hands event to the new_qname publisher, reporting
+// whether there was room for it.
+func (edm *DnstapMinimiser) tryQueueNewQname(event *protocols.NewQnameJSON) bool {
+	select {
+	case edm.newQnamePublisherCh <- event:
+		edm.promNewQnameQueued.Inc()
+		return true
+	default:
+		return false
+	}
+}
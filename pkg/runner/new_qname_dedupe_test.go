@@ -0,0 +1,172 @@
+package runner
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/dnstapir/edm/pkg/protocols"
+)
+
+func TestNewQnameDedupeName(t *testing.T) {
+	tests := []struct {
+		qname  string
+		labels int
+		want   string
+	}{
+		{qname: "www.example.com.", labels: 1, want: "example.com."},
+		{qname: "a.b.c.example.com.", labels: 1, want: "example.com."},
+		{qname: "a.b.c.example.com.", labels: 2, want: "c.example.com."},
+		{qname: "a.b.example.co.uk.", labels: 1, want: "example.co.uk."},
+		{qname: "example.com.", labels: 1, want: "example.com."},
+		{qname: "example.com.", labels: 2, want: "example.com."},
+		{qname: "com.", labels: 1, want: "com."},
+		// Names outside the Public Suffix List have a single label
+		// suffix.
+		{qname: "x.y.internal-zone.", labels: 1, want: "y.internal-zone."},
+		{qname: ".", labels: 1, want: "."},
+	}
+
+	for _, test := range tests {
+		if got := newQnameDedupeName(test.qname, test.labels); got != test.want {
+			t.Errorf("newQnameDedupeName(%q, %d) = %q, want %q", test.qname, test.labels, got, test.want)
+		}
+	}
+}
+
+// collectNewQnames returns a send func for newQnameDedupe.flush accepting
+// up to limit events and the subname counts of the accepted events.
+func collectNewQnames(t *testing.T, limit int) (func(*protocols.NewQnameJSON) bool, map[string]int) {
+	t.Helper()
+	counts := map[string]int{}
+	return func(event *protocols.NewQnameJSON) bool {
+		if len(counts) == limit {
+			return false
+		}
+		if event.SubnameCount == nil {
+			t.Fatalf("%s sent without a subname count", event.Qname)
+		}
+		counts[event.Qname] = *event.SubnameCount
+		return true
+	}, counts
+}
+
+func TestNewQnameDedupeFlush(t *testing.T) {
+	d := newNewQnameDedupe()
+
+	// Subnames of names without a pending event are not counted.
+	d.addSubname("example.com.", "ignored.example.com.")
+
+	if err := d.add("example.com.", "a.example.com.", &protocols.NewQnameJSON{Qname: "example.com."}); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 10 {
+		d.addSubname("example.com.", fmt.Sprintf("%d.example.com.", i))
+	}
+	d.addSubname("example.com.", "a.example.com.")
+	if err := d.add("example.net.", "example.net.", &protocols.NewQnameJSON{Qname: "example.net."}); err != nil {
+		t.Fatal(err)
+	}
+
+	send, counts := collectNewQnames(t, -1)
+	if pending := d.flush(send); pending != 0 {
+		t.Fatalf("events pending after flush: %d", pending)
+	}
+	if len(counts) != 2 || counts["example.com."] != 11 || counts["example.net."] != 1 {
+		t.Fatalf("subname counts = %v, want example.com.: 11, example.net.: 1", counts)
+	}
+
+	send, counts = collectNewQnames(t, -1)
+	d.flush(send)
+	if len(counts) != 0 {
+		t.Fatalf("events sent again: %v", counts)
+	}
+}
+
+func TestNewQnameDedupeFlushHeldOver(t *testing.T) {
+	d := newNewQnameDedupe()
+	for _, name := range []string{"example.com.", "example.net."} {
+		if err := d.add(name, "a."+name, &protocols.NewQnameJSON{Qname: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// An event send does not accept stays pending and keeps counting.
+	send, counts := collectNewQnames(t, 1)
+	if pending := d.flush(send); pending != 1 || len(counts) != 1 {
+		t.Fatalf("flush = %d pending, sent %v, want 1 of each", pending, counts)
+	}
+	held := "example.com."
+	if _, ok := counts[held]; ok {
+		held = "example.net."
+	}
+	d.addSubname(held, "b."+held)
+	if err := d.add(held, "c."+held, &protocols.NewQnameJSON{Qname: held}); err != nil {
+		t.Fatal(err)
+	}
+
+	send, counts = collectNewQnames(t, -1)
+	if pending := d.flush(send); pending != 0 || len(counts) != 1 || counts[held] != 3 {
+		t.Fatalf("second flush = %d pending, sent %v, want %s: 3", pending, counts, held)
+	}
+}
+
+func TestNewQnameDedupeFlushedAtHistogramRotation(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		tc := defaultTC
+		tc.HistogramInterval = "5m"
+		edm := newSynctestDnstapMinimiser(t, tc)
+		edm.newQnameDedupe = newNewQnameDedupe()
+		wkd, err := newWellKnownDomainsTracker(testDawgFinder(t, "example.com."), time.Unix(0, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		histogramEnd := time.Now().UTC().Truncate(5 * time.Minute).Add(5 * time.Minute)
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go edm.dataCollector(&wg, wkd, "unused.dawg")
+
+		if err := edm.newQnameDedupe.add("example.com.", "a.example.com.", &protocols.NewQnameJSON{Qname: "example.com."}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Subnames are counted for the whole histogram interval.
+		time.Sleep(2 * time.Minute)
+		edm.newQnameDedupe.addSubname("example.com.", "b.example.com.")
+		time.Sleep(time.Until(histogramEnd) - time.Second)
+		edm.newQnameDedupe.addSubname("example.com.", "c.example.com.")
+		synctest.Wait()
+		if len(edm.newQnamePublisherCh) != 0 {
+			t.Fatal("event queued before the histogram interval ended")
+		}
+
+		time.Sleep(time.Second)
+		synctest.Wait()
+		select {
+		case ev := <-edm.newQnamePublisherCh:
+			if ev.Qname != "example.com." || ev.SubnameCount == nil || *ev.SubnameCount != 3 {
+				t.Fatalf("flushed event = %#v", ev)
+			}
+		default:
+			t.Fatal("event not queued at the histogram rotation")
+		}
+
+		// Events pending when the collector stops are queued as well.
+		if err := edm.newQnameDedupe.add("example.net.", "example.net.", &protocols.NewQnameJSON{Qname: "example.net."}); err != nil {
+			t.Fatal(err)
+		}
+		close(wkd.stop)
+		wg.Wait()
+		select {
+		case ev := <-edm.newQnamePublisherCh:
+			if ev.Qname != "example.net." {
+				t.Fatalf("event queued on stop = %s", ev.Qname)
+			}
+		default:
+			t.Fatal("pending event not queued on stop")
+		}
+	})
+}
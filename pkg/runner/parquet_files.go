@@ -178,3 +178,35 @@ func timestampToFileString(ts time.Time) string {
 
 	return timeString
 }
+
+// Output partitioned per dnstap identity is written to hive style sub
+// directories named identityPartitionPrefix + the escaped identity, e.g.
+// "identity=resolver-1.example.net".
+const identityPartitionPrefix = "identity="
+
+// identityPartitionDir returns baseDir for data without an identity and the
+// identity partition directory below baseDir otherwise.
+func identityPartitionDir(baseDir string, identity string) string {
+	if identity == "" {
+		return baseDir
+	}
+	return filepath.Join(baseDir, identityPartitionPrefix+escapePartitionValue(identity))
+}
+
+// escapePartitionValue makes an arbitrary identity safe to use as a single
+// path element. Letters, digits, '-', '.' and '_' are kept and every other
+// byte is percent-encoded, so the result can be decoded with
+// url.PathUnescape.
+func escapePartitionValue(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '.', c == '_':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -6,11 +6,14 @@ import (
 	"io"
 	"io/fs"
 	"log/slog"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/parquet-go/parquet-go"
 )
 
 func TestTimestampsFromFilenameRejectsMalformedNames(t *testing.T) {
@@ -83,19 +86,18 @@ func TestCreateSessionAndHistogramFiles(t *testing.T) {
 	edm := newTestDnstapMinimiser(t, defaultTC)
 	dataDir := t.TempDir()
 	rotationTime := time.Date(2026, 5, 28, 12, 1, 0, 0, time.UTC)
-	ps := &prevSessions{
-		rotationTime: rotationTime,
-		sessions: []*sessionData{{
-			dnsLabels: dnsLabels{Label0: ptr("com")},
-			ServerID:  ptr("server"),
-		}},
-	}
-	sessionFile, err := edm.createSessionFile(ps, dataDir)
+	w := edm.newSessionFileWriter(dataDir)
+	w.write(&sessionData{
+		dnsLabels: dnsLabels{Label0: ptr("com")},
+		ServerID:  ptr("server"),
+	}, rotationTime.Add(-time.Minute))
+	w.rotate(rotationTime)
+	sessionFiles, err := filepath.Glob(filepath.Join(dataDir, "parquet", "sessions", "*"))
 	if err != nil {
 		t.Fatal(err)
 	}
-	if strings.HasSuffix(sessionFile, ".tmp") {
-		t.Fatalf("session file kept tmp suffix: %s", sessionFile)
+	if want := filepath.Join(dataDir, "parquet", "sessions", "dns_session_block-2026-05-28T12-00-00Z_2026-05-28T12-01-00Z.parquet"); len(sessionFiles) != 1 || sessionFiles[0] != want {
+		t.Fatalf("session files = %v, want %s", sessionFiles, want)
 	}
 
 	finder := testDawgFinder(t, "example.com.")
@@ -368,3 +370,90 @@ func TestWriteRotatedParquet(t *testing.T) {
 		}
 	})
 }
+
+func TestIdentityPartitionDir(t *testing.T) {
+	tests := []struct {
+		identity string
+		want     string
+	}{
+		{identity: "", want: "base"},
+		{identity: "resolver-1.example.net", want: filepath.Join("base", "identity=resolver-1.example.net")},
+		{identity: "../etc", want: filepath.Join("base", "identity=..%2Fetc")},
+		{identity: "a b=c%", want: filepath.Join("base", "identity=a%20b%3Dc%25")},
+		{identity: "räksmörgås", want: filepath.Join("base", "identity=r%C3%A4ksm%C3%B6rg%C3%A5s")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.identity, func(t *testing.T) {
+			got := identityPartitionDir("base", test.identity)
+			if got != test.want {
+				t.Fatalf("identityPartitionDir(%q) = %q, want %q", test.identity, got, test.want)
+			}
+			if test.identity == "" {
+				return
+			}
+			unescaped, err := url.PathUnescape(strings.TrimPrefix(filepath.Base(got), identityPartitionPrefix))
+			if err != nil || unescaped != test.identity {
+				t.Fatalf("unescaped partition value = %q (%v), want %q", unescaped, err, test.identity)
+			}
+		})
+	}
+}
+
+func TestCreatePartitionedSessionAndHistogramFiles(t *testing.T) {
+	tc := defaultTC
+	tc.PartitionByIdentity = true
+	edm := newTestDnstapMinimiser(t, tc)
+	dataDir := t.TempDir()
+	rotationTime := time.Date(2026, 5, 28, 12, 1, 0, 0, time.UTC)
+	w := edm.newSessionFileWriter(dataDir)
+	w.write(&sessionData{ServerID: ptr("resolver 1")}, rotationTime.Add(-time.Minute))
+	w.write(&sessionData{}, rotationTime.Add(-time.Minute))
+	w.rotate(rotationTime)
+	sessionFile := filepath.Join(dataDir, "parquet", "sessions", "identity=resolver%201", "dns_session_block-2026-05-28T12-00-00Z_2026-05-28T12-01-00Z.parquet")
+	if _, err := os.Stat(sessionFile); err != nil {
+		t.Fatalf("partitioned session file: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "parquet", "sessions", filepath.Base(sessionFile))); err != nil {
+		t.Fatalf("session file without identity: %s", err)
+	}
+
+	outboxDir := filepath.Join(dataDir, "parquet", "histograms", "outbox")
+	wkd := &wellKnownDomainsData{
+		rotationTime: rotationTime,
+		dawgFinder:   testDawgFinder(t, "example.com."),
+		m:            map[int]*histogramData{0: edm.newHistogramData(getHllDefaults(0), false)},
+		identity:     "resolver 1",
+	}
+	histFile, err := edm.createHistogramFile(wkd, defaultLabelLimit, outboxDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(outboxDir, "identity=resolver%201"); filepath.Dir(histFile) != want {
+		t.Fatalf("histogram file %s not written to %s", histFile, want)
+	}
+
+	f, err := os.Open(histFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pf, err := parquet.OpenFile(f, fi.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity, ok := pf.Lookup(histogramIdentityMetadataKey); !ok || identity != "resolver 1" {
+		t.Fatalf("histogram identity metadata = %q, %t", identity, ok)
+	}
+	if version, ok := pf.Lookup(histogramSchemaVersionMetadataKey); !ok || version != histogramSchemaVersion {
+		t.Fatalf("histogram schema version metadata = %q, %t", version, ok)
+	}
+}
@@ -6,8 +6,13 @@ import (
 	"time"
 )
 
+// parquetRotationRequest asks the data collector to rotate the collected
+// data at rotationTime. A manual request rotates both sessions and
+// histograms, a scheduled one, as sent when replaying dnstap files, only
+// rotates those whose interval has ended at rotationTime.
 type parquetRotationRequest struct {
 	rotationTime time.Time
+	scheduled    bool
 	done         chan error
 }
 
@@ -0,0 +1,62 @@
+package runner
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"net"
+	"net/netip"
+)
+
+// addressPseudonymiser maps client and server addresses to their
+// pseudonyms. The method has the signature of
+// [github.com/yawning/cryptopan.Cryptopan.Anonymize] so a Crypto-PAn
+// instance can be used as is.
+type addressPseudonymiser interface {
+	Anonymize(addr net.IP) net.IP
+}
+
+// truncatePseudonymiser zeroes the host bits of an address below a prefix
+// length, e.g. keeping the /24 of IPv4 and the /48 of IPv6 addresses.
+type truncatePseudonymiser struct {
+	ipv4PrefixLength int
+	ipv6PrefixLength int
+}
+
+func (tp truncatePseudonymiser) Anonymize(addr net.IP) net.IP {
+	if ip4 := addr.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(tp.ipv4PrefixLength, 8*net.IPv4len))
+	}
+	return addr.Mask(net.CIDRMask(tp.ipv6PrefixLength, 8*net.IPv6len))
+}
+
+// hmacPseudonymiser replaces an address with a keyed hash of it, mapped
+// into the address space of the same family. Unlike Crypto-PAn it does not
+// preserve prefixes, so addresses in the same network can not be linked by
+// their pseudonyms.
+type hmacPseudonymiser struct {
+	key []byte
+}
+
+func (hp hmacPseudonymiser) Anonymize(addr net.IP) net.IP {
+	ip, ok := netip.AddrFromSlice(addr)
+	if !ok {
+		return nil
+	}
+	ip = ip.Unmap()
+
+	mac := hmac.New(sha256.New, hp.key)
+	mac.Write(ip.AsSlice())
+	sum := mac.Sum(nil)
+
+	if ip.Is4() {
+		return net.IP(sum[:net.IPv4len])
+	}
+	return net.IP(sum[:net.IPv6len])
+}
+
+// noPseudonymiser leaves addresses as they are, for lab setups only.
+type noPseudonymiser struct{}
+
+func (noPseudonymiser) Anonymize(addr net.IP) net.IP {
+	return addr
+}
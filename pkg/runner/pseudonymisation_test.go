@@ -0,0 +1,117 @@
+package runner
+
+import (
+	"net/netip"
+	"testing"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+func TestPseudonymisationModes(t *testing.T) {
+	v4 := netip.MustParseAddr("198.51.100.20")
+	v4Neighbour := netip.MustParseAddr("198.51.100.21")
+	v6 := netip.MustParseAddr("2001:db8:1122:3344:5566:7788:99aa:bbcc")
+
+	tests := []struct {
+		mode  string
+		check func(t *testing.T, pseudonymise func(netip.Addr) netip.Addr)
+	}{
+		{
+			mode: PseudonymisationModeTruncate,
+			check: func(t *testing.T, pseudonymise func(netip.Addr) netip.Addr) {
+				if got := pseudonymise(v4); got != netip.MustParseAddr("198.51.100.0") {
+					t.Fatalf("truncated IPv4 = %s", got)
+				}
+				if got := pseudonymise(v6); got != netip.MustParseAddr("2001:db8:1122::") {
+					t.Fatalf("truncated IPv6 = %s", got)
+				}
+			},
+		},
+		{
+			mode: PseudonymisationModeHMAC,
+			check: func(t *testing.T, pseudonymise func(netip.Addr) netip.Addr) {
+				got := pseudonymise(v4)
+				if !got.Is4() || got == v4 || got != pseudonymise(v4) {
+					t.Fatalf("hashed IPv4 = %s", got)
+				}
+				// Addresses in the same network do not share a
+				// prefix.
+				if neighbour := pseudonymise(v4Neighbour); netip.PrefixFrom(got, 24).Masked() == netip.PrefixFrom(neighbour, 24).Masked() {
+					t.Fatalf("hashed neighbours %s and %s share their /24", got, neighbour)
+				}
+				if got := pseudonymise(v6); !got.Is6() || got.Is4In6() || got == v6 {
+					t.Fatalf("hashed IPv6 = %s", got)
+				}
+			},
+		},
+		{
+			mode: PseudonymisationModeNone,
+			check: func(t *testing.T, pseudonymise func(netip.Addr) netip.Addr) {
+				if got := pseudonymise(v4); got != v4 {
+					t.Fatalf("IPv4 = %s, want it unchanged", got)
+				}
+				if got := pseudonymise(v6); got != v6 {
+					t.Fatalf("IPv6 = %s, want it unchanged", got)
+				}
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.mode, func(t *testing.T) {
+			conf := defaultTC
+			conf.PseudonymisationMode = tc.mode
+			edm := newTestDnstapMinimiser(t, conf)
+			cache, err := lru.New[netip.Addr, netip.Addr](10)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tc.check(t, func(addr netip.Addr) netip.Addr {
+				t.Helper()
+				b, err := edm.pseudonymiseIP(addr.AsSlice(), edm.cryptopan.Load().cpn, cache)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, ok := netip.AddrFromSlice(b)
+				if !ok {
+					t.Fatalf("invalid pseudonymised address %v", b)
+				}
+				return got
+			})
+		})
+	}
+}
+
+func TestHMACPseudonymiserKey(t *testing.T) {
+	addr := netip.MustParseAddr("198.51.100.20").AsSlice()
+	a := hmacPseudonymiser{key: []byte("key a")}.Anonymize(addr)
+	b := hmacPseudonymiser{key: []byte("key b")}.Anonymize(addr)
+	if a.Equal(b) {
+		t.Fatalf("different keys gave the same pseudonym %s", a)
+	}
+}
+
+func TestPseudonymisationModeNotReloaded(t *testing.T) {
+	edm := newTestDnstapMinimiser(t, defaultTC)
+
+	// A reload that changes the key installs a new pseudonymiser, but of
+	// the mode captured at startup.
+	next := defaultTC
+	next.DataDir = edm.getConfig().DataDir
+	next.CryptopanKey = "key2"
+	next.PseudonymisationMode = PseudonymisationModeNone
+	edm.configer = next
+	if err := edm.updateConfig(); err != nil {
+		t.Fatal(err)
+	}
+	conf := edm.getConfig()
+	if err := edm.setCryptopan(conf.CryptopanKey, conf.CryptopanKeySalt, conf.CryptopanAddressEntries); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := edm.cryptopan.Load().cpn.(noPseudonymiser); ok {
+		t.Fatal("reload switched the pseudonymisation mode")
+	}
+	if edm.pseudonymisation.mode != PseudonymisationModeCryptopan {
+		t.Fatalf("pseudonymisation mode = %q, want %q", edm.pseudonymisation.mode, PseudonymisationModeCryptopan)
+	}
+}
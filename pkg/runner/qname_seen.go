@@ -1,50 +1,150 @@
 package runner
 
 import (
+	"context"
 	"strings"
+	"sync"
+	"time"
 
 	lru "github.com/hashicorp/golang-lru/v2"
-	"github.com/miekg/dns"
 )
 
+// seenQnameRefreshDivisor sets how often the last-seen timestamp of a
+// qname that keeps being seen is written to the store with seen-qname-ttl
+// enabled: at most once every seen-qname-ttl / seenQnameRefreshDivisor. The
+// stored timestamp may lag that much behind the real last sighting, so a
+// name can be re-announced after being quiet for a tenth less than the TTL.
+const seenQnameRefreshDivisor = 10
+
+// seenQnameExpiryInterval is how often expired qnames are dropped from the
+// seen-qname store.
+const seenQnameExpiryInterval = time.Hour
+
+// seenQname is the seen-qname LRU entry of a qname.
+type seenQname struct {
+	// lastSeen is when the qname was last seen, the zero time if it is
+	// not known for a qname recorded before seen-qname-ttl existed.
+	lastSeen time.Time
+	// stored is the last-seen timestamp recorded in the seen-qname store.
+	stored time.Time
+}
+
 // qnameSeen reports whether qname has been seen since startup, recording it
-// (in the in-memory LRU and in the store) on first sight. syncWrites selects
+// (in the in-memory LRU and in the store) on first sight. qname is matched
+// case-insensitively. syncWrites selects
 // fsynced store inserts and mirrors [Config.PebbleSync].
 //
+// With a ttl above 0 a qname that has not been seen for longer than ttl
+// before now is reported as new again, and the last-seen timestamp in the
+// store is kept up to date for the seen-qname expiry.
+//
 // The check-and-record runs under edm.seenQnameMutex so concurrent minimiser
 // workers report any given qname as new at most once.
-func (edm *DnstapMinimiser) qnameSeen(msg *dns.Msg, seenQnameLRU *lru.Cache[string, struct{}], store seenQnameStore, syncWrites bool) bool {
-	qname := strings.ToLower(msg.Question[0].Name)
+func (edm *DnstapMinimiser) qnameSeen(qname string, seenQnameLRU *lru.Cache[string, seenQname], store SeenQnameStore, syncWrites bool, now time.Time, ttl time.Duration) bool {
+	qname = strings.ToLower(qname)
 	edm.seenQnameMutex.Lock()
 	defer edm.seenQnameMutex.Unlock()
 
-	_, ok := seenQnameLRU.Get(qname)
-	if ok {
+	entry, ok := seenQnameLRU.Get(qname)
+	if ok && ttl <= 0 {
 		// It exists in the LRU cache
 		return true
 	}
-	// Add it to the LRU
-	evicted := seenQnameLRU.Add(qname, struct{}{})
+
+	if !ok {
+		lastSeen, found, err := store.LastSeen(qname)
+		if err != nil {
+			// LastSeen reports found=true together with a non-nil
+			// error when the value was found but releasing its
+			// resources failed; honor the lookup result so an
+			// already-recorded qname is not republished as new. The
+			// insert is skipped either way: the qname is already
+			// recorded, or the store is in unknown shape.
+			edm.log.Error("unable to get key from seen-qname store", "error", err)
+			edm.addSeenQname(seenQnameLRU, qname, seenQname{lastSeen: now, stored: now})
+			return found
+		}
+		if found {
+			entry = seenQname{lastSeen: lastSeen, stored: lastSeen}
+			ok = true
+		}
+	}
+
+	seen := ok && (ttl <= 0 || entry.lastSeen.IsZero() || now.Sub(entry.lastSeen) <= ttl)
+	if !seen || (ttl > 0 && now.Sub(entry.stored) >= ttl/seenQnameRefreshDivisor) {
+		if err := store.MarkSeen(qname, now, syncWrites); err != nil {
+			edm.log.Error("unable to insert key in seen-qname store", "error", err)
+		}
+		entry.stored = now
+	}
+	if now.After(entry.lastSeen) {
+		entry.lastSeen = now
+	}
+	edm.addSeenQname(seenQnameLRU, qname, entry)
+
+	return seen
+}
+
+func (edm *DnstapMinimiser) addSeenQname(seenQnameLRU *lru.Cache[string, seenQname], qname string, entry seenQname) {
+	evicted := seenQnameLRU.Add(qname, entry)
 	if evicted {
 		edm.promSeenQnameLRUEvicted.Inc()
 	}
+}
 
-	seen, err := store.Has(qname)
-	if err != nil {
-		// Has reports seen=true together with a non-nil error when the
-		// value was found but releasing its resources failed; honor the
-		// lookup result so an already-recorded qname is not republished
-		// as new. The insert is skipped either way: the qname is already
-		// recorded, or the store is in unknown shape.
-		edm.log.Error("unable to get key from seen-qname store", "error", err)
-		return seen
-	}
-	if seen {
-		return true
+// seenQnameExpirer drops qnames that have not been seen for longer than
+// ttl from the seen-qname store every seenQnameExpiryInterval, starting
+// right away, and reports the size of the store. Qnames recorded before
+// seen-qname-ttl existed are given a full ttl from the first run.
+func (edm *DnstapMinimiser) seenQnameExpirer(ctx context.Context, wg *sync.WaitGroup, store SeenQnameStore, ttl time.Duration) {
+	defer wg.Done()
+
+	for {
+		now := edm.deps.Clock.Now()
+		entries, expired, err := store.Expire(now.Add(-ttl), now)
+		if err != nil {
+			edm.log.Error("seenQnameExpirer: unable to expire seen-qname store", "error", err)
+		} else {
+			edm.promSeenQnameExpired.Add(float64(expired))
+			edm.promSeenQnameStoreEntries.Set(float64(entries))
+			edm.log.Info("seenQnameExpirer: expired seen-qname store", "expired", expired, "entries", entries)
+		}
+
+		select {
+		case <-edm.deps.Clock.After(seenQnameExpiryInterval):
+		case <-ctx.Done():
+			edm.log.Info("exiting seenQnameExpirer loop")
+			return
+		}
 	}
+}
+
+// bloomSeenQnameFlusher writes the bloom seen-qname store to disk every
+// bloomSeenQnameFlushInterval and reports how full the filter is, starting
+// right away. It warns once when the false-positive rate passes the one the
+// filter was sized for. The store writes itself once more when it is
+// closed.
+func (edm *DnstapMinimiser) bloomSeenQnameFlusher(ctx context.Context, wg *sync.WaitGroup, bs *bloomSeenQnameStore) {
+	defer wg.Done()
+
+	warned := false
+	for {
+		if err := bs.flush(); err != nil {
+			edm.log.Error("bloomSeenQnameFlusher: unable to write bloom filter", "error", err)
+		}
+		ratio, falsePositiveRate := bs.fill()
+		edm.promSeenQnameBloomFillRatio.Set(ratio)
+		edm.promSeenQnameBloomFPRate.Set(falsePositiveRate)
+		if !warned && falsePositiveRate > bs.falsePositiveRate {
+			edm.log.Warn("bloomSeenQnameFlusher: bloom filter is past its capacity, new qnames are going unannounced, raise seen-qname-capacity", "false_positive_rate", falsePositiveRate, "seen_qname_false_positive_rate", bs.falsePositiveRate)
+			warned = true
+		}
 
-	if err := store.MarkSeen(qname, syncWrites); err != nil {
-		edm.log.Error("unable to insert key in seen-qname store", "error", err)
+		select {
+		case <-edm.deps.Clock.After(bloomSeenQnameFlushInterval):
+		case <-ctx.Done():
+			edm.log.Info("exiting bloomSeenQnameFlusher loop")
+			return
+		}
 	}
-	return false
 }
@@ -3,6 +3,7 @@ package runner
 import (
 	"strconv"
 	"testing"
+	"time"
 
 	lru "github.com/hashicorp/golang-lru/v2"
 	"github.com/miekg/dns"
@@ -18,7 +19,7 @@ func BenchmarkQnameSeen(b *testing.B) {
 	edm := newTestDnstapMinimiser(b, defaultTC)
 
 	const nQnames = 10_000
-	cache, err := lru.New[string, struct{}](nQnames * 2) // oversized so nothing is evicted
+	cache, err := lru.New[string, seenQname](nQnames * 2) // oversized so nothing is evicted
 	if err != nil {
 		b.Fatalf("lru.New: %s", err)
 	}
@@ -31,12 +32,12 @@ func BenchmarkQnameSeen(b *testing.B) {
 		m.SetQuestion("host"+strconv.Itoa(i)+".example.com.", dns.TypeA)
 		msgs[i] = m
 		// Record it so the benchmarked calls below all take the seen path.
-		edm.qnameSeen(m, cache, store, defaultTC.PebbleSync)
+		edm.qnameSeen(m.Question[0].Name, cache, store, defaultTC.PebbleSync, time.Unix(10, 0), 0)
 	}
 
 	// Sanity check (in the benchmark goroutine, not the parallel workers): a
 	// seeded qname must report as already seen.
-	if !edm.qnameSeen(msgs[0], cache, store, defaultTC.PebbleSync) {
+	if !edm.qnameSeen(msgs[0].Question[0].Name, cache, store, defaultTC.PebbleSync, time.Unix(10, 0), 0) {
 		b.Fatal("seeded qname should report as already seen")
 	}
 
@@ -45,7 +46,7 @@ func BenchmarkQnameSeen(b *testing.B) {
 	b.RunParallel(func(pb *testing.PB) {
 		i := 0
 		for pb.Next() {
-			edm.qnameSeen(msgs[i%nQnames], cache, store, defaultTC.PebbleSync)
+			edm.qnameSeen(msgs[i%nQnames].Question[0].Name, cache, store, defaultTC.PebbleSync, time.Unix(10, 0), 0)
 			i++
 		}
 	})
@@ -1,41 +1,50 @@
 package runner
 
 import (
+	"context"
 	"sync"
 	"testing"
+	"testing/synctest"
+	"time"
 
 	lru "github.com/hashicorp/golang-lru/v2"
 	"github.com/miekg/dns"
 )
 
 func TestQnameSeen(t *testing.T) {
-	edm := newTestDnstapMinimiser(t, defaultTC)
-	db := newTestPebble(t)
-	cache, err := lru.New[string, struct{}](1)
-	if err != nil {
-		t.Fatal(err)
-	}
+	for _, backend := range testSeenQnameBackends {
+		t.Run(backend, func(t *testing.T) {
+			edm := newTestDnstapMinimiser(t, defaultTC)
+			store := newTestSeenQnameStore(t, backend)
+			cache, err := lru.New[string, seenQname](1)
+			if err != nil {
+				t.Fatal(err)
+			}
 
-	msg := new(dns.Msg)
-	msg.SetQuestion("Example.COM.", dns.TypeA)
-	if edm.qnameSeen(msg, cache, &pebbleSeenQnameStore{db: db}, defaultTC.PebbleSync) {
-		t.Fatal("first qnameSeen call returned true")
-	}
-	if !edm.qnameSeen(msg, cache, &pebbleSeenQnameStore{db: db}, defaultTC.PebbleSync) {
-		t.Fatal("second qnameSeen call returned false")
-	}
+			msg := new(dns.Msg)
+			msg.SetQuestion("Example.COM.", dns.TypeA)
+			if edm.qnameSeen(msg.Question[0].Name, cache, store, defaultTC.PebbleSync, time.Unix(10, 0), 0) {
+				t.Fatal("first qnameSeen call returned true")
+			}
+			if !edm.qnameSeen(msg.Question[0].Name, cache, store, defaultTC.PebbleSync, time.Unix(10, 0), 0) {
+				t.Fatal("second qnameSeen call returned false")
+			}
 
-	cache, err = lru.New[string, struct{}](1)
-	if err != nil {
-		t.Fatal(err)
-	}
-	if !edm.qnameSeen(msg, cache, &pebbleSeenQnameStore{db: db}, defaultTC.PebbleSync) {
-		t.Fatal("qnameSeen did not find qname in pebble")
-	}
+			cache, err = lru.New[string, seenQname](1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !edm.qnameSeen(msg.Question[0].Name, cache, store, defaultTC.PebbleSync, time.Unix(10, 0), 0) {
+				t.Fatal("qnameSeen did not find qname in the store")
+			}
 
-	other := new(dns.Msg)
-	other.SetQuestion("other.example.", dns.TypeA)
-	_ = edm.qnameSeen(other, cache, &pebbleSeenQnameStore{db: db}, defaultTC.PebbleSync)
+			other := new(dns.Msg)
+			other.SetQuestion("other.example.", dns.TypeA)
+			if edm.qnameSeen(other.Question[0].Name, cache, store, defaultTC.PebbleSync, time.Unix(10, 0), 0) {
+				t.Fatal("qnameSeen of another qname returned true")
+			}
+		})
+	}
 }
 
 // TestQnameSeenLRUEviction verifies the LRU-evicted bookkeeping arm of
@@ -43,29 +52,33 @@ func TestQnameSeen(t *testing.T) {
 // previously-cached qname is evicted and promSeenQnameLRUEvicted is
 // incremented.
 func TestQnameSeenLRUEviction(t *testing.T) {
-	edm := newTestDnstapMinimiser(t, defaultTC)
-	db := newTestPebble(t)
-	cache, err := lru.New[string, struct{}](1)
-	if err != nil {
-		t.Fatal(err)
-	}
+	for _, backend := range testSeenQnameBackends {
+		t.Run(backend, func(t *testing.T) {
+			edm := newTestDnstapMinimiser(t, defaultTC)
+			store := newTestSeenQnameStore(t, backend)
+			cache, err := lru.New[string, seenQname](1)
+			if err != nil {
+				t.Fatal(err)
+			}
 
-	first := new(dns.Msg)
-	first.SetQuestion("a.example.", dns.TypeA)
-	if edm.qnameSeen(first, cache, &pebbleSeenQnameStore{db: db}, defaultTC.PebbleSync) {
-		t.Fatal("first qname unexpectedly already-seen")
-	}
+			first := new(dns.Msg)
+			first.SetQuestion("a.example.", dns.TypeA)
+			if edm.qnameSeen(first.Question[0].Name, cache, store, defaultTC.PebbleSync, time.Unix(10, 0), 0) {
+				t.Fatal("first qname unexpectedly already-seen")
+			}
 
-	second := new(dns.Msg)
-	second.SetQuestion("b.example.", dns.TypeA)
-	// Adding the second distinct qname evicts the first from the LRU,
-	// exercising the evicted/promSeenQnameLRUEvicted.Inc() arm.
-	_ = edm.qnameSeen(second, cache, &pebbleSeenQnameStore{db: db}, defaultTC.PebbleSync)
-	if cache.Len() != 1 {
-		t.Fatalf("cache len = %d, want 1 after eviction", cache.Len())
-	}
-	if cache.Contains("a.example.") {
-		t.Fatal("a.example. should have been evicted")
+			second := new(dns.Msg)
+			second.SetQuestion("b.example.", dns.TypeA)
+			// Adding the second distinct qname evicts the first from the LRU,
+			// exercising the evicted/promSeenQnameLRUEvicted.Inc() arm.
+			_ = edm.qnameSeen(second.Question[0].Name, cache, store, defaultTC.PebbleSync, time.Unix(10, 0), 0)
+			if cache.Len() != 1 {
+				t.Fatalf("cache len = %d, want 1 after eviction", cache.Len())
+			}
+			if cache.Contains("a.example.") {
+				t.Fatal("a.example. should have been evicted")
+			}
+		})
 	}
 }
 
@@ -76,15 +89,24 @@ type fakeSeenQnameStore struct {
 	hasErr    error
 	markCalls int
 	markErr   error
+	// expireCutoffs records the cutoffs Expire was called with.
+	expireCutoffs []time.Time
 }
 
-func (f *fakeSeenQnameStore) Has(string) (bool, error) { return f.hasSeen, f.hasErr }
+func (f *fakeSeenQnameStore) LastSeen(string) (time.Time, bool, error) {
+	return time.Time{}, f.hasSeen, f.hasErr
+}
 
-func (f *fakeSeenQnameStore) MarkSeen(string, bool) error {
+func (f *fakeSeenQnameStore) MarkSeen(string, time.Time, bool) error {
 	f.markCalls++
 	return f.markErr
 }
 
+func (f *fakeSeenQnameStore) Expire(cutoff, _ time.Time) (int, int, error) {
+	f.expireCutoffs = append(f.expireCutoffs, cutoff)
+	return 5, 2, nil
+}
+
 func (f *fakeSeenQnameStore) Close() error { return nil }
 
 // TestQnameSeenStoreError verifies qnameSeen honors the lookup result when the
@@ -105,14 +127,14 @@ func TestQnameSeenStoreError(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			edm := newTestDnstapMinimiser(t, defaultTC)
-			cache, err := lru.New[string, struct{}](1)
+			cache, err := lru.New[string, seenQname](1)
 			if err != nil {
 				t.Fatal(err)
 			}
 
 			msg := new(dns.Msg)
 			msg.SetQuestion("example.com.", dns.TypeA)
-			if got := edm.qnameSeen(msg, cache, tt.store, defaultTC.PebbleSync); got != tt.want {
+			if got := edm.qnameSeen(msg.Question[0].Name, cache, tt.store, defaultTC.PebbleSync, time.Unix(10, 0), 0); got != tt.want {
 				t.Fatalf("qnameSeen = %t, want %t", got, tt.want)
 			}
 			if tt.store.markCalls != tt.wantMarks {
@@ -123,43 +145,258 @@ func TestQnameSeenStoreError(t *testing.T) {
 }
 
 func TestQnameSeenConcurrentFirstSeenOnce(t *testing.T) {
-	edm := newTestDnstapMinimiser(t, defaultTC)
+	for _, backend := range testSeenQnameBackends {
+		t.Run(backend, func(t *testing.T) {
+			edm := newTestDnstapMinimiser(t, defaultTC)
+
+			seenQnameLRU, err := lru.New[string, seenQname](10)
+			if err != nil {
+				t.Fatalf("lru.New: %s", err)
+			}
+
+			store := newTestSeenQnameStore(t, backend)
+
+			msg := new(dns.Msg)
+			msg.SetQuestion("race.example.", dns.TypeA)
+
+			const goroutines = 64
+			start := make(chan struct{})
+			results := make(chan bool, goroutines)
 
-	seenQnameLRU, err := lru.New[string, struct{}](10)
+			var wg sync.WaitGroup
+			wg.Add(goroutines)
+			for range goroutines {
+				go func() {
+					defer wg.Done()
+					<-start
+					results <- edm.qnameSeen(msg.Question[0].Name, seenQnameLRU, store, defaultTC.PebbleSync, time.Unix(10, 0), 0)
+				}()
+			}
+
+			close(start)
+			wg.Wait()
+			close(results)
+
+			var firstSeen int
+			for seen := range results {
+				if !seen {
+					firstSeen++
+				}
+			}
+			if firstSeen != 1 {
+				t.Fatalf("first-seen results have: %d, want: 1", firstSeen)
+			}
+		})
+	}
+}
+
+// markLegacySeen records qname in store the way it was recorded before
+// seen-qname-ttl existed: without a timestamp.
+func markLegacySeen(t *testing.T, store SeenQnameStore, qname string) {
+	t.Helper()
+	var err error
+	if ps, ok := store.(*pebbleSeenQnameStore); ok {
+		err = ps.db.Set([]byte(qname), []byte{}, nil)
+	} else {
+		err = store.MarkSeen(qname, time.Time{}, false)
+	}
 	if err != nil {
-		t.Fatalf("lru.New: %s", err)
+		t.Fatal(err)
+	}
+}
+
+func TestQnameSeenTTL(t *testing.T) {
+	for _, backend := range testSeenQnameTTLBackends {
+		t.Run(backend, func(t *testing.T) {
+			edm := newTestDnstapMinimiser(t, defaultTC)
+			store := newTestSeenQnameStore(t, backend)
+			cache, err := lru.New[string, seenQname](10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			const ttl = 24 * time.Hour
+			start := time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+
+			msg := new(dns.Msg)
+			msg.SetQuestion("example.com.", dns.TypeA)
+			lastSeen := func() time.Time {
+				t.Helper()
+				ts, ok, err := store.LastSeen("example.com.")
+				if err != nil || !ok {
+					t.Fatalf("LastSeen = %s, %t, %v", ts, ok, err)
+				}
+				return ts
+			}
+
+			for _, step := range []struct {
+				after      time.Duration
+				wantSeen   bool
+				wantStored time.Duration
+			}{
+				{0, false, 0},
+				// Not written again within a tenth of the TTL.
+				{time.Hour, true, 0},
+				{3 * time.Hour, true, 3 * time.Hour},
+				// Quiet for longer than the TTL, announced again.
+				{3*time.Hour + ttl + time.Second, false, 3*time.Hour + ttl + time.Second},
+			} {
+				now := start.Add(step.after)
+				if got := edm.qnameSeen(msg.Question[0].Name, cache, store, defaultTC.PebbleSync, now, ttl); got != step.wantSeen {
+					t.Fatalf("qnameSeen after %s = %t, want %t", step.after, got, step.wantSeen)
+				}
+				if got := lastSeen(); !got.Equal(start.Add(step.wantStored)) {
+					t.Fatalf("stored last seen after %s = %s, want %s", step.after, got, start.Add(step.wantStored))
+				}
+			}
+
+			// Without the LRU entry the stored timestamp decides.
+			cache.Purge()
+			now := start.Add(3*time.Hour + 2*ttl + 2*time.Second)
+			if edm.qnameSeen(msg.Question[0].Name, cache, store, defaultTC.PebbleSync, now, ttl) {
+				t.Fatal("qname quiet for longer than the TTL in the store reported as seen")
+			}
+
+			// A qname recorded before timestamps were stored is kept as seen and
+			// gets a timestamp.
+			markLegacySeen(t, store, "legacy.example.")
+			legacy := new(dns.Msg)
+			legacy.SetQuestion("legacy.example.", dns.TypeA)
+			if !edm.qnameSeen(legacy.Question[0].Name, cache, store, defaultTC.PebbleSync, now, ttl) {
+				t.Fatal("qname without a timestamp reported as new")
+			}
+			if ts, ok, err := store.LastSeen("legacy.example."); err != nil || !ok || !ts.Equal(now) {
+				t.Fatalf("legacy LastSeen = %s, %t, %v, want %s", ts, ok, err, now)
+			}
+		})
 	}
+}
 
-	pdb := newTestPebble(t)
+func TestSeenQnameStoreExpire(t *testing.T) {
+	for _, backend := range testSeenQnameTTLBackends {
+		t.Run(backend, func(t *testing.T) {
+			store := newTestSeenQnameStore(t, backend)
+			start := time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
 
-	msg := new(dns.Msg)
-	msg.SetQuestion("race.example.", dns.TypeA)
+			if err := store.MarkSeen("old.example.", start, false); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.MarkSeen("new.example.", start.Add(2*time.Hour), false); err != nil {
+				t.Fatal(err)
+			}
+			markLegacySeen(t, store, "legacy.example.")
 
-	const goroutines = 64
-	start := make(chan struct{})
-	results := make(chan bool, goroutines)
+			now := start.Add(3 * time.Hour)
+			entries, expired, err := store.Expire(start.Add(time.Hour), now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entries != 2 || expired != 1 {
+				t.Fatalf("Expire = %d entries, %d expired, want 2, 1", entries, expired)
+			}
+			if _, ok, _ := store.LastSeen("old.example."); ok {
+				t.Fatal("expired qname still in the store")
+			}
+			for _, qname := range []string{"new.example.", "legacy.example."} {
+				if _, ok, _ := store.LastSeen(qname); !ok {
+					t.Fatalf("%s removed from the store", qname)
+				}
+			}
 
-	var wg sync.WaitGroup
-	wg.Add(goroutines)
-	for range goroutines {
-		go func() {
-			defer wg.Done()
-			<-start
-			results <- edm.qnameSeen(msg, seenQnameLRU, &pebbleSeenQnameStore{db: pdb}, defaultTC.PebbleSync)
-		}()
+			// A qname without a timestamp is stamped by the first run
+			// and expires like any other one after that.
+			if lastSeen, _, _ := store.LastSeen("legacy.example."); !lastSeen.Equal(now) {
+				t.Fatalf("legacy qname last seen = %s, want %s", lastSeen, now)
+			}
+			if _, expired, err := store.Expire(now.Add(time.Hour), now.Add(2*time.Hour)); err != nil || expired != 2 {
+				t.Fatalf("second Expire = %d expired, %v, want 2", expired, err)
+			}
+		})
 	}
+}
 
-	close(start)
-	wg.Wait()
-	close(results)
+// TestPebbleSeenQnameStoreExpireRefreshed checks that a qname refreshed by
+// MarkSeen after Expire read it as expired is kept.
+func TestPebbleSeenQnameStoreExpireRefreshed(t *testing.T) {
+	store := newTestSeenQnameStore(t, SeenQnameBackendPebble).(*pebbleSeenQnameStore)
+	start := time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
 
-	var firstSeen int
-	for seen := range results {
-		if !seen {
-			firstSeen++
-		}
+	if err := store.MarkSeen("refreshed.example.", start, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.MarkSeen("old.example.", start, false); err != nil {
+		t.Fatal(err)
+	}
+	// Both were read as expired, then one was seen again.
+	if err := store.MarkSeen("refreshed.example.", start.Add(2*time.Hour), false); err != nil {
+		t.Fatal(err)
+	}
+
+	kept, expired, err := store.expireBatch([][]byte{[]byte("refreshed.example."), []byte("old.example.")}, start.Add(time.Hour), start.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kept != 1 || expired != 1 {
+		t.Fatalf("expireBatch = %d kept, %d expired, want 1, 1", kept, expired)
 	}
-	if firstSeen != 1 {
-		t.Fatalf("first-seen results have: %d, want: 1", firstSeen)
+	if _, ok, _ := store.LastSeen("refreshed.example."); !ok {
+		t.Fatal("refreshed qname removed from the store")
+	}
+}
+
+// TestMemorySeenQnameStoreExpireRefreshed checks that a qname refreshed by
+// MarkSeen after Expire listed it is kept.
+func TestMemorySeenQnameStoreExpireRefreshed(t *testing.T) {
+	store := newTestSeenQnameStore(t, SeenQnameBackendMemory).(*memorySeenQnameStore)
+	start := time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+
+	if err := store.MarkSeen("refreshed.example.", start, false); err != nil {
+		t.Fatal(err)
 	}
+	markLegacySeen(t, store, "legacy.example.")
+	// Both were listed, then seen again.
+	if err := store.MarkSeen("refreshed.example.", start.Add(2*time.Hour), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.MarkSeen("legacy.example.", start.Add(3*time.Hour), false); err != nil {
+		t.Fatal(err)
+	}
+
+	if store.expireQname("refreshed.example.", start.Add(time.Hour), start.Add(2*time.Hour)) {
+		t.Fatal("refreshed qname removed from the store")
+	}
+	store.expireQname("legacy.example.", start.Add(time.Hour), start.Add(2*time.Hour))
+	if lastSeen, _, _ := store.LastSeen("legacy.example."); !lastSeen.Equal(start.Add(3 * time.Hour)) {
+		t.Fatalf("refreshed legacy qname last seen = %s, want %s", lastSeen, start.Add(3*time.Hour))
+	}
+}
+
+func TestSeenQnameExpirer(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		edm := newSynctestDnstapMinimiser(t, defaultTC)
+		store := &fakeSeenQnameStore{}
+		const ttl = 24 * time.Hour
+
+		ctx, cancel := context.WithCancel(t.Context())
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go edm.seenQnameExpirer(ctx, &wg, store, ttl)
+
+		synctest.Wait()
+		start := time.Now()
+		time.Sleep(seenQnameExpiryInterval)
+		synctest.Wait()
+
+		cancel()
+		wg.Wait()
+
+		if len(store.expireCutoffs) != 2 || !store.expireCutoffs[0].Equal(start.Add(-ttl)) || !store.expireCutoffs[1].Equal(start.Add(seenQnameExpiryInterval-ttl)) {
+			t.Fatalf("Expire cutoffs = %v", store.expireCutoffs)
+		}
+		if got := testMetricValue(t, edm.promSeenQnameStoreEntries); got != 5 {
+			t.Fatalf("store entries = %f, want 5", got)
+		}
+		if got := testMetricValue(t, edm.promSeenQnameExpired); got != 4 {
+			t.Fatalf("expired = %f, want 4", got)
+		}
+	})
 }
@@ -97,6 +97,10 @@ func (edm *DnstapMinimiser) applyUpdate(startConf Config) {
 		edm.log.Error("configUpdater: unable to run edm.setIgnoredQuestionNames", "error", err)
 	}
 
+	if err := edm.setDnstapFilters(); err != nil {
+		edm.log.Error("configUpdater: unable to run edm.setDnstapFilters", "error", err)
+	}
+
 	if !conf.DisableHistogramSender {
 		if err := edm.loadHTTPClientCert(); err != nil {
 			edm.log.Error("configUpdater: unable to run edm.loadHTTPClientCert", "error", err)
@@ -136,7 +140,7 @@ func (edm *DnstapMinimiser) applyUpdate(startConf Config) {
 		}
 	}
 
-	if oldConf != conf {
+	if !reflect.DeepEqual(oldConf, conf) {
 		edm.reloadMinimiserMutex.RLock()
 		for minimiserID := range edm.reloadMinimiserConfigCh {
 			select {
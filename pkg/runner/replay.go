@@ -0,0 +1,118 @@
+package runner
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// replayState tracks capture time while replaying dnstap files.
+//
+// Histogram and session intervals are normally cut by a wall clock ticker at
+// the end of every interval. A replay instead advances time from the frame
+// timestamps and requests a scheduled parquet rotation whenever a frame
+// crosses into a new minute, so the written intervals match the capture
+// period.
+//
+// Replay runs a single minimiser worker, which is the only writer of
+// intervalStart. The collector reads the time through the [clock] methods.
+type replayState struct {
+	intervalStart time.Time    // start of the open interval, zero before the first frame
+	now           atomic.Int64 // intervalStart in Unix nanoseconds, 0 before the first frame
+}
+
+// Now returns the start of the open interval, or the zero time before the
+// first frame has been seen.
+func (r *replayState) Now() time.Time {
+	ns := r.now.Load()
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns).UTC()
+}
+
+// After returns a channel that never fires, replay time only moves with
+// the frames.
+func (r *replayState) After(time.Duration) <-chan time.Time {
+	return nil
+}
+
+// NewTicker returns a ticker that never fires, rotations are requested by
+// [DnstapMinimiser.replayAdvance] instead.
+func (r *replayState) NewTicker(time.Duration) ticker {
+	return replayTicker{}
+}
+
+func (r *replayState) setIntervalStart(t time.Time) {
+	r.intervalStart = t
+	r.now.Store(t.UnixNano())
+}
+
+type replayTicker struct{}
+
+func (replayTicker) C() <-chan time.Time { return nil }
+func (replayTicker) Stop()               {}
+func (replayTicker) Reset(time.Duration) {}
+
+// intervalClock returns the clock used for cutting histogram and session
+// intervals: capture time when replaying, otherwise the real clock.
+func (edm *DnstapMinimiser) intervalClock() clock {
+	if edm.replay != nil {
+		return edm.replay
+	}
+	return edm.deps.Clock
+}
+
+// replayAdvance moves replay time to the minute of ts, rotating the
+// collected data at the end of the open interval when ts is past it.
+// Frames older than the open interval, as can happen where two capture
+// files meet, are counted in the open interval.
+func (edm *DnstapMinimiser) replayAdvance(ts time.Time) {
+	r := edm.replay
+	minute := ts.Truncate(time.Minute)
+	if r.intervalStart.IsZero() {
+		r.setIntervalStart(minute)
+		return
+	}
+	if !minute.After(r.intervalStart) {
+		return
+	}
+
+	intervalEnd := r.intervalStart.Add(time.Minute)
+	edm.replayRotate(intervalEnd, true)
+	// Rotate again when the capture has a gap so the next interval starts
+	// at the minute of this frame rather than at the end of the previous
+	// one. Nothing has been collected in between so no files are written.
+	if minute.After(intervalEnd) {
+		edm.replayRotate(minute, true)
+	}
+	r.setIntervalStart(minute)
+}
+
+// replayFinish rotates out the last open interval once the replay is done,
+// even if it ends before the configured session or histogram interval.
+func (edm *DnstapMinimiser) replayFinish() {
+	r := edm.replay
+	if r.intervalStart.IsZero() {
+		return
+	}
+	intervalEnd := r.intervalStart.Add(time.Minute)
+	edm.replayRotate(intervalEnd, false)
+	r.setIntervalStart(intervalEnd)
+}
+
+// replayRotate asks the data collector to rotate at rotationTime, only what
+// is due when scheduled is set, and waits for it to finish, so frames after
+// the boundary can not end up in the interval before it. The request deliberately ignores ctx: the collector
+// keeps serving rotations until wkdTracker.stop is closed, which Run only
+// does after every minimiser has exited.
+func (edm *DnstapMinimiser) replayRotate(rotationTime time.Time, scheduled bool) {
+	req := parquetRotationRequest{
+		rotationTime: rotationTime,
+		scheduled:    scheduled,
+		done:         make(chan error, 1),
+	}
+	edm.parquetRotationRequestCh <- req
+	if err := <-req.done; err != nil {
+		edm.log.Error("replay: unable to rotate parquet data", "error", err, "rotation_time", rotationTime)
+	}
+}
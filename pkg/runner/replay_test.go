@@ -0,0 +1,285 @@
+package runner
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+)
+
+// replayFrame returns a marshaled client response for name answered at ts.
+func replayFrame(t *testing.T, name string, ts time.Time) []byte {
+	t.Helper()
+
+	dt := testDnstapMessage(t, dnstap.Message_CLIENT_RESPONSE, dnstap.SocketFamily_INET, packedDNSMsg(t, name, dns.TypeA, dns.RcodeSuccess))
+	sec := uint64(ts.Unix())
+	nsec := uint32(ts.Nanosecond())
+	dt.Message.ResponseTimeSec = &sec
+	dt.Message.ResponseTimeNsec = &nsec
+	return marshaledDnstap(t, dt)
+}
+
+// writeDnstapCapture writes frames to a framestream capture file the way
+// "dnstap -w" does and returns its path.
+func writeDnstapCapture(t *testing.T, frames ...[]byte) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "capture.fstrm")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := dnstap.NewWriter(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, frame := range frames {
+		if _, err := w.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func readAllFrames(t *testing.T, input *fileDnstapInput) ([][]byte, error) {
+	t.Helper()
+
+	output := make(chan []byte, 16)
+	err := input.ReadInto(t.Context(), output)
+	close(output)
+	var frames [][]byte
+	for frame := range output {
+		frames = append(frames, frame)
+	}
+	return frames, err
+}
+
+func TestFileDnstapInputReadInto(t *testing.T) {
+	first := writeDnstapCapture(t, []byte("one"), []byte("two"))
+	second := writeDnstapCapture(t, []byte("three"))
+
+	edm := newTestDnstapMinimiser(t, defaultTC)
+	input := newFileDnstapInput(osFileSystem{}, []string{first, second})
+	input.SetMetrics(edm.newDnstapInputMetrics("replay"))
+
+	frames, err := readAllFrames(t, input)
+	if err != nil {
+		t.Fatalf("ReadInto: %s", err)
+	}
+	want := [][]byte{[]byte("one"), []byte("two"), []byte("three")}
+	if !slices.EqualFunc(frames, want, slices.Equal) {
+		t.Fatalf("frames = %q, want %q", frames, want)
+	}
+	if got := testMetricValue(t, edm.promDnstapInputFrames.WithLabelValues("replay")); got != 3 {
+		t.Fatalf("frames metric = %v, want 3", got)
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		missing := filepath.Join(t.TempDir(), "missing.fstrm")
+		frames, err := readAllFrames(t, newFileDnstapInput(osFileSystem{}, []string{first, missing}))
+		if !errors.Is(err, fs.ErrNotExist) || !strings.Contains(err.Error(), missing) {
+			t.Fatalf("ReadInto err = %v, want fs.ErrNotExist naming %s", err, missing)
+		}
+		if len(frames) != 2 {
+			t.Fatalf("got %d frames before the failure, want 2", len(frames))
+		}
+	})
+
+	t.Run("not a capture file", func(t *testing.T) {
+		garbage := writeTempFile(t, "garbage.fstrm", []byte("not framestream"))
+		if _, err := readAllFrames(t, newFileDnstapInput(osFileSystem{}, []string{garbage})); err == nil {
+			t.Fatal("ReadInto succeeded on a file that is not framestream")
+		}
+	})
+
+	t.Run("truncated file", func(t *testing.T) {
+		data, err := os.ReadFile(first)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Drop the 12 byte stop frame and the last byte of "two".
+		truncated := writeTempFile(t, "truncated.fstrm", data[:len(data)-13])
+		frames, err := readAllFrames(t, newFileDnstapInput(osFileSystem{}, []string{truncated}))
+		if err != nil {
+			t.Fatalf("ReadInto: %s", err)
+		}
+		if !slices.EqualFunc(frames, [][]byte{[]byte("one")}, slices.Equal) {
+			t.Fatalf("frames = %q, want only the complete frame", frames)
+		}
+	})
+}
+
+// parquetIntervals returns the start/stop interval of every parquet file in
+// dir, in order.
+func parquetIntervals(t *testing.T, dir string) []string {
+	t.Helper()
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var intervals []string
+	for _, path := range paths {
+		start, stop, err := timestampsFromFilename(filepath.Base(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		intervals = append(intervals, start.Format("15:04")+"-"+stop.Format("15:04"))
+	}
+	slices.Sort(intervals)
+	return intervals
+}
+
+func TestRunReplay(t *testing.T) {
+	base := time.Date(2023, 11, 14, 22, 13, 0, 0, time.UTC)
+	first := writeDnstapCapture(t,
+		replayFrame(t, "example.com.", base.Add(10*time.Second)),
+		replayFrame(t, "new.example.org.", base.Add(50*time.Second)),
+		replayFrame(t, "example.com.", base.Add(65*time.Second)),
+	)
+	// A capture gap and a frame older than the open interval at the seam
+	// between the two files.
+	second := writeDnstapCapture(t,
+		replayFrame(t, "example.com.", base.Add(7*time.Minute+5*time.Second)),
+		replayFrame(t, "example.com.", base.Add(6*time.Minute+59*time.Second)),
+	)
+
+	tc := runCoreTC(t)
+	tc.InputUnix = ""
+	tc.ReplayFiles = []string{first, second}
+	tc.MinimiserWorkers = 4
+	tc.DisableSessionFiles = false
+	edm := newTestDnstapMinimiser(t, tc)
+	pinHTTPServersToEphemeral(t, edm)
+
+	// Run returns on its own once the files have been replayed.
+	if err := edm.Run(t.Context()); err != nil {
+		t.Fatalf("Run: %s", err)
+	}
+
+	histograms := parquetIntervals(t, filepath.Join(tc.DataDir, "parquet", "histograms", "outbox"))
+	if want := []string{"22:13-22:14", "22:14-22:15", "22:20-22:21"}; !slices.Equal(histograms, want) {
+		t.Fatalf("histogram intervals = %q, want %q", histograms, want)
+	}
+	sessions := parquetIntervals(t, filepath.Join(tc.DataDir, "parquet", "sessions"))
+	if want := []string{"22:13-22:14"}; !slices.Equal(sessions, want) {
+		t.Fatalf("session intervals = %q, want %q", sessions, want)
+	}
+}
+
+func TestRunReplayMissingTimestamp(t *testing.T) {
+	base := time.Date(2023, 11, 14, 22, 13, 0, 0, time.UTC)
+	untimed := testDnstapMessage(t, dnstap.Message_CLIENT_RESPONSE, dnstap.SocketFamily_INET, packedDNSMsg(t, "example.com.", dns.TypeA, dns.RcodeSuccess))
+	untimed.Message.ResponseTimeSec = nil
+	untimed.Message.ResponseTimeNsec = nil
+	capture := writeDnstapCapture(t,
+		marshaledDnstap(t, untimed),
+		replayFrame(t, "example.com.", base.Add(10*time.Second)),
+	)
+
+	tc := runCoreTC(t)
+	tc.InputUnix = ""
+	tc.ReplayFiles = []string{capture}
+	edm := newTestDnstapMinimiser(t, tc)
+	pinHTTPServersToEphemeral(t, edm)
+
+	if err := edm.Run(t.Context()); err != nil {
+		t.Fatalf("Run: %s", err)
+	}
+
+	// The frame without a timestamp must not start the interval in 1970.
+	histograms := parquetIntervals(t, filepath.Join(tc.DataDir, "parquet", "histograms", "outbox"))
+	if want := []string{"22:13-22:14"}; !slices.Equal(histograms, want) {
+		t.Fatalf("histogram intervals = %q, want %q", histograms, want)
+	}
+}
+
+func TestRunReplayFilteredFrames(t *testing.T) {
+	base := time.Date(2023, 11, 14, 22, 13, 0, 0, time.UTC)
+	filtered := testDnstapMessage(t, dnstap.Message_RESOLVER_RESPONSE, dnstap.SocketFamily_INET, packedDNSMsg(t, "example.com.", dns.TypeA, dns.RcodeSuccess))
+	sec := uint64(base.Add(3*time.Minute + 5*time.Second).Unix())
+	filtered.Message.ResponseTimeSec = &sec
+	capture := writeDnstapCapture(t,
+		replayFrame(t, "example.com.", base.Add(10*time.Second)),
+		marshaledDnstap(t, filtered),
+	)
+
+	tc := runCoreTC(t)
+	tc.InputUnix = ""
+	tc.ReplayFiles = []string{capture}
+	tc.IgnoredMessageTypes = []string{"RESOLVER_RESPONSE"}
+	tc.HistogramInterval = "5m"
+	edm := newTestDnstapMinimiser(t, tc)
+	pinHTTPServersToEphemeral(t, edm)
+
+	if err := edm.Run(t.Context()); err != nil {
+		t.Fatalf("Run: %s", err)
+	}
+
+	// The filtered frame still moves replay time past the end of the
+	// histogram interval.
+	histograms := parquetIntervals(t, filepath.Join(tc.DataDir, "parquet", "histograms", "outbox"))
+	if want := []string{"22:13-22:15"}; !slices.Equal(histograms, want) {
+		t.Fatalf("histogram intervals = %q, want %q", histograms, want)
+	}
+}
+
+func TestRunReplayRotationIntervals(t *testing.T) {
+	base := time.Date(2023, 11, 14, 22, 13, 0, 0, time.UTC)
+	capture := writeDnstapCapture(t,
+		replayFrame(t, "example.com.", base.Add(10*time.Second)),
+		replayFrame(t, "new.example.org.", base.Add(50*time.Second)),
+		replayFrame(t, "example.com.", base.Add(65*time.Second)),
+		replayFrame(t, "example.com.", base.Add(7*time.Minute+5*time.Second)),
+	)
+
+	tc := runCoreTC(t)
+	tc.InputUnix = ""
+	tc.ReplayFiles = []string{capture}
+	tc.DisableSessionFiles = false
+	tc.SessionInterval = "1h"
+	tc.HistogramInterval = "5m"
+	edm := newTestDnstapMinimiser(t, tc)
+	pinHTTPServersToEphemeral(t, edm)
+
+	if err := edm.Run(t.Context()); err != nil {
+		t.Fatalf("Run: %s", err)
+	}
+
+	// The first interval starts at the first frame and the last one ends
+	// with the capture, the ones in between follow the wall clock.
+	histograms := parquetIntervals(t, filepath.Join(tc.DataDir, "parquet", "histograms", "outbox"))
+	if want := []string{"22:13-22:15", "22:20-22:21"}; !slices.Equal(histograms, want) {
+		t.Fatalf("histogram intervals = %q, want %q", histograms, want)
+	}
+	sessions := parquetIntervals(t, filepath.Join(tc.DataDir, "parquet", "sessions"))
+	if want := []string{"22:13-22:21"}; !slices.Equal(sessions, want) {
+		t.Fatalf("session intervals = %q, want %q", sessions, want)
+	}
+}
+
+func TestRunReplayInputError(t *testing.T) {
+	tc := runCoreTC(t)
+	tc.InputUnix = ""
+	tc.ReplayFiles = []string{filepath.Join(t.TempDir(), "missing.fstrm")}
+	edm := newTestDnstapMinimiser(t, tc)
+	pinHTTPServersToEphemeral(t, edm)
+
+	err := edm.Run(t.Context())
+	if !errors.Is(err, fs.ErrNotExist) || !strings.Contains(err.Error(), "dnstap input failed") {
+		t.Fatalf("Run err = %v, want dnstap input failure wrapping fs.ErrNotExist", err)
+	}
+}
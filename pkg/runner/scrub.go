@@ -0,0 +1,235 @@
+package runner
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+)
+
+// scrubDNSMessage returns the wire format of msg with client identifying
+// data removed, for storing in session files:
+//
+//   - The address of an EDNS Client Subnet option is pseudonymised with cpn
+//     and masked to its source prefix length again, or the option is removed
+//     if that is not possible.
+//   - DNS cookie options (client and server cookies) are removed.
+//   - A reverse lookup of the client's own address, clientIP, is rewritten
+//     to a lookup of its pseudonym, pseudoClientIP.
+//
+// msg itself is left untouched, the scrubbed copy is returned together with
+// its wire format. If there is nothing to scrub, msg and wire are returned
+// as they are so the stored bytes stay identical to what was seen on the
+// wire.
+func scrubDNSMessage(wire []byte, msg *dns.Msg, cpn addressPseudonymiser, clientIP, pseudoClientIP netip.Addr) (*dns.Msg, []byte, error) {
+	var scrubbed *dns.Msg
+	scrub := func() *dns.Msg {
+		if scrubbed == nil {
+			scrubbed = msg.Copy()
+		}
+		return scrubbed
+	}
+
+	if opt := msg.IsEdns0(); opt != nil && optNeedsScrubbing(opt) {
+		scrubOPT(scrub().IsEdns0(), cpn)
+	}
+
+	if clientIP.IsValid() && pseudoClientIP.IsValid() && clientIP != pseudoClientIP {
+		clientReverse, err := dns.ReverseAddr(clientIP.String())
+		if err == nil && containsName(msg, clientReverse) {
+			pseudoReverse, err := dns.ReverseAddr(pseudoClientIP.String())
+			if err != nil {
+				return nil, nil, fmt.Errorf("scrubDNSMessage: unable to create reverse name: %w", err)
+			}
+			renameOwner(scrub(), clientReverse, pseudoReverse)
+		}
+	}
+
+	if scrubbed == nil {
+		return msg, wire, nil
+	}
+
+	scrubbed.Compress = true
+	out, err := scrubbed.Pack()
+	if err != nil {
+		return nil, nil, fmt.Errorf("scrubDNSMessage: unable to pack message: %w", err)
+	}
+
+	return scrubbed, out, nil
+}
+
+// optNeedsScrubbing reports whether opt carries an EDNS Client Subnet or
+// DNS cookie option.
+func optNeedsScrubbing(opt *dns.OPT) bool {
+	for _, option := range opt.Option {
+		switch option.(type) {
+		case *dns.EDNS0_SUBNET, *dns.EDNS0_COOKIE:
+			return true
+		}
+	}
+	return false
+}
+
+// scrubSession scrubs the DNS message stored in sd, see scrubDNSMessage.
+// The question labels of sd are updated if the question name was rewritten.
+// If the message can not be scrubbed it is left out of sd rather than
+// stored as is.
+//
+// With messages false only the question labels are stored: a reverse
+// lookup of the client's own address is still renamed in the labels, but
+// there is no message to repack.
+func (edm *DnstapMinimiser) scrubSession(sd *sessionData, dt *dnstap.Dnstap, msg *dns.Msg, isQuery bool, labelLimit int, cpn addressPseudonymiser, dangerRealClientIP []byte, messages bool) {
+	// Both addresses are left invalid when the client address is missing
+	// or could not be parsed, in which case there is no reverse name to
+	// look for.
+	clientIP, _ := netip.AddrFromSlice(dangerRealClientIP)
+	pseudoClientIP, _ := netip.AddrFromSlice(dt.Message.QueryAddress)
+
+	if !messages {
+		edm.scrubSessionLabels(sd, msg, labelLimit, clientIP.Unmap(), pseudoClientIP.Unmap())
+		return
+	}
+
+	wire := dt.Message.ResponseMessage
+	if isQuery {
+		wire = dt.Message.QueryMessage
+	}
+
+	scrubbed, out, err := scrubDNSMessage(wire, msg, cpn, clientIP.Unmap(), pseudoClientIP.Unmap())
+	if err != nil {
+		edm.log.Error("scrubSession: unable to scrub DNS message, leaving it out of the session", "error", err)
+		edm.promSessionScrubError.Inc()
+		sd.QueryMessage = nil
+		sd.ResponseMessage = nil
+		return
+	}
+	if scrubbed == msg {
+		return
+	}
+
+	ms := string(out)
+	if isQuery {
+		sd.QueryMessage = &ms
+	} else {
+		sd.ResponseMessage = &ms
+	}
+
+	if scrubbed.Question[0].Name != msg.Question[0].Name {
+		sd.dnsLabels = dnsLabels{}
+		edm.setLabels(dns.SplitDomainName(scrubbed.Question[0].Name), labelLimit, &sd.dnsLabels)
+	}
+}
+
+// scrubSessionLabels replaces the question labels of sd with those of the
+// reverse name of pseudoClientIP if the question is a reverse lookup of the
+// client's own address, clientIP. If that name can not be created the
+// labels are cleared rather than left as they are.
+func (edm *DnstapMinimiser) scrubSessionLabels(sd *sessionData, msg *dns.Msg, labelLimit int, clientIP, pseudoClientIP netip.Addr) {
+	if len(msg.Question) == 0 || !clientIP.IsValid() || !pseudoClientIP.IsValid() || clientIP == pseudoClientIP {
+		return
+	}
+	clientReverse, err := dns.ReverseAddr(clientIP.String())
+	if err != nil || !strings.EqualFold(msg.Question[0].Name, clientReverse) {
+		return
+	}
+
+	sd.dnsLabels = dnsLabels{}
+	pseudoReverse, err := dns.ReverseAddr(pseudoClientIP.String())
+	if err != nil {
+		edm.log.Error("scrubSessionLabels: unable to create reverse name, leaving the labels out of the session", "error", err)
+		edm.promSessionScrubError.Inc()
+		return
+	}
+	edm.setLabels(dns.SplitDomainName(pseudoReverse), labelLimit, &sd.dnsLabels)
+}
+
+// scrubOPT pseudonymises EDNS Client Subnet addresses and removes DNS
+// cookies from opt.
+func scrubOPT(opt *dns.OPT, cpn addressPseudonymiser) {
+	options := opt.Option[:0]
+	for _, option := range opt.Option {
+		switch o := option.(type) {
+		case *dns.EDNS0_COOKIE:
+			continue
+		case *dns.EDNS0_SUBNET:
+			if !pseudonymiseSubnet(o, cpn) {
+				continue
+			}
+		}
+		options = append(options, option)
+	}
+	opt.Option = options
+}
+
+// pseudonymiseSubnet replaces the address of an EDNS Client Subnet option
+// with its pseudonym, reporting false if that is not possible.
+func pseudonymiseSubnet(subnet *dns.EDNS0_SUBNET, cpn addressPseudonymiser) bool {
+	var bits int
+	var ip net.IP
+	switch subnet.Family {
+	case 1:
+		bits = 8 * net.IPv4len
+		ip = subnet.Address.To4()
+	case 2:
+		bits = 8 * net.IPv6len
+		ip = subnet.Address.To16()
+	default:
+		return false
+	}
+	if ip == nil || int(subnet.SourceNetmask) > bits {
+		return false
+	}
+
+	pseudonym := cpn.Anonymize(ip)
+	if bits == 8*net.IPv4len {
+		pseudonym = pseudonym.To4()
+	} else if pseudonym.To4() != nil {
+		// A pseudonymiser must not turn an IPv6 address into an
+		// IPv4-mapped one, keep the family of the option intact.
+		return false
+	}
+	if len(pseudonym) != bits/8 {
+		return false
+	}
+
+	subnet.Address = pseudonym.Mask(net.CIDRMask(int(subnet.SourceNetmask), bits))
+	return true
+}
+
+// containsName reports whether name is the name of a question or the owner
+// of a record in msg.
+func containsName(msg *dns.Msg, name string) bool {
+	for _, q := range msg.Question {
+		if strings.EqualFold(q.Name, name) {
+			return true
+		}
+	}
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if strings.EqualFold(rr.Header().Name, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// renameOwner renames every question and record owner name in msg that is
+// equal to from to to.
+func renameOwner(msg *dns.Msg, from, to string) {
+	for i := range msg.Question {
+		if strings.EqualFold(msg.Question[i].Name, from) {
+			msg.Question[i].Name = to
+		}
+	}
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if strings.EqualFold(rr.Header().Name, from) {
+				rr.Header().Name = to
+			}
+		}
+	}
+}
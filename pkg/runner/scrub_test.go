@@ -0,0 +1,183 @@
+package runner
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+)
+
+func TestScrubDNSMessage(t *testing.T) {
+	edm := newTestDnstapMinimiser(t, defaultTC)
+	cpn := edm.cryptopan.Load().cpn
+
+	clientIP := netip.MustParseAddr("198.51.100.20")
+	pseudoClientIP, ok := netip.AddrFromSlice(cpn.Anonymize(clientIP.AsSlice()))
+	if !ok {
+		t.Fatal("unable to pseudonymise client address")
+	}
+	pseudoClientIP = pseudoClientIP.Unmap()
+
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.com.", dns.TypeA)
+	m.SetEdns0(1232, true)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option,
+		&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("198.51.100.0").To4()},
+		&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708a1a2a3a4a5a6a7a8a9aaabacadaeaf"},
+		&dns.EDNS0_NSID{Code: dns.EDNS0NSID},
+	)
+	wire, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scrubbed, out, err := scrubDNSMessage(wire, m, cpn, clientIP, pseudoClientIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := new(dns.Msg)
+	if err := got.Unpack(out); err != nil {
+		t.Fatal(err)
+	}
+	if got.Question[0].Name != "www.example.com." {
+		t.Fatalf("question name = %s", got.Question[0].Name)
+	}
+	options := got.IsEdns0().Option
+	if len(options) != 2 {
+		t.Fatalf("options = %v, want ECS and NSID", options)
+	}
+	subnet, ok := options[0].(*dns.EDNS0_SUBNET)
+	if !ok {
+		t.Fatalf("first option = %v, want ECS", options[0])
+	}
+	wantSubnet := cpn.Anonymize(net.ParseIP("198.51.100.0")).To4().Mask(net.CIDRMask(24, 32))
+	if !subnet.Address.Equal(wantSubnet) || subnet.SourceNetmask != 24 || subnet.Address.Equal(net.ParseIP("198.51.100.0")) {
+		t.Fatalf("ECS = %s/%d, want %s/24", subnet.Address, subnet.SourceNetmask, wantSubnet)
+	}
+	if _, ok := options[1].(*dns.EDNS0_NSID); !ok {
+		t.Fatalf("second option = %v, want NSID", options[1])
+	}
+	if scrubbed == m || len(m.IsEdns0().Option) != 3 {
+		t.Fatal("scrubbing modified the original message")
+	}
+
+	// A message without anything to scrub is stored as received.
+	plain := new(dns.Msg)
+	plain.SetQuestion("www.example.com.", dns.TypeA)
+	plainWire, err := plain.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	scrubbed, out, err = scrubDNSMessage(plainWire, plain, cpn, clientIP, pseudoClientIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scrubbed != plain || &out[0] != &plainWire[0] {
+		t.Fatal("message without anything to scrub was repacked")
+	}
+}
+
+func TestScrubSessionReverseLookup(t *testing.T) {
+	edm := newTestDnstapMinimiser(t, defaultTC)
+	cpn := edm.cryptopan.Load().cpn
+
+	clientIP := netip.MustParseAddr("198.51.100.20")
+	m := new(dns.Msg)
+	m.SetQuestion("20.100.51.198.in-addr.arpa.", dns.TypePTR)
+	m.Response = true
+	ptr, err := dns.NewRR("20.100.51.198.in-addr.arpa. 3600 IN PTR host.example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Answer = append(m.Answer, ptr)
+	wire, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dt := &dnstap.Dnstap{
+		Message: &dnstap.Message{
+			Type:            dnstap.Message_CLIENT_RESPONSE.Enum(),
+			SocketFamily:    dnstap.SocketFamily_INET.Enum(),
+			QueryAddress:    clientIP.AsSlice(),
+			ResponseMessage: wire,
+		},
+	}
+	edm.pseudonymiseDnstap(dt, cpn, nil)
+	pseudoClientIP, _ := netip.AddrFromSlice(dt.Message.QueryAddress)
+	wantName, err := dns.ReverseAddr(pseudoClientIP.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sd := edm.newSession(dt, m, false, defaultLabelLimit, time.Unix(10, 0))
+	edm.scrubSession(sd, dt, m, false, defaultLabelLimit, cpn, clientIP.AsSlice(), true)
+
+	got := new(dns.Msg)
+	if err := got.Unpack([]byte(*sd.ResponseMessage)); err != nil {
+		t.Fatal(err)
+	}
+	if got.Question[0].Name != wantName || got.Answer[0].Header().Name != wantName {
+		t.Fatalf("names = %s, %s, want %s", got.Question[0].Name, got.Answer[0].Header().Name, wantName)
+	}
+	if got.Answer[0].(*dns.PTR).Ptr != "host.example.com." {
+		t.Fatalf("PTR target = %s", got.Answer[0].(*dns.PTR).Ptr)
+	}
+	// Label0 is "arpa", Label2 the first octet of the address.
+	wantLabel := dns.SplitDomainName(wantName)[3]
+	if sd.Label2 == nil || *sd.Label2 != wantLabel || *sd.Label2 == "198" {
+		t.Fatalf("label2 = %v, want %s", sd.Label2, wantLabel)
+	}
+}
+
+func TestScrubSessionReverseLookupWithoutMessages(t *testing.T) {
+	tc := defaultTC
+	tc.DisableSessionMessages = true
+	edm := newTestDnstapMinimiser(t, tc)
+	cpn := edm.cryptopan.Load().cpn
+
+	clientIP := netip.MustParseAddr("198.51.100.20")
+	m := new(dns.Msg)
+	m.SetQuestion("20.100.51.198.in-addr.arpa.", dns.TypePTR)
+	wire, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dt := &dnstap.Dnstap{
+		Message: &dnstap.Message{
+			Type:         dnstap.Message_CLIENT_QUERY.Enum(),
+			SocketFamily: dnstap.SocketFamily_INET.Enum(),
+			QueryAddress: clientIP.AsSlice(),
+			QueryMessage: wire,
+		},
+	}
+	edm.pseudonymiseDnstap(dt, cpn, nil)
+	pseudoClientIP, _ := netip.AddrFromSlice(dt.Message.QueryAddress)
+	wantName, err := dns.ReverseAddr(pseudoClientIP.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sd := edm.newSession(dt, m, true, defaultLabelLimit, time.Unix(10, 0))
+	edm.scrubSession(sd, dt, m, true, defaultLabelLimit, cpn, clientIP.AsSlice(), false)
+
+	// The message columns are not written, there is no need to repack.
+	if sd.QueryMessage == nil || *sd.QueryMessage != string(wire) {
+		t.Fatal("query message was repacked with disable-session-messages")
+	}
+	// Label0 is "arpa", Label2 to Label5 the octets of the address.
+	split := dns.SplitDomainName(wantName)
+	for i, label := range []*string{sd.Label2, sd.Label3, sd.Label4, sd.Label5} {
+		if want := split[3-i]; label == nil || *label != want {
+			t.Fatalf("label%d = %v, want %s", i+2, label, want)
+		}
+	}
+	if *sd.Label2 == "198" && *sd.Label3 == "51" {
+		t.Fatal("labels still hold the client address")
+	}
+}
@@ -0,0 +1,289 @@
+package runner
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/miekg/dns"
+)
+
+// seenQnameImportBatchSize is how many imported qnames are committed to the
+// seen-qname store at a time.
+const seenQnameImportBatchSize = 10000
+
+// ErrSeenQnameStoreInUse is returned by [OpenSeenQnameDB] when another
+// process, normally a running dnstapir-edm, holds the store open.
+var ErrSeenQnameStoreInUse = errors.New("seen-qname store is in use, is dnstapir-edm running?")
+
+// ErrSeenQnameBackendNotPebble is returned when a seen-qname store of
+// another seen-qname-backend than pebble is to be opened as a [SeenQnameDB].
+var ErrSeenQnameBackendNotPebble = errors.New("only the pebble seen-qname-backend can be inspected and maintained")
+
+// SeenQnameDB is the pebble seen-qname store of a data directory, opened for
+// inspection and maintenance while dnstapir-edm is not running.
+type SeenQnameDB struct {
+	lock  *pebble.Lock
+	store *pebbleSeenQnameStore
+}
+
+// seenQnameStoreDir returns the directory of the seen-qname store in
+// dataDir.
+func seenQnameStoreDir(dataDir string) string {
+	return filepath.Join(dataDir, "pebble")
+}
+
+// OpenSeenQnameDB opens the seen-qname store in dataDir. The store must
+// already exist unless create is true. The store directory is locked before
+// it is opened, returning an error wrapping [ErrSeenQnameStoreInUse] if that
+// fails because the store is held open elsewhere. A missing store in a
+// dataDir holding a bloom store is reported with an error wrapping
+// [ErrSeenQnameBackendNotPebble].
+func OpenSeenQnameDB(dataDir string, create bool) (*SeenQnameDB, error) {
+	dir := seenQnameStoreDir(dataDir)
+	if create {
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			return nil, fmt.Errorf("unable to create seen-qname store directory: %w", err)
+		}
+	} else if _, err := os.Stat(dir); err != nil {
+		if _, bloomErr := os.Stat(filepath.Join(dataDir, bloomSeenQnameFile)); bloomErr == nil {
+			return nil, fmt.Errorf("%w: %s holds a %s store", ErrSeenQnameBackendNotPebble, dataDir, SeenQnameBackendBloom)
+		}
+		return nil, fmt.Errorf("unable to open seen-qname store: %w", err)
+	}
+
+	lock, err := pebble.LockDirectory(dir, vfs.Default)
+	if err != nil {
+		// Failing to create the lock file is reported as a path error,
+		// failing to lock it (or finding it locked by this process) is
+		// not.
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) {
+			return nil, fmt.Errorf("unable to lock seen-qname store: %w", err)
+		}
+		return nil, fmt.Errorf("%w: %s: %w", ErrSeenQnameStoreInUse, dir, err)
+	}
+
+	store, err := openPebbleSeenQnameStore(dir, &pebble.Options{Lock: lock, ErrorIfNotExists: !create})
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("unable to open seen-qname store %q: %w", dir, err), lock.Close())
+	}
+
+	return &SeenQnameDB{lock: lock, store: store}, nil
+}
+
+// Close closes the store and releases its lock.
+func (s *SeenQnameDB) Close() error {
+	return errors.Join(s.store.Close(), s.lock.Close())
+}
+
+// normaliseSeenQname returns name as it is keyed in the seen-qname store: a
+// lower-cased FQDN.
+func normaliseSeenQname(name string) (string, error) {
+	name = strings.ToLower(dns.Fqdn(name))
+	if _, ok := dns.IsDomainName(name); !ok {
+		return "", fmt.Errorf("invalid domain name %q", name)
+	}
+	return name, nil
+}
+
+// List calls fn with every qname in the store starting with prefix, in key
+// order, together with its last-seen time, which is the zero time if it is
+// not known. Iteration stops at the first error returned by fn.
+func (s *SeenQnameDB) List(prefix string, fn func(qname string, lastSeen time.Time) error) error {
+	iterOpts := &pebble.IterOptions{}
+	if prefix != "" {
+		iterOpts.LowerBound = []byte(strings.ToLower(prefix))
+		iterOpts.UpperBound = prefixUpperBound(iterOpts.LowerBound)
+	}
+
+	iter, err := s.store.db.NewIter(iterOpts)
+	if err != nil {
+		return fmt.Errorf("unable to create iterator: %w", err)
+	}
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		if err := fn(string(iter.Key()), decodeSeenQnameTime(iter.Value())); err != nil {
+			_ = iter.Close()
+			return err
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return fmt.Errorf("unable to iterate seen-qname store: %w", err)
+	}
+
+	return nil
+}
+
+// prefixUpperBound returns the smallest key greater than every key starting
+// with prefix, nil if there is none.
+func prefixUpperBound(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		end[i]++
+		if end[i] != 0 {
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// LastSeen reports whether name is in the store and its last-seen time.
+func (s *SeenQnameDB) LastSeen(name string) (time.Time, bool, error) {
+	qname, err := normaliseSeenQname(name)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return s.store.LastSeen(qname)
+}
+
+// Delete removes name from the store so it is announced as new again the
+// next time it is seen. With suffix set, every name at or below name is
+// removed as well. It returns the number of removed qnames.
+func (s *SeenQnameDB) Delete(name string, suffix bool) (int, error) {
+	qname, err := normaliseSeenQname(name)
+	if err != nil {
+		return 0, err
+	}
+
+	batch := s.store.db.NewBatch()
+	defer batch.Close()
+
+	if !suffix {
+		_, found, err := s.store.LastSeen(qname)
+		if err != nil || !found {
+			return 0, err
+		}
+		if err := batch.Delete([]byte(qname), nil); err != nil {
+			return 0, fmt.Errorf("unable to delete %q: %w", qname, err)
+		}
+	} else {
+		// The store is keyed on the qname as written, so finding the
+		// names below a domain takes a full scan.
+		err := s.List("", func(key string, _ time.Time) error {
+			if key != qname && qname != "." && !strings.HasSuffix(key, "."+qname) {
+				return nil
+			}
+			if err := batch.Delete([]byte(key), nil); err != nil {
+				return fmt.Errorf("unable to delete %q: %w", key, err)
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	deleted := int(batch.Count())
+	if err := batch.Commit(pebble.Sync); err != nil {
+		return 0, fmt.Errorf("unable to commit deletes: %w", err)
+	}
+
+	return deleted, nil
+}
+
+// Import records the names read from r, one per line, as seen, so they are
+// not announced as new. A line may carry an RFC 3339 last-seen time after
+// the name, as written by [SeenQnameDB.Export]; names without one are
+// recorded as last seen at lastSeen. Empty lines and lines starting with "#"
+// are skipped. It returns the number of imported names; names are committed
+// in batches, so on error the names of earlier batches stay imported.
+func (s *SeenQnameDB) Import(r io.Reader, lastSeen time.Time) (int, error) {
+	batch := s.store.db.NewBatch()
+	defer func() {
+		_ = batch.Close()
+	}()
+
+	var imported, lineNum int
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineNum++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) > 2 {
+			return imported, fmt.Errorf("line %d: unexpected fields after the last-seen time", lineNum)
+		}
+
+		qname, err := normaliseSeenQname(fields[0])
+		if err != nil {
+			return imported, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		value := encodeSeenQnameTime(lastSeen)
+		if len(fields) == 2 {
+			value = nil
+			if fields[1] != "-" {
+				ts, err := time.Parse(time.RFC3339, fields[1])
+				if err != nil {
+					return imported, fmt.Errorf("line %d: invalid last-seen time: %w", lineNum, err)
+				}
+				value = encodeSeenQnameTime(ts)
+			}
+		}
+		if err := batch.Set([]byte(qname), value, nil); err != nil {
+			return imported, fmt.Errorf("line %d: unable to add %q: %w", lineNum, qname, err)
+		}
+
+		if batch.Count() >= seenQnameImportBatchSize {
+			n := int(batch.Count())
+			if err := batch.Commit(pebble.Sync); err != nil {
+				return imported, fmt.Errorf("unable to commit imported names: %w", err)
+			}
+			imported += n
+			_ = batch.Close()
+			batch = s.store.db.NewBatch()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return imported, fmt.Errorf("unable to read names: %w", err)
+	}
+
+	n := int(batch.Count())
+	if err := batch.Commit(pebble.Sync); err != nil {
+		return imported, fmt.Errorf("unable to commit imported names: %w", err)
+	}
+
+	return imported + n, nil
+}
+
+// Export writes every qname in the store to w, one "<qname> <last-seen>"
+// line per name in the format read by [SeenQnameDB.Import]. The last-seen
+// time is "-" if it is not known. It returns the number of exported names.
+func (s *SeenQnameDB) Export(w io.Writer) (int, error) {
+	var exported int
+	err := s.List("", func(qname string, lastSeen time.Time) error {
+		ts := "-"
+		if !lastSeen.IsZero() {
+			ts = lastSeen.UTC().Format(time.RFC3339)
+		}
+		if _, err := fmt.Fprintf(w, "%s %s\n", qname, ts); err != nil {
+			return err
+		}
+		exported++
+		return nil
+	})
+	return exported, err
+}
+
+// Stats returns the number of qnames in the store and the disk space it
+// uses in bytes.
+func (s *SeenQnameDB) Stats() (int, uint64, error) {
+	var entries int
+	err := s.List("", func(string, time.Time) error {
+		entries++
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return entries, s.store.db.Metrics().DiskSpaceUsage(), nil
+}
@@ -0,0 +1,185 @@
+package runner
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func listSeenQnames(t *testing.T, s *SeenQnameDB, prefix string) []string {
+	t.Helper()
+	var qnames []string
+	err := s.List(prefix, func(qname string, _ time.Time) error {
+		qnames = append(qnames, qname)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return qnames
+}
+
+func TestSeenQnameDB(t *testing.T) {
+	dataDir := t.TempDir()
+
+	if _, err := OpenSeenQnameDB(dataDir, false); err == nil {
+		t.Fatal("opening a missing store without create succeeded")
+	}
+	bloomDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bloomDir, bloomSeenQnameFile), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenSeenQnameDB(bloomDir, false); !errors.Is(err, ErrSeenQnameBackendNotPebble) {
+		t.Fatalf("opening a bloom data-dir: %v, want %v", err, ErrSeenQnameBackendNotPebble)
+	}
+
+	s, err := OpenSeenQnameDB(dataDir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenSeenQnameDB(dataDir, false); !errors.Is(err, ErrSeenQnameStoreInUse) {
+		t.Fatalf("opening a store held open: %v, want %v", err, ErrSeenQnameStoreInUse)
+	}
+
+	now := time.Unix(1700000000, 0)
+	input := "# pre-seeded names\nWWW.Example.com\n\nmail.example.com. 2023-01-02T03:04:05Z\nexample.com -\nexample.org\n"
+	imported, err := s.Import(strings.NewReader(input), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported != 4 {
+		t.Fatalf("imported %d names, want 4", imported)
+	}
+	if _, err := s.Import(strings.NewReader("example.net\nbad..name\n"), now); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("importing an invalid name: %v", err)
+	}
+	if _, found, err := s.LastSeen("example.net"); err != nil || found {
+		t.Fatalf("name before an invalid one imported: %t, %v", found, err)
+	}
+	if _, err := s.Import(strings.NewReader("example.net\n"), now); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := listSeenQnames(t, s, "ex"), []string{"example.com.", "example.net.", "example.org."}; !slices.Equal(got, want) {
+		t.Fatalf("list = %v, want %v", got, want)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		found    bool
+		lastSeen time.Time
+	}{
+		{name: "www.example.com", found: true, lastSeen: now},
+		{name: "MAIL.example.com.", found: true, lastSeen: time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{name: "example.com", found: true},
+		{name: "missing.example.com"},
+	} {
+		lastSeen, found, err := s.LastSeen(tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != tc.found || !lastSeen.Equal(tc.lastSeen) {
+			t.Fatalf("LastSeen(%s) = %s, %t, want %s, %t", tc.name, lastSeen, found, tc.lastSeen, tc.found)
+		}
+	}
+
+	var export strings.Builder
+	exported, err := s.Export(&export)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantExport := "example.com. -\nexample.net. 2023-11-14T22:13:20Z\nexample.org. 2023-11-14T22:13:20Z\nmail.example.com. 2023-01-02T03:04:05Z\nwww.example.com. 2023-11-14T22:13:20Z\n"
+	if exported != 5 || export.String() != wantExport {
+		t.Fatalf("export = %d, %q, want 5, %q", exported, export.String(), wantExport)
+	}
+
+	deleted, err := s.Delete("example.org", false)
+	if err != nil || deleted != 1 {
+		t.Fatalf("Delete(example.org) = %d, %v", deleted, err)
+	}
+	deleted, err = s.Delete("example.org", false)
+	if err != nil || deleted != 0 {
+		t.Fatalf("Delete(example.org) again = %d, %v", deleted, err)
+	}
+	deleted, err = s.Delete("Example.com.", true)
+	if err != nil || deleted != 3 {
+		t.Fatalf("Delete(example.com, suffix) = %d, %v", deleted, err)
+	}
+
+	entries, diskUsage, err := s.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries != 1 || diskUsage == 0 {
+		t.Fatalf("Stats() = %d, %d", entries, diskUsage)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// An exported store imports into an identical one.
+	s, err = OpenSeenQnameDB(t.TempDir(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Import(strings.NewReader(wantExport), now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	export.Reset()
+	if _, err := s.Export(&export); err != nil {
+		t.Fatal(err)
+	}
+	if export.String() != wantExport {
+		t.Fatalf("re-export = %q, want %q", export.String(), wantExport)
+	}
+}
+
+func TestSeenQnameDBReopen(t *testing.T) {
+	dataDir := t.TempDir()
+
+	store, err := configSeenQnameStoreFactory{}.OpenSeenQnameStore(Config{SeenQnameBackend: SeenQnameBackendPebble, DataDir: dataDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.MarkSeen("example.com.", time.Unix(1700000000, 0), true); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenSeenQnameDB(dataDir, false); !errors.Is(err, ErrSeenQnameStoreInUse) {
+		t.Fatalf("opening a store held open by the minimiser: %v, want %v", err, ErrSeenQnameStoreInUse)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := OpenSeenQnameDB(dataDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if got := listSeenQnames(t, s, ""); !slices.Equal(got, []string{"example.com."}) {
+		t.Fatalf("list = %v", got)
+	}
+}
+
+func TestPrefixUpperBound(t *testing.T) {
+	for _, tc := range []struct {
+		prefix string
+		want   []byte
+	}{
+		{prefix: "abc", want: []byte("abd")},
+		{prefix: "ab\xff", want: []byte("ac")},
+		{prefix: "\xff\xff"},
+	} {
+		if got := prefixUpperBound([]byte(tc.prefix)); !slices.Equal(got, tc.want) {
+			t.Fatalf("prefixUpperBound(%q) = %q, want %q", tc.prefix, got, tc.want)
+		}
+	}
+}
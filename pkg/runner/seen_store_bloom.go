@@ -0,0 +1,262 @@
+package runner
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"math/bits"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/twmb/murmur3"
+)
+
+// bloomSeenQnameFile is the file in the data directory the "bloom"
+// seen-qname backend is persisted to.
+const bloomSeenQnameFile = "seen-qnames.bloom"
+
+// bloomSeenQnameVersion is the format version of the persisted filter.
+const bloomSeenQnameVersion = 1
+
+// bloomSeenQnameFlushInterval is how often a changed filter is written to
+// disk while running, bounding what is lost on a crash.
+const bloomSeenQnameFlushInterval = 10 * time.Minute
+
+// bloomSeenQnameMagic starts a persisted filter.
+var bloomSeenQnameMagic = [8]byte{'E', 'D', 'M', 'B', 'L', 'O', 'O', 'M'}
+
+// bloomSeenQnameHeader precedes the filter bits in the persisted filter.
+type bloomSeenQnameHeader struct {
+	Magic   [8]byte
+	Version uint32
+	Hashes  uint32
+	Words   uint64
+	Count   uint64
+}
+
+// bloomSeenQnameStore is the "bloom" seen-qname backend: a Bloom filter
+// sized up front for a number of qnames and a false-positive rate, so its
+// memory footprint is fixed. A false positive makes a new qname go
+// unannounced; the filter does not grow, so past the capacity the
+// false-positive rate climbs without bound. A Bloom
+// filter cannot tell when a qname was last seen or forget it, so qnames are
+// recorded without a timestamp and never expire.
+//
+// The filter is kept in memory and written to path every
+// bloomSeenQnameFlushInterval and on Close, replacing the previous file;
+// qnames recorded since the last write are lost on a crash.
+type bloomSeenQnameStore struct {
+	mu sync.Mutex
+	// flushMu serializes writing the filter to disk.
+	flushMu sync.Mutex
+	path    string
+	bits    []uint64
+	hashes  uint64
+	// falsePositiveRate is the rate the filter was sized for.
+	falsePositiveRate float64
+	// count is the number of qnames recorded, counting those that only
+	// set bits already set by others once.
+	count uint64
+	dirty bool
+}
+
+// bloomFilterSize returns the number of 64 bit words and hash functions of
+// a Bloom filter for capacity entries at false-positive rate p:
+// -capacity * ln(p) / ln(2)^2 bits and bits / capacity * ln(2) hash
+// functions.
+func bloomFilterSize(capacity int, p float64) (words uint64, hashes uint64) {
+	bits := math.Ceil(-float64(capacity) * math.Log(p) / (math.Ln2 * math.Ln2))
+	words = uint64(math.Ceil(bits / 64))
+	hashes = uint64(math.Round(bits / float64(capacity) * math.Ln2))
+	return words, max(hashes, 1)
+}
+
+// openBloomSeenQnameStore loads the filter persisted at path, or creates an
+// empty one if there is none. A persisted filter sized for another capacity
+// or false-positive rate is refused rather than silently discarded.
+func openBloomSeenQnameStore(path string, capacity int, p float64) (*bloomSeenQnameStore, error) {
+	words, hashes := bloomFilterSize(capacity, p)
+	bs := &bloomSeenQnameStore{
+		path:              path,
+		bits:              make([]uint64, words),
+		hashes:            hashes,
+		falsePositiveRate: p,
+	}
+
+	f, err := os.Open(path) // #nosec G304 -- path is in the configured data directory
+	if errors.Is(err, fs.ErrNotExist) {
+		return bs, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to open bloom filter: %w", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var header bloomSeenQnameHeader
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return nil, fmt.Errorf("unable to read bloom filter header of %s: %w", path, err)
+	}
+	switch {
+	case header.Magic != bloomSeenQnameMagic:
+		return nil, fmt.Errorf("%s is not a seen-qname bloom filter", path)
+	case header.Version != bloomSeenQnameVersion:
+		return nil, fmt.Errorf("%s has unsupported bloom filter version %d", path, header.Version)
+	case header.Words != words || uint64(header.Hashes) != hashes:
+		return nil, fmt.Errorf("%s was created for another seen-qname-capacity or seen-qname-false-positive-rate, restore those or remove the file to start over", path)
+	}
+	if err := binary.Read(r, binary.BigEndian, bs.bits); err != nil {
+		return nil, fmt.Errorf("unable to read bloom filter %s: %w", path, err)
+	}
+	if _, err := r.ReadByte(); !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s has trailing data after the bloom filter", path)
+	}
+	bs.count = header.Count
+
+	return bs, nil
+}
+
+// bitIndexes calls fn with the word and bit mask of each of the bits of
+// qname, using double hashing of the two halves of a 128 bit murmur3 hash.
+func (bs *bloomSeenQnameStore) bitIndexes(qname string, fn func(word int, mask uint64) bool) {
+	h1, h2 := murmur3.StringSum128(qname)
+	m := uint64(len(bs.bits)) * 64
+	for i := range bs.hashes {
+		bit := (h1 + i*h2) % m
+		if !fn(int(bit/64), 1<<(bit%64)) { // #nosec G115 -- bit/64 indexes bs.bits
+			return
+		}
+	}
+}
+
+// LastSeen reports qnames in the filter as seen without a timestamp.
+func (bs *bloomSeenQnameStore) LastSeen(qname string) (time.Time, bool, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	found := true
+	bs.bitIndexes(qname, func(word int, mask uint64) bool {
+		found = bs.bits[word]&mask != 0
+		return found
+	})
+	return time.Time{}, found, nil
+}
+
+// MarkSeen adds qname to the filter. The filter is written to disk by
+// flush rather than on every change, so lastSeen and sync are ignored.
+func (bs *bloomSeenQnameStore) MarkSeen(qname string, _ time.Time, _ bool) error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	added := false
+	bs.bitIndexes(qname, func(word int, mask uint64) bool {
+		if bs.bits[word]&mask == 0 {
+			bs.bits[word] |= mask
+			added = true
+		}
+		return true
+	})
+	if added {
+		bs.count++
+		bs.dirty = true
+	}
+	return nil
+}
+
+// Expire removes nothing, qnames in the filter have no timestamp.
+func (bs *bloomSeenQnameStore) Expire(time.Time, time.Time) (int, int, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	return int(min(bs.count, math.MaxInt)), 0, nil // #nosec G115 -- Clamped to MaxInt
+}
+
+// fill returns the share of the filter bits that are set and the
+// false-positive rate that gives, the chance that all bits of a qname not in
+// the filter are set.
+func (bs *bloomSeenQnameStore) fill() (ratio float64, falsePositiveRate float64) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	var set int
+	for _, word := range bs.bits {
+		set += bits.OnesCount64(word)
+	}
+	ratio = float64(set) / float64(64*len(bs.bits))
+	return ratio, math.Pow(ratio, float64(bs.hashes))
+}
+
+// Close writes the filter to disk if it changed since it was last written.
+func (bs *bloomSeenQnameStore) Close() error {
+	return bs.flush()
+}
+
+// flush writes the filter to disk if it changed since it was last written.
+// The filter is written to a temporary file renamed over the previous one,
+// so a crash while writing leaves the previous filter in place. A copy of
+// the filter is written, so MarkSeen is not held up by the disk.
+func (bs *bloomSeenQnameStore) flush() error {
+	bs.flushMu.Lock()
+	defer bs.flushMu.Unlock()
+
+	bs.mu.Lock()
+	if !bs.dirty {
+		bs.mu.Unlock()
+		return nil
+	}
+	words := slices.Clone(bs.bits)
+	header := bloomSeenQnameHeader{
+		Magic:   bloomSeenQnameMagic,
+		Version: bloomSeenQnameVersion,
+		Hashes:  uint32(bs.hashes), // #nosec G115 -- At most a few dozen hash functions
+		Words:   uint64(len(bs.bits)),
+		Count:   bs.count,
+	}
+	bs.dirty = false
+	bs.mu.Unlock()
+
+	if err := writeBloomSeenQnameFile(bs.path, header, words); err != nil {
+		bs.mu.Lock()
+		bs.dirty = true
+		bs.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func writeBloomSeenQnameFile(path string, header bloomSeenQnameHeader, words []uint64) error {
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600) // #nosec G304 -- path is in the configured data directory
+	if err != nil {
+		return fmt.Errorf("unable to create bloom filter file: %w", err)
+	}
+
+	w := bufio.NewWriter(f)
+	err = binary.Write(w, binary.BigEndian, header)
+	if err == nil {
+		err = binary.Write(w, binary.BigEndian, words)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to write bloom filter %s: %w", path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,200 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+func TestBloomFilterSize(t *testing.T) {
+	// 10M names at 0.1% take about 14.4 bits and 10 hash functions per
+	// name.
+	words, hashes := bloomFilterSize(10_000_000, 0.001)
+	if words != 2_246_499 || hashes != 10 {
+		t.Fatalf("bloomFilterSize = %d words, %d hashes", words, hashes)
+	}
+	if _, hashes := bloomFilterSize(10, 0.9); hashes != 1 {
+		t.Fatalf("bloomFilterSize with a high false-positive rate = %d hashes, want 1", hashes)
+	}
+}
+
+func TestBloomSeenQnameStoreFalsePositiveRate(t *testing.T) {
+	const capacity = 10_000
+	const p = 0.01
+	path := filepath.Join(t.TempDir(), bloomSeenQnameFile)
+	bs, err := openBloomSeenQnameStore(path, capacity, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range capacity {
+		if err := bs.MarkSeen(fmt.Sprintf("%d.example.", i), time.Time{}, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var falsePositives int
+	for i := range capacity {
+		qname := fmt.Sprintf("%d.example.", i)
+		if _, found, _ := bs.LastSeen(qname); !found {
+			t.Fatalf("%s not in the filter", qname)
+		}
+		if _, found, _ := bs.LastSeen(fmt.Sprintf("%d.example.org.", i)); found {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / capacity; rate > 2*p {
+		t.Fatalf("false-positive rate at capacity = %f, want about %f", rate, p)
+	}
+}
+
+func TestBloomSeenQnameStorePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), bloomSeenQnameFile)
+
+	bs, err := openBloomSeenQnameStore(path, 1000, 0.001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, qname := range []string{"a.example.", "b.example.", "a.example."} {
+		if err := bs.MarkSeen(qname, time.Unix(10, 0), true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if lastSeen, found, err := bs.LastSeen("a.example."); err != nil || !found || !lastSeen.IsZero() {
+		t.Fatalf("LastSeen = %s, %t, %v, want the zero time, true", lastSeen, found, err)
+	}
+	if entries, expired, err := bs.Expire(time.Unix(20, 0), time.Unix(30, 0)); err != nil || entries != 2 || expired != 0 {
+		t.Fatalf("Expire = %d, %d, %v, want 2, 0", entries, expired, err)
+	}
+	if err := bs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	bs, err = openBloomSeenQnameStore(path, 1000, 0.001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, qname := range []string{"a.example.", "b.example."} {
+		if _, found, _ := bs.LastSeen(qname); !found {
+			t.Fatalf("%s lost on reopen", qname)
+		}
+	}
+	if entries, _, _ := bs.Expire(time.Time{}, time.Time{}); entries != 2 {
+		t.Fatalf("entries after reopen = %d, want 2", entries)
+	}
+	if err := bs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("temporary file left behind: %v", err)
+	}
+
+	if _, err := openBloomSeenQnameStore(path, 2000, 0.001); err == nil || !strings.Contains(err.Error(), "another seen-qname-capacity") {
+		t.Fatalf("opening with another capacity: %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte("not a bloom filter at all, but long enough"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openBloomSeenQnameStore(path, 1000, 0.001); err == nil || !strings.Contains(err.Error(), "is not a seen-qname bloom filter") {
+		t.Fatalf("opening a corrupt filter: %v", err)
+	}
+}
+
+func TestBloomSeenQnameFlusher(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		edm := newSynctestDnstapMinimiser(t, defaultTC)
+		path := filepath.Join(t.TempDir(), bloomSeenQnameFile)
+		bs, err := openBloomSeenQnameStore(path, 1000, 0.001)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bs.MarkSeen("a.example.", time.Time{}, false); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(t.Context())
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go edm.bloomSeenQnameFlusher(ctx, &wg, bs)
+		synctest.Wait()
+
+		// The filter is written without waiting for Close, so a crash
+		// does not lose it.
+		reopened, err := openBloomSeenQnameStore(path, 1000, 0.001)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, found, _ := reopened.LastSeen("a.example."); !found {
+			t.Fatal("qname not written by the flusher")
+		}
+
+		if err := bs.MarkSeen("b.example.", time.Time{}, false); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(bloomSeenQnameFlushInterval)
+		synctest.Wait()
+		reopened, err = openBloomSeenQnameStore(path, 1000, 0.001)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, found, _ := reopened.LastSeen("b.example."); !found {
+			t.Fatal("qname not written at the next flush")
+		}
+
+		ratio, falsePositiveRate := bs.fill()
+		if got := testMetricValue(t, edm.promSeenQnameBloomFillRatio); got != ratio || ratio <= 0 {
+			t.Fatalf("fill ratio = %f, want %f above 0", got, ratio)
+		}
+		if got := testMetricValue(t, edm.promSeenQnameBloomFPRate); got != falsePositiveRate || falsePositiveRate <= 0 || falsePositiveRate >= 0.001 {
+			t.Fatalf("false-positive rate = %f, want %f below 0.001", got, falsePositiveRate)
+		}
+
+		cancel()
+		wg.Wait()
+		if err := bs.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestBloomSeenQnameFlusherWarnsOnce(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		edm := newSynctestDnstapMinimiser(t, defaultTC)
+		logBuf := &syncBuf{}
+		edm.log = slog.New(slog.NewJSONHandler(logBuf, nil))
+		bs, err := openBloomSeenQnameStore(filepath.Join(t.TempDir(), bloomSeenQnameFile), 10, 0.01)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Ten times the capacity.
+		for i := range 100 {
+			if err := bs.MarkSeen(fmt.Sprintf("%d.example.", i), time.Time{}, false); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		ctx, cancel := context.WithCancel(t.Context())
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go edm.bloomSeenQnameFlusher(ctx, &wg, bs)
+		time.Sleep(2 * bloomSeenQnameFlushInterval)
+		synctest.Wait()
+		cancel()
+		wg.Wait()
+
+		if n := strings.Count(logBuf.String(), "bloom filter is past its capacity"); n != 1 {
+			t.Fatalf("capacity warnings = %d, want 1: %s", n, logBuf.String())
+		}
+		if err := bs.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,74 @@
+package runner
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+// memorySeenQnameStore is the "memory" seen-qname backend: an LRU holding
+// at most capacity qnames, dropping the least recently seen ones beyond
+// that. Nothing is persisted, so every qname is announced again after a
+// restart.
+type memorySeenQnameStore struct {
+	// mu is held by MarkSeen and while Expire checks and updates a
+	// qname, so a qname seen meanwhile is not removed or given an older
+	// timestamp.
+	mu     sync.Mutex
+	qnames *lru.Cache[string, time.Time]
+}
+
+func newMemorySeenQnameStore(capacity int) (*memorySeenQnameStore, error) {
+	qnames, err := lru.New[string, time.Time](capacity)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create memory seen-qname store: %w", err)
+	}
+	return &memorySeenQnameStore{qnames: qnames}, nil
+}
+
+func (ms *memorySeenQnameStore) LastSeen(qname string) (time.Time, bool, error) {
+	lastSeen, ok := ms.qnames.Get(qname)
+	return lastSeen, ok, nil
+}
+
+func (ms *memorySeenQnameStore) MarkSeen(qname string, lastSeen time.Time, _ bool) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.qnames.Add(qname, lastSeen)
+	return nil
+}
+
+func (ms *memorySeenQnameStore) Expire(cutoff, now time.Time) (int, int, error) {
+	var expired int
+	for _, qname := range ms.qnames.Keys() {
+		if ms.expireQname(qname, cutoff, now) {
+			expired++
+		}
+	}
+	return ms.qnames.Len(), expired, nil
+}
+
+// expireQname removes qname if it was last seen before cutoff and stamps
+// it with now if it has no timestamp, reporting whether it was removed.
+func (ms *memorySeenQnameStore) expireQname(qname string, cutoff, now time.Time) bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	lastSeen, ok := ms.qnames.Peek(qname)
+	switch {
+	case !ok:
+	case lastSeen.IsZero():
+		ms.qnames.Add(qname, now)
+	case lastSeen.Before(cutoff):
+		ms.qnames.Remove(qname)
+		return true
+	}
+	return false
+}
+
+func (ms *memorySeenQnameStore) Close() error {
+	return nil
+}
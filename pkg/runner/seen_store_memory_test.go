@@ -0,0 +1,39 @@
+package runner
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemorySeenQnameStoreCapacity(t *testing.T) {
+	ms, err := newMemorySeenQnameStore(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, qname := range []string{"a.example.", "b.example."} {
+		if err := ms.MarkSeen(qname, time.Unix(10, 0), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A lookup makes a.example. the most recently seen qname.
+	if _, found, _ := ms.LastSeen("a.example."); !found {
+		t.Fatal("a.example. not in the store")
+	}
+	if err := ms.MarkSeen("c.example.", time.Unix(20, 0), false); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, found, _ := ms.LastSeen("b.example."); found {
+		t.Fatal("least recently seen qname kept beyond the capacity")
+	}
+	for _, qname := range []string{"a.example.", "c.example."} {
+		if _, found, _ := ms.LastSeen(qname); !found {
+			t.Fatalf("%s dropped from the store", qname)
+		}
+	}
+
+	if _, err := newMemorySeenQnameStore(0); err == nil {
+		t.Fatal("memory store without capacity created")
+	}
+}
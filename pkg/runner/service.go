@@ -22,7 +22,6 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promauto"
-	"github.com/yawning/cryptopan"
 	"go4.org/netipx"
 )
 
@@ -42,13 +41,13 @@ var (
 	// failures with [errors.Is].
 	ErrInvalidConfig = errors.New("invalid configuration")
 
-	errNoClientCertificate      = errors.New("no client certificate loaded")
-	errEmptyDawgFile            = errors.New("dawg file is empty")
-	errNoInputConfigured        = errors.New("no dnstap input configured")
-	errMultipleInputsConfigured = errors.New("only one dnstap input may be configured")
-	errNotEdDSAJWK              = errors.New("JWK is not an EdDSA (Ed25519/Ed448) key")
-	errJWKMissingKeyID          = errors.New("JWK has no key ID set")
-	errAppendCertsFromPEM       = errors.New("failed to append certs from PEM")
+	errNoClientCertificate = errors.New("no client certificate loaded")
+	errEmptyDawgFile       = errors.New("dawg file is empty")
+	errNoInputConfigured   = errors.New("no dnstap input configured")
+	errDuplicateInput      = errors.New("dnstap input configured more than once")
+	errNotEdDSAJWK         = errors.New("JWK is not an EdDSA (Ed25519/Ed448) key")
+	errJWKMissingKeyID     = errors.New("JWK has no key ID set")
+	errAppendCertsFromPEM  = errors.New("failed to append certs from PEM")
 )
 
 // Run lifecycle states tracked in DnstapMinimiser.state. The only
@@ -75,6 +74,14 @@ func WithLoggerLevel(loggerLevel *slog.LevelVar) DnstapMinimiserOption {
 	}
 }
 
+// WithSeenQnameStoreFactory replaces the seen-qname backend selected with
+// [Config.SeenQnameBackend] with the store opened by factory.
+func WithSeenQnameStoreFactory(factory SeenQnameStoreFactory) DnstapMinimiserOption {
+	return func(options *dnstapMinimiserOptions) {
+		options.deps.SeenQnameStoreFactory = factory
+	}
+}
+
 // withDependencies replaces external runner functionality.
 //
 // Nil fields in deps are filled with production implementations.
@@ -88,7 +95,8 @@ func withDependencies(deps dependencies) DnstapMinimiserOption {
 //
 // Run is not reentrant. It returns startup and runtime errors directly. When
 // ctx is cancelled after startup, workers drain in shutdown order and Run
-// returns nil.
+// returns nil. When [Config.ReplayFiles] is set Run reads those capture files
+// instead of listening for dnstap, and returns once they have been processed.
 func (edm *DnstapMinimiser) Run(ctx context.Context) error {
 	if ctx == nil {
 		return ErrNilRunContext
@@ -110,7 +118,8 @@ func (edm *DnstapMinimiser) Run(ctx context.Context) error {
 	}()
 
 	// Shutdown ordering is load-bearing:
-	// minimisers exit → close wkdTracker.stop → close newQnamePublisherCh →
+	// minimisers exit → close wkdTracker.stop → (if deduplicating
+	// new_qname) flush pending events → close newQnamePublisherCh →
 	// (if MQTT) mqttCancel → configUpdater exits →
 	// wg.Wait → (if MQTT) autopahoWg.Wait.
 
@@ -134,6 +143,13 @@ func (edm *DnstapMinimiser) Run(ctx context.Context) error {
 		}
 	}
 
+	// A replay reads capture files instead of listening for dnstap and
+	// ends once all files have been processed.
+	replay := len(startConf.ReplayFiles) > 0
+	if replay {
+		edm.replay = &replayState{}
+	}
+
 	// Clear any DAWG copies orphaned by a previous process before the first
 	// staged load below reads from the staging directory.
 	if err := edm.prepareDawgStaging(); err != nil {
@@ -148,6 +164,10 @@ func (edm *DnstapMinimiser) Run(ctx context.Context) error {
 		return fmt.Errorf("unable to configure ignored question names: %w", err)
 	}
 
+	if err := edm.setDnstapFilters(); err != nil {
+		return fmt.Errorf("unable to configure message type and identity filters: %w", err)
+	}
+
 	// Configuration is reloaded on SIGHUP (systemctl reload). The channel
 	// buffer of 1 combined with signal.Notify's non-blocking send coalesces
 	// signals arriving while a reload is already in progress.
@@ -161,14 +181,13 @@ func (edm *DnstapMinimiser) Run(ctx context.Context) error {
 		configUpdater(ctx, hupCh, edm)
 	}()
 
-	pdbDir := filepath.Join(startConf.DataDir, "pebble")
-	seenStore, err := edm.deps.SeenQnameStoreFactory.OpenSeenQnameStore(pdbDir)
+	seenStore, err := edm.deps.SeenQnameStoreFactory.OpenSeenQnameStore(startConf)
 	if err != nil {
-		return fmt.Errorf("unable to open pebble database %q: %w", pdbDir, err)
+		return fmt.Errorf("unable to open %s seen-qname store: %w", startConf.SeenQnameBackend, err)
 	}
 	defer func() {
 		if err := seenStore.Close(); err != nil {
-			edm.log.Error("unable to close pebble database", "error", err)
+			edm.log.Error("unable to close seen-qname store", "error", err)
 		}
 	}()
 
@@ -217,7 +236,7 @@ func (edm *DnstapMinimiser) Run(ctx context.Context) error {
 	// domain list yet we have seen since we started. To limit the
 	// possibility of unbounded memory usage we use a LRU cache instead of
 	// something simpler like a map.
-	seenQnameLRU, err := lru.New[string, struct{}](startConf.QnameSeenEntries)
+	seenQnameLRU, err := lru.New[string, seenQname](startConf.QnameSeenEntries)
 	if err != nil {
 		return fmt.Errorf("unable to create seen-qname LRU: %w", err)
 	}
@@ -293,6 +312,22 @@ func (edm *DnstapMinimiser) Run(ctx context.Context) error {
 	wg.Add(1)
 	go edm.diskCleaner(ctx, &wg, sentDir)
 
+	if interval := edm.pseudonymisation.keyRotation; interval > 0 {
+		wg.Add(1)
+		go edm.cryptopanKeyRotator(ctx, &wg, interval)
+	}
+
+	// A replay reads old frames, the wall clock would expire the names it
+	// records right away.
+	if ttl := startConf.seenQnameTTL(); ttl > 0 && edm.replay == nil {
+		wg.Add(1)
+		go edm.seenQnameExpirer(ctx, &wg, seenStore, ttl)
+	}
+	if bs, ok := seenStore.(*bloomSeenQnameStore); ok {
+		wg.Add(1)
+		go edm.bloomSeenQnameFlusher(ctx, &wg, bs)
+	}
+
 	dawgFile := startConf.WellKnownDomainsFile
 
 	dawgFinder, dawgModTime, err := edm.loadDawgFileStaged(dawgFile)
@@ -328,9 +363,17 @@ func (edm *DnstapMinimiser) Run(ctx context.Context) error {
 		}()
 	}
 
-	// Start data collector
-	wg.Add(1)
-	go edm.dataCollector(&wg, wkdTracker, dawgFile)
+	// Deduplicated new_qname events are held until the data collector
+	// rotates the histograms.
+	if startConf.NewQnameDedupeLabels > 0 && !startConf.DisableMQTT {
+		edm.newQnameDedupe = newNewQnameDedupe()
+	}
+
+	// Start data collector, waited for separately as it queues the
+	// deduplicated new_qname events still pending when it exits.
+	var dataCollectorWg sync.WaitGroup
+	dataCollectorWg.Add(1)
+	go edm.dataCollector(&dataCollectorWg, wkdTracker, dawgFile)
 
 	var minimiserWg sync.WaitGroup
 
@@ -338,6 +381,12 @@ func (edm *DnstapMinimiser) Run(ctx context.Context) error {
 	if numMinimiserWorkers <= 0 {
 		numMinimiserWorkers = runtime.GOMAXPROCS(0)
 	}
+	// Replay rotates intervals from the frame timestamps, which needs
+	// the frames processed in capture order.
+	if replay && numMinimiserWorkers != 1 {
+		edm.log.Info("Run: using a single minimiser worker for replay", "minimiser_workers", numMinimiserWorkers)
+		numMinimiserWorkers = 1
+	}
 
 	// Per-worker Crypto-PAn caches. Each worker holds its own LRU so the
 	// pseudonymise hot path takes no shared lock. Created before any
@@ -384,15 +433,30 @@ func (edm *DnstapMinimiser) Run(ctx context.Context) error {
 			dnstapInputErr = err
 			stop()
 		}
+		// Let the minimiser drain the remaining frames and exit once
+		// the replay has read everything.
+		if replay {
+			close(edm.inputChannel)
+		}
 	}()
 
 	// Wait here until all instances of runMinimiser() is done
 	minimiserWg.Wait()
 	dnstapInputWg.Wait()
 
+	// The background workers run until ctx is cancelled, which a
+	// finished replay has to do itself.
+	if replay {
+		stop()
+	}
+
 	// Tell collector it is time to stop reading data
 	close(wkdTracker.stop)
 
+	// Wait for the collector to queue the deduplicated new_qname events
+	// still pending
+	dataCollectorWg.Wait()
+
 	// Make sure writers have completed their work
 	close(edm.newQnamePublisherCh)
 
@@ -442,41 +506,68 @@ type DnstapMinimiser struct {
 	state        atomic.Int32 // run lifecycle: runStateIdle → runStateRunning → runStateDone
 	inputChannel chan []byte  // the channel passed to DNSTAP input readers
 	log          *slog.Logger // any information logging is sent here
+	replay       *replayState // capture time, only set while replaying dnstap files
+
+	// newQnameDedupe holds the new_qname events deduplicated per
+	// registrable domain, only set with new-qname-dedupe-labels and MQTT
+	// enabled.
+	newQnameDedupe *newQnameDedupe
 
 	// Cryptopan instance is held in an atomic.Pointer so the hot path
 	// reads it without locking. setCryptopan swaps the pointer and
 	// bumps cryptopanGen; per-worker caches compare their last-seen
-	// generation against this and Purge when it changes.
-	cryptopan                 atomic.Pointer[cryptopan.Cryptopan]
-	cryptopanGen              atomic.Uint64
-	promReg                   *prometheus.Registry
-	promCryptopanCacheHit     prometheus.Counter
-	promCryptopanCacheEvicted prometheus.Counter
-	promDnstapProcessed       prometheus.Counter
-	promNewQnameQueued        prometheus.Counter
-	promNewQnameDiscarded     prometheus.Counter
-	promSeenQnameLRUEvicted   prometheus.Counter
-	promNewQnameChannelLen    prometheus.Gauge
-	promClientIPIgnored       prometheus.Counter
-	promClientIPIgnoredError  prometheus.Counter
-	promQuestionNameIgnored   prometheus.Counter
-	promDNSParseError         prometheus.Counter
-	promEmptyQuestionSection  prometheus.Counter
-	promInvalidQuestionName   prometheus.Counter
-	debug                     bool // if we should print debug messages during operation
-	sessionWriterCh           chan *prevSessions
-	histogramWriterCh         chan *wellKnownDomainsData
-	parquetRotationRequestCh  chan parquetRotationRequest
-	newQnamePublisherCh       chan *protocols.NewQnameJSON
-	sessionCollectorCh        chan *sessionData
-	aggregSenderMutex         sync.RWMutex
-	aggregSender              aggregateSender
-	mqttPubCh                 chan []byte
-	mqttSignedCh              chan []byte
-	autopahoWg                sync.WaitGroup
-	// Hot-path lookups (clientIPIsIgnored, questionIsIgnored) read these
-	// without locking. Reload writers atomic.Store a fresh value and leave the
-	// old value for the GC to reclaim. For ignoredQuestions the dawgFinderHolder
+	// generation against this and Purge when it changes. cryptopanMu
+	// serializes setCryptopan, which is called both on reload and by the
+	// key rotator, so an older key can not be stored last.
+	cryptopanMu                      sync.Mutex
+	pseudonymisation                 pseudonymisationSettings
+	cryptopan                        atomic.Pointer[cryptopanState]
+	cryptopanGen                     atomic.Uint64
+	promReg                          *prometheus.Registry
+	promCryptopanCacheHit            prometheus.Counter
+	promCryptopanCacheEvicted        prometheus.Counter
+	promDnstapProcessed              prometheus.Counter
+	promDnstapInputFrames            *prometheus.CounterVec
+	promDnstapInputConnections       *prometheus.CounterVec
+	promDnstapInputActiveConnections *prometheus.GaugeVec
+	promNewQnameQueued               prometheus.Counter
+	promNewQnameDiscarded            prometheus.Counter
+	promSeenQnameLRUEvicted          prometheus.Counter
+	promNewQnameChannelLen           prometheus.Gauge
+	promClientIPIgnored              prometheus.Counter
+	promClientIPIgnoredError         prometheus.Counter
+	promQuestionNameIgnored          prometheus.Counter
+	promDNSParseError                prometheus.Counter
+	promEmptyQuestionSection         prometheus.Counter
+	promInvalidQuestionName          prometheus.Counter
+	promMessageTypeIgnored           prometheus.Counter
+	promMessageTypeNotAllowed        prometheus.Counter
+	promIdentityIgnored              prometheus.Counter
+	promIdentityNotAllowed           prometheus.Counter
+	promSessionsCorrelated           prometheus.Counter
+	promSessionsUncorrelated         prometheus.Counter
+	promHistogramRowsSuppressed      prometheus.Counter
+	promSessionScrubError            prometheus.Counter
+	promSessionRowsDropped           prometheus.Counter
+	promSeenQnameExpired             prometheus.Counter
+	promSeenQnameStoreEntries        prometheus.Gauge
+	promSeenQnameBloomFillRatio      prometheus.Gauge
+	promSeenQnameBloomFPRate         prometheus.Gauge
+	debug                            bool // if we should print debug messages during operation
+	sessionWriterCh                  chan sessionWriterMsg
+	histogramWriterCh                chan *wellKnownDomainsData
+	parquetRotationRequestCh         chan parquetRotationRequest
+	newQnamePublisherCh              chan *protocols.NewQnameJSON
+	sessionCollectorCh               chan *sessionData
+	aggregSenderMutex                sync.RWMutex
+	aggregSender                     aggregateSender
+	mqttPubCh                        chan []byte
+	mqttSignedCh                     chan []byte
+	autopahoWg                       sync.WaitGroup
+	// Hot-path lookups (clientIPIsIgnored, questionIsIgnored,
+	// messageIsFiltered) read these without locking. Reload writers
+	// atomic.Store a fresh value and leave the old value for the GC to
+	// reclaim. For ignoredQuestions the dawgFinderHolder
 	// wrapper is needed because dawg.Finder is an interface and atomic.Pointer
 	// wants a concrete type; its old finder is deliberately NOT Close()d on
 	// swap, since Close() (munmap) would race with hot-path readers still
@@ -486,6 +577,7 @@ type DnstapMinimiser struct {
 	ignoredClientsIPSet           atomic.Pointer[netipx.IPSet]
 	ignoredClientCIDRsParsed      atomic.Uint64
 	ignoredQuestions              atomic.Pointer[dawgFinderHolder]
+	dnstapFilter                  atomic.Pointer[dnstapFilter]
 	dawgReloadRequested           atomic.Bool // set on SIGHUP, consumed by rotateTracker
 	httpClientCertStore           *certStore  // client cert/key for mTLS authentication
 	mqttClientCertStore           *certStore  // client cert/key for mTLS authentication
@@ -526,6 +618,7 @@ func NewDnstapMinimiser(provider ConfigProvider, logger *slog.Logger, opts ...Dn
 
 	conf := edm.getConfig()
 
+	edm.pseudonymisation = newPseudonymisationSettings(conf)
 	err = edm.setCryptopan(conf.CryptopanKey, conf.CryptopanKeySalt, conf.CryptopanAddressEntries)
 	if err != nil {
 		return nil, fmt.Errorf("NewDnstapMinimiser: %w", err)
@@ -559,6 +652,21 @@ func NewDnstapMinimiser(provider ConfigProvider, logger *slog.Logger, opts ...Dn
 		Help: "The total number of processed dnstap packets",
 	})
 
+	edm.promDnstapInputFrames = promauto.With(promReg).NewCounterVec(prometheus.CounterOpts{
+		Name: "edm_dnstap_input_frames_total",
+		Help: "The total number of dnstap frames received per dnstap input",
+	}, []string{"input"})
+
+	edm.promDnstapInputConnections = promauto.With(promReg).NewCounterVec(prometheus.CounterOpts{
+		Name: "edm_dnstap_input_connections_total",
+		Help: "The total number of accepted dnstap connections per dnstap input",
+	}, []string{"input"})
+
+	edm.promDnstapInputActiveConnections = promauto.With(promReg).NewGaugeVec(prometheus.GaugeOpts{
+		Name: "edm_dnstap_input_active_connections",
+		Help: "The number of currently open dnstap connections per dnstap input",
+	}, []string{"input"})
+
 	edm.promNewQnameQueued = promauto.With(promReg).NewCounter(prometheus.CounterOpts{
 		Name: "edm_new_qname_queued_total",
 		Help: "The total number of queued new_qname events",
@@ -609,6 +717,71 @@ func NewDnstapMinimiser(provider ConfigProvider, logger *slog.Logger, opts ...Dn
 		Help: "The total number of times we have ignored a dnstap packet because it contained an invalid name in the question section",
 	})
 
+	edm.promMessageTypeIgnored = promauto.With(promReg).NewCounter(prometheus.CounterOpts{
+		Name: "edm_ignored_message_type_total",
+		Help: "The total number of times we have ignored a dnstap packet because its message type is in ignored-message-types",
+	})
+
+	edm.promMessageTypeNotAllowed = promauto.With(promReg).NewCounter(prometheus.CounterOpts{
+		Name: "edm_not_allowed_message_type_total",
+		Help: "The total number of times we have ignored a dnstap packet because its message type is not in allowed-message-types",
+	})
+
+	edm.promIdentityIgnored = promauto.With(promReg).NewCounter(prometheus.CounterOpts{
+		Name: "edm_ignored_identity_total",
+		Help: "The total number of times we have ignored a dnstap packet because its identity is in ignored-identities",
+	})
+
+	edm.promIdentityNotAllowed = promauto.With(promReg).NewCounter(prometheus.CounterOpts{
+		Name: "edm_not_allowed_identity_total",
+		Help: "The total number of times we have ignored a dnstap packet because its identity is not in allowed-identities",
+	})
+
+	edm.promSessionsCorrelated = promauto.With(promReg).NewCounter(prometheus.CounterOpts{
+		Name: "edm_correlated_sessions_total",
+		Help: "The total number of session rows where a query was joined with its response",
+	})
+
+	edm.promSessionsUncorrelated = promauto.With(promReg).NewCounter(prometheus.CounterOpts{
+		Name: "edm_uncorrelated_sessions_total",
+		Help: "The total number of session rows written without the other half of their query/response pair",
+	})
+
+	edm.promHistogramRowsSuppressed = promauto.With(promReg).NewCounter(prometheus.CounterOpts{
+		Name: "edm_histogram_rows_suppressed_total",
+		Help: "The total number of histogram rows left out or merged into a per-TLD row because they had fewer clients than histogram-min-clients",
+	})
+
+	edm.promSessionScrubError = promauto.With(promReg).NewCounter(prometheus.CounterOpts{
+		Name: "edm_session_scrub_error_total",
+		Help: "The total number of DNS messages left out of session files because they could not be scrubbed of client identifying data",
+	})
+
+	edm.promSessionRowsDropped = promauto.With(promReg).NewCounter(prometheus.CounterOpts{
+		Name: "edm_session_rows_dropped_total",
+		Help: "The total number of session rows lost because their session file could not be opened or written",
+	})
+
+	edm.promSeenQnameExpired = promauto.With(promReg).NewCounter(prometheus.CounterOpts{
+		Name: "edm_seen_qname_expired_total",
+		Help: "The total number of qnames removed from the seen-qname store because they were not seen for longer than seen-qname-ttl",
+	})
+
+	edm.promSeenQnameStoreEntries = promauto.With(promReg).NewGauge(prometheus.GaugeOpts{
+		Name: "edm_seen_qname_store_entries",
+		Help: "The number of qnames in the seen-qname store, updated when expired qnames are removed",
+	})
+
+	edm.promSeenQnameBloomFillRatio = promauto.With(promReg).NewGauge(prometheus.GaugeOpts{
+		Name: "edm_seen_qname_bloom_fill_ratio",
+		Help: "The share of set bits in the bloom seen-qname filter",
+	})
+
+	edm.promSeenQnameBloomFPRate = promauto.With(promReg).NewGauge(prometheus.GaugeOpts{
+		Name: "edm_seen_qname_bloom_false_positive_rate",
+		Help: "The estimated false-positive rate of the bloom seen-qname filter, the chance that a new qname is not announced",
+	})
+
 	edm.promReg = promReg
 	// Buffer enough frames to absorb scheduling jitter under high QPS.
 	// A 1024-frame buffer keeps producers from stalling without growing
@@ -636,7 +809,7 @@ func NewDnstapMinimiser(provider ConfigProvider, logger *slog.Logger, opts ...Dn
 	// to not block the loop if writing/sending data is slow.
 	// NOTE: Remember to close all of these channels at the end of the
 	// minimiser loop, otherwise the program can hang on shutdown.
-	edm.sessionWriterCh = make(chan *prevSessions, 100)
+	edm.sessionWriterCh = make(chan sessionWriterMsg, 10000)
 	edm.histogramWriterCh = make(chan *wellKnownDomainsData, 100)
 	edm.parquetRotationRequestCh = make(chan parquetRotationRequest, 1)
 	edm.newQnamePublisherCh = make(chan *protocols.NewQnameJSON, conf.NewQnameBuffer)
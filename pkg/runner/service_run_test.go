@@ -36,10 +36,10 @@ func (fn httpServerRunnerFunc) ListenAndServeHTTP(server *http.Server) error {
 	return fn(server)
 }
 
-type seenQnameStoreFactoryFunc func(string) (seenQnameStore, error)
+type seenQnameStoreFactoryFunc func(Config) (SeenQnameStore, error)
 
-func (fn seenQnameStoreFactoryFunc) OpenSeenQnameStore(path string) (seenQnameStore, error) {
-	return fn(path)
+func (fn seenQnameStoreFactoryFunc) OpenSeenQnameStore(conf Config) (SeenQnameStore, error) {
+	return fn(conf)
 }
 
 // pinHTTPServersToEphemeral overrides the pprof/metrics listen addresses
@@ -95,7 +95,7 @@ func TestRunCore_ErrorPaths(t *testing.T) {
 	t.Run("seen-qname store open error", func(t *testing.T) {
 		tc := runCoreTC(t)
 		edm := newTestDnstapMinimiser(t, tc)
-		edm.deps.SeenQnameStoreFactory = seenQnameStoreFactoryFunc(func(string) (seenQnameStore, error) {
+		edm.deps.SeenQnameStoreFactory = seenQnameStoreFactoryFunc(func(Config) (SeenQnameStore, error) {
 			return nil, errInjected
 		})
 		err := edm.Run(t.Context())
@@ -29,6 +29,9 @@ func TestNewDnstapMinimiserAPI(t *testing.T) {
 		defaultTC, logger,
 		WithLoggerLevel(loggerLevel),
 		withDependencies(dependencies{PprofListenAddr: "127.0.0.1:0", CryptopanFactory: fastTestCryptopanFactory{}}),
+		WithSeenQnameStoreFactory(seenQnameStoreFactoryFunc(func(Config) (SeenQnameStore, error) {
+			return &fakeSeenQnameStore{}, nil
+		})),
 	)
 	if err != nil {
 		t.Fatalf("NewDnstapMinimiser: %s", err)
@@ -37,6 +40,9 @@ func TestNewDnstapMinimiserAPI(t *testing.T) {
 	if edm.loggerLevel != loggerLevel {
 		t.Fatal("WithLoggerLevel did not install the supplied level var")
 	}
+	if _, ok := edm.deps.SeenQnameStoreFactory.(seenQnameStoreFactoryFunc); !ok {
+		t.Fatalf("WithSeenQnameStoreFactory did not install the supplied factory, got %T", edm.deps.SeenQnameStoreFactory)
+	}
 	if edm.deps.PprofListenAddr != "127.0.0.1:0" {
 		t.Fatalf("PprofListenAddr = %q, want custom value", edm.deps.PprofListenAddr)
 	}
@@ -3,18 +3,15 @@ package runner
 import (
 	"encoding/binary"
 	"fmt"
-	"io"
+	"maps"
 	"math"
 	"net/netip"
-	"path/filepath"
 	"strings"
-	"sync"
 	"time"
 
 	dnstap "github.com/dnstap/golang-dnstap"
 	"github.com/miekg/dns"
 	"github.com/parquet-go/parquet-go"
-	"github.com/parquet-go/parquet-go/format"
 )
 
 // We need to create the session data schema by hand instead of basing it of
@@ -29,35 +26,98 @@ import (
 // https://github.com/parquet-go/parquet-go/issues/43
 // Commit that makes the map sorted:
 // https://github.com/parquet-go/parquet-go/commit/035e69db6792fdc9089e238084bebe39e26c74b0
-var sessionDataSchema = parquet.NewSchema(
-	"sessionData",
-	parquet.Group{
-		"label0":              parquet.Optional(parquet.String()),
-		"label1":              parquet.Optional(parquet.String()),
-		"label2":              parquet.Optional(parquet.String()),
-		"label3":              parquet.Optional(parquet.String()),
-		"label4":              parquet.Optional(parquet.String()),
-		"label5":              parquet.Optional(parquet.String()),
-		"label6":              parquet.Optional(parquet.String()),
-		"label7":              parquet.Optional(parquet.String()),
-		"label8":              parquet.Optional(parquet.String()),
-		"label9":              parquet.Optional(parquet.String()),
-		"server_id":           parquet.Optional(parquet.Leaf(parquet.ByteArrayType)),
-		"query_time":          parquet.Optional(parquet.Timestamp(parquet.Microsecond)),
-		"response_time":       parquet.Optional(parquet.Timestamp(parquet.Microsecond)),
-		"source_ipv4":         parquet.Optional(parquet.Uint(32)),
-		"dest_ipv4":           parquet.Optional(parquet.Uint(32)),
-		"source_ipv6_network": parquet.Optional(parquet.Uint(64)),
-		"source_ipv6_host":    parquet.Optional(parquet.Uint(64)),
-		"dest_ipv6_network":   parquet.Optional(parquet.Uint(64)),
-		"dest_ipv6_host":      parquet.Optional(parquet.Uint(64)),
-		"source_port":         parquet.Optional(parquet.Uint(16)),
-		"dest_port":           parquet.Optional(parquet.Uint(16)),
-		"dns_protocol":        parquet.Optional(parquet.Uint(8)),
-		"query_message":       parquet.Optional(parquet.Leaf(parquet.ByteArrayType)),
-		"response_message":    parquet.Optional(parquet.Leaf(parquet.ByteArrayType)),
-	},
-)
+//
+// The schema is put together from column groups selected by
+// [sessionColumns]: the base columns are always present, the raw message
+// and derived columns are optional.
+var sessionBaseColumns = parquet.Group{
+	"label0":              parquet.Optional(parquet.String()),
+	"label1":              parquet.Optional(parquet.String()),
+	"label2":              parquet.Optional(parquet.String()),
+	"label3":              parquet.Optional(parquet.String()),
+	"label4":              parquet.Optional(parquet.String()),
+	"label5":              parquet.Optional(parquet.String()),
+	"label6":              parquet.Optional(parquet.String()),
+	"label7":              parquet.Optional(parquet.String()),
+	"label8":              parquet.Optional(parquet.String()),
+	"label9":              parquet.Optional(parquet.String()),
+	"server_id":           parquet.Optional(parquet.Leaf(parquet.ByteArrayType)),
+	"query_time":          parquet.Optional(parquet.Timestamp(parquet.Microsecond)),
+	"response_time":       parquet.Optional(parquet.Timestamp(parquet.Microsecond)),
+	"source_ipv4":         parquet.Optional(parquet.Uint(32)),
+	"dest_ipv4":           parquet.Optional(parquet.Uint(32)),
+	"source_ipv6_network": parquet.Optional(parquet.Uint(64)),
+	"source_ipv6_host":    parquet.Optional(parquet.Uint(64)),
+	"dest_ipv6_network":   parquet.Optional(parquet.Uint(64)),
+	"dest_ipv6_host":      parquet.Optional(parquet.Uint(64)),
+	"source_port":         parquet.Optional(parquet.Uint(16)),
+	"dest_port":           parquet.Optional(parquet.Uint(16)),
+	"dns_protocol":        parquet.Optional(parquet.Uint(8)),
+	"dnstap_message_type": parquet.Optional(parquet.Uint(8)),
+	"latency_us":          parquet.Optional(parquet.Int(64)),
+}
+
+// sessionMessageColumns hold the DNS messages in wire format.
+var sessionMessageColumns = parquet.Group{
+	"query_message":    parquet.Optional(parquet.Leaf(parquet.ByteArrayType)),
+	"response_message": parquet.Optional(parquet.Leaf(parquet.ByteArrayType)),
+}
+
+// sessionDerivedColumns hold fields parsed out of the DNS message of a row,
+// the response message for a row with both a query and a response.
+var sessionDerivedColumns = parquet.Group{
+	"qtype":            parquet.Optional(parquet.Uint(16)),
+	"qclass":           parquet.Optional(parquet.Uint(16)),
+	"rcode":            parquet.Optional(parquet.Uint(16)),
+	"flag_qr":          parquet.Optional(parquet.Leaf(parquet.BooleanType)),
+	"flag_aa":          parquet.Optional(parquet.Leaf(parquet.BooleanType)),
+	"flag_tc":          parquet.Optional(parquet.Leaf(parquet.BooleanType)),
+	"flag_rd":          parquet.Optional(parquet.Leaf(parquet.BooleanType)),
+	"flag_ra":          parquet.Optional(parquet.Leaf(parquet.BooleanType)),
+	"flag_ad":          parquet.Optional(parquet.Leaf(parquet.BooleanType)),
+	"flag_cd":          parquet.Optional(parquet.Leaf(parquet.BooleanType)),
+	"answer_count":     parquet.Optional(parquet.Uint(16)),
+	"first_answer_ttl": parquet.Optional(parquet.Uint(32)),
+	"edns_buffer_size": parquet.Optional(parquet.Uint(16)),
+	"message_size":     parquet.Optional(parquet.Uint(16)),
+}
+
+// sessionColumns selects the optional column groups of a session file.
+type sessionColumns struct {
+	messages bool
+	derived  bool
+}
+
+// String returns the schema variant recorded in the
+// sessionColumnsMetadataKey metadata of a session file, the comma separated
+// column groups in the file, e.g. "base,messages".
+func (c sessionColumns) String() string {
+	groups := []string{"base"}
+	if c.messages {
+		groups = append(groups, "messages")
+	}
+	if c.derived {
+		groups = append(groups, "derived")
+	}
+	return strings.Join(groups, ",")
+}
+
+// schema returns the session parquet schema with the selected column groups.
+func (c sessionColumns) schema() *parquet.Schema {
+	group := parquet.Group{}
+	maps.Copy(group, sessionBaseColumns)
+	if c.messages {
+		maps.Copy(group, sessionMessageColumns)
+	}
+	if c.derived {
+		maps.Copy(group, sessionDerivedColumns)
+	}
+	return parquet.NewSchema("sessionData", group)
+}
+
+// sessionDataSchema is the schema of session files with the default
+// columns.
+var sessionDataSchema = sessionColumns{messages: true}.schema()
 
 type dnsLabels struct {
 	// Store label fields as pointers so we can signal them being unset as
@@ -82,21 +142,44 @@ type sessionData struct {
 	SourceIPv4   *int32  `parquet:"source_ipv4"`
 	DestIPv4     *int32  `parquet:"dest_ipv4"`
 	// IPv6 addresses are split up into a network and host part, for one thing go does not have native uint128 types
-	SourceIPv6Network *int64  `parquet:"source_ipv6_network"`
-	SourceIPv6Host    *int64  `parquet:"source_ipv6_host"`
-	DestIPv6Network   *int64  `parquet:"dest_ipv6_network"`
-	DestIPv6Host      *int64  `parquet:"dest_ipv6_host"`
-	SourcePort        *int32  `parquet:"source_port"`
-	DestPort          *int32  `parquet:"dest_port"`
-	DNSProtocol       *int32  `parquet:"dns_protocol"`
-	QueryMessage      *string `parquet:"query_message"`
-	ResponseMessage   *string `parquet:"response_message"`
-}
-
-type prevSessions struct {
-	sessions     []*sessionData
-	startTime    time.Time
-	rotationTime time.Time
+	SourceIPv6Network *int64 `parquet:"source_ipv6_network"`
+	SourceIPv6Host    *int64 `parquet:"source_ipv6_host"`
+	DestIPv6Network   *int64 `parquet:"dest_ipv6_network"`
+	DestIPv6Host      *int64 `parquet:"dest_ipv6_host"`
+	SourcePort        *int32 `parquet:"source_port"`
+	DestPort          *int32 `parquet:"dest_port"`
+	DNSProtocol       *int32 `parquet:"dns_protocol"`
+	// The dnstap Message.Type the row was created from, e.g.
+	// CLIENT_QUERY or CLIENT_RESPONSE
+	DnstapMessageType *int32 `parquet:"dnstap_message_type"`
+	// Microseconds from query to response, only set when a query has
+	// been joined with its response, see sessionCorrelator
+	LatencyMicroseconds *int64  `parquet:"latency_us"`
+	QueryMessage        *string `parquet:"query_message"`
+	ResponseMessage     *string `parquet:"response_message"`
+
+	// Derived columns, only set with session-derived-columns
+	Qtype          *int32 `parquet:"qtype"`
+	Qclass         *int32 `parquet:"qclass"`
+	Rcode          *int32 `parquet:"rcode"`
+	FlagQR         *bool  `parquet:"flag_qr"`
+	FlagAA         *bool  `parquet:"flag_aa"`
+	FlagTC         *bool  `parquet:"flag_tc"`
+	FlagRD         *bool  `parquet:"flag_rd"`
+	FlagRA         *bool  `parquet:"flag_ra"`
+	FlagAD         *bool  `parquet:"flag_ad"`
+	FlagCD         *bool  `parquet:"flag_cd"`
+	AnswerCount    *int32 `parquet:"answer_count"`
+	FirstAnswerTTL *int32 `parquet:"first_answer_ttl"`
+	EDNSBufferSize *int32 `parquet:"edns_buffer_size"`
+	MessageSize    *int32 `parquet:"message_size"`
+
+	// correlationKey is set when query/response correlation is enabled
+	// and the row can be joined with the other half of its transaction.
+	correlationKey *sessionKey
+	// cryptopanEpoch is the Crypto-PAn key epoch the addresses were
+	// pseudonymised in, the zero time without key rotation.
+	cryptopanEpoch time.Time
 }
 
 func (edm *DnstapMinimiser) setLabels(labels []string, labelLimit int, l *dnsLabels) {
@@ -269,46 +352,56 @@ func (edm *DnstapMinimiser) newSession(dt *dnstap.Dnstap, msg *dns.Msg, isQuery
 		edm.log.Error("packet is neither INET or INET6")
 	}
 
-	if dt.Message.SocketProtocol != nil {
-		dnsProtocol := int32(dt.Message.GetSocketProtocol())
+	if protocol := dnstapSocketProtocol(dt.Message); protocol != 0 {
+		dnsProtocol := int32(protocol)
 		sd.DNSProtocol = &dnsProtocol
 	}
 
+	if dt.Message.Type != nil {
+		messageType := int32(dt.Message.GetType())
+		sd.DnstapMessageType = &messageType
+	}
+
 	return sd
 }
 
-func (edm *DnstapMinimiser) createSessionFile(ps *prevSessions, dataDir string) (string, error) {
-	// Write session file to a sessions dir where it can be read by other tools
-	sessionsDir := filepath.Join(dataDir, "parquet", "sessions")
-
-	startTime := intervalStartFromTimes(ps.startTime, ps.rotationTime)
-
-	absoluteTmpFileName, absoluteFileName := buildParquetFilenames(sessionsDir, "dns_session_block", startTime, ps.rotationTime)
-
-	absoluteTmpFileName = filepath.Clean(absoluteTmpFileName) // Make gosec happy
-
-	name, err := edm.writeRotatedParquet("session", absoluteTmpFileName, absoluteFileName, func(w io.Writer) error {
-		return edm.writeSessionParquet(w, ps)
-	})
-	if err != nil {
-		return "", fmt.Errorf("createSessionFile: %w", err)
+// setDerivedColumns fills in the derived columns of sd from msg, which was
+// messageSize bytes on the wire.
+func (sd *sessionData) setDerivedColumns(msg *dns.Msg, messageSize int) {
+	qtype := int32(msg.Question[0].Qtype)
+	qclass := int32(msg.Question[0].Qclass)
+	rcode := int32(msg.Rcode) // #nosec G115 -- Extended RCODEs are 12 bits
+	sd.Qtype = &qtype
+	sd.Qclass = &qclass
+	sd.Rcode = &rcode
+
+	// Copy the flags rather than pointing into msg.
+	flags := [...]bool{
+		msg.Response,
+		msg.Authoritative,
+		msg.Truncated,
+		msg.RecursionDesired,
+		msg.RecursionAvailable,
+		msg.AuthenticatedData,
+		msg.CheckingDisabled,
+	}
+	sd.FlagQR, sd.FlagAA, sd.FlagTC, sd.FlagRD = &flags[0], &flags[1], &flags[2], &flags[3]
+	sd.FlagRA, sd.FlagAD, sd.FlagCD = &flags[4], &flags[5], &flags[6]
+
+	answerCount := int32(min(len(msg.Answer), math.MaxUint16)) // #nosec G115 -- Capped to the uint16 ANCOUNT range
+	sd.AnswerCount = &answerCount
+	if len(msg.Answer) > 0 {
+		ttl := int32(msg.Answer[0].Header().Ttl) // #nosec G115 -- Used in parquet struct with convertedType=UINT_32
+		sd.FirstAnswerTTL = &ttl
 	}
-	return name, nil
-}
-
-func (edm *DnstapMinimiser) sessionWriter(dataDir string, wg *sync.WaitGroup) {
-	defer wg.Done()
-
-	edm.log.Info("sessionWriter: starting")
 
-	for ps := range edm.sessionWriterCh {
-		_, err := edm.createSessionFile(ps, dataDir)
-		if err != nil {
-			edm.log.Error("sessionWriter", "error", err.Error())
-		}
+	if opt := msg.IsEdns0(); opt != nil {
+		bufferSize := int32(opt.UDPSize())
+		sd.EDNSBufferSize = &bufferSize
 	}
 
-	edm.log.Info("sessionWriter: exiting loop")
+	size := int32(min(messageSize, math.MaxUint16)) // #nosec G115 -- Capped to the uint16 DNS message size range
+	sd.MessageSize = &size
 }
 
 func ipBytesToInt(ip4Bytes []byte) (uint32, error) {
@@ -342,22 +435,3 @@ func ip6BytesToInt(ip6Bytes []byte) (uint64, uint64, error) {
 
 	return ipIntNetwork, ipIntHost, nil
 }
-
-func (edm *DnstapMinimiser) writeSessionParquet(output io.Writer, ps *prevSessions) error {
-	snappyCodec := parquet.LookupCompressionCodec(format.Snappy)
-	parquetWriter := parquet.NewGenericWriter[sessionData](output, sessionDataSchema, parquet.Compression(snappyCodec))
-
-	for _, sd := range ps.sessions {
-		_, err := parquetWriter.Write([]sessionData{*sd})
-		if err != nil {
-			return fmt.Errorf("writeSessionParquet: unable to call Write() on parquet writer: %w", err)
-		}
-	}
-
-	err := parquetWriter.Close()
-	if err != nil {
-		return fmt.Errorf("writeSessionParquet: unable to call Close() on parquet writer: %w", err)
-	}
-
-	return nil
-}
@@ -169,6 +169,7 @@ func BenchmarkSessionWriter(b *testing.B) {
 		SourcePort:        ptr(int32(1337)),
 		DestPort:          ptr(int32(1337)),
 		DNSProtocol:       ptr(int32(1)),
+		DnstapMessageType: ptr(int32(dnstap.Message_CLIENT_RESPONSE)),
 		QueryMessage:      ptr("query message"),
 		ResponseMessage:   ptr("response message"),
 	}
@@ -223,6 +224,7 @@ func TestSessionWriter(t *testing.T) {
 		SourcePort:        ptr(int32(1337)),
 		DestPort:          ptr(int32(1337)),
 		DNSProtocol:       ptr(int32(1)),
+		DnstapMessageType: ptr(int32(dnstap.Message_CLIENT_RESPONSE)),
 		QueryMessage:      ptr("query message"),
 		ResponseMessage:   ptr("response message"),
 	}
@@ -281,7 +283,7 @@ func TestSessionParquetAndSessionConstruction(t *testing.T) {
 	edm := newTestDnstapMinimiser(t, defaultTC)
 	packed := packedDNSMsg(t, "www.example.com.", dns.TypeA, dns.RcodeSuccess)
 	dt := testDnstapMessage(t, dnstap.Message_CLIENT_RESPONSE, dnstap.SocketFamily_INET, packed)
-	msg, ts := edm.parsePacket(dt, false)
+	msg, ts, _ := edm.parsePacket(dt, false)
 	if msg == nil {
 		t.Fatal("parsePacket returned nil msg")
 	}
@@ -295,9 +297,12 @@ func TestSessionParquetAndSessionConstruction(t *testing.T) {
 	if sd.SourceIPv4 == nil || sd.DestIPv4 == nil || sd.DNSProtocol == nil {
 		t.Fatalf("session missing network fields: %#v", sd)
 	}
+	if sd.DnstapMessageType == nil || *sd.DnstapMessageType != int32(dnstap.Message_CLIENT_RESPONSE) {
+		t.Fatalf("session dnstap message type = %v, want CLIENT_RESPONSE", sd.DnstapMessageType)
+	}
 
 	var buf bytes.Buffer
-	if err := edm.writeSessionParquet(&buf, &prevSessions{sessions: []*sessionData{sd}}); err != nil {
+	if err := parquet.Write(&buf, []sessionData{*sd}, sessionDataSchema); err != nil {
 		t.Fatal(err)
 	}
 	rows, err := parquet.Read[sessionData](bytes.NewReader(buf.Bytes()), int64(buf.Len()))
@@ -309,7 +314,7 @@ func TestSessionParquetAndSessionConstruction(t *testing.T) {
 	}
 
 	queryDT := testDnstapMessage(t, dnstap.Message_CLIENT_QUERY, dnstap.SocketFamily_INET6, packed)
-	queryMsg, queryTS := edm.parsePacket(queryDT, true)
+	queryMsg, queryTS, _ := edm.parsePacket(queryDT, true)
 	querySession := edm.newSession(queryDT, queryMsg, true, defaultLabelLimit, queryTS)
 	if querySession.QueryTime == nil || querySession.QueryMessage == nil || querySession.SourceIPv6Network == nil || querySession.DestIPv6Host == nil {
 		t.Fatalf("query session missing fields: %#v", querySession)
@@ -317,17 +322,17 @@ func TestSessionParquetAndSessionConstruction(t *testing.T) {
 
 	huge := uint64(math.MaxInt64) + 1
 	queryDT.Message.QueryTimeSec = &huge
-	if _, zeroTS := edm.parsePacket(queryDT, true); !zeroTS.Equal(time.Unix(0, 0).UTC()) {
+	if _, zeroTS, ok := edm.parsePacket(queryDT, true); ok || !zeroTS.Equal(time.Unix(0, 0).UTC()) {
 		t.Fatalf("overflow query timestamp = %v, want Unix zero", zeroTS)
 	}
 	responseDT := testDnstapMessage(t, dnstap.Message_CLIENT_RESPONSE, dnstap.SocketFamily_INET, packed)
 	huge = uint64(math.MaxInt64) + 1
 	responseDT.Message.ResponseTimeSec = &huge
-	if _, zeroTS := edm.parsePacket(responseDT, false); !zeroTS.Equal(time.Unix(0, 0).UTC()) {
+	if _, zeroTS, ok := edm.parsePacket(responseDT, false); ok || !zeroTS.Equal(time.Unix(0, 0).UTC()) {
 		t.Fatalf("overflow response timestamp = %v, want Unix zero", zeroTS)
 	}
 
-	badMsg, _ := edm.parsePacket(&dnstap.Dnstap{Message: &dnstap.Message{QueryMessage: []byte{1}, QueryTimeSec: ptr(uint64(0)), QueryTimeNsec: ptr(uint32(0))}}, true)
+	badMsg, _, _ := edm.parsePacket(&dnstap.Dnstap{Message: &dnstap.Message{QueryMessage: []byte{1}, QueryTimeSec: ptr(uint64(0)), QueryTimeNsec: ptr(uint32(0))}}, true)
 	if badMsg != nil {
 		t.Fatal("bad query packet returned non-nil message")
 	}
@@ -348,7 +353,7 @@ func TestNewSessionBranches(t *testing.T) {
 		big := uint32(math.MaxInt32) + 1
 		dt.Message.QueryPort = &big
 		dt.Message.ResponsePort = &big
-		msg, ts := edm.parsePacket(dt, false)
+		msg, ts, _ := edm.parsePacket(dt, false)
 		sd := edm.newSession(dt, msg, false, defaultLabelLimit, ts)
 		if sd.SourcePort == nil || *sd.SourcePort != 0 {
 			t.Fatalf("SourcePort = %v, want 0", sd.SourcePort)
@@ -362,7 +367,7 @@ func TestNewSessionBranches(t *testing.T) {
 		dt := testDnstapMessage(t, dnstap.Message_CLIENT_RESPONSE, dnstap.SocketFamily_INET, packed)
 		dt.Message.QueryAddress = []byte{1, 2, 3}
 		dt.Message.ResponseAddress = []byte{4, 5, 6}
-		msg, ts := edm.parsePacket(dt, false)
+		msg, ts, _ := edm.parsePacket(dt, false)
 		sd := edm.newSession(dt, msg, false, defaultLabelLimit, ts)
 		if sd.SourceIPv4 != nil {
 			t.Fatalf("SourceIPv4 should be nil for bad addr bytes, got %v", *sd.SourceIPv4)
@@ -376,7 +381,7 @@ func TestNewSessionBranches(t *testing.T) {
 		dt := testDnstapMessage(t, dnstap.Message_CLIENT_RESPONSE, dnstap.SocketFamily_INET, packed)
 		dt.Message.QueryAddress = netip.MustParseAddr("2001:db8::20").AsSlice()
 		dt.Message.ResponseAddress = netip.MustParseAddr("2001:db8::53").AsSlice()
-		msg, ts := edm.parsePacket(dt, false)
+		msg, ts, _ := edm.parsePacket(dt, false)
 		sd := edm.newSession(dt, msg, false, defaultLabelLimit, ts)
 		if sd.SourceIPv4 != nil {
 			t.Fatalf("SourceIPv4 should be nil for IPv6 bytes with INET family, got %d", *sd.SourceIPv4)
@@ -390,7 +395,7 @@ func TestNewSessionBranches(t *testing.T) {
 		dt := testDnstapMessage(t, dnstap.Message_CLIENT_RESPONSE, dnstap.SocketFamily_INET6, packed)
 		dt.Message.QueryAddress = []byte{1, 2, 3}
 		dt.Message.ResponseAddress = []byte{4, 5, 6}
-		msg, ts := edm.parsePacket(dt, false)
+		msg, ts, _ := edm.parsePacket(dt, false)
 		sd := edm.newSession(dt, msg, false, defaultLabelLimit, ts)
 		if sd.SourceIPv6Network != nil {
 			t.Fatalf("SourceIPv6Network should be nil for bad addr bytes")
@@ -404,7 +409,7 @@ func TestNewSessionBranches(t *testing.T) {
 		dt := testDnstapMessage(t, dnstap.Message_CLIENT_RESPONSE, dnstap.SocketFamily_INET, packed)
 		unknown := dnstap.SocketFamily(99)
 		dt.Message.SocketFamily = &unknown
-		msg, ts := edm.parsePacket(dt, false)
+		msg, ts, _ := edm.parsePacket(dt, false)
 		sd := edm.newSession(dt, msg, false, defaultLabelLimit, ts)
 		if sd.SourceIPv4 != nil || sd.SourceIPv6Network != nil {
 			t.Fatal("expected no IP fields populated for unknown family")
@@ -414,7 +419,7 @@ func TestNewSessionBranches(t *testing.T) {
 	t.Run("empty identity leaves ServerID nil", func(t *testing.T) {
 		dt := testDnstapMessage(t, dnstap.Message_CLIENT_RESPONSE, dnstap.SocketFamily_INET, packed)
 		dt.Identity = nil
-		msg, ts := edm.parsePacket(dt, false)
+		msg, ts, _ := edm.parsePacket(dt, false)
 		sd := edm.newSession(dt, msg, false, defaultLabelLimit, ts)
 		if sd.ServerID != nil {
 			t.Fatalf("ServerID should be nil for empty identity, got %q", *sd.ServerID)
@@ -423,8 +428,8 @@ func TestNewSessionBranches(t *testing.T) {
 }
 
 // TestSessionWriterLogsCreateError verifies the sessionWriter worker logs and
-// keeps running when createSessionFile fails. The failure is injected through
-// FileSystem.Create so writeSessionParquet is never reached.
+// keeps running when a session file can not be opened. The failure is
+// injected through FileSystem.Create so no row is ever written.
 func TestSessionWriterLogsCreateError(t *testing.T) {
 	edm := newTestDnstapMinimiser(t, defaultTC)
 	var buf bytes.Buffer
@@ -432,7 +437,9 @@ func TestSessionWriterLogsCreateError(t *testing.T) {
 
 	edm.deps.FileSystem = faultingFileSystem{fileSystem: edm.deps.FileSystem, create: func(string) (fsFile, error) { return nil, errInjected }}
 
-	edm.sessionWriterCh <- &prevSessions{rotationTime: time.Now()}
+	edm.sessionWriterCh <- sessionWriterMsg{sd: &sessionData{}, startTime: time.Now()}
+	edm.sessionWriterCh <- sessionWriterMsg{sd: &sessionData{}, startTime: time.Now()}
+	edm.sessionWriterCh <- sessionWriterMsg{rotationTime: time.Now()}
 	close(edm.sessionWriterCh)
 
 	var wg sync.WaitGroup
@@ -465,3 +472,54 @@ func TestNewSessionAllowsMissingSocketMetadata(t *testing.T) {
 		t.Fatalf("IP fields should stay nil when SocketFamily is missing: %#v", sd)
 	}
 }
+
+func TestSetDerivedColumns(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.Response = true
+	m.RecursionAvailable = true
+	m.AuthenticatedData = true
+	m.SetEdns0(1232, false)
+	a, err := dns.NewRR("example.com. 300 IN A 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aaaa, err := dns.NewRR("example.com. 60 IN AAAA 2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Answer = []dns.RR{a, aaaa}
+
+	sd := &sessionData{}
+	sd.setDerivedColumns(m, 100)
+
+	for name, tc := range map[string]struct {
+		got  *int32
+		want int32
+	}{
+		"qtype":            {sd.Qtype, int32(dns.TypeA)},
+		"qclass":           {sd.Qclass, int32(dns.ClassINET)},
+		"rcode":            {sd.Rcode, dns.RcodeSuccess},
+		"answer_count":     {sd.AnswerCount, 2},
+		"first_answer_ttl": {sd.FirstAnswerTTL, 300},
+		"edns_buffer_size": {sd.EDNSBufferSize, 1232},
+		"message_size":     {sd.MessageSize, 100},
+	} {
+		if tc.got == nil || *tc.got != tc.want {
+			t.Fatalf("%s = %v, want %d", name, tc.got, tc.want)
+		}
+	}
+	// SetQuestion sets RD.
+	if !*sd.FlagQR || !*sd.FlagRD || !*sd.FlagRA || !*sd.FlagAD || *sd.FlagAA || *sd.FlagTC || *sd.FlagCD {
+		t.Fatalf("unexpected flags %#v", sd)
+	}
+
+	// No answers and no OPT record leave their columns unset.
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	sd = &sessionData{}
+	sd.setDerivedColumns(q, 29)
+	if sd.FirstAnswerTTL != nil || sd.EDNSBufferSize != nil || *sd.AnswerCount != 0 {
+		t.Fatalf("unexpected columns for query %#v", sd)
+	}
+}
@@ -0,0 +1,299 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/format"
+)
+
+// Session parquet files are named sessionFileBase + "-<start>_<stop>" +
+// parquetFileSuffix, see [buildParquetFilenames].
+const sessionFileBase = "dns_session_block"
+
+// sessionCryptopanEpochMetadataKey is the parquet key/value metadata key
+// holding the Crypto-PAn key epochs of the rows in a session file, as a
+// comma separated list of RFC 3339 epoch start times. It is only set when
+// cryptopan-key-rotation is enabled.
+const sessionCryptopanEpochMetadataKey = "edm_cryptopan_epoch"
+
+// The parquet key/value metadata keys describing how the addresses in a
+// session file were pseudonymised: the pseudonymisation-mode and, only with
+// the truncate mode, the number of leading address bits kept.
+const (
+	sessionPseudonymisationModeMetadataKey = "edm_pseudonymisation_mode"
+	sessionIPv4PrefixMetadataKey           = "edm_pseudonymisation_ipv4_prefix"
+	sessionIPv6PrefixMetadataKey           = "edm_pseudonymisation_ipv6_prefix"
+)
+
+// sessionColumnsMetadataKey is the parquet key/value metadata key holding
+// the schema variant of a session file, see [sessionColumns.String].
+const sessionColumnsMetadataKey = "edm_session_columns"
+
+// sessionWriterMsg is sent from the data collector to the session writer. A
+// message with a session row is written to the open file of the interval
+// starting at startTime, a message without one ends the interval at
+// rotationTime.
+type sessionWriterMsg struct {
+	sd           *sessionData
+	startTime    time.Time
+	rotationTime time.Time
+}
+
+// countingWriter keeps track of how many bytes have been written to an open
+// session file.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// sessionFile is a session parquet file that rows are currently written to.
+// It is written under a temporary name and renamed once the interval ends.
+type sessionFile struct {
+	dir       string
+	tmpName   string
+	file      fsFile
+	output    *countingWriter
+	writer    *parquet.GenericWriter[sessionData]
+	startTime time.Time
+	// latest is the newest row timestamp written to the file, it is where
+	// the file is cut when it grows past the maximum size.
+	latest time.Time
+	// cryptopanEpochs are the Crypto-PAn key epochs of the rows in the
+	// file, in the order they were first seen.
+	cryptopanEpochs []time.Time
+}
+
+// sessionFileWriter streams session rows to parquet files instead of
+// buffering a whole interval in memory. The parquet writer holds at most one
+// row group of rows before flushing it to the file, so memory use depends on
+// the row group size rather than the query rate.
+//
+// There is one open file per identity partition (only one unless
+// partition-by-identity is set). A file that has grown past the maximum size
+// is closed early and the rows that follow go to a new file for the rest of
+// the interval. The size is only known once a row group has been flushed
+// and has passed the parquet write buffer, so a file can grow past the
+// maximum by a row group.
+//
+// It is only used by the session writer goroutine and is not safe for
+// concurrent use.
+type sessionFileWriter struct {
+	edm          *DnstapMinimiser
+	columns      sessionColumns
+	schema       *parquet.Schema
+	metadata     []parquet.WriterOption
+	sessionsDir  string
+	rowGroupSize int64
+	maxFileSize  int64
+	partition    bool
+	files        map[string]*sessionFile
+	// cutTimes holds where an early rotation cut the previous file of a
+	// partition in the current interval.
+	cutTimes map[string]time.Time
+	// openFailed holds the start time of the file a partition failed to
+	// open, so the failure is logged once rather than for every row of
+	// the interval.
+	openFailed map[string]time.Time
+}
+
+func (edm *DnstapMinimiser) newSessionFileWriter(dataDir string) *sessionFileWriter {
+	conf := edm.getConfig()
+	columns := sessionColumns{
+		messages: !conf.DisableSessionMessages,
+		derived:  conf.SessionDerivedColumns,
+	}
+	metadata := []parquet.WriterOption{
+		parquet.KeyValueMetadata(sessionColumnsMetadataKey, columns.String()),
+		parquet.KeyValueMetadata(sessionPseudonymisationModeMetadataKey, edm.pseudonymisation.mode),
+	}
+	if edm.pseudonymisation.mode == PseudonymisationModeTruncate {
+		metadata = append(metadata,
+			parquet.KeyValueMetadata(sessionIPv4PrefixMetadataKey, strconv.Itoa(edm.pseudonymisation.ipv4Prefix)),
+			parquet.KeyValueMetadata(sessionIPv6PrefixMetadataKey, strconv.Itoa(edm.pseudonymisation.ipv6Prefix)),
+		)
+	}
+	return &sessionFileWriter{
+		edm:      edm,
+		columns:  columns,
+		schema:   columns.schema(),
+		metadata: metadata,
+		// Write session files to a sessions dir where they can be read by other tools
+		sessionsDir:  filepath.Join(dataDir, "parquet", "sessions"),
+		rowGroupSize: int64(conf.SessionRowGroupSize),
+		maxFileSize:  int64(conf.SessionMaxFileSize) * 1024 * 1024,
+		partition:    conf.PartitionByIdentity,
+		files:        map[string]*sessionFile{},
+		cutTimes:     map[string]time.Time{},
+		openFailed:   map[string]time.Time{},
+	}
+}
+
+// write adds sd to the open file of its partition, opening a new file if
+// needed. startTime is the start of the interval sd belongs to.
+func (w *sessionFileWriter) write(sd *sessionData, startTime time.Time) {
+	var identity string
+	if w.partition && sd.ServerID != nil {
+		identity = *sd.ServerID
+	}
+
+	f, ok := w.files[identity]
+	if !ok {
+		if cutTime, ok := w.cutTimes[identity]; ok && cutTime.After(startTime) {
+			startTime = cutTime
+		}
+		if failedStart, ok := w.openFailed[identity]; ok && failedStart.Equal(startTime) {
+			w.edm.promSessionRowsDropped.Inc()
+			return
+		}
+		var err error
+		f, err = w.open(identityPartitionDir(w.sessionsDir, identity), startTime)
+		if err != nil {
+			w.edm.log.Error("sessionWriter: unable to open session file, dropping rows until the interval ends", "error", err, "identity", identity, "start_time", startTime)
+			w.edm.promSessionRowsDropped.Inc()
+			w.openFailed[identity] = startTime
+			return
+		}
+		delete(w.openFailed, identity)
+		w.files[identity] = f
+	}
+
+	if _, err := f.writer.Write([]sessionData{*sd}); err != nil {
+		w.edm.log.Error("sessionWriter: unable to call Write() on parquet writer", "error", err, "filename", f.tmpName)
+		w.edm.promSessionRowsDropped.Inc()
+		w.discard(f)
+		delete(w.files, identity)
+		return
+	}
+	if ts := sd.timestamp(); ts.After(f.latest) {
+		f.latest = ts
+	}
+	if !sd.cryptopanEpoch.IsZero() && !slices.ContainsFunc(f.cryptopanEpochs, sd.cryptopanEpoch.Equal) {
+		f.cryptopanEpochs = append(f.cryptopanEpochs, sd.cryptopanEpoch)
+	}
+
+	// The file names have a resolution of one second, so a file is not
+	// cut before the second it was started in has passed.
+	if w.maxFileSize > 0 && f.output.n >= w.maxFileSize && f.latest.Truncate(time.Second).After(f.startTime.Truncate(time.Second)) {
+		w.edm.log.Info("sessionWriter: session file reached max size, rotating early", "filename", f.tmpName, "size", f.output.n)
+		w.close(f, f.latest)
+		delete(w.files, identity)
+		w.cutTimes[identity] = f.latest
+	}
+}
+
+// rotate closes every open file at the end of the interval.
+func (w *sessionFileWriter) rotate(rotationTime time.Time) {
+	for identity, f := range w.files {
+		w.close(f, rotationTime)
+		delete(w.files, identity)
+	}
+	clear(w.cutTimes)
+	clear(w.openFailed)
+}
+
+func (w *sessionFileWriter) open(dir string, startTime time.Time) (*sessionFile, error) {
+	// The stop time is not known until the file is closed, the
+	// temporary name only needs to be unique.
+	tmpName := filepath.Join(dir, fmt.Sprintf("%s-%s%s.tmp", sessionFileBase, timestampToFileString(startTime.UTC()), parquetFileSuffix))
+	tmpName = filepath.Clean(tmpName) // Make gosec happy
+
+	w.edm.log.Info("writing out session file", "filename", tmpName)
+	outFile, err := w.edm.createFile(tmpName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open session file: %w", err)
+	}
+
+	output := &countingWriter{w: outFile}
+	snappyCodec := parquet.LookupCompressionCodec(format.Snappy)
+	options := append([]parquet.WriterOption{w.schema, parquet.Compression(snappyCodec), parquet.MaxRowsPerRowGroup(w.rowGroupSize)}, w.metadata...)
+	writer := parquet.NewGenericWriter[sessionData](output, options...)
+	return &sessionFile{
+		dir:       dir,
+		tmpName:   tmpName,
+		file:      outFile,
+		output:    output,
+		writer:    writer,
+		startTime: startTime,
+	}, nil
+}
+
+// close finishes f and atomically renames it to its real name covering
+// the time until stopTime. Like [DnstapMinimiser.writeRotatedParquet] a
+// failed write or close removes the incomplete file while a failed rename
+// leaves the complete temporary file in place.
+func (w *sessionFileWriter) close(f *sessionFile, stopTime time.Time) {
+	if len(f.cryptopanEpochs) > 0 {
+		epochs := make([]string, 0, len(f.cryptopanEpochs))
+		for _, epoch := range f.cryptopanEpochs {
+			epochs = append(epochs, epoch.UTC().Format(time.RFC3339))
+		}
+		f.writer.SetKeyValueMetadata(sessionCryptopanEpochMetadataKey, strings.Join(epochs, ","))
+	}
+	if err := f.writer.Close(); err != nil {
+		w.edm.log.Error("sessionWriter: unable to call Close() on parquet writer", "error", err, "filename", f.tmpName)
+		w.discard(f)
+		return
+	}
+	if err := f.file.Close(); err != nil {
+		w.edm.log.Error("sessionWriter: unable to call Close() on file", "error", err, "filename", f.tmpName)
+		w.remove(f)
+		return
+	}
+
+	startTime := intervalStartFromTimes(f.startTime, stopTime)
+	_, finalName := buildParquetFilenames(f.dir, sessionFileBase, startTime, stopTime)
+	w.edm.log.Info("renaming session file", "from", f.tmpName, "to", finalName)
+	if err := w.edm.deps.FileSystem.Rename(f.tmpName, finalName); err != nil {
+		w.edm.log.Error("sessionWriter: unable to rename output file", "error", err, "filename", f.tmpName)
+	}
+}
+
+// discard closes and removes a file that could not be written in full.
+func (w *sessionFileWriter) discard(f *sessionFile) {
+	if err := f.file.Close(); err != nil {
+		w.edm.log.Error("unable to do deferred close of session outFile", "error", err)
+	}
+	w.remove(f)
+}
+
+func (w *sessionFileWriter) remove(f *sessionFile) {
+	w.edm.log.Info("cleaning up session file because write failed", "filename", f.tmpName)
+	if err := w.edm.deps.FileSystem.Remove(f.tmpName); err != nil {
+		w.edm.log.Error("unable to remove session outFile", "error", err, "filename", f.tmpName)
+	}
+}
+
+func (edm *DnstapMinimiser) sessionWriter(dataDir string, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	edm.log.Info("sessionWriter: starting")
+
+	w := edm.newSessionFileWriter(dataDir)
+	for msg := range edm.sessionWriterCh {
+		if msg.sd == nil {
+			w.rotate(msg.rotationTime)
+			continue
+		}
+		w.write(msg.sd, msg.startTime)
+	}
+
+	// The data collector ends the last interval before closing the
+	// channel, this only matters if it did not get the chance to.
+	w.rotate(edm.intervalClock().Now().UTC())
+
+	edm.log.Info("sessionWriter: exiting loop")
+}
@@ -0,0 +1,264 @@
+package runner
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/parquet-go/parquet-go"
+)
+
+func sessionAt(ts time.Time) *sessionData {
+	us := ts.UnixMicro()
+	return &sessionData{ServerID: ptr("server"), ResponseTime: &us}
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func readSessionFile(t *testing.T, name string) *parquet.File {
+	t.Helper()
+
+	f, err := os.Open(name) // #nosec G304 -- test file in t.TempDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = f.Close() })
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pf, err := parquet.OpenFile(f, info.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pf
+}
+
+func TestSessionFileWriterRowGroups(t *testing.T) {
+	tc := defaultTC
+	tc.SessionRowGroupSize = 2
+	edm := newTestDnstapMinimiser(t, tc)
+	dataDir := t.TempDir()
+
+	start := time.Date(2026, 5, 28, 12, 0, 0, 0, time.UTC)
+	w := edm.newSessionFileWriter(dataDir)
+	for i := range 5 {
+		w.write(sessionAt(start.Add(time.Duration(i)*time.Second)), start)
+	}
+
+	// Nothing is renamed into place until the interval ends.
+	tmpFiles, err := filepath.Glob(filepath.Join(dataDir, "parquet", "sessions", "*.tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tmpFiles) != 1 {
+		t.Fatalf("open session files = %v, want one", tmpFiles)
+	}
+
+	w.rotate(start.Add(time.Minute))
+	pf := readSessionFile(t, filepath.Join(dataDir, "parquet", "sessions", "dns_session_block-2026-05-28T12-00-00Z_2026-05-28T12-01-00Z.parquet"))
+	if pf.NumRows() != 5 {
+		t.Fatalf("session rows = %d, want 5", pf.NumRows())
+	}
+	if got := len(pf.RowGroups()); got != 3 {
+		t.Fatalf("row groups = %d, want 3", got)
+	}
+}
+
+func TestSessionFileWriterMaxFileSize(t *testing.T) {
+	tc := defaultTC
+	tc.SessionRowGroupSize = 1
+	edm := newTestDnstapMinimiser(t, tc)
+	dataDir := t.TempDir()
+
+	start := time.Date(2026, 5, 28, 12, 0, 0, 0, time.UTC)
+	w := edm.newSessionFileWriter(dataDir)
+	// Every row is bigger than this and the parquet write buffer.
+	w.maxFileSize = 1
+	sessionWithPayloadAt := func(ts time.Time) *sessionData {
+		sd := sessionAt(ts)
+		sd.ResponseMessage = ptr(hex.EncodeToString(randomBytes(t, 32*1024)))
+		return sd
+	}
+	w.write(sessionWithPayloadAt(start), start)
+	// Not cut within the second the file was started in.
+	w.write(sessionWithPayloadAt(start.Add(500*time.Millisecond)), start)
+	w.write(sessionWithPayloadAt(start.Add(20*time.Second)), start)
+	w.write(sessionWithPayloadAt(start.Add(30*time.Second)), start)
+	// A row group is flushed when the row after it is written, so the
+	// last row is not enough to cut the second file.
+	w.rotate(start.Add(time.Minute))
+
+	entries, err := os.ReadDir(filepath.Join(dataDir, "parquet", "sessions"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	rows := map[string]int64{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+		rows[entry.Name()] = readSessionFile(t, filepath.Join(dataDir, "parquet", "sessions", entry.Name())).NumRows()
+	}
+	want := []string{
+		"dns_session_block-2026-05-28T12-00-00Z_2026-05-28T12-00-20Z.parquet",
+		"dns_session_block-2026-05-28T12-00-20Z_2026-05-28T12-01-00Z.parquet",
+	}
+	if !slices.Equal(names, want) {
+		t.Fatalf("session files = %q, want %q", names, want)
+	}
+	if rows[want[0]] != 3 || rows[want[1]] != 1 {
+		t.Fatalf("rows per file = %v", rows)
+	}
+}
+
+func TestSessionFileWriterCryptopanEpochs(t *testing.T) {
+	edm := newTestDnstapMinimiser(t, defaultTC)
+	dataDir := t.TempDir()
+
+	start := time.Date(2026, 5, 28, 23, 59, 0, 0, time.UTC)
+	epoch := time.Date(2026, 5, 28, 0, 0, 0, 0, time.UTC)
+	w := edm.newSessionFileWriter(dataDir)
+	for _, e := range []time.Time{epoch, epoch, epoch.Add(24 * time.Hour)} {
+		sd := sessionAt(start)
+		sd.cryptopanEpoch = e
+		w.write(sd, start)
+	}
+	// Rows without an epoch do not add to the metadata.
+	w.write(sessionAt(start), start)
+	w.rotate(start.Add(time.Minute))
+
+	pf := readSessionFile(t, filepath.Join(dataDir, "parquet", "sessions", "dns_session_block-2026-05-28T23-59-00Z_2026-05-29T00-00-00Z.parquet"))
+	want := "2026-05-28T00:00:00Z,2026-05-29T00:00:00Z"
+	if got, ok := pf.Lookup(sessionCryptopanEpochMetadataKey); !ok || got != want {
+		t.Fatalf("epoch metadata = %q, %t, want %q", got, ok, want)
+	}
+}
+
+func TestSessionFileWriterPseudonymisationMetadata(t *testing.T) {
+	for _, tc := range []struct {
+		mode string
+		want map[string]string
+	}{
+		{
+			mode: PseudonymisationModeCryptopan,
+			want: map[string]string{sessionPseudonymisationModeMetadataKey: PseudonymisationModeCryptopan},
+		},
+		{
+			mode: PseudonymisationModeTruncate,
+			want: map[string]string{
+				sessionPseudonymisationModeMetadataKey: PseudonymisationModeTruncate,
+				sessionIPv4PrefixMetadataKey:           "24",
+				sessionIPv6PrefixMetadataKey:           "48",
+			},
+		},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			conf := defaultTC
+			conf.PseudonymisationMode = tc.mode
+			edm := newTestDnstapMinimiser(t, conf)
+			dataDir := t.TempDir()
+
+			start := time.Date(2026, 5, 28, 12, 0, 0, 0, time.UTC)
+			w := edm.newSessionFileWriter(dataDir)
+			w.write(sessionAt(start), start)
+			w.rotate(start.Add(time.Minute))
+
+			pf := readSessionFile(t, filepath.Join(dataDir, "parquet", "sessions", "dns_session_block-2026-05-28T12-00-00Z_2026-05-28T12-01-00Z.parquet"))
+			for _, key := range []string{sessionPseudonymisationModeMetadataKey, sessionIPv4PrefixMetadataKey, sessionIPv6PrefixMetadataKey} {
+				got, ok := pf.Lookup(key)
+				if want, wantOK := tc.want[key]; got != want || ok != wantOK {
+					t.Fatalf("metadata %s = %q, %t, want %q, %t", key, got, ok, want, wantOK)
+				}
+			}
+		})
+	}
+}
+
+func TestSessionFileWriterColumns(t *testing.T) {
+	tc := defaultTC
+	tc.DisableSessionMessages = true
+	tc.SessionDerivedColumns = true
+	edm := newTestDnstapMinimiser(t, tc)
+	dataDir := t.TempDir()
+
+	start := time.Date(2026, 5, 28, 12, 0, 0, 0, time.UTC)
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeAAAA)
+	m.Response = true
+	m.Rcode = dns.RcodeNameError
+	sd := sessionAt(start)
+	sd.ResponseMessage = ptr("raw message")
+	sd.setDerivedColumns(m, 29)
+
+	w := edm.newSessionFileWriter(dataDir)
+	w.write(sd, start)
+	w.rotate(start.Add(time.Minute))
+
+	pf := readSessionFile(t, filepath.Join(dataDir, "parquet", "sessions", "dns_session_block-2026-05-28T12-00-00Z_2026-05-28T12-01-00Z.parquet"))
+	if got, ok := pf.Lookup(sessionColumnsMetadataKey); !ok || got != "base,derived" {
+		t.Fatalf("columns metadata = %q, %t, want %q", got, ok, "base,derived")
+	}
+	for _, column := range []string{"response_message", "query_message"} {
+		if _, ok := pf.Schema().Lookup(column); ok {
+			t.Fatalf("column %s written with disable-session-messages", column)
+		}
+	}
+
+	rows := make([]sessionData, 1)
+	r := parquet.NewGenericReader[sessionData](pf)
+	if n, _ := r.Read(rows); n != 1 {
+		t.Fatalf("read %d rows, want 1", n)
+	}
+	got := rows[0]
+	if got.ResponseMessage != nil || got.Qtype == nil || *got.Qtype != int32(dns.TypeAAAA) || got.Rcode == nil || *got.Rcode != dns.RcodeNameError || got.MessageSize == nil || *got.MessageSize != 29 {
+		t.Fatalf("unexpected row %#v", got)
+	}
+}
+
+func TestSessionFileWriterOpenFailure(t *testing.T) {
+	edm := newTestDnstapMinimiser(t, defaultTC)
+	buf := &syncBuf{}
+	edm.log = slog.New(slog.NewTextHandler(buf, nil))
+	createErr := errInjected
+	edm.deps.FileSystem = faultingFileSystem{fileSystem: edm.deps.FileSystem, create: func(name string) (fsFile, error) {
+		if createErr != nil {
+			return nil, createErr
+		}
+		return os.Create(name) // #nosec G304 -- test file in t.TempDir()
+	}}
+	dataDir := t.TempDir()
+
+	start := time.Date(2026, 5, 28, 12, 0, 0, 0, time.UTC)
+	w := edm.newSessionFileWriter(dataDir)
+	for i := range 3 {
+		w.write(sessionAt(start.Add(time.Duration(i)*time.Second)), start)
+	}
+	if got := strings.Count(buf.String(), "dropping rows until the interval ends"); got != 1 {
+		t.Fatalf("open failure logged %d times, want once", got)
+	}
+	if got := testMetricValue(t, edm.promSessionRowsDropped); got != 3 {
+		t.Fatalf("dropped rows = %f, want 3", got)
+	}
+
+	// The next interval tries to open a file again.
+	createErr = nil
+	w.rotate(start.Add(time.Minute))
+	w.write(sessionAt(start.Add(time.Minute)), start.Add(time.Minute))
+	w.rotate(start.Add(2 * time.Minute))
+	readSessionFile(t, filepath.Join(dataDir, "parquet", "sessions", "dns_session_block-2026-05-28T12-01-00Z_2026-05-28T12-02-00Z.parquet"))
+}
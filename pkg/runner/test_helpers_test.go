@@ -48,7 +48,7 @@ var testCryptopanCaches sync.Map // map[*DnstapMinimiser]*lru.Cache[netip.Addr,
 
 func (edm *DnstapMinimiser) testPseudonymiseDnstap(dt *dnstap.Dnstap) {
 	cache := edm.testCryptopanCache()
-	edm.pseudonymiseDnstap(dt, edm.cryptopan.Load(), cache)
+	edm.pseudonymiseDnstap(dt, edm.cryptopan.Load().cpn, cache)
 }
 
 // testCryptopanCache returns the shared per-edm-instance cache, creating
@@ -481,6 +481,34 @@ func newTestPebble(t testing.TB) *pebble.DB {
 	return db
 }
 
+// testSeenQnameBackends are the seen-qname backends the qnameSeen tests run
+// against, testSeenQnameTTLBackends those supporting seen-qname-ttl.
+var (
+	testSeenQnameBackends    = []string{SeenQnameBackendPebble, SeenQnameBackendMemory, SeenQnameBackendBloom}
+	testSeenQnameTTLBackends = []string{SeenQnameBackendPebble, SeenQnameBackendMemory}
+)
+
+// newTestSeenQnameStore opens an empty seen-qname store of backend in a
+// temporary data directory, closed when the test ends.
+func newTestSeenQnameStore(t testing.TB, backend string) SeenQnameStore {
+	t.Helper()
+
+	conf := DefaultConfig()
+	conf.DataDir = t.TempDir()
+	conf.SeenQnameBackend = backend
+	conf.SeenQnameCapacity = 1000
+	store, err := configSeenQnameStoreFactory{}.OpenSeenQnameStore(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := store.Close(); err != nil {
+			t.Fatalf("unable to close %s seen-qname store: %s", backend, err)
+		}
+	})
+	return store
+}
+
 // syncBuf is a thread-safe bytes.Buffer wrapper for slog handlers whose
 // output is consumed concurrently by both the worker under test and the
 // goroutine polling for assertions.
@@ -575,3 +603,35 @@ func (ffs faultingFileSystem) ReadDir(name string) ([]os.DirEntry, error) {
 	}
 	return ffs.fileSystem.ReadDir(name)
 }
+
+// sessionInterval holds the session rows the data collector sent to the
+// session writer for one interval.
+type sessionInterval struct {
+	sessions     []*sessionData
+	startTime    time.Time
+	rotationTime time.Time
+}
+
+// readSessionInterval reads session rows from ch up to the message ending
+// their interval. ok is false if ch is closed before that.
+func readSessionInterval(ch <-chan sessionWriterMsg) (si sessionInterval, ok bool) {
+	for msg := range ch {
+		if msg.sd == nil {
+			si.rotationTime = msg.rotationTime
+			return si, true
+		}
+		if len(si.sessions) == 0 {
+			si.startTime = msg.startTime
+		}
+		si.sessions = append(si.sessions, msg.sd)
+	}
+	return si, false
+}
+
+// collectedHistogram collects what the minimiser workers have counted in
+// their histogram shards and returns the histogram data without an
+// identity. The collector goroutine must not be running.
+func collectedHistogram(wkd *wellKnownDomainsTracker) map[int]*histogramData {
+	wkd.collectShards(wkd.snap.Load().dawgModTime)
+	return wkd.m
+}
@@ -3,12 +3,10 @@ package runner
 import "time"
 
 func getStartTimeFromRotationTime(rotationTime time.Time) time.Time {
-	// The ticker used to interrupt minimiserLoop is hardcoded to tick at
-	// the start of every minute so we can assume the duration we have
-	// captured dnstap packets for is 1 minute which should be always true
-	// except for the very first collection at startup based on what
-	// second the program started, but in that case we just pretend we have
-	// the full minute.
+	// The data collector always records when an interval started, the
+	// start is only unknown for the first interval of a replay which is
+	// rotated at the end of the first captured minute, so we can assume
+	// the duration we have captured dnstap packets for is 1 minute.
 	return rotationTime.Add(-time.Second * 60)
 }
 
@@ -26,3 +24,61 @@ func timeUntilNextMinute() time.Duration {
 func timeUntilNextMinuteFrom(now time.Time) time.Duration {
 	return now.Truncate(time.Minute).Add(time.Minute).Sub(now)
 }
+
+// nextIntervalBoundary returns the first wall clock boundary of interval
+// after t. Boundaries are counted from the zero time, so for intervals that
+// evenly divide a day they line up with midnight UTC.
+func nextIntervalBoundary(t time.Time, interval time.Duration) time.Time {
+	return t.Truncate(interval).Add(interval)
+}
+
+// rotationSchedule keeps track of the open interval of one series of
+// parquet files (sessions or histograms) rotated every interval at wall
+// clock boundaries.
+type rotationSchedule struct {
+	interval time.Duration
+	// start and end of the open interval, end is always a boundary
+	start time.Time
+	end   time.Time
+}
+
+func newRotationSchedule(start time.Time, interval time.Duration) *rotationSchedule {
+	rs := &rotationSchedule{interval: interval, start: start}
+	if !start.IsZero() {
+		rs.end = nextIntervalBoundary(start, interval)
+	}
+	return rs
+}
+
+// due returns the end of the open interval and true if it has ended at ts.
+func (rs *rotationSchedule) due(ts time.Time) (time.Time, bool) {
+	if rs.start.IsZero() {
+		// Replay time is the zero time until the first frame, the
+		// first rotation request comes at the end of the first
+		// captured minute.
+		rs.start = getStartTimeFromRotationTime(ts)
+		rs.end = nextIntervalBoundary(rs.start, rs.interval)
+	}
+	if ts.Before(rs.end) {
+		return time.Time{}, false
+	}
+	return rs.end, true
+}
+
+// advance opens the interval following a rotation at rotationTime. now is
+// the current time, the new interval starts at the boundary before now
+// rather than at rotationTime when one or more intervals have been skipped,
+// as for a gap in a replayed capture.
+func (rs *rotationSchedule) advance(rotationTime time.Time, now time.Time) {
+	rs.start = rotationTime
+	if boundary := now.Truncate(rs.interval); boundary.After(rotationTime) {
+		rs.start = boundary
+	}
+	rs.end = nextIntervalBoundary(rs.start, rs.interval)
+}
+
+// postpone keeps the open interval going until the next boundary after now,
+// used when a rotation failed.
+func (rs *rotationSchedule) postpone(now time.Time) {
+	rs.end = nextIntervalBoundary(now, rs.interval)
+}
@@ -37,3 +37,47 @@ func TestTimeUntilNextMinuteFrom(t *testing.T) {
 		})
 	}
 }
+
+func TestRotationSchedule(t *testing.T) {
+	start := time.Date(2026, 4, 29, 12, 3, 20, 0, time.UTC)
+	rs := newRotationSchedule(start, 15*time.Minute)
+	if want := time.Date(2026, 4, 29, 12, 15, 0, 0, time.UTC); !rs.end.Equal(want) {
+		t.Fatalf("first interval ends at %s, want %s", rs.end, want)
+	}
+
+	if _, ok := rs.due(time.Date(2026, 4, 29, 12, 14, 0, 0, time.UTC)); ok {
+		t.Fatal("interval due before its end")
+	}
+	tick := time.Date(2026, 4, 29, 12, 15, 0, 3*int(time.Millisecond), time.UTC)
+	rotationTime, ok := rs.due(tick)
+	if !ok || !rotationTime.Equal(rs.end) {
+		t.Fatalf("due = %s, %t, want the interval end", rotationTime, ok)
+	}
+	rs.advance(rotationTime, tick)
+	if !rs.start.Equal(rotationTime) || !rs.end.Equal(rotationTime.Add(15*time.Minute)) {
+		t.Fatalf("interval after rotation = %s-%s", rs.start, rs.end)
+	}
+
+	// Skipped intervals are not written as one long interval.
+	late := time.Date(2026, 4, 29, 13, 2, 0, 0, time.UTC)
+	rotationTime, _ = rs.due(late)
+	rs.advance(rotationTime, late)
+	if want := time.Date(2026, 4, 29, 13, 0, 0, 0, time.UTC); !rs.start.Equal(want) || !rs.end.Equal(want.Add(15*time.Minute)) {
+		t.Fatalf("interval after gap = %s-%s, want it to start at %s", rs.start, rs.end, want)
+	}
+
+	rs.postpone(time.Date(2026, 4, 29, 13, 15, 1, 0, time.UTC))
+	if want := time.Date(2026, 4, 29, 13, 30, 0, 0, time.UTC); !rs.end.Equal(want) {
+		t.Fatalf("postponed interval ends at %s, want %s", rs.end, want)
+	}
+
+	// Replay starts out at the zero time and is rotated at the end of
+	// the first captured minute.
+	replay := newRotationSchedule(time.Time{}, time.Hour)
+	if _, ok := replay.due(time.Date(2026, 4, 29, 12, 4, 0, 0, time.UTC)); ok {
+		t.Fatal("first replay interval due after one minute")
+	}
+	if want := time.Date(2026, 4, 29, 12, 3, 0, 0, time.UTC); !replay.start.Equal(want) {
+		t.Fatalf("first replay interval starts at %s, want %s", replay.start, want)
+	}
+}
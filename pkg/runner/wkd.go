@@ -2,13 +2,17 @@ package runner
 
 import (
 	"fmt"
+	"maps"
 	"net/netip"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	dnstap "github.com/dnstap/golang-dnstap"
 	"github.com/miekg/dns"
+	"github.com/segmentio/go-hll"
 	"github.com/smhanov/dawg"
 	"github.com/twmb/murmur3"
 )
@@ -34,6 +38,18 @@ type wellKnownDomainsTracker struct {
 	// rotateTracker), so it needs no lock.
 	m map[int]*histogramData
 
+	// partitions holds one aggregator like m per dnstap identity when
+	// partitioning per identity, updates without an identity still go
+	// to m. Owned by dataCollector in the same way as m.
+	partitions map[string]map[int]*histogramData
+
+	// shards holds the histogram data counted directly by each
+	// minimiser worker, which m and partitions only receive when the
+	// collector takes it at rotation, see collectShards. m and
+	// partitions only get the updates retried after a DAWG swap.
+	shardsMu sync.Mutex
+	shards   []*histogramShard
+
 	updateCh    chan wkdUpdate
 	retryCh     chan wkdUpdate
 	stop        chan struct{}
@@ -45,16 +61,36 @@ type wellKnownDomainsTracker struct {
 // used to map bucket indices back to names. It is produced by rotateTracker
 // on normal rotation and by the shutdown flush in dataCollector; in both cases
 // dawgFinder is the snapshot finder that was active for the data in m.
+//
+// identity is set for a batch belonging to one dnstap identity partition.
+// The batch returned by rotateTracker carries the batches of all identity
+// partitions for the same interval in partitions.
 type wellKnownDomainsData struct {
 	m            map[int]*histogramData
 	startTime    time.Time
 	rotationTime time.Time
 	dawgFinder   dawg.Finder
+	identity     string
+	partitions   []*wellKnownDomainsData
+}
+
+// histogramShard is the histogram data of one minimiser worker for the
+// current interval. The worker counts its well-known domain hits here
+// itself instead of sending every hit to the single dataCollector
+// goroutine, so the counting and HLL work scales with the number of
+// workers. mu is only contended when the collector takes the data at
+// rotation.
+type histogramShard struct {
+	mu          sync.Mutex
+	m           map[int]*histogramData
+	partitions  map[string]map[int]*histogramData
+	dawgModTime time.Time
 }
 
 func newWellKnownDomainsTracker(dawgFinder dawg.Finder, dawgModTime time.Time) (*wellKnownDomainsTracker, error) {
 	wkd := &wellKnownDomainsTracker{
 		m:           map[int]*histogramData{},
+		partitions:  map[string]map[int]*histogramData{},
 		updateCh:    make(chan wkdUpdate, 10000),
 		retryCh:     make(chan wkdUpdate, 10000),
 		stop:        make(chan struct{}),
@@ -100,6 +136,9 @@ type wkdUpdate struct {
 	dawgModTime time.Time
 	retry       int
 	retryLimit  int
+	// identity selects the histogram partition to update, empty unless
+	// partitioning per dnstap identity.
+	identity string
 }
 
 func (wkd *wellKnownDomainsTracker) lookup(msg *dns.Msg) (int, bool, time.Time) {
@@ -139,7 +178,12 @@ func (wkd *wellKnownDomainsTracker) updateRetryer(edm *DnstapMinimiser, wg *sync
 	close(wkd.retryerDone)
 }
 
-func (wkd *wellKnownDomainsTracker) sendUpdate(ipBytes []byte, msg *dns.Msg, dawgIndex int, suffixMatch bool, dawgModTime time.Time) {
+// newWKDUpdate returns the histogram counters for msg. isQuery marks msg
+// as coming from a query type dnstap message, which carries no meaningful
+// rcode, so only the response counters are based on the rcode. protocol
+// is the transport msg was sent over, 0 if unknown. identity is the
+// dnstap identity partition to count msg in, or empty.
+func newWKDUpdate(ipBytes []byte, msg *dns.Msg, isQuery bool, protocol dnstap.SocketProtocol, dawgIndex int, suffixMatch bool, dawgModTime time.Time, identity string) wkdUpdate {
 	wu := wkdUpdate{
 		dawgIndex:   dawgIndex,
 		suffixMatch: suffixMatch,
@@ -147,6 +191,7 @@ func (wkd *wellKnownDomainsTracker) sendUpdate(ipBytes []byte, msg *dns.Msg, daw
 		hllHash:     0,
 		retryLimit:  10,
 		msg:         msg,
+		identity:    identity,
 	}
 
 	// Create hash from IP address for use in HLL data
@@ -159,15 +204,68 @@ func (wkd *wellKnownDomainsTracker) sendUpdate(ipBytes []byte, msg *dns.Msg, daw
 	}
 
 	// Counters based on header
-	switch msg.Rcode {
-	case dns.RcodeSuccess:
-		wu.OKCount++
-	case dns.RcodeNameError:
-		wu.NXCount++
-	case dns.RcodeServerFailure:
-		wu.FailCount++
+	if isQuery {
+		wu.QueryCount++
+	} else {
+		wu.ResponseCount++
+		switch msg.Rcode {
+		case dns.RcodeSuccess:
+			wu.OKCount++
+		case dns.RcodeNameError:
+			wu.NXCount++
+		case dns.RcodeServerFailure:
+			wu.FailCount++
+		case dns.RcodeRefused:
+			wu.RefusedCount++
+		case dns.RcodeFormatError:
+			wu.FormErrCount++
+		default:
+			wu.OtherRcodeCount++
+		}
+		if msg.AuthenticatedData {
+			wu.ADCount++
+		}
+		if msg.Truncated {
+			wu.TCCount++
+		}
+	}
+
+	// Counters based on DNSSEC and EDNS signals
+	if msg.CheckingDisabled {
+		wu.CDCount++
+	}
+	if opt := msg.IsEdns0(); opt != nil {
+		if opt.Do() {
+			wu.DOCount++
+		}
+		if !isQuery {
+			for _, option := range opt.Option {
+				if option.Option() == dns.EDNS0SUBNET {
+					wu.ECSCount++
+					break
+				}
+			}
+		}
+	}
+
+	// Counters based on transport
+	switch protocol {
+	case dnstap.SocketProtocol_UDP:
+		wu.UDPCount++
+	case dnstap.SocketProtocol_TCP:
+		wu.TCPCount++
+	case dnstap.SocketProtocol_DOT:
+		wu.DOTCount++
+	case dnstap.SocketProtocol_DOH:
+		wu.DOHCount++
+	case socketProtocolDOQ:
+		wu.DOQCount++
+	case socketProtocolDNSCryptUDP:
+		wu.DNSCryptUDPCount++
+	case socketProtocolDNSCryptTCP:
+		wu.DNSCryptTCPCount++
 	default:
-		wu.OtherRcodeCount++
+		wu.OtherProtocolCount++
 	}
 
 	// Counters based on question class and type
@@ -181,6 +279,24 @@ func (wkd *wellKnownDomainsTracker) sendUpdate(ipBytes []byte, msg *dns.Msg, daw
 			wu.MXCount++
 		case dns.TypeNS:
 			wu.NSCount++
+		case dns.TypeHTTPS:
+			wu.HTTPSCount++
+		case dns.TypeSVCB:
+			wu.SVCBCount++
+		case dns.TypeTXT:
+			wu.TXTCount++
+		case dns.TypePTR:
+			wu.PTRCount++
+		case dns.TypeCNAME:
+			wu.CNAMECount++
+		case dns.TypeSOA:
+			wu.SOACount++
+		case dns.TypeDS:
+			wu.DSCount++
+		case dns.TypeDNSKEY:
+			wu.DNSKEYCount++
+		case dns.TypeANY:
+			wu.ANYCount++
 		default:
 			wu.OtherTypeCount++
 		}
@@ -188,7 +304,111 @@ func (wkd *wellKnownDomainsTracker) sendUpdate(ipBytes []byte, msg *dns.Msg, daw
 		wu.NonINCount++
 	}
 
-	wkd.updateCh <- wu
+	return wu
+}
+
+// newShard registers and returns the histogram shard of a minimiser
+// worker.
+func (wkd *wellKnownDomainsTracker) newShard() *histogramShard {
+	wkd.shardsMu.Lock()
+	defer wkd.shardsMu.Unlock()
+
+	shard := &histogramShard{
+		m:           map[int]*histogramData{},
+		partitions:  map[string]map[int]*histogramData{},
+		dawgModTime: wkd.snap.Load().dawgModTime,
+	}
+	wkd.shards = append(wkd.shards, shard)
+	return shard
+}
+
+// add counts wu in the shard. It returns false without counting wu if
+// the DAWG has been swapped since wu was looked up, the update then has
+// to be retried against the new DAWG.
+func (s *histogramShard) add(edm *DnstapMinimiser, wu wkdUpdate, hllSettings hll.Settings) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if wu.dawgModTime != s.dawgModTime {
+		return false
+	}
+	edm.countUpdate(partitionMap(s.m, s.partitions, wu.identity), wu, hllSettings)
+	return true
+}
+
+// collectShards moves the histogram data of all worker shards into m and
+// partitions, leaving the shards empty. dawgModTime is the DAWG the
+// shards count against from now on. Like rotateTracker it must only be
+// called from the dataCollector goroutine.
+func (wkd *wellKnownDomainsTracker) collectShards(dawgModTime time.Time) {
+	wkd.shardsMu.Lock()
+	defer wkd.shardsMu.Unlock()
+
+	for _, shard := range wkd.shards {
+		shard.mu.Lock()
+		m, partitions := shard.m, shard.partitions
+		shard.m = map[int]*histogramData{}
+		shard.partitions = map[string]map[int]*histogramData{}
+		shard.dawgModTime = dawgModTime
+		shard.mu.Unlock()
+
+		// The merge is done without holding the shard lock so the
+		// worker can go on counting into its new maps.
+		mergeHistogramMaps(wkd.m, m)
+		for identity, pm := range partitions {
+			mergeHistogramMaps(partitionMap(wkd.m, wkd.partitions, identity), pm)
+		}
+	}
+}
+
+// partitionMap returns the histogram map in m or partitions that updates
+// for identity are counted in, creating it if needed.
+func partitionMap(m map[int]*histogramData, partitions map[string]map[int]*histogramData, identity string) map[int]*histogramData {
+	if identity == "" {
+		return m
+	}
+	pm := partitions[identity]
+	if pm == nil {
+		pm = map[int]*histogramData{}
+		partitions[identity] = pm
+	}
+	return pm
+}
+
+// countUpdate adds the counters and client address of wu to the histogram
+// data for its domain in m.
+func (edm *DnstapMinimiser) countUpdate(m map[int]*histogramData, wu wkdUpdate, hllSettings hll.Settings) {
+	hd, exists := m[wu.dawgIndex]
+	if !exists {
+		hd = edm.newHistogramData(hllSettings, wu.suffixMatch)
+		m[wu.dawgIndex] = hd
+	}
+
+	hd.addCounters(&wu.histogramData)
+
+	if wu.ip.IsValid() {
+		if wu.ip.Unmap().Is4() {
+			hd.v4ClientHLL.AddRaw(wu.hllHash)
+		} else {
+			hd.v6ClientHLL.AddRaw(wu.hllHash)
+		}
+	}
+}
+
+// mergeHistogramMaps adds the histogram data in src to dst. Data for a
+// domain only in src is moved over as is.
+func mergeHistogramMaps(dst map[int]*histogramData, src map[int]*histogramData) {
+	for dawgIndex, hd := range src {
+		cur, exists := dst[dawgIndex]
+		if !exists {
+			dst[dawgIndex] = hd
+			continue
+		}
+		cur.addCounters(hd)
+		cur.EDMStatusBits |= hd.EDMStatusBits
+		cur.v4ClientHLL.Union(hd.v4ClientHLL)
+		cur.v6ClientHLL.Union(hd.v6ClientHLL)
+	}
 }
 
 func (wkd *wellKnownDomainsTracker) rotateTracker(edm *DnstapMinimiser, dawgFile string, startTime time.Time, rotationTime time.Time) (*wellKnownDomainsData, error) {
@@ -213,10 +433,24 @@ func (wkd *wellKnownDomainsTracker) rotateTracker(edm *DnstapMinimiser, dawgFile
 		edm.log.Info("dawg file reload requested, swapping in newly loaded file", "prev_time", curSnap.dawgModTime, "cur_time", dawgModTime)
 	}
 
+	// The DAWG snapshot is a separate atomic Store so hot-path lookup()
+	// callers see a consistent view. It is swapped before the worker
+	// shards are collected: a worker that looked a name up in the old
+	// DAWG either counts it before its shard is collected or finds that
+	// the shard has moved on to the new DAWG and retries the update.
+	if dawgFileChanged {
+		wkd.snap.Store(&wkdSnapshot{
+			dawgFinder:  dawgFinder,
+			dawgModTime: dawgModTime,
+		})
+	} else {
+		dawgModTime = curSnap.dawgModTime
+	}
+	wkd.collectShards(dawgModTime)
+
 	// rotateTracker runs in the dataCollector goroutine, which is also
 	// the only writer of wkd.m (see the case wu := <-wkd.updateCh branch).
-	// No lock needed for the map swap. The DAWG snapshot is a separate
-	// atomic Store so hot-path lookup() callers see a consistent view.
+	// No lock needed for the map swap.
 	prevWKD := &wellKnownDomainsData{
 		m:            wkd.m,
 		dawgFinder:   curSnap.dawgFinder,
@@ -224,12 +458,29 @@ func (wkd *wellKnownDomainsTracker) rotateTracker(edm *DnstapMinimiser, dawgFile
 		rotationTime: rotationTime,
 	}
 	wkd.m = map[int]*histogramData{}
-	if dawgFileChanged {
-		wkd.snap.Store(&wkdSnapshot{
-			dawgFinder:  dawgFinder,
-			dawgModTime: dawgModTime,
-		})
-	}
+	prevWKD.partitions = wkd.takePartitions(curSnap.dawgFinder, startTime, rotationTime)
 
 	return prevWKD, nil
 }
+
+// takePartitions returns the histogram batches of all identity partitions,
+// sorted by identity, and starts new empty partitions. Like rotateTracker
+// it must only be called from the dataCollector goroutine.
+func (wkd *wellKnownDomainsTracker) takePartitions(dawgFinder dawg.Finder, startTime time.Time, rotationTime time.Time) []*wellKnownDomainsData {
+	if len(wkd.partitions) == 0 {
+		return nil
+	}
+	identities := slices.Sorted(maps.Keys(wkd.partitions))
+	batches := make([]*wellKnownDomainsData, 0, len(identities))
+	for _, identity := range identities {
+		batches = append(batches, &wellKnownDomainsData{
+			m:            wkd.partitions[identity],
+			startTime:    startTime,
+			rotationTime: rotationTime,
+			dawgFinder:   dawgFinder,
+			identity:     identity,
+		})
+	}
+	wkd.partitions = map[string]map[int]*histogramData{}
+	return batches
+}
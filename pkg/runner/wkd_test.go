@@ -11,6 +11,7 @@ import (
 	"testing/synctest"
 	"time"
 
+	dnstap "github.com/dnstap/golang-dnstap"
 	"github.com/miekg/dns"
 	"github.com/smhanov/dawg"
 )
@@ -243,15 +244,24 @@ func TestWellKnownDomainUpdatesAndRotation(t *testing.T) {
 	msg := new(dns.Msg)
 	msg.SetQuestion("example.com.", dns.TypeMX)
 	msg.Rcode = dns.RcodeNameError
-	wkd.sendUpdate(netip.MustParseAddr("198.51.100.20").AsSlice(), msg, 0, false, modTime)
+	wu := newWKDUpdate(netip.MustParseAddr("198.51.100.20").AsSlice(), msg, false, dnstap.SocketProtocol_UDP, 0, false, modTime, "")
+	if wu.NXCount != 1 || wu.MXCount != 1 || !wu.ip.IsValid() || wu.hllHash == 0 {
+		t.Fatalf("unexpected update: %#v", wu)
+	}
 
-	select {
-	case wu := <-wkd.updateCh:
-		if wu.NXCount != 1 || wu.MXCount != 1 || !wu.ip.IsValid() || wu.hllHash == 0 {
-			t.Fatalf("unexpected update: %#v", wu)
-		}
-	case <-time.After(time.Second):
-		t.Fatal("timed out waiting for update")
+	// The worker shards are merged into one histogram at rotation.
+	hllSettings := getHllDefaults(edm.conf.HistogramHLLExplicitThreshold)
+	first, second := wkd.newShard(), wkd.newShard()
+	if !first.add(edm, wu, hllSettings) || !second.add(edm, wu, hllSettings) {
+		t.Fatal("update for the current DAWG not counted")
+	}
+	other := newWKDUpdate(netip.MustParseAddr("2001:db8::20").AsSlice(), msg, false, dnstap.SocketProtocol_UDP, 0, false, modTime, "")
+	if !second.add(edm, other, hllSettings) {
+		t.Fatal("update for the current DAWG not counted")
+	}
+	stale := newWKDUpdate(nil, msg, false, dnstap.SocketProtocol_UDP, 0, false, modTime.Add(-time.Second), "")
+	if first.add(edm, stale, hllSettings) {
+		t.Fatal("update for a previous DAWG counted")
 	}
 
 	prev, err := wkd.rotateTracker(edm, path, time.Unix(0, 0), time.Unix(60, 0))
@@ -261,6 +271,16 @@ func TestWellKnownDomainUpdatesAndRotation(t *testing.T) {
 	if !prev.startTime.Equal(time.Unix(0, 0)) || !prev.rotationTime.Equal(time.Unix(60, 0)) || len(wkd.m) != 0 {
 		t.Fatalf("unexpected rotation state: %#v", prev)
 	}
+	hd := prev.m[0]
+	if hd == nil || hd.NXCount != 3 || hd.MXCount != 3 {
+		t.Fatalf("merged histogram = %#v, want 3 NXDOMAIN MX responses", hd)
+	}
+	if hd.v4ClientHLL.Cardinality() != 1 || hd.v6ClientHLL.Cardinality() != 1 {
+		t.Fatalf("merged client counts = %d/%d, want 1/1", hd.v4ClientHLL.Cardinality(), hd.v6ClientHLL.Cardinality())
+	}
+	if len(first.m) != 0 || len(second.m) != 0 {
+		t.Fatal("rotation left data in the worker shards")
+	}
 	if wkd.snap.Load().dawgFinder != finder {
 		t.Fatal("rotation without reload request should keep the dawg finder")
 	}
@@ -316,16 +336,10 @@ func TestUpdateRetryer(t *testing.T) {
 	})
 }
 
-// TestSendUpdateBranches exercises the rcode/qtype switch arms and the
-// invalid-IP-slice fallback in sendUpdate. TestWellKnownDomainUpdatesAndRotation
+// TestNewWKDUpdateBranches exercises the rcode/qtype switch arms and the
+// invalid-IP-slice fallback in newWKDUpdate. TestWellKnownDomainUpdatesAndRotation
 // already covers the RcodeNameError+TypeMX path; this drives the rest.
-func TestSendUpdateBranches(t *testing.T) {
-	finder := testDawgFinder(t, "example.com.")
-	wkd, err := newWellKnownDomainsTracker(finder, time.Unix(2, 0))
-	if err != nil {
-		t.Fatal(err)
-	}
-
+func TestNewWKDUpdateBranches(t *testing.T) {
 	cases := []struct {
 		name    string
 		ipBytes []byte
@@ -349,7 +363,7 @@ func TestSendUpdateBranches(t *testing.T) {
 		{
 			name:    "Other rcode NS in",
 			ipBytes: netip.MustParseAddr("198.51.100.20").AsSlice(),
-			rcode:   dns.RcodeRefused,
+			rcode:   dns.RcodeNotImplemented,
 			qtype:   dns.TypeNS,
 			qclass:  dns.ClassINET,
 			check: func(t *testing.T, wu wkdUpdate) {
@@ -405,15 +419,131 @@ func TestSendUpdateBranches(t *testing.T) {
 			msg.SetQuestion("example.com.", tc.qtype)
 			msg.Question[0].Qclass = tc.qclass
 			msg.Rcode = tc.rcode
-			wkd.sendUpdate(tc.ipBytes, msg, 0, false, time.Unix(2, 0))
-			select {
-			case wu := <-wkd.updateCh:
-				tc.check(t, wu)
-			case <-time.After(time.Second):
-				t.Fatal("timed out waiting for update")
+			tc.check(t, newWKDUpdate(tc.ipBytes, msg, false, dnstap.SocketProtocol_UDP, 0, false, time.Unix(2, 0), ""))
+		})
+	}
+}
+
+// TestNewWKDUpdateSchemaV2Counters checks the query type and rcode counters
+// added in histogram schema version 2.
+func TestNewWKDUpdateSchemaV2Counters(t *testing.T) {
+	qtypes := []struct {
+		qtype   uint16
+		counter func(wkdUpdate) uint64
+	}{
+		{dns.TypeHTTPS, func(wu wkdUpdate) uint64 { return wu.HTTPSCount }},
+		{dns.TypeSVCB, func(wu wkdUpdate) uint64 { return wu.SVCBCount }},
+		{dns.TypeTXT, func(wu wkdUpdate) uint64 { return wu.TXTCount }},
+		{dns.TypePTR, func(wu wkdUpdate) uint64 { return wu.PTRCount }},
+		{dns.TypeCNAME, func(wu wkdUpdate) uint64 { return wu.CNAMECount }},
+		{dns.TypeSOA, func(wu wkdUpdate) uint64 { return wu.SOACount }},
+		{dns.TypeDS, func(wu wkdUpdate) uint64 { return wu.DSCount }},
+		{dns.TypeDNSKEY, func(wu wkdUpdate) uint64 { return wu.DNSKEYCount }},
+		{dns.TypeANY, func(wu wkdUpdate) uint64 { return wu.ANYCount }},
+	}
+	for _, tc := range qtypes {
+		t.Run(dns.TypeToString[tc.qtype], func(t *testing.T) {
+			msg := new(dns.Msg)
+			msg.SetQuestion("example.com.", tc.qtype)
+			wu := newWKDUpdate(nil, msg, false, dnstap.SocketProtocol_UDP, 0, false, time.Unix(2, 0), "")
+			if tc.counter(wu) != 1 || wu.OtherTypeCount != 0 {
+				t.Fatalf("unexpected update: %#v", wu)
 			}
 		})
 	}
+
+	rcodes := []struct {
+		rcode   int
+		counter func(wkdUpdate) uint64
+	}{
+		{dns.RcodeRefused, func(wu wkdUpdate) uint64 { return wu.RefusedCount }},
+		{dns.RcodeFormatError, func(wu wkdUpdate) uint64 { return wu.FormErrCount }},
+	}
+	for _, tc := range rcodes {
+		t.Run(dns.RcodeToString[tc.rcode], func(t *testing.T) {
+			msg := new(dns.Msg)
+			msg.SetQuestion("example.com.", dns.TypeA)
+			msg.Rcode = tc.rcode
+			wu := newWKDUpdate(nil, msg, false, dnstap.SocketProtocol_UDP, 0, false, time.Unix(2, 0), "")
+			if tc.counter(wu) != 1 || wu.OtherRcodeCount != 0 {
+				t.Fatalf("unexpected update: %#v", wu)
+			}
+			// Queries carry no rcode.
+			if wu := newWKDUpdate(nil, msg, true, dnstap.SocketProtocol_UDP, 0, false, time.Unix(2, 0), ""); tc.counter(wu) != 0 {
+				t.Fatalf("query counted in rcode counter: %#v", wu)
+			}
+		})
+	}
+}
+
+func TestNewWKDUpdateDNSSECCounters(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	msg.AuthenticatedData = true
+	msg.Truncated = true
+	msg.CheckingDisabled = true
+	msg.SetEdns0(1232, true)
+	opt := msg.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: netip.MustParseAddr("198.51.100.0").AsSlice()})
+
+	wu := newWKDUpdate(nil, msg, false, dnstap.SocketProtocol_UDP, 0, false, time.Unix(2, 0), "")
+	if wu.ADCount != 1 || wu.TCCount != 1 || wu.DOCount != 1 || wu.CDCount != 1 || wu.ECSCount != 1 {
+		t.Fatalf("unexpected response update: %#v", wu)
+	}
+
+	// AD, TC and ECS are only counted for responses.
+	wu = newWKDUpdate(nil, msg, true, dnstap.SocketProtocol_UDP, 0, false, time.Unix(2, 0), "")
+	if wu.ADCount != 0 || wu.TCCount != 0 || wu.DOCount != 1 || wu.CDCount != 1 || wu.ECSCount != 0 {
+		t.Fatalf("unexpected query update: %#v", wu)
+	}
+
+	plain := new(dns.Msg)
+	plain.SetQuestion("example.com.", dns.TypeA)
+	wu = newWKDUpdate(nil, plain, false, dnstap.SocketProtocol_UDP, 0, false, time.Unix(2, 0), "")
+	if wu.ADCount != 0 || wu.TCCount != 0 || wu.DOCount != 0 || wu.CDCount != 0 || wu.ECSCount != 0 {
+		t.Fatalf("unexpected update without signals: %#v", wu)
+	}
+
+	hd := &histogramData{ADCount: 1, ECSCount: 2}
+	hd.addCounters(&histogramData{ADCount: 3, DOCount: 4})
+	if hd.ADCount != 4 || hd.DOCount != 4 || hd.ECSCount != 2 {
+		t.Fatalf("unexpected merged counters: %#v", hd)
+	}
+}
+
+func TestNewWKDUpdateProtocolCounters(t *testing.T) {
+	protocols := []struct {
+		protocol dnstap.SocketProtocol
+		counter  func(wkdUpdate) uint64
+	}{
+		{dnstap.SocketProtocol_UDP, func(wu wkdUpdate) uint64 { return wu.UDPCount }},
+		{dnstap.SocketProtocol_TCP, func(wu wkdUpdate) uint64 { return wu.TCPCount }},
+		{dnstap.SocketProtocol_DOT, func(wu wkdUpdate) uint64 { return wu.DOTCount }},
+		{dnstap.SocketProtocol_DOH, func(wu wkdUpdate) uint64 { return wu.DOHCount }},
+		{socketProtocolDOQ, func(wu wkdUpdate) uint64 { return wu.DOQCount }},
+		{socketProtocolDNSCryptUDP, func(wu wkdUpdate) uint64 { return wu.DNSCryptUDPCount }},
+		{socketProtocolDNSCryptTCP, func(wu wkdUpdate) uint64 { return wu.DNSCryptTCPCount }},
+		{0, func(wu wkdUpdate) uint64 { return wu.OtherProtocolCount }},
+		{42, func(wu wkdUpdate) uint64 { return wu.OtherProtocolCount }},
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	for _, tc := range protocols {
+		t.Run(tc.protocol.String(), func(t *testing.T) {
+			wu := newWKDUpdate(nil, msg, true, tc.protocol, 0, false, time.Unix(2, 0), "")
+			total := wu.UDPCount + wu.TCPCount + wu.DOTCount + wu.DOHCount + wu.DOQCount + wu.DNSCryptUDPCount + wu.DNSCryptTCPCount + wu.OtherProtocolCount
+			if tc.counter(wu) != 1 || total != 1 {
+				t.Fatalf("unexpected update: %#v", wu)
+			}
+		})
+	}
+
+	// Transports are summed like the other counters when merged.
+	hd := &histogramData{UDPCount: 1, DOQCount: 2}
+	hd.addCounters(&histogramData{UDPCount: 3, DOQCount: 4, OtherProtocolCount: 5})
+	if hd.UDPCount != 4 || hd.DOQCount != 6 || hd.OtherProtocolCount != 5 {
+		t.Fatalf("unexpected merged counters: %#v", hd)
+	}
 }
 
 // TestUpdateRetryerBranches drives the two skip arms of updateRetryer